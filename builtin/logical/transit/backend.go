@@ -3,8 +3,12 @@ package transit
 import (
 	"context"
 	"strings"
+	"sync"
 
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/consts"
 	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/locksutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -24,6 +28,12 @@ func Backend(conf *logical.BackendConfig) *backend {
 			SealWrapStorage: []string{
 				"archive/",
 				"policy/",
+				keysutil.LocalStoragePrefix + "archive/",
+				keysutil.LocalStoragePrefix + "policy/",
+			},
+
+			LocalStorage: []string{
+				keysutil.LocalStoragePrefix,
 			},
 		},
 
@@ -31,30 +41,56 @@ func Backend(conf *logical.BackendConfig) *backend {
 			// Rotate/Config needs to come before Keys
 			// as the handler is greedy
 			b.pathConfig(),
+			b.pathConfigVersion(),
+			b.pathConfigKeys(),
 			b.pathRotate(),
+			b.pathRotateCheck(),
+			b.pathApproveRotation(),
+			b.pathAgree(),
+			b.pathUndelete(),
+			b.pathDeriveChild(),
 			b.pathRewrap(),
+			b.pathBulkDeleteKeys(),
+			b.pathKeyHealth(),
+			b.pathImportCheck(),
+			b.pathCrossSignCert(),
+			b.pathArchiveOld(),
 			b.pathKeys(),
 			b.pathListKeys(),
+			b.pathListNamespacedKeys(),
 			b.pathExportKeys(),
 			b.pathEncrypt(),
 			b.pathDecrypt(),
+			b.pathQuarantine(),
+			b.pathEscrow(),
+			b.pathEnvelopeEncrypt(),
+			b.pathEnvelopeDecrypt(),
 			b.pathDatakey(),
 			b.pathRandom(),
 			b.pathHash(),
+			b.pathHMACWindowInit(),
 			b.pathHMAC(),
+			b.pathHMACSessions(),
 			b.pathSign(),
 			b.pathVerify(),
 			b.pathBackup(),
 			b.pathRestore(),
 			b.pathTrim(),
+			b.pathLifecyclePolicies(),
+			b.pathListLifecyclePolicies(),
+			b.pathSnapshot(),
 		},
 
-		Secrets:     []*framework.Secret{},
-		Invalidate:  b.invalidate,
-		BackendType: logical.TypeLogical,
+		Secrets:      []*framework.Secret{},
+		Invalidate:   b.invalidate,
+		BackendType:  logical.TypeLogical,
+		PeriodicFunc: b.periodicFunc,
 	}
 
+	b.warnScheduledDeletion(b.Backend.Paths)
 	b.lm = keysutil.NewLockManager(conf.System.CachingDisabled())
+	b.nonceTrackingLocks = locksutil.CreateLocks()
+	b.statusWebhookSlots = make(chan struct{}, maxConcurrentStatusWebhooks)
 
 	return &b
 }
@@ -62,6 +98,50 @@ func Backend(conf *logical.BackendConfig) *backend {
 type backend struct {
 	*framework.Backend
 	lm *keysutil.LockManager
+
+	// hmacSessionsLock serializes updates to the buffers of HMAC sessions
+	hmacSessionsLock sync.Mutex
+
+	// keyCreationLock serializes key creation so that the key count checked
+	// against max_key_count cannot change before the key is created
+	keyCreationLock sync.Mutex
+
+	// nonceTrackingLocks serialize, per key, the recording of nonces from
+	// loading a nonce filter until writing it back
+	nonceTrackingLocks []*locksutil.LockEntry
+
+	// quarantineLock serializes quarantine writes so that concurrent
+	// decryptions cannot exceed maxQuarantineEntries
+	quarantineLock sync.Mutex
+
+	// lifecyclePolicyLock is held for writing while a lifecycle policy is
+	// deleted, and for reading while a key is attached to one, so that a
+	// policy cannot be deleted between the check that it has no keys and
+	// its deletion
+	lifecyclePolicyLock sync.RWMutex
+
+	// statusWebhookSlots holds a token for each status webhook call in
+	// flight, up to maxConcurrentStatusWebhooks
+	statusWebhookSlots chan struct{}
+}
+
+func (b *backend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	// Keys are only rotated and deleted on nodes that can write to storage
+	if !b.System().LocalMount() && b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary|consts.ReplicationPerformanceStandby) {
+		return nil
+	}
+
+	var errs *multierror.Error
+	if err := b.autoRotateKeys(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := b.deleteScheduledKeys(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if err := b.purgeSoftDeletedKeys(ctx, req.Storage); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	return errs.ErrorOrNil()
 }
 
 func (b *backend) invalidate(_ context.Context, key string) {
@@ -72,5 +152,8 @@ func (b *backend) invalidate(_ context.Context, key string) {
 	case strings.HasPrefix(key, "policy/"):
 		name := strings.TrimPrefix(key, "policy/")
 		b.lm.InvalidatePolicy(name)
+	case strings.HasPrefix(key, keysutil.LocalStoragePrefix+"policy/"):
+		name := strings.TrimPrefix(key, keysutil.LocalStoragePrefix+"policy/")
+		b.lm.InvalidatePolicy(name)
 	}
 }
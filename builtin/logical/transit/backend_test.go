@@ -2,12 +2,15 @@ package transit
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"math/rand"
 	"os"
 	"path"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -303,6 +306,473 @@ func TestBackend_datakey(t *testing.T) {
 	})
 }
 
+func TestTransit_DatakeyKeyLength(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+
+	resp, err := doReq("keys/test", map[string]interface{}{
+		"derived": true,
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	contextB64 := base64.StdEncoding.EncodeToString([]byte("context"))
+	var keys [][]byte
+	for _, bits := range []int{40, 128, 192, 256, 512, 1024} {
+		resp, err = doReq("datakey/plaintext/test", map[string]interface{}{
+			"context":         contextB64,
+			"key_length_bits": bits,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bits:%d err:%v resp:%#v", bits, err, resp)
+		}
+		plaintext := resp.Data["plaintext"].(string)
+		key, err := base64.StdEncoding.DecodeString(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(key) != bits/8 {
+			t.Fatalf("expected %d bytes, got %d", bits/8, len(key))
+		}
+
+		resp, err = doReq("decrypt/test", map[string]interface{}{
+			"context":    contextB64,
+			"ciphertext": resp.Data["ciphertext"],
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("bits:%d err:%v resp:%#v", bits, err, resp)
+		}
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bits:%d: decrypted key does not match", bits)
+		}
+
+		// Keys of different lengths must not be truncations of one another
+		for _, other := range keys {
+			if strings.HasPrefix(string(key), string(other)) {
+				t.Fatalf("bits:%d: key shares a prefix with a %d-bit key", bits, len(other)*8)
+			}
+		}
+		keys = append(keys, key)
+	}
+
+	for _, bits := range []int{0, -8, 12, 1032} {
+		resp, err = doReq("datakey/plaintext/test", map[string]interface{}{
+			"context":         contextB64,
+			"key_length_bits": bits,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("bits:%d: expected error", bits)
+		}
+	}
+}
+
+func TestTransit_DatakeyDerivationAlgorithm(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	mustSucceed("keys/derived", map[string]interface{}{
+		"derived": true,
+	})
+	mustSucceed("keys/plain", nil)
+	contextB64 := base64.StdEncoding.EncodeToString([]byte("context"))
+
+	for algorithm, label := range map[string]string{
+		"hkdf-sha256": "vault:v1:",
+		"hkdf-sha512": "vault:v1:hkdf-sha512:",
+	} {
+		resp := mustSucceed("datakey/plaintext/derived", map[string]interface{}{
+			"context":              contextB64,
+			"derivation_algorithm": algorithm,
+		})
+		ciphertext := resp.Data["ciphertext"].(string)
+		plaintext := resp.Data["plaintext"].(string)
+		encoded := strings.TrimPrefix(ciphertext, label)
+		if !strings.HasPrefix(ciphertext, label) || strings.Contains(encoded, ":") {
+			t.Fatalf("%s: expected ciphertext to start with %q, got %q", algorithm, label, ciphertext)
+		}
+
+		// The algorithm round-trips through the ciphertext
+		resp = mustSucceed("decrypt/derived", map[string]interface{}{
+			"context":    contextB64,
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("%s: decrypted key does not match", algorithm)
+		}
+
+		// Decrypting under the other algorithm derives a different key
+		other := "vault:v1:hkdf-sha512:" + encoded
+		if algorithm == "hkdf-sha512" {
+			other = "vault:v1:" + encoded
+		}
+		mustFail("decrypt/derived", map[string]interface{}{
+			"context":    contextB64,
+			"ciphertext": other,
+		})
+	}
+
+	// HKDF-SHA512 only applies to derived keys
+	mustFail("datakey/plaintext/plain", map[string]interface{}{
+		"derivation_algorithm": "hkdf-sha512",
+	})
+	mustFail("datakey/plaintext/derived", map[string]interface{}{
+		"context":              contextB64,
+		"derivation_algorithm": "hkdf-md5",
+	})
+	resp := mustSucceed("encrypt/plain", map[string]interface{}{
+		"plaintext": contextB64,
+	})
+	mustFail("decrypt/plain", map[string]interface{}{
+		"ciphertext": strings.Replace(resp.Data["ciphertext"].(string), "vault:v1:", "vault:v1:hkdf-sha512:", 1),
+	})
+}
+
+func TestTransit_DatakeyWrappingAlgorithm(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	mustSucceed("keys/aes", nil)
+	mustSucceed("keys/derived", map[string]interface{}{
+		"derived": true,
+	})
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustSucceed("keys/aes/rotate", nil)
+	contextB64 := base64.StdEncoding.EncodeToString([]byte("context"))
+
+	unwrap := map[string]func(kek, wrapped []byte) ([]byte, error){
+		"aes-kw":  keysutil.UnwrapKeyAES,
+		"aes-kwp": keysutil.UnwrapKeyAESPadded,
+	}
+	for algorithm, unwrapKey := range unwrap {
+		for _, name := range []string{"aes", "derived"} {
+			data := map[string]interface{}{
+				"wrapping_algorithm": algorithm,
+				"key_version":        1,
+				"key_length_bits":    192,
+			}
+			if name == "derived" {
+				data["context"] = contextB64
+			}
+			resp := mustSucceed("datakey/plaintext/"+name, data)
+			if resp.Data["key_version"] != 1 || resp.Data["wrapping_algorithm"] != algorithm {
+				t.Fatalf("%s/%s: bad response: %#v", algorithm, name, resp.Data)
+			}
+			wrapped, err := base64.StdEncoding.DecodeString(resp.Data["ciphertext"].(string))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(wrapped) != 192/8+8 {
+				t.Fatalf("%s/%s: bad wrapped key length %d", algorithm, name, len(wrapped))
+			}
+
+			p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+				Storage: storage,
+				Name:    name,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			kek, err := p.DeriveKey([]byte("context"), 1, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			key, err := unwrapKey(kek, wrapped)
+			if err != nil {
+				t.Fatalf("%s/%s: %v", algorithm, name, err)
+			}
+			if base64.StdEncoding.EncodeToString(key) != resp.Data["plaintext"] {
+				t.Fatalf("%s/%s: unwrapped key does not match", algorithm, name)
+			}
+		}
+	}
+
+	// AES key wrap with padding accepts keys of any length, unlike AES-KW
+	resp := mustSucceed("datakey/wrapped/aes", map[string]interface{}{
+		"wrapping_algorithm": "aes-kwp",
+		"key_length_bits":    40,
+	})
+	if resp.Data["plaintext"] != nil || resp.Data["key_version"] != 2 {
+		t.Fatalf("bad response: %#v", resp.Data)
+	}
+	mustFail("datakey/wrapped/aes", map[string]interface{}{
+		"wrapping_algorithm": "aes-kw",
+		"key_length_bits":    40,
+	})
+
+	// RSA-OAEP is the native encryption of RSA keys
+	resp = mustSucceed("datakey/plaintext/rsa", map[string]interface{}{
+		"wrapping_algorithm": "rsa-oaep",
+	})
+	resp = mustSucceed("decrypt/rsa", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	if resp.Data["plaintext"] == nil {
+		t.Fatal("expected plaintext")
+	}
+
+	mustFail("datakey/plaintext/aes", map[string]interface{}{
+		"wrapping_algorithm": "rsa-oaep",
+	})
+	mustFail("datakey/plaintext/rsa", map[string]interface{}{
+		"wrapping_algorithm": "aes-kw",
+	})
+	mustFail("datakey/plaintext/aes", map[string]interface{}{
+		"wrapping_algorithm": "des-kw",
+	})
+	mustFail("datakey/plaintext/derived", map[string]interface{}{
+		"wrapping_algorithm": "aes-kw",
+	})
+}
+
+func TestTransit_KeyID(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	keyIDs := func(name string) map[string]string {
+		return doReq(logical.ReadOperation, "keys/"+name, nil).Data["key_ids"].(map[string]string)
+	}
+
+	for _, keyType := range []string{"aes256-gcm96", "ecdsa-p256", "ed25519", "rsa-2048"} {
+		doReq(logical.UpdateOperation, "keys/"+keyType, map[string]interface{}{
+			"type":       keyType,
+			"exportable": true,
+		})
+		doReq(logical.UpdateOperation, "keys/"+keyType+"/rotate", nil)
+
+		ids := keyIDs(keyType)
+		if len(ids) != 2 || len(ids["1"]) != 32 || ids["1"] == ids["2"] {
+			t.Fatalf("%s: bad key IDs: %#v", keyType, ids)
+		}
+
+		// Metadata changes and restores leave the IDs alone
+		doReq(logical.UpdateOperation, "keys/"+keyType+"/config", map[string]interface{}{
+			"min_decryption_version": 2,
+			"allow_plaintext_backup": true,
+		})
+		if keyIDs(keyType)["2"] != ids["2"] {
+			t.Fatalf("%s: key ID changed with metadata", keyType)
+		}
+		backup := doReq(logical.ReadOperation, "backup/"+keyType, nil).Data["backup"]
+		doReq(logical.UpdateOperation, "restore/"+keyType+"-restored", map[string]interface{}{
+			"backup": backup,
+		})
+		restored := keyIDs(keyType + "-restored")
+		if restored["2"] != ids["2"] {
+			t.Fatalf("%s: key IDs changed on restore: %#v, %#v", keyType, restored, ids)
+		}
+	}
+
+	// The ID is derived from the key material alone
+	p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+		Storage: storage,
+		Name:    "aes256-gcm96",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(p.Keys["2"].Key)
+	if expected := hex.EncodeToString(sum[:16]); keyIDs("aes256-gcm96")["2"] != expected {
+		t.Fatalf("expected key ID %s", expected)
+	}
+
+	// Ciphertexts report the ID of the version that encrypted them
+	doReq(logical.UpdateOperation, "keys/aes", nil)
+	doReq(logical.UpdateOperation, "keys/aes/rotate", nil)
+	ids := keyIDs("aes")
+	plaintext := base64.StdEncoding.EncodeToString([]byte(testPlaintext))
+	resp := doReq(logical.UpdateOperation, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	if resp.Data["key_version"] != 2 || resp.Data["key_id"] != ids["2"] {
+		t.Fatalf("bad response: %#v", resp.Data)
+	}
+	resp = doReq(logical.UpdateOperation, "encrypt/aes", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext, "key_version": 1},
+			map[string]interface{}{"plaintext": plaintext},
+		},
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].KeyID != ids["1"] || results[0].KeyVersion != 1 || results[1].KeyID != ids["2"] {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+}
+
+func TestTransit_BulkDeleteKeys(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	for _, name := range []string{"k1", "k2", "k3"} {
+		doReq(logical.UpdateOperation, "keys/"+name, nil)
+	}
+	for _, name := range []string{"k1", "k2"} {
+		doReq(logical.UpdateOperation, "keys/"+name+"/config", map[string]interface{}{
+			"deletion_allowed": true,
+		})
+	}
+
+	// k3 does not allow deletion and k4 does not exist, so nothing is deleted
+	resp := doReq(logical.UpdateOperation, "keys/bulk-delete", map[string]interface{}{
+		"key_names": []string{"k1", "k2", "k3", "k4"},
+	})
+	if deleted := resp.Data["deleted"].([]string); len(deleted) != 0 {
+		t.Fatalf("expected nothing to be deleted, got %v", deleted)
+	}
+	failed := resp.Data["failed"].(map[string]string)
+	if len(failed) != 2 || failed["k3"] == "" || failed["k4"] == "" {
+		t.Fatalf("bad: failed: %#v", failed)
+	}
+	resp = doReq(logical.ListOperation, "keys/", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"k1", "k2", "k3"}) {
+		t.Fatalf("bad: keys: %#v", resp.Data["keys"])
+	}
+	for _, name := range []string{"k1", "k2", "k3"} {
+		doReq(logical.UpdateOperation, "encrypt/"+name, map[string]interface{}{
+			"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+		})
+	}
+
+	// By default the keys are soft-deleted, like a single key
+	resp = doReq(logical.UpdateOperation, "keys/bulk-delete", map[string]interface{}{
+		"key_names": "k1,k2,k1",
+	})
+	if !reflect.DeepEqual(resp.Data["deleted"], []string{"k1", "k2"}) {
+		t.Fatalf("bad: deleted: %#v", resp.Data["deleted"])
+	}
+	for _, name := range []string{"k1", "k2"} {
+		resp = doReq(logical.ReadOperation, "keys/"+name, nil)
+		if resp.Data["soft_deleted"] != true {
+			t.Fatalf("expected %s to be soft-deleted, got %#v", name, resp.Data)
+		}
+	}
+	resp = doReq(logical.UpdateOperation, "keys/bulk-delete", map[string]interface{}{
+		"key_names": "k1",
+	})
+	if failed := resp.Data["failed"].(map[string]string); failed["k1"] == "" {
+		t.Fatalf("expected an already soft-deleted key to fail, got %#v", failed)
+	}
+
+	// A key with a deletion grace period is only scheduled for deletion
+	doReq(logical.UpdateOperation, "keys/k3/config", map[string]interface{}{
+		"deletion_allowed": true,
+	})
+	doReq(logical.UpdateOperation, "keys/k3/config", map[string]interface{}{
+		"deletion_grace_period": 3600,
+	})
+	resp = doReq(logical.UpdateOperation, "keys/bulk-delete", map[string]interface{}{
+		"key_names": "k3",
+		"permanent": true,
+	})
+	if deleted := resp.Data["deleted"].([]string); len(deleted) != 0 {
+		t.Fatalf("expected nothing to be deleted, got %v", deleted)
+	}
+	if _, ok := resp.Data["deletion_scheduled_at"].(map[string]time.Time)["k3"]; !ok {
+		t.Fatalf("expected k3 to be scheduled for deletion, got %#v", resp.Data)
+	}
+	resp = doReq(logical.ReadOperation, "keys/k3", nil)
+	if resp.Data["soft_deleted"] != false {
+		t.Fatalf("expected k3 not to be deleted yet, got %#v", resp.Data)
+	}
+	doReq(logical.UpdateOperation, "keys/k3/config", map[string]interface{}{
+		"deletion_grace_period": 0,
+	})
+
+	resp = doReq(logical.UpdateOperation, "keys/bulk-delete", map[string]interface{}{
+		"key_names": "k1,k2,k3",
+		"permanent": true,
+	})
+	if !reflect.DeepEqual(resp.Data["deleted"], []string{"k1", "k2", "k3"}) {
+		t.Fatalf("bad: deleted: %#v", resp.Data["deleted"])
+	}
+	if failed := resp.Data["failed"].(map[string]string); len(failed) != 0 {
+		t.Fatalf("bad: failed: %#v", failed)
+	}
+	resp = doReq(logical.ListOperation, "keys/", nil)
+	if resp.Data["keys"] != nil {
+		t.Fatalf("bad: keys: %#v", resp.Data["keys"])
+	}
+	resp = doReq(logical.ReadOperation, "keys/k1", nil)
+	if resp != nil {
+		t.Fatalf("expected nil response, got %#v", resp)
+	}
+}
+
 func TestBackend_rotation(t *testing.T) {
 	defer os.Setenv("TRANSIT_ACC_KEY_TYPE", "")
 	testBackendRotation(t)
@@ -485,6 +955,9 @@ func testAccStepDeletePolicy(t *testing.T, name string) logicaltest.TestStep {
 	return logicaltest.TestStep{
 		Operation: logical.DeleteOperation,
 		Path:      "keys/" + name,
+		Data: map[string]interface{}{
+			"permanent": true,
+		},
 	}
 }
 
@@ -1468,3 +1941,442 @@ func TestBadInput(t *testing.T) {
 		t.Fatal("expected error")
 	}
 }
+
+func TestTransit_ReplicationScope(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/cluster", nil)
+	mustSucceed(logical.UpdateOperation, "keys/local", map[string]interface{}{
+		"replication_scope": "local",
+	})
+	for _, scope := range []string{"global", "dr-only"} {
+		resp, err := doReq(logical.UpdateOperation, "keys/bad", map[string]interface{}{
+			"replication_scope": scope,
+		})
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected error for unknown replication scope %q, got %#v", scope, resp)
+		}
+	}
+
+	for name, scope := range map[string]string{"cluster": "cluster", "local": "local"} {
+		resp := mustSucceed(logical.ReadOperation, "keys/"+name, nil)
+		if resp.Data["replication_scope"] != scope {
+			t.Fatalf("%s: expected replication scope %q, got %v", name, scope, resp.Data["replication_scope"])
+		}
+	}
+
+	resp := mustSucceed(logical.ListOperation, "keys/", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"cluster", "local"}) {
+		t.Fatalf("bad: %#v", resp.Data["keys"])
+	}
+
+	// Every storage entry of a local key is covered by the local storage
+	// paths, and so is left out of replication, while cluster keys are not
+	isLocal := func(key string) bool {
+		for _, prefix := range b.SpecialPaths().LocalStorage {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	mustSucceed(logical.UpdateOperation, "keys/local/rotate", nil)
+	expected := map[string]bool{
+		"policy/cluster":      false,
+		"archive/cluster":     false,
+		"local/policy/local":  true,
+		"local/archive/local": true,
+	}
+	for key, local := range expected {
+		entry, err := s.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			t.Fatalf("missing storage entry %q", key)
+		}
+		if isLocal(key) != local {
+			t.Fatalf("%s: expected local %t", key, local)
+		}
+	}
+	for _, key := range []string{"policy/local", "archive/local"} {
+		entry, err := s.Get(context.Background(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry != nil {
+			t.Fatalf("unexpected replicated storage entry %q", key)
+		}
+	}
+
+	// Local keys work after being evicted from the cache
+	resp = mustSucceed(logical.UpdateOperation, "encrypt/local", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	b.invalidate(context.Background(), "local/policy/local")
+	resp = mustSucceed(logical.UpdateOperation, "decrypt/local", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != "dGhlIHF1aWNrIGJyb3duIGZveA==" {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/local/config", map[string]interface{}{
+		"deletion_allowed": true,
+	})
+	mustSucceed(logical.DeleteOperation, "keys/local", map[string]interface{}{
+		"permanent": true,
+	})
+	keys, err := s.List(context.Background(), "local/policy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("bad: %#v", keys)
+	}
+}
+
+func TestTransit_KeyReadPagination(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	for _, keyType := range []string{"aes256-gcm96", "ed25519"} {
+		mustSucceed(logical.UpdateOperation, "keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+		for i := 0; i < 9; i++ {
+			mustSucceed(logical.UpdateOperation, "keys/"+keyType+"/rotate", nil)
+		}
+
+		// Without page_size every version is returned under "keys"
+		resp := mustSucceed(logical.ReadOperation, "keys/"+keyType, nil)
+		if keys := reflect.ValueOf(resp.Data["keys"]); keys.Len() != 10 {
+			t.Fatalf("%s: expected 10 keys, got %d", keyType, keys.Len())
+		}
+		if _, ok := resp.Data["versions"]; ok {
+			t.Fatalf("%s: unexpected versions in unpaginated read", keyType)
+		}
+
+		// Pages of 4 give versions 1-4, 5-8 and 9-10
+		var seen []string
+		token := ""
+		for page := 0; ; page++ {
+			data := map[string]interface{}{"page_size": 4}
+			if token != "" {
+				data["page"] = token
+			}
+			resp = mustSucceed(logical.ReadOperation, "keys/"+keyType, data)
+			if resp.Data["total_versions"] != 10 {
+				t.Fatalf("%s: bad total_versions %v", keyType, resp.Data["total_versions"])
+			}
+			if _, ok := resp.Data["keys"]; ok {
+				t.Fatalf("%s: unexpected keys in paginated read", keyType)
+			}
+			versions := reflect.ValueOf(resp.Data["versions"])
+			expected := 4
+			if page == 2 {
+				expected = 2
+			}
+			if versions.Len() != expected {
+				t.Fatalf("%s: page %d has %d versions, expected %d", keyType, page, versions.Len(), expected)
+			}
+			for _, k := range versions.MapKeys() {
+				seen = append(seen, k.String())
+			}
+
+			token = resp.Data["next_page_token"].(string)
+			if token == "" {
+				if page != 2 {
+					t.Fatalf("%s: pagination ended after page %d", keyType, page)
+				}
+				break
+			}
+		}
+		sort.Slice(seen, func(i, j int) bool {
+			a, _ := strconv.Atoi(seen[i])
+			b, _ := strconv.Atoi(seen[j])
+			return a < b
+		})
+		if strings.Join(seen, ",") != "1,2,3,4,5,6,7,8,9,10" {
+			t.Fatalf("%s: bad versions across pages: %v", keyType, seen)
+		}
+
+		// A page that ends exactly at the last version has no next page
+		resp = mustSucceed(logical.ReadOperation, "keys/"+keyType, map[string]interface{}{
+			"page_size": 5,
+			"page":      "6",
+		})
+		if reflect.ValueOf(resp.Data["versions"]).Len() != 5 || resp.Data["next_page_token"] != "" {
+			t.Fatalf("%s: bad last page: %#v", keyType, resp.Data)
+		}
+		resp = mustSucceed(logical.ReadOperation, "keys/"+keyType, map[string]interface{}{
+			"page_size": 10,
+		})
+		if reflect.ValueOf(resp.Data["versions"]).Len() != 10 || resp.Data["next_page_token"] != "" {
+			t.Fatalf("%s: bad single page: %#v", keyType, resp.Data)
+		}
+	}
+
+	// total_versions does not count trimmed versions
+	mustSucceed(logical.UpdateOperation, "keys/aes256-gcm96/config", map[string]interface{}{
+		"min_decryption_version": 4,
+		"min_encryption_version": 4,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/aes256-gcm96/trim", map[string]interface{}{
+		"min_available_version": 4,
+	})
+	resp := mustSucceed(logical.ReadOperation, "keys/aes256-gcm96", map[string]interface{}{
+		"page_size": 3,
+	})
+	if resp.Data["total_versions"] != 7 || resp.Data["next_page_token"] != "7" {
+		t.Fatalf("bad page after trim: %#v", resp.Data)
+	}
+	if _, ok := resp.Data["versions"].(map[string]int64)["4"]; !ok {
+		t.Fatalf("expected first page to start at version 4: %#v", resp.Data["versions"])
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"page_size": -1},
+		{"page": "2"},
+		{"page_size": 2, "page": "0"},
+		{"page_size": 2, "page": "abc"},
+	} {
+		resp, err := doReq(logical.ReadOperation, "keys/aes256-gcm96", data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error for %#v", data)
+		}
+	}
+}
+
+func TestTransit_KeyNamespace(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s data:%#v err:%v resp:%#v", path, data, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+
+	// Encrypting with a namespace upserts a separate key per tenant
+	ciphertexts := map[string]string{}
+	for _, tenant := range []string{"tenantA", "tenantB"} {
+		resp, err := doReq(logical.CreateOperation, "encrypt/session", map[string]interface{}{
+			"plaintext":     plaintext,
+			"key_namespace": tenant,
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		ciphertexts[tenant] = resp.Data["ciphertext"].(string)
+	}
+	mustSucceed(logical.UpdateOperation, "keys/session", nil)
+
+	// Keys are listed by name, separately per namespace
+	resp := mustSucceed(logical.ListOperation, "keys", nil)
+	if keys := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, []string{"session"}) {
+		t.Fatalf("bad keys: %#v", keys)
+	}
+	resp = mustSucceed(logical.ListOperation, "key-namespaces/tenantA/", nil)
+	if keys := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, []string{"session"}) {
+		t.Fatalf("bad keys in tenantA: %#v", keys)
+	}
+
+	// Each tenant only decrypts its own ciphertexts
+	for tenant, ciphertext := range ciphertexts {
+		resp = mustSucceed(logical.UpdateOperation, "decrypt/session", map[string]interface{}{
+			"ciphertext":    ciphertext,
+			"key_namespace": tenant,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("%s: bad plaintext", tenant)
+		}
+		mustFail(logical.UpdateOperation, "decrypt/session", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+	}
+	mustFail(logical.UpdateOperation, "decrypt/session", map[string]interface{}{
+		"ciphertext":    ciphertexts["tenantA"],
+		"key_namespace": "tenantB",
+	})
+
+	// HMACs and data keys use separate material too
+	hmacs := map[string]string{}
+	for _, tenant := range []string{"", "tenantA", "tenantB"} {
+		resp = mustSucceed(logical.UpdateOperation, "hmac/session", map[string]interface{}{
+			"input":         plaintext,
+			"key_namespace": tenant,
+		})
+		hmacs[tenant] = resp.Data["hmac"].(string)
+	}
+	if hmacs[""] == hmacs["tenantA"] || hmacs["tenantA"] == hmacs["tenantB"] {
+		t.Fatalf("expected different HMACs per namespace: %#v", hmacs)
+	}
+	resp = mustSucceed(logical.UpdateOperation, "verify/session", map[string]interface{}{
+		"input":         plaintext,
+		"hmac":          hmacs["tenantA"],
+		"key_namespace": "tenantB",
+	})
+	if resp.Data["valid"] != false {
+		t.Fatal("expected HMAC of another namespace to be invalid")
+	}
+	resp = mustSucceed(logical.UpdateOperation, "datakey/plaintext/session", map[string]interface{}{
+		"key_namespace": "tenantA",
+	})
+	dataKey := resp.Data["plaintext"]
+	resp = mustSucceed(logical.UpdateOperation, "decrypt/session", map[string]interface{}{
+		"ciphertext":    resp.Data["ciphertext"],
+		"key_namespace": "tenantA",
+	})
+	if resp.Data["plaintext"] != dataKey {
+		t.Fatal("bad data key plaintext")
+	}
+
+	// Namespaced signing keys are created and managed through keys/
+	for _, tenant := range []string{"tenantA", "tenantB"} {
+		mustSucceed(logical.UpdateOperation, "keys/signer", map[string]interface{}{
+			"type":          "ed25519",
+			"key_namespace": tenant,
+		})
+	}
+	resp = mustSucceed(logical.UpdateOperation, "sign/signer", map[string]interface{}{
+		"input":         plaintext,
+		"key_namespace": "tenantA",
+	})
+	signature := resp.Data["signature"].(string)
+	for tenant, valid := range map[string]bool{"tenantA": true, "tenantB": false} {
+		resp = mustSucceed(logical.UpdateOperation, "verify/signer", map[string]interface{}{
+			"input":         plaintext,
+			"signature":     signature,
+			"key_namespace": tenant,
+		})
+		if resp.Data["valid"] != valid {
+			t.Fatalf("%s: expected valid to be %t", tenant, valid)
+		}
+	}
+	mustFail(logical.UpdateOperation, "sign/signer", map[string]interface{}{
+		"input": plaintext,
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/signer", map[string]interface{}{
+		"key_namespace": "tenantB",
+	})
+	if resp.Data["name"] != "signer:tenantB" {
+		t.Fatalf("bad name: %#v", resp.Data["name"])
+	}
+	mustSucceed(logical.UpdateOperation, "keys/signer/config", map[string]interface{}{
+		"deletion_allowed": true,
+		"key_namespace":    "tenantB",
+	})
+	mustSucceed(logical.DeleteOperation, "keys/signer", map[string]interface{}{
+		"permanent":     true,
+		"key_namespace": "tenantB",
+	})
+	if resp = mustSucceed(logical.ReadOperation, "keys/signer", map[string]interface{}{
+		"key_namespace": "tenantB",
+	}); resp != nil {
+		t.Fatal("expected namespaced key to be deleted")
+	}
+	mustSucceed(logical.UpdateOperation, "sign/signer", map[string]interface{}{
+		"input":         plaintext,
+		"key_namespace": "tenantA",
+	})
+
+	// Namespaced keys are rotated, rewrapped and backed up like any other
+	mustSucceed(logical.UpdateOperation, "keys/session/rotate", map[string]interface{}{
+		"key_namespace": "tenantA",
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/session", map[string]interface{}{
+		"key_namespace": "tenantA",
+	})
+	if resp.Data["latest_version"] != 2 {
+		t.Fatalf("expected namespaced key to be rotated: %#v", resp.Data["latest_version"])
+	}
+	resp = mustSucceed(logical.ReadOperation, "keys/session", map[string]interface{}{
+		"key_namespace": "tenantB",
+	})
+	if resp.Data["latest_version"] != 1 {
+		t.Fatalf("expected other namespaces to be unaffected: %#v", resp.Data["latest_version"])
+	}
+	resp = mustSucceed(logical.UpdateOperation, "rewrap/session", map[string]interface{}{
+		"ciphertext":    ciphertexts["tenantA"],
+		"key_namespace": "tenantA",
+	})
+	if !strings.HasPrefix(resp.Data["ciphertext"].(string), "vault:v2:") {
+		t.Fatalf("bad rewrapped ciphertext: %#v", resp.Data)
+	}
+	mustSucceed(logical.UpdateOperation, "keys/session/config", map[string]interface{}{
+		"exportable":             true,
+		"allow_plaintext_backup": true,
+		"key_namespace":          "tenantA",
+	})
+	backup := mustSucceed(logical.ReadOperation, "backup/session", map[string]interface{}{
+		"key_namespace": "tenantA",
+	}).Data["backup"]
+	mustSucceed(logical.UpdateOperation, "restore/session", map[string]interface{}{
+		"backup":        backup,
+		"key_namespace": "tenantC",
+	})
+	resp = mustSucceed(logical.ListOperation, "key-namespaces/tenantC", nil)
+	if keys := resp.Data["keys"].([]string); !reflect.DeepEqual(keys, []string{"session"}) {
+		t.Fatalf("bad keys in tenantC: %#v", keys)
+	}
+
+	for _, namespace := range []string{strings.Repeat("a", 129), "a:b", "a/b", "-a"} {
+		mustFail(logical.CreateOperation, "encrypt/session", map[string]interface{}{
+			"plaintext":     plaintext,
+			"key_namespace": namespace,
+		})
+	}
+	mustSucceed(logical.CreateOperation, "encrypt/session", map[string]interface{}{
+		"plaintext":     plaintext,
+		"key_namespace": strings.Repeat("a", 128),
+	})
+}
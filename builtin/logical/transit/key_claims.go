@@ -0,0 +1,113 @@
+package transit
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// validateRequiredClaims checks that the key can authenticate claims, which
+// are bound into the associated data
+func validateRequiredClaims(p *keysutil.Policy, claims map[string]string) error {
+	if len(claims) == 0 {
+		return nil
+	}
+	switch p.Type {
+	case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305:
+	default:
+		return fmt.Errorf("required claims are not supported for key type %v", p.Type)
+	}
+	if p.ConvergentEncryption {
+		return fmt.Errorf("required claims are not supported with convergent encryption")
+	}
+	for name := range claims {
+		if name == "" {
+			return fmt.Errorf("claim names cannot be empty")
+		}
+	}
+	return nil
+}
+
+// requestClaims returns the claims the key requires, taken from the
+// metadata of the requesting entity, as segments of associated data in name
+// order. A claim is looked up in the metadata of the entity's aliases
+// before that of the entity itself. It returns a user error if a claim is
+// missing or does not have its required value.
+func (b *backend) requestClaims(p *keysutil.Policy, req *logical.Request) ([]aadSegment, error) {
+	if len(p.RequiredClaims) == 0 {
+		return nil, nil
+	}
+	if req.EntityID == "" {
+		return nil, errutil.UserError{Err: "the key requires claims, but the request has no entity"}
+	}
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if entity == nil {
+		return nil, errutil.UserError{Err: "the key requires claims, but the request's entity could not be found"}
+	}
+
+	lookup := func(name string) (string, bool) {
+		for _, alias := range entity.Aliases {
+			if value, ok := alias.Metadata[name]; ok {
+				return value, true
+			}
+		}
+		value, ok := entity.Metadata[name]
+		return value, ok
+	}
+
+	names := make([]string, 0, len(p.RequiredClaims))
+	for name := range p.RequiredClaims {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	segments := make([]aadSegment, 0, len(names))
+	for _, name := range names {
+		value, ok := lookup(name)
+		switch {
+		case !ok:
+			return nil, errutil.UserError{Err: fmt.Sprintf("missing required claim %q", name)}
+		case p.RequiredClaims[name] != "" && value != p.RequiredClaims[name]:
+			return nil, errutil.UserError{Err: fmt.Sprintf("claim %q does not have the required value", name)}
+		}
+		segments = append(segments, aadSegment{label: "claim:" + name, value: []byte(value)})
+	}
+	return segments, nil
+}
+
+// bindClaims replaces the associated data in opts with one that also
+// authenticates the claims
+func bindClaims(opts *keysutil.CipherOptions, claims []aadSegment) {
+	if len(claims) == 0 {
+		return
+	}
+	segments := append(append([]aadSegment{}, claims...), aadSegment{label: "associated_data", value: opts.AssociatedData})
+	opts.AssociatedData = composeAssociatedData(segments...)
+}
+
+// bindRequestClaims binds the claims the key requires into each of the
+// cipher options, which may be nil for batch items that already failed. It
+// returns an error response if the requesting entity does not carry them.
+func (b *backend) bindRequestClaims(p *keysutil.Policy, req *logical.Request, opts ...*keysutil.CipherOptions) (*logical.Response, error) {
+	claims, err := b.requestClaims(p, req)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+		default:
+			return nil, err
+		}
+	}
+	for _, o := range opts {
+		if o != nil {
+			bindClaims(o, claims)
+		}
+	}
+	return nil, nil
+}
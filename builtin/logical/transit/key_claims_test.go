@@ -0,0 +1,153 @@
+package transit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_RequiredClaims(t *testing.T) {
+	sysView := logical.TestSystemView()
+	storage := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: storage,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	setEntity := func(entityMetadata, aliasMetadata map[string]string) {
+		sysView.EntityVal = &logical.Entity{
+			ID:       "entity-id",
+			Metadata: entityMetadata,
+			Aliases: []*logical.Alias{
+				{MountType: "userpass", Name: "alice", Metadata: aliasMetadata},
+			},
+		}
+	}
+	doReq := func(entityID, path string, data map[string]interface{}) (*logical.Response, error) {
+		var op logical.Operation = logical.UpdateOperation
+		if data == nil {
+			op = logical.ReadOperation
+		}
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+			EntityID:  entityID,
+		})
+	}
+	mustSucceed := func(entityID, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(entityID, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(entityID, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(entityID, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("", "keys/aes", map[string]interface{}{})
+	mustSucceed("", "keys/aes/config", map[string]interface{}{
+		"required_claims": map[string]interface{}{
+			"department": "finance",
+			"user_id":    "",
+		},
+	})
+	resp := mustSucceed("", "keys/aes", nil)
+	expected := map[string]string{"department": "finance", "user_id": ""}
+	if !reflect.DeepEqual(resp.Data["required_claims"], expected) {
+		t.Fatalf("bad required claims: %#v", resp.Data["required_claims"])
+	}
+
+	// Claims are found in alias or entity metadata
+	setEntity(map[string]string{"user_id": "u1"}, map[string]string{"department": "finance"})
+	resp = mustSucceed("entity-id", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	resp = mustSucceed("entity-id", "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// A missing claim, a wrong value or no entity at all is rejected
+	resp, err := doReq("", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	if err != logical.ErrPermissionDenied || resp == nil || !resp.IsError() {
+		t.Fatalf("expected permission denied; err:%v resp:%#v", err, resp)
+	}
+	setEntity(nil, map[string]string{"department": "finance"})
+	mustFail("entity-id", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustFail("entity-id", "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	setEntity(map[string]string{"user_id": "u1"}, map[string]string{"department": "engineering"})
+	mustFail("entity-id", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+
+	// The claim values are authenticated, so an entity with other values
+	// that still satisfy the requirements cannot decrypt
+	setEntity(map[string]string{"user_id": "u2"}, map[string]string{"department": "finance"})
+	mustFail("entity-id", "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+
+	// Data keys and rewrapped ciphertexts carry the claims too
+	setEntity(map[string]string{"user_id": "u1"}, map[string]string{"department": "finance"})
+	resp = mustSucceed("entity-id", "datakey/plaintext/aes", map[string]interface{}{})
+	datakeyPlaintext, datakeyCiphertext := resp.Data["plaintext"], resp.Data["ciphertext"].(string)
+	resp = mustSucceed("entity-id", "decrypt/aes", map[string]interface{}{
+		"ciphertext": datakeyCiphertext,
+	})
+	if resp.Data["plaintext"] != datakeyPlaintext {
+		t.Fatalf("bad data key plaintext: %v", resp.Data["plaintext"])
+	}
+	mustSucceed("", "keys/aes/rotate", map[string]interface{}{})
+	resp = mustSucceed("entity-id", "rewrap/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	resp = mustSucceed("entity-id", "decrypt/aes", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// Removing the requirement allows requests without an entity
+	mustSucceed("", "keys/aes/config", map[string]interface{}{
+		"required_claims": map[string]interface{}{},
+	})
+	if _, ok := mustSucceed("", "keys/aes", nil).Data["required_claims"]; ok {
+		t.Fatal("expected required claims to be removed")
+	}
+	mustSucceed("", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+
+	// Only AEAD keys can authenticate claims
+	mustSucceed("", "keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustFail("", "keys/rsa/config", map[string]interface{}{
+		"required_claims": map[string]interface{}{"department": ""},
+	})
+}
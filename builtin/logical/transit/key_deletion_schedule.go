@@ -0,0 +1,90 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// warnScheduledDeletion wraps the callbacks of the paths that operate on a
+// named key so that their responses carry a warning while the key is
+// scheduled for deletion. Every path with a name field names a key, except
+// for the lifecycle policy paths.
+func (b *backend) warnScheduledDeletion(paths []*framework.Path) {
+	for _, path := range paths {
+		if _, ok := path.Fields["name"]; !ok || strings.HasPrefix(path.Pattern, "lifecycle-policies/") {
+			continue
+		}
+		_, hasNamespace := path.Fields["key_namespace"]
+		for op, callback := range path.Callbacks {
+			path.Callbacks[op] = b.withDeletionWarning(callback, hasNamespace)
+		}
+	}
+}
+
+func (b *backend) withDeletionWarning(callback framework.OperationFunc, hasNamespace bool) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		resp, err := callback(ctx, req, d)
+		if err != nil {
+			return resp, err
+		}
+
+		name := d.Get("name").(string)
+		if hasNamespace {
+			var nameErr error
+			if name, nameErr = keyName(d); nameErr != nil {
+				return resp, nil
+			}
+		}
+		if name == "" {
+			return resp, nil
+		}
+		scheduledAt, lookupErr := b.lm.DeletionScheduledAt(ctx, req.Storage, name)
+		if lookupErr != nil || scheduledAt.IsZero() {
+			return resp, nil
+		}
+
+		if resp == nil {
+			resp = &logical.Response{}
+		}
+		resp.AddWarning(fmt.Sprintf("key scheduled for deletion at %s", scheduledAt.Format(time.RFC3339)))
+		return resp, nil
+	}
+}
+
+// deleteScheduledKeys deletes the keys whose deletion grace period has
+// passed, the way their deletion was asked for
+func (b *backend) deleteScheduledKeys(ctx context.Context, s logical.Storage) error {
+	keys, err := keysutil.ListPolicies(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var errs *multierror.Error
+	for _, key := range keys {
+		p, err := keysutil.LoadPolicyMetadata(ctx, s, key)
+		if err != nil {
+			errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to read key %q: {{err}}", key), err))
+			continue
+		}
+		if p == nil || p.SoftDeleted || p.DeletionScheduledAt.IsZero() || now.Before(p.DeletionScheduledAt) {
+			continue
+		}
+
+		if err := b.deleteKey(ctx, s, key, p, p.DeletionScheduledPermanent); err != nil {
+			errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to delete key %q: {{err}}", key), err))
+			continue
+		}
+		b.Logger().Info("deleted key at the end of its deletion grace period", "key", key)
+	}
+
+	return errs.ErrorOrNil()
+}
@@ -0,0 +1,210 @@
+package transit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/consts"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_DeletionGracePeriod(t *testing.T) {
+	for _, cachingDisabled := range []bool{false, true} {
+		sysView := logical.TestSystemView()
+		sysView.CachingDisabledVal = cachingDisabled
+		s := &logical.InmemStorage{}
+		conf := &logical.BackendConfig{
+			StorageView: s,
+			System:      sysView,
+		}
+		b := Backend(conf)
+		if err := b.Backend.Setup(context.Background(), conf); err != nil {
+			t.Fatal(err)
+		}
+
+		doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   s,
+				Operation: op,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+			t.Helper()
+			resp, err := doReq(op, path, data)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("caching disabled %t: path:%s err:%v resp:%#v", cachingDisabled, path, err, resp)
+			}
+			return resp
+		}
+		mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+			t.Helper()
+			resp, err := doReq(op, path, data)
+			if err == nil && (resp == nil || !resp.IsError()) {
+				t.Fatalf("caching disabled %t: expected error; path:%s data:%#v", cachingDisabled, path, data)
+			}
+		}
+		warned := func(resp *logical.Response) bool {
+			if resp == nil {
+				return false
+			}
+			for _, warning := range resp.Warnings {
+				if strings.HasPrefix(warning, "key scheduled for deletion at ") {
+					return true
+				}
+			}
+			return false
+		}
+
+		plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+		for _, name := range []string{"soft", "permanent", "cancelled"} {
+			mustSucceed(logical.UpdateOperation, "keys/"+name, nil)
+			mustSucceed(logical.UpdateOperation, "keys/"+name+"/config", map[string]interface{}{
+				"deletion_allowed":      true,
+				"deletion_grace_period": 1,
+			})
+		}
+		resp := mustSucceed(logical.UpdateOperation, "encrypt/soft", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		if warned(resp) {
+			t.Fatalf("caching disabled %t: unexpected warning", cachingDisabled)
+		}
+		ciphertext := resp.Data["ciphertext"].(string)
+
+		// Deleting only schedules the deletion
+		resp = mustSucceed(logical.DeleteOperation, "keys/soft", nil)
+		scheduledAt, ok := resp.Data["deletion_scheduled_at"].(time.Time)
+		if !ok || !warned(resp) {
+			t.Fatalf("caching disabled %t: bad response: %#v", cachingDisabled, resp)
+		}
+		mustSucceed(logical.DeleteOperation, "keys/permanent", map[string]interface{}{
+			"permanent": true,
+		})
+		mustSucceed(logical.DeleteOperation, "keys/cancelled", nil)
+
+		// The key stays usable during the grace period, with a warning
+		resp = mustSucceed(logical.UpdateOperation, "decrypt/soft", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext || !warned(resp) {
+			t.Fatalf("caching disabled %t: bad response: %#v", cachingDisabled, resp)
+		}
+		resp = mustSucceed(logical.ReadOperation, "keys/soft", nil)
+		if !resp.Data["deletion_scheduled_at"].(time.Time).Equal(scheduledAt) || !warned(resp) {
+			t.Fatalf("caching disabled %t: bad response: %#v", cachingDisabled, resp)
+		}
+		resp = mustSucceed(logical.UpdateOperation, "hmac/soft", map[string]interface{}{
+			"input": plaintext,
+		})
+		if !warned(resp) {
+			t.Fatalf("caching disabled %t: bad response: %#v", cachingDisabled, resp)
+		}
+
+		// A lifecycle policy named after the key is not the key
+		resp = mustSucceed(logical.UpdateOperation, "lifecycle-policies/soft", nil)
+		if warned(resp) {
+			t.Fatalf("caching disabled %t: unexpected warning", cachingDisabled)
+		}
+
+		// Deleting again keeps the schedule
+		resp = mustSucceed(logical.DeleteOperation, "keys/soft", nil)
+		if !resp.Data["deletion_scheduled_at"].(time.Time).Equal(scheduledAt) {
+			t.Fatalf("caching disabled %t: schedule moved: %#v", cachingDisabled, resp)
+		}
+
+		// Disallowing deletion cancels it
+		resp = mustSucceed(logical.UpdateOperation, "keys/cancelled/config", map[string]interface{}{
+			"deletion_allowed": false,
+		})
+		if warned(resp) {
+			t.Fatalf("caching disabled %t: unexpected warning", cachingDisabled)
+		}
+
+		time.Sleep(time.Until(scheduledAt) + 100*time.Millisecond)
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The keys are deleted the way their deletion was asked for
+		mustFail(logical.UpdateOperation, "decrypt/soft", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		p, err := keysutil.LoadPolicyMetadata(context.Background(), s, "soft")
+		if err != nil || p == nil || !p.SoftDeleted || !p.DeletionScheduledAt.IsZero() {
+			t.Fatalf("caching disabled %t: expected soft-deleted key; err:%v", cachingDisabled, err)
+		}
+		if p, err := keysutil.LoadPolicyMetadata(context.Background(), s, "permanent"); err != nil || p != nil {
+			t.Fatalf("caching disabled %t: expected key to be removed; err:%v", cachingDisabled, err)
+		}
+		resp = mustSucceed(logical.UpdateOperation, "encrypt/cancelled", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		if warned(resp) {
+			t.Fatalf("caching disabled %t: unexpected warning", cachingDisabled)
+		}
+
+		// An undeleted key is not deleted again
+		mustSucceed(logical.UpdateOperation, "keys/soft/undelete", nil)
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+			t.Fatal(err)
+		}
+		mustSucceed(logical.UpdateOperation, "decrypt/soft", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+
+		mustFail(logical.UpdateOperation, "keys/cancelled/config", map[string]interface{}{
+			"deletion_grace_period": -1,
+		})
+	}
+}
+
+func TestTransit_DeletionGracePeriodPerfStandby(t *testing.T) {
+	sysView := logical.TestSystemView()
+	s := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: s,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	doReq(logical.UpdateOperation, "keys/key", nil)
+	doReq(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"deletion_allowed":      true,
+		"deletion_grace_period": 1,
+	})
+	resp := doReq(logical.DeleteOperation, "keys/key", nil)
+	scheduledAt := resp.Data["deletion_scheduled_at"].(time.Time)
+
+	// Nodes that cannot write to storage leave scheduled deletions alone
+	sysView.ReplicationStateVal = consts.ReplicationPerformanceStandby
+	time.Sleep(time.Until(scheduledAt) + 100*time.Millisecond)
+	if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+		t.Fatal(err)
+	}
+	p, err := keysutil.LoadPolicyMetadata(context.Background(), s, "key")
+	if err != nil || p == nil || p.SoftDeleted || !p.DeletionScheduledAt.Equal(scheduledAt) {
+		t.Fatalf("expected the deletion to stay scheduled; err:%v", err)
+	}
+}
@@ -0,0 +1,23 @@
+package transit
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// checkRateLimit takes one request from the key's limiter of the given
+// class. Once the limit is exceeded it returns a 429 response whose
+// retry_after is the number of seconds to wait before retrying.
+func (b *backend) checkRateLimit(p *keysutil.Policy, req *logical.Request, class keysutil.RateLimitClass) (*logical.Response, error) {
+	delay := b.lm.ReserveRateLimit(p, class)
+	if delay == 0 {
+		return nil, nil
+	}
+
+	resp := logical.ErrorResponse("rate limit exceeded for key " + p.Name)
+	resp.Data["retry_after"] = int(math.Ceil(delay.Seconds()))
+	return logical.RespondWithStatusCode(resp, req, http.StatusTooManyRequests)
+}
@@ -0,0 +1,113 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_RateLimit(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatalf("path:%s err:%v", path, err)
+		}
+		return resp
+	}
+	limited := func(resp *logical.Response) bool {
+		t.Helper()
+		if resp == nil || resp.Data[logical.HTTPStatusCode] == nil {
+			return false
+		}
+		if resp.Data[logical.HTTPStatusCode] != http.StatusTooManyRequests {
+			t.Fatalf("bad status code: %#v", resp.Data)
+		}
+		var body struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal([]byte(resp.Data[logical.HTTPRawBody].(string)), &body); err != nil {
+			t.Fatal(err)
+		}
+		if retryAfter, ok := body.Data["retry_after"].(float64); !ok || retryAfter < 1 {
+			t.Fatalf("bad retry_after: %#v", body.Data)
+		}
+		return true
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp := doReq(path, data)
+		if limited(resp) || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s resp:%#v", path, resp)
+		}
+		return resp
+	}
+
+	input := base64.StdEncoding.EncodeToString([]byte("the quick brown fox"))
+	hmacData := map[string]interface{}{"input": input}
+	encryptData := map[string]interface{}{"plaintext": input}
+
+	mustSucceed("keys/test", nil)
+	mustSucceed("keys/test/config", map[string]interface{}{
+		"rate_limit_per_second":      2,
+		"hmac_rate_limit_per_second": 3,
+	})
+
+	// The HMAC limiter allows a burst of its rate and then fires
+	var hmacs []string
+	for i := 0; i < 3; i++ {
+		resp := mustSucceed("hmac/test", hmacData)
+		hmacs = append(hmacs, resp.Data["hmac"].(string))
+	}
+	if !limited(doReq("hmac/test", hmacData)) {
+		t.Fatal("expected HMAC to be rate limited")
+	}
+	if !limited(doReq("verify/test", map[string]interface{}{"input": input, "hmac": hmacs[0]})) {
+		t.Fatal("expected HMAC verification to be rate limited")
+	}
+
+	// Encryption on the same key is limited independently
+	resp := mustSucceed("encrypt/test", encryptData)
+	mustSucceed("decrypt/test", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	if !limited(doReq("encrypt/test", encryptData)) {
+		t.Fatal("expected encryption to be rate limited")
+	}
+
+	// The limiters refill at the configured rate
+	time.Sleep(time.Second)
+	for i := 0; i < 3; i++ {
+		mustSucceed("hmac/test", hmacData)
+	}
+	mustSucceed("encrypt/test", encryptData)
+
+	// Removing the limits lifts them immediately
+	mustSucceed("keys/test/config", map[string]interface{}{
+		"rate_limit_per_second":      0,
+		"hmac_rate_limit_per_second": 0,
+	})
+	for i := 0; i < 10; i++ {
+		mustSucceed("hmac/test", hmacData)
+		mustSucceed("encrypt/test", encryptData)
+	}
+
+	resp = doReq("keys/test/config", map[string]interface{}{
+		"hmac_rate_limit_per_second": -1,
+	})
+	if resp == nil || !resp.IsError() {
+		t.Fatal("expected error for a negative rate limit")
+	}
+}
@@ -0,0 +1,146 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// The statuses a key moves through, as reported to its status webhook
+const (
+	keyStatusCreated                      = "created"
+	keyStatusRotated                      = "rotated"
+	keyStatusMinDecryptionVersionAdvanced = "min_decryption_version_advanced"
+	keyStatusScheduledForDeletion         = "scheduled_for_deletion"
+	keyStatusDeleted                      = "deleted"
+)
+
+// keyStatusWebhookTimeout bounds each call to a status webhook
+const keyStatusWebhookTimeout = 5 * time.Second
+
+// maxConcurrentStatusWebhooks bounds the status webhook calls in flight.
+// Notifications beyond it are dropped.
+const maxConcurrentStatusWebhooks = 16
+
+// statusWebhookClient calls status webhooks. Redirects are not followed, so
+// that a webhook cannot send requests on to hosts outside the allowlist.
+var statusWebhookClient = &http.Client{
+	Timeout: keyStatusWebhookTimeout,
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// keyStatusEvent is the body posted to a status webhook
+type keyStatusEvent struct {
+	KeyName    string    `json:"key_name"`
+	OldState   string    `json:"old_state"`
+	NewState   string    `json:"new_state"`
+	Timestamp  time.Time `json:"timestamp"`
+	KeyVersion int       `json:"key_version"`
+}
+
+// keyStatus returns the current status of the key
+func keyStatus(p *keysutil.Policy) string {
+	switch {
+	case p.SoftDeleted:
+		return keyStatusScheduledForDeletion
+	case p.Status != "":
+		return p.Status
+	default:
+		return keyStatusCreated
+	}
+}
+
+// validateStatusWebhookURL checks that a status webhook URL is an absolute
+// http or https URL whose host is one of the allowed hosts. An empty URL
+// disables the webhook.
+func validateStatusWebhookURL(webhookURL string, allowedHosts []string) error {
+	if webhookURL == "" {
+		return nil
+	}
+	u, err := url.Parse(webhookURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid status webhook URL %q, must be an http or https URL", webhookURL)
+	}
+	if !strutil.StrListContains(allowedHosts, strings.ToLower(u.Hostname())) {
+		return fmt.Errorf("status webhook host %q is not in the mount's status_webhook_allowed_hosts", u.Hostname())
+	}
+	return nil
+}
+
+// notifyKeyStatus posts the status change of the key to its status webhook,
+// if it has one and its host is still allowed. The call is made in the
+// background and failures are only logged, so that a webhook never holds up
+// or fails the operation.
+func (b *backend) notifyKeyStatus(ctx context.Context, s logical.Storage, p *keysutil.Policy, oldStatus, newStatus string) {
+	if p.StatusWebhookURL == "" {
+		return
+	}
+
+	webhookURL := p.StatusWebhookURL
+	keysConfig, err := b.getKeysConfig(ctx, s)
+	if err != nil {
+		b.Logger().Error("failed to send key status webhook", "key", p.Name, "new_state", newStatus, "error", err)
+		return
+	}
+	if err := validateStatusWebhookURL(webhookURL, keysConfig.StatusWebhookAllowedHosts); err != nil {
+		b.Logger().Warn("skipped key status webhook", "key", p.Name, "new_state", newStatus, "error", err)
+		return
+	}
+
+	event := keyStatusEvent{
+		KeyName:    p.Name,
+		OldState:   oldStatus,
+		NewState:   newStatus,
+		Timestamp:  time.Now().UTC(),
+		KeyVersion: p.LatestVersion,
+	}
+
+	select {
+	case b.statusWebhookSlots <- struct{}{}:
+	default:
+		b.Logger().Warn("dropped key status webhook, too many in flight", "key", event.KeyName, "new_state", event.NewState)
+		return
+	}
+
+	go func() {
+		defer func() { <-b.statusWebhookSlots }()
+		if err := postKeyStatusEvent(webhookURL, event); err != nil {
+			b.Logger().Error("failed to send key status webhook", "key", event.KeyName, "new_state", event.NewState, "error", err)
+		}
+	}()
+}
+
+func postKeyStatusEvent(webhookURL string, event keyStatusEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := statusWebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package transit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_KeyStatusWebhook(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	events := make(chan keyStatusEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event keyStatusEvent
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&event) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- event
+	}))
+	defer server.Close()
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	// expect waits for the given transitions, in any order as the webhook
+	// calls are made concurrently
+	type transition struct {
+		old, new string
+		version  int
+	}
+	expect := func(expected ...transition) {
+		t.Helper()
+		var got []transition
+		for range expected {
+			select {
+			case event := <-events:
+				if event.KeyName != "key" || time.Since(event.Timestamp) > time.Minute {
+					t.Fatalf("bad event: %#v", event)
+				}
+				got = append(got, transition{event.OldState, event.NewState, event.KeyVersion})
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %v, got %v", expected, got)
+			}
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].new < got[j].new })
+		sort.Slice(expected, func(i, j int) bool { return expected[i].new < expected[j].new })
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("bad transitions %v, expected %v", got, expected)
+		}
+	}
+
+	// Webhooks must be on a host the mount allows
+	mustFail(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"status_webhook_url": server.URL,
+	})
+	mustFail(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"status_webhook_allowed_hosts": "127.0.0.1:8200",
+	})
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"status_webhook_allowed_hosts": "127.0.0.1,example.com",
+	})
+	mustFail(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"status_webhook_url": "ftp://example.com",
+	})
+	mustFail(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"status_webhook_url": "https://example.org",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"status_webhook_url": server.URL,
+	})
+	expect(transition{"", "created", 1})
+
+	mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+	expect(transition{"created", "rotated", 2})
+
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"min_decryption_version": 2,
+	})
+	expect(transition{"rotated", "min_decryption_version_advanced", 2})
+
+	// Automatic advancement follows the rotation
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"auto_min_decryption_version_lag": 0,
+		"deletion_allowed":                true,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+	expect(
+		transition{"min_decryption_version_advanced", "rotated", 3},
+		transition{"rotated", "min_decryption_version_advanced", 3},
+	)
+
+	mustSucceed(logical.DeleteOperation, "keys/key", nil)
+	expect(transition{"min_decryption_version_advanced", "scheduled_for_deletion", 3})
+	mustSucceed(logical.UpdateOperation, "keys/key/undelete", nil)
+	expect(transition{"scheduled_for_deletion", "min_decryption_version_advanced", 3})
+
+	// Other configuration changes and failed operations are not reported
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"audit_read": true,
+	})
+	mustFail(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"status_webhook_url": "not a url",
+	})
+	mustFail(logical.UpdateOperation, "keys/key/undelete", nil)
+
+	mustSucceed(logical.DeleteOperation, "keys/key", map[string]interface{}{
+		"permanent": true,
+	})
+	expect(transition{"min_decryption_version_advanced", "deleted", 3})
+
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Keys without a webhook, or whose webhook was removed, send nothing
+	mustSucceed(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"status_webhook_url": server.URL,
+	})
+	expect(transition{"", "created", 1})
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"status_webhook_url": "",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Webhooks stop once their host is no longer allowed
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"status_webhook_url": server.URL,
+	})
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"status_webhook_allowed_hosts": "example.com",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected event: %#v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestTransit_KeyStatusWebhookRedirect(t *testing.T) {
+	redirected := make(chan struct{}, 1)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected <- struct{}{}
+	}))
+	defer target.Close()
+	server := httptest.NewServer(http.RedirectHandler(target.URL, http.StatusTemporaryRedirect))
+	defer server.Close()
+
+	if err := postKeyStatusEvent(server.URL, keyStatusEvent{KeyName: "key"}); err == nil {
+		t.Fatal("expected error for a redirect")
+	}
+	select {
+	case <-redirected:
+		t.Fatal("redirect was followed")
+	default:
+	}
+}
@@ -0,0 +1,97 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/namespace"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// checkAllowedSubjects returns a user error unless the key has no allowed
+// subjects or the requesting entity matches one of them, by its ID or by the
+// name of one of its aliases
+func (b *backend) checkAllowedSubjects(p *keysutil.Policy, entityID string) error {
+	if len(p.AllowedSubjects) == 0 {
+		return nil
+	}
+	if entityID == "" {
+		return errutil.UserError{Err: "the key is restricted to allowed subjects, but the request has no entity"}
+	}
+	if strutil.StrListContainsGlob(p.AllowedSubjects, entityID) {
+		return nil
+	}
+
+	entity, err := b.System().EntityInfo(entityID)
+	if err != nil {
+		return err
+	}
+	if entity != nil {
+		for _, alias := range entity.Aliases {
+			if strutil.StrListContainsGlob(p.AllowedSubjects, alias.Name) {
+				return nil
+			}
+		}
+	}
+	return errutil.UserError{Err: "the requesting entity is not an allowed subject of the key"}
+}
+
+// authorizeSubject returns a permission denied response if the requesting
+// entity may not use the key
+func (b *backend) authorizeSubject(p *keysutil.Policy, req *logical.Request) (*logical.Response, error) {
+	if err := b.checkAllowedSubjects(p, req.EntityID); err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrPermissionDenied
+		default:
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// rootNamespaceName stands for the root namespace in a key's allowed encrypt
+// and decrypt namespaces, as its canonical path is empty
+const rootNamespaceName = "root"
+
+// canonicalNamespacePath returns the form of a namespace path stored in a
+// key's allowed encrypt and decrypt namespaces
+func canonicalNamespacePath(nsPath string) string {
+	nsPath = namespace.Canonicalize(nsPath)
+	if nsPath == "" || nsPath == "/" || nsPath == rootNamespaceName+"/" {
+		return rootNamespaceName
+	}
+	return nsPath
+}
+
+// authorizeEncryptNamespace returns a permission denied response if the key
+// restricts encryption to namespaces other than the request's. Requests
+// without a namespace are treated as coming from the root namespace.
+func (b *backend) authorizeEncryptNamespace(ctx context.Context, p *keysutil.Policy) (*logical.Response, error) {
+	return authorizeNamespace(ctx, p.AllowedEncryptNamespaces, "encryption")
+}
+
+// authorizeDecryptNamespace is the decryption counterpart of
+// authorizeEncryptNamespace. The two lists are checked independently.
+func (b *backend) authorizeDecryptNamespace(ctx context.Context, p *keysutil.Policy) (*logical.Response, error) {
+	return authorizeNamespace(ctx, p.AllowedDecryptNamespaces, "decryption")
+}
+
+func authorizeNamespace(ctx context.Context, allowed []string, operation string) (*logical.Response, error) {
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+
+	ns, err := namespace.FromContext(ctx)
+	if err != nil {
+		ns = namespace.RootNamespace
+	}
+	nsPath := canonicalNamespacePath(ns.Path)
+	if strutil.StrListContains(allowed, nsPath) {
+		return nil, nil
+	}
+	return logical.ErrorResponse(fmt.Sprintf("%s with the key is not allowed from namespace %q", operation, nsPath)), logical.ErrPermissionDenied
+}
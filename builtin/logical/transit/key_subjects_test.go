@@ -0,0 +1,341 @@
+package transit
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/namespace"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_AllowedSubjects(t *testing.T) {
+	sysView := logical.TestSystemView()
+	storage := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: storage,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	setEntity := func(id, aliasName string) {
+		sysView.EntityVal = &logical.Entity{
+			ID: id,
+			Aliases: []*logical.Alias{
+				{MountType: "userpass", Name: aliasName},
+			},
+		}
+	}
+	doReq := func(entityID, path string, data map[string]interface{}) (*logical.Response, error) {
+		var op logical.Operation = logical.UpdateOperation
+		if data == nil {
+			op = logical.ReadOperation
+		}
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+			EntityID:  entityID,
+		})
+	}
+	mustSucceed := func(entityID, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(entityID, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustBeDenied := func(entityID, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(entityID, path, data)
+		if err != logical.ErrPermissionDenied || resp == nil || !resp.IsError() {
+			t.Fatalf("expected permission denied; path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("", "keys/aes", map[string]interface{}{})
+	mustSucceed("", "keys/ecdsa", map[string]interface{}{
+		"type": "ecdsa-p256",
+	})
+	resp := mustSucceed("", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+
+	for _, name := range []string{"aes", "ecdsa"} {
+		mustSucceed("", "keys/"+name+"/config", map[string]interface{}{
+			"allowed_subjects": "entity-1,user-*, user-*",
+		})
+	}
+	resp = mustSucceed("", "keys/aes", nil)
+	if !reflect.DeepEqual(resp.Data["allowed_subjects"], []string{"entity-1", "user-*"}) {
+		t.Fatalf("bad allowed subjects: %#v", resp.Data["allowed_subjects"])
+	}
+
+	// Subjects match by entity ID or by alias name, with wildcards
+	for _, entity := range [][2]string{{"entity-1", "bob"}, {"entity-2", "user-alice"}} {
+		setEntity(entity[0], entity[1])
+		resp = mustSucceed(entity[0], "decrypt/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+		}
+		mustSucceed(entity[0], "encrypt/aes", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		resp = mustSucceed(entity[0], "sign/ecdsa", map[string]interface{}{
+			"input": plaintext,
+		})
+		mustSucceed(entity[0], "verify/ecdsa", map[string]interface{}{
+			"input":     plaintext,
+			"signature": resp.Data["signature"],
+		})
+	}
+
+	// Other entities and requests without an entity are rejected on every
+	// operation
+	setEntity("entity-3", "admin-user")
+	for _, entityID := range []string{"entity-3", ""} {
+		mustBeDenied(entityID, "encrypt/aes", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		mustBeDenied(entityID, "decrypt/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		mustBeDenied(entityID, "rewrap/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		mustBeDenied(entityID, "datakey/plaintext/aes", map[string]interface{}{})
+		mustBeDenied(entityID, "hmac/aes", map[string]interface{}{
+			"input": plaintext,
+		})
+		mustBeDenied(entityID, "sign/ecdsa", map[string]interface{}{
+			"input": plaintext,
+		})
+	}
+
+	// The key can still be managed, and removing the restriction allows
+	// everyone again
+	mustSucceed("entity-3", "keys/aes/rotate", map[string]interface{}{})
+	mustSucceed("entity-3", "keys/aes/config", map[string]interface{}{
+		"allowed_subjects": "",
+	})
+	if _, ok := mustSucceed("", "keys/aes", nil).Data["allowed_subjects"]; ok {
+		t.Fatal("expected allowed subjects to be removed")
+	}
+	mustSucceed("entity-3", "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+}
+
+func TestTransit_AllowedEncryptNamespaces(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	rootCtx := namespace.RootContext(context.Background())
+	ns1Ctx := namespace.ContextWithNamespace(context.Background(), &namespace.Namespace{
+		ID:   "ns1",
+		Path: "ns1/",
+	})
+	childCtx := namespace.ContextWithNamespace(context.Background(), &namespace.Namespace{
+		ID:   "ns1-child",
+		Path: "ns1/child/",
+	})
+
+	doReq := func(ctx context.Context, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(ctx context.Context, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(ctx, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustBeDenied := func(ctx context.Context, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(ctx, path, data)
+		if err != logical.ErrPermissionDenied || resp == nil || !resp.IsError() {
+			t.Fatalf("expected permission denied; path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed(rootCtx, "keys/aes", nil)
+	resp := mustSucceed(childCtx, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+
+	mustSucceed(rootCtx, "keys/aes/config", map[string]interface{}{
+		"allowed_encrypt_namespaces": "/ns1, root,ns1/",
+	})
+	resp, err := b.HandleRequest(rootCtx, &logical.Request{
+		Storage:   s,
+		Operation: logical.ReadOperation,
+		Path:      "keys/aes",
+	})
+	if err != nil || !reflect.DeepEqual(resp.Data["allowed_encrypt_namespaces"], []string{"ns1/", "root"}) {
+		t.Fatalf("bad allowed encrypt namespaces: %v %#v", err, resp)
+	}
+
+	// The listed namespaces, and requests without a namespace as the root,
+	// can encrypt
+	for _, ctx := range []context.Context{rootCtx, ns1Ctx, context.Background()} {
+		mustSucceed(ctx, "encrypt/aes", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		mustSucceed(ctx, "datakey/wrapped/aes", map[string]interface{}{})
+		mustSucceed(ctx, "rewrap/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+	}
+
+	// Child namespaces are not covered by their parent's entry
+	mustBeDenied(childCtx, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustBeDenied(childCtx, "encrypt/aes", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext},
+		},
+	})
+	mustBeDenied(childCtx, "datakey/plaintext/aes", map[string]interface{}{})
+	mustBeDenied(childCtx, "envelope/aes/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustBeDenied(childCtx, "rewrap/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+
+	// Decryption is not restricted
+	resp = mustSucceed(childCtx, "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	mustSucceed(rootCtx, "keys/aes/config", map[string]interface{}{
+		"allowed_encrypt_namespaces": "",
+	})
+	mustSucceed(childCtx, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+}
+
+func TestTransit_AllowedDecryptNamespaces(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	rootCtx := namespace.RootContext(context.Background())
+	aCtx := namespace.ContextWithNamespace(context.Background(), &namespace.Namespace{
+		ID:   "a",
+		Path: "A/",
+	})
+	bCtx := namespace.ContextWithNamespace(context.Background(), &namespace.Namespace{
+		ID:   "b",
+		Path: "B/",
+	})
+
+	doReq := func(ctx context.Context, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(ctx, &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(ctx context.Context, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(ctx, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustBeDenied := func(ctx context.Context, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(ctx, path, data)
+		if err != logical.ErrPermissionDenied || resp == nil || !resp.IsError() {
+			t.Fatalf("expected permission denied; path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed(rootCtx, "keys/aes", nil)
+	mustSucceed(rootCtx, "keys/aes/config", map[string]interface{}{
+		"allowed_encrypt_namespaces": "A",
+		"allowed_decrypt_namespaces": "B/",
+	})
+	resp, err := b.HandleRequest(rootCtx, &logical.Request{
+		Storage:   s,
+		Operation: logical.ReadOperation,
+		Path:      "keys/aes",
+	})
+	if err != nil || !reflect.DeepEqual(resp.Data["allowed_decrypt_namespaces"], []string{"B/"}) {
+		t.Fatalf("bad allowed decrypt namespaces: %v %#v", err, resp)
+	}
+
+	// Only A can encrypt
+	resp = mustSucceed(aCtx, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	envelope := mustSucceed(aCtx, "envelope/aes/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	for _, ctx := range []context.Context{bCtx, rootCtx} {
+		mustBeDenied(ctx, "encrypt/aes", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+	}
+
+	// Only B can decrypt
+	resp = mustSucceed(bCtx, "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+	mustSucceed(bCtx, "envelope/aes/decrypt", envelope.Data)
+	for _, ctx := range []context.Context{aCtx, rootCtx} {
+		mustBeDenied(ctx, "decrypt/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		mustBeDenied(ctx, "decrypt/aes", map[string]interface{}{
+			"batch_input": []interface{}{
+				map[string]interface{}{"ciphertext": ciphertext},
+			},
+		})
+		mustBeDenied(ctx, "envelope/aes/decrypt", envelope.Data)
+	}
+
+	// Rewrapping decrypts and encrypts, so no namespace is allowed both
+	for _, ctx := range []context.Context{aCtx, bCtx} {
+		mustBeDenied(ctx, "rewrap/aes", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+	}
+
+	mustSucceed(rootCtx, "keys/aes/config", map[string]interface{}{
+		"allowed_decrypt_namespaces": "",
+	})
+	mustSucceed(aCtx, "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	mustBeDenied(bCtx, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+}
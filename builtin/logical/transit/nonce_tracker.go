@@ -0,0 +1,188 @@
+package transit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+const (
+	nonceTrackerPrefix = "nonce-tracker/"
+
+	// With 2^19 bits and 7 hashes, a filter holding 50,000 nonces wrongly
+	// reports a fresh nonce as used less than 1% of the time
+	nonceFilterBits   = 1 << 19
+	nonceFilterHashes = 7
+)
+
+// nonceFilter is a bloom filter of the nonces used with one key version.
+// Nonces are recorded together with the derivation context, as the same nonce
+// is safe to use with keys derived from different contexts.
+type nonceFilter struct {
+	Bits []byte `json:"bits"`
+}
+
+func newNonceFilter() *nonceFilter {
+	return &nonceFilter{
+		Bits: make([]byte, nonceFilterBits/8),
+	}
+}
+
+// positions returns the bits set for the nonce, using double hashing over a
+// single SHA-256 sum
+func (f *nonceFilter) positions(context, nonce []byte) []uint32 {
+	h := sha256.New()
+	var contextLen [4]byte
+	binary.BigEndian.PutUint32(contextLen[:], uint32(len(context)))
+	h.Write(contextLen[:])
+	h.Write(context)
+	h.Write(nonce)
+	sum := h.Sum(nil)
+
+	h1 := binary.BigEndian.Uint32(sum[0:4])
+	h2 := binary.BigEndian.Uint32(sum[4:8]) | 1
+	positions := make([]uint32, nonceFilterHashes)
+	for i := range positions {
+		positions[i] = (h1 + uint32(i)*h2) % nonceFilterBits
+	}
+	return positions
+}
+
+func (f *nonceFilter) contains(context, nonce []byte) bool {
+	for _, pos := range f.positions(context, nonce) {
+		if f.Bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *nonceFilter) add(context, nonce []byte) {
+	for _, pos := range f.positions(context, nonce) {
+		f.Bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+func nonceFilterPath(name string, ver int) string {
+	return nonceTrackerPrefix + name + "/" + strconv.Itoa(ver)
+}
+
+// nonceTracker rejects caller-supplied nonces that were already used with a
+// key version and context during one encrypt request. The filters are loaded
+// as they are needed and written back once by persist, and the key's nonce
+// tracking lock is held from the first nonce until release, so that
+// concurrent requests do not miss each other's nonces.
+type nonceTracker struct {
+	b    *backend
+	ctx  context.Context
+	s    logical.Storage
+	name string
+
+	// l guards the fields below, as batch items may be encrypted in
+	// parallel
+	l       sync.Mutex
+	lock    *locksutil.LockEntry
+	filters map[int]*nonceFilter
+	changed map[int]bool
+}
+
+func (b *backend) newNonceTracker(ctx context.Context, s logical.Storage, name string) *nonceTracker {
+	return &nonceTracker{
+		b:       b,
+		ctx:     ctx,
+		s:       s,
+		name:    name,
+		filters: make(map[int]*nonceFilter),
+		changed: make(map[int]bool),
+	}
+}
+
+// trackFunc returns a keysutil.CipherOptions TrackNonce function for
+// encryptions with the given derivation context
+func (t *nonceTracker) trackFunc(context []byte) func(int, []byte) error {
+	return func(ver int, nonce []byte) error {
+		t.l.Lock()
+		defer t.l.Unlock()
+
+		if t.lock == nil {
+			t.lock = locksutil.LockForKey(t.b.nonceTrackingLocks, t.name)
+			t.lock.Lock()
+		}
+
+		filter, ok := t.filters[ver]
+		if !ok {
+			entry, err := t.s.Get(t.ctx, nonceFilterPath(t.name, ver))
+			if err != nil {
+				return err
+			}
+			filter = newNonceFilter()
+			if entry != nil {
+				if err := entry.DecodeJSON(filter); err != nil {
+					return err
+				}
+			}
+			t.filters[ver] = filter
+		}
+
+		if filter.contains(context, nonce) {
+			return errutil.UserError{Err: "the nonce has already been used with this key version and context"}
+		}
+		filter.add(context, nonce)
+		t.changed[ver] = true
+		return nil
+	}
+}
+
+// persist writes back the filters that nonces were added to
+func (t *nonceTracker) persist() error {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	for ver := range t.changed {
+		entry, err := logical.StorageEntryJSON(nonceFilterPath(t.name, ver), t.filters[ver])
+		if err != nil {
+			return err
+		}
+		if err := t.s.Put(t.ctx, entry); err != nil {
+			return err
+		}
+		delete(t.changed, ver)
+	}
+	return nil
+}
+
+// release releases the key's nonce tracking lock, if it was taken
+func (t *nonceTracker) release() {
+	t.l.Lock()
+	defer t.l.Unlock()
+
+	if t.lock != nil {
+		t.lock.Unlock()
+		t.lock = nil
+	}
+}
+
+// deleteNonceFilters removes the nonce filters of every version of the named
+// key, so that a key created later under the same name starts afresh
+func (b *backend) deleteNonceFilters(ctx context.Context, s logical.Storage, name string) error {
+	lock := locksutil.LockForKey(b.nonceTrackingLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	vers, err := s.List(ctx, nonceTrackerPrefix+name+"/")
+	if err != nil {
+		return err
+	}
+	for _, ver := range vers {
+		if err := s.Delete(ctx, nonceTrackerPrefix+name+"/"+ver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
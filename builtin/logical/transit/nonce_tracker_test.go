@@ -0,0 +1,212 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// countingPutStorage counts the writes under the given prefix
+type countingPutStorage struct {
+	logical.Storage
+	prefix string
+	puts   int
+}
+
+func (s *countingPutStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		s.puts++
+	}
+	return s.Storage.Put(ctx, entry)
+}
+
+func TestTransit_NonceTracking(t *testing.T) {
+	b, inmem := createBackendWithStorage(t)
+	s := &countingPutStorage{
+		Storage: inmem,
+		prefix:  nonceTrackerPrefix,
+	}
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/chacha", map[string]interface{}{
+		"type": "chacha20-poly1305",
+	})
+	mustFail(logical.UpdateOperation, "keys/chacha/config", map[string]interface{}{
+		"nonce_tracking": true,
+	})
+
+	// Nonces that the key generates itself are not recorded
+	mustSucceed(logical.UpdateOperation, "keys/random", nil)
+	mustSucceed(logical.UpdateOperation, "keys/random/config", map[string]interface{}{
+		"nonce_tracking": true,
+	})
+	resp := mustSucceed(logical.ReadOperation, "keys/random", nil)
+	if resp.Data["nonce_tracking"] != true {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	mustSucceed(logical.UpdateOperation, "encrypt/random", map[string]interface{}{
+		"plaintext": b64("the quick brown fox"),
+	})
+	if s.puts != 0 {
+		t.Fatalf("expected no nonce filter writes, got %d", s.puts)
+	}
+
+	// Caller-supplied nonces are only used by keys with the first convergent
+	// encryption version, so the key is downgraded to it
+	mustSucceed(logical.UpdateOperation, "keys/convergent", map[string]interface{}{
+		"derived":               true,
+		"convergent_encryption": true,
+	})
+	useCallerNonces(t, b, s, "convergent")
+
+	mustSucceed(logical.UpdateOperation, "keys/convergent/config", map[string]interface{}{
+		"nonce_tracking": true,
+	})
+
+	encrypt := func(context, nonce, plaintext string) map[string]interface{} {
+		return map[string]interface{}{
+			"context":   b64(context),
+			"nonce":     b64(nonce),
+			"plaintext": b64(plaintext),
+		}
+	}
+	resp = mustSucceed(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000001", "the quick brown fox"))
+	ciphertext := resp.Data["ciphertext"].(string)
+
+	// Reusing the nonce is rejected, also in a batch, while a fresh nonce or
+	// the same nonce with another context is accepted
+	mustFail(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000001", "jumps over the lazy dog"))
+	mustSucceed(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000002", "jumps over the lazy dog"))
+	mustSucceed(logical.UpdateOperation, "encrypt/convergent", encrypt("other", "nonce-000001", "jumps over the lazy dog"))
+
+	// A batch writes the filter once, and also rejects a nonce reused
+	// within the batch
+	s.puts = 0
+	resp = mustSucceed(logical.UpdateOperation, "encrypt/convergent", map[string]interface{}{
+		"batch_input": []interface{}{
+			encrypt("context", "nonce-000003", "jumps over the lazy dog"),
+			encrypt("context", "nonce-000002", "the quick brown fox"),
+			encrypt("context", "nonce-000004", "the quick brown fox"),
+			encrypt("context", "nonce-000004", "jumps over the lazy dog"),
+		},
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].Error != "" || results[1].Error == "" || results[2].Error != "" || results[3].Error == "" {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+	if s.puts != 1 {
+		t.Fatalf("expected one nonce filter write, got %d", s.puts)
+	}
+	mustFail(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000003", "the quick brown fox"))
+
+	resp = mustSucceed(logical.UpdateOperation, "decrypt/convergent", map[string]interface{}{
+		"context":    b64("context"),
+		"nonce":      b64("nonce-000001"),
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != b64("the quick brown fox") {
+		t.Fatalf("bad plaintext: %#v", resp.Data)
+	}
+
+	// Disabling tracking accepts the reused nonce
+	mustSucceed(logical.UpdateOperation, "keys/convergent/config", map[string]interface{}{
+		"nonce_tracking": false,
+	})
+	mustSucceed(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000001", "jumps over the lazy dog"))
+
+	// The filters are removed with the key, whether it is deleted at once
+	// or purged after being soft-deleted, so a key created later under the
+	// same name does not inherit them
+	filters := func() []string {
+		t.Helper()
+		vers, err := s.List(context.Background(), nonceTrackerPrefix+"convergent/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return vers
+	}
+	if len(filters()) != 1 {
+		t.Fatalf("expected a nonce filter, got %v", filters())
+	}
+	mustSucceed(logical.UpdateOperation, "keys/convergent/config", map[string]interface{}{
+		"deletion_allowed": true,
+	})
+	mustSucceed(logical.DeleteOperation, "keys/convergent", map[string]interface{}{
+		"permanent": true,
+	})
+	if vers := filters(); len(vers) != 0 {
+		t.Fatalf("expected the nonce filters to be deleted, got %v", vers)
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/convergent", map[string]interface{}{
+		"derived":               true,
+		"convergent_encryption": true,
+	})
+	useCallerNonces(t, b, s, "convergent")
+	mustSucceed(logical.UpdateOperation, "keys/convergent/config", map[string]interface{}{
+		"nonce_tracking":   true,
+		"deletion_allowed": true,
+	})
+	mustSucceed(logical.UpdateOperation, "encrypt/convergent", encrypt("context", "nonce-000001", "the quick brown fox"))
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"recovery_window": 1,
+	})
+	mustSucceed(logical.DeleteOperation, "keys/convergent", nil)
+	if len(filters()) != 1 {
+		t.Fatalf("expected the nonce filter to be kept while the key can be recovered, got %v", filters())
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+		t.Fatal(err)
+	}
+	if vers := filters(); len(vers) != 0 {
+		t.Fatalf("expected the nonce filters to be purged, got %v", vers)
+	}
+}
+
+func TestTransit_NonceFilter(t *testing.T) {
+	f := newNonceFilter()
+	if f.contains(nil, []byte("nonce")) {
+		t.Fatal("empty filter contains nonce")
+	}
+	f.add(nil, []byte("nonce"))
+	if !f.contains(nil, []byte("nonce")) {
+		t.Fatal("filter does not contain added nonce")
+	}
+
+	// The context is length-prefixed, so moving bytes between the context
+	// and the nonce gives a different entry
+	if f.contains([]byte("n"), []byte("once")) {
+		t.Fatal("filter confuses context and nonce")
+	}
+}
@@ -0,0 +1,171 @@
+package transit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	agreeKDFNone       = "none"
+	agreeKDFHKDFSHA256 = "hkdf-sha256"
+
+	// maxAgreeKDFBytes is the largest output HKDF-SHA256 can produce
+	maxAgreeKDFBytes = 255 * sha256.Size
+)
+
+func (b *backend) pathAgree() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/agree",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"peer_public_key": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Base64 encoded X25519 public key of the peer",
+			},
+
+			"key_version": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The version of the key to use for the agreement.
+Must be 0 (for latest) or a value greater than or equal
+to the min_encryption_version configured on the key.`,
+			},
+
+			"kdf": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: agreeKDFNone,
+				Description: `The KDF applied to the shared secret before it is
+returned. Valid values are "none" and "hkdf-sha256".
+Defaults to "none".`,
+			},
+
+			"context": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Base64 encoded info passed to the KDF. Only valid
+when kdf is "hkdf-sha256".`,
+			},
+
+			"length": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 32,
+				Description: `The number of bytes the KDF outputs. Only valid
+when kdf is "hkdf-sha256". Defaults to 32.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathAgreeWrite,
+		},
+
+		HelpSynopsis:    pathAgreeHelpSyn,
+		HelpDescription: pathAgreeHelpDesc,
+	}
+}
+
+func (b *backend) pathAgreeWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	ver := d.Get("key_version").(int)
+
+	peerPublicKey, err := base64.StdEncoding.DecodeString(d.Get("peer_public_key").(string))
+	if err != nil {
+		return logical.ErrorResponse("failed to base64-decode peer_public_key"), logical.ErrInvalidRequest
+	}
+	if len(peerPublicKey) == 0 {
+		return logical.ErrorResponse("missing peer_public_key"), logical.ErrInvalidRequest
+	}
+
+	kdf := d.Get("kdf").(string)
+	var info []byte
+	length := d.Get("length").(int)
+	switch kdf {
+	case agreeKDFNone:
+		_, contextSet := d.GetOk("context")
+		_, lengthSet := d.GetOk("length")
+		if contextSet || lengthSet {
+			return logical.ErrorResponse(`context and length require kdf to be "hkdf-sha256"`), logical.ErrInvalidRequest
+		}
+	case agreeKDFHKDFSHA256:
+		info, err = base64.StdEncoding.DecodeString(d.Get("context").(string))
+		if err != nil {
+			return logical.ErrorResponse("failed to base64-decode context"), logical.ErrInvalidRequest
+		}
+		if length <= 0 || length > maxAgreeKDFBytes {
+			return logical.ErrorResponse(fmt.Sprintf("length must be between 1 and %d", maxAgreeKDFBytes)), logical.ErrInvalidRequest
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid kdf %q", kdf)), logical.ErrInvalidRequest
+	}
+
+	// Get the policy
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if !p.Type.KeyAgreementSupported() {
+		return logical.ErrorResponse(fmt.Sprintf("key type %v does not support key agreement", p.Type)), logical.ErrInvalidRequest
+	}
+
+	secret, err := p.SharedSecret(ver, peerPublicKey)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	if kdf == agreeKDFHKDFSHA256 {
+		out := make([]byte, length)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, info), out); err != nil {
+			return nil, err
+		}
+		secret = out
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"shared_secret": base64.StdEncoding.EncodeToString(secret),
+		},
+	}, nil
+}
+
+const pathAgreeHelpSyn = `Perform an X25519 key agreement with a peer public key`
+
+const pathAgreeHelpDesc = `
+This path computes the X25519 shared secret between the named key and the
+given peer public key. The secret is returned either as-is or after being run
+through HKDF-SHA256; the private key itself is never returned.
+`
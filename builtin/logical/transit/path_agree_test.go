@@ -0,0 +1,145 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_AgreeX25519(t *testing.T) {
+	type instance struct {
+		b *backend
+		s logical.Storage
+	}
+	alice, aliceStorage := createBackendWithStorage(t)
+	bob, bobStorage := createBackendWithStorage(t)
+	instances := []instance{{alice, aliceStorage}, {bob, bobStorage}}
+
+	doReq := func(in instance, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return in.b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   in.s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(in instance, op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(in, op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(in instance, op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(in, op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	publicKey := func(in instance, ver string) string {
+		resp := mustSucceed(in, logical.ReadOperation, "keys/agree", nil)
+		if resp.Data["type"] != "x25519" {
+			t.Fatalf("bad type: %#v", resp.Data["type"])
+		}
+		key := resp.Data["keys"].(map[string]map[string]interface{})[ver]
+		if key["name"] != "x25519" {
+			t.Fatalf("bad key name: %#v", key)
+		}
+		return key["public_key"].(string)
+	}
+	agree := func(in instance, data map[string]interface{}) string {
+		resp := mustSucceed(in, logical.UpdateOperation, "keys/agree/agree", data)
+		return resp.Data["shared_secret"].(string)
+	}
+
+	for _, in := range instances {
+		mustSucceed(in, logical.UpdateOperation, "keys/agree", map[string]interface{}{
+			"type": "x25519",
+		})
+	}
+	alicePub := publicKey(instances[0], "1")
+	bobPub := publicKey(instances[1], "1")
+
+	// Each side supplies the other's public key and arrives at the same secret
+	aliceSecret := agree(instances[0], map[string]interface{}{"peer_public_key": bobPub})
+	bobSecret := agree(instances[1], map[string]interface{}{"peer_public_key": alicePub})
+	if aliceSecret != bobSecret {
+		t.Fatalf("shared secrets differ: %q vs %q", aliceSecret, bobSecret)
+	}
+	raw, err := base64.StdEncoding.DecodeString(aliceSecret)
+	if err != nil || len(raw) != 32 {
+		t.Fatalf("bad shared secret %q: %v", aliceSecret, err)
+	}
+
+	// KDF output matches on both sides and differs from the raw secret
+	kdfData := func(peer string) map[string]interface{} {
+		return map[string]interface{}{
+			"peer_public_key": peer,
+			"kdf":             "hkdf-sha256",
+			"context":         "c2Vzc2lvbg==",
+			"length":          64,
+		}
+	}
+	aliceDerived := agree(instances[0], kdfData(bobPub))
+	bobDerived := agree(instances[1], kdfData(alicePub))
+	if aliceDerived != bobDerived {
+		t.Fatalf("derived secrets differ: %q vs %q", aliceDerived, bobDerived)
+	}
+	if aliceDerived == aliceSecret {
+		t.Fatal("expected kdf output to differ from the raw shared secret")
+	}
+	raw, err = base64.StdEncoding.DecodeString(aliceDerived)
+	if err != nil || len(raw) != 64 {
+		t.Fatalf("bad derived secret %q: %v", aliceDerived, err)
+	}
+
+	// After rotation the new version gives a new secret, and the old version
+	// can still be selected explicitly
+	mustSucceed(instances[0], logical.UpdateOperation, "keys/agree/rotate", nil)
+	if agree(instances[0], map[string]interface{}{"peer_public_key": bobPub}) == aliceSecret {
+		t.Fatal("expected a different secret after rotation")
+	}
+	if agree(instances[0], map[string]interface{}{"peer_public_key": bobPub, "key_version": 1}) != aliceSecret {
+		t.Fatal("expected version 1 to reproduce the original secret")
+	}
+
+	// Invalid input
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{})
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{
+		"peer_public_key": "c2hvcnQ=",
+	})
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{
+		"peer_public_key": base64.StdEncoding.EncodeToString(make([]byte, 32)),
+	})
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{
+		"peer_public_key": bobPub,
+		"key_version":     3,
+	})
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{
+		"peer_public_key": bobPub,
+		"kdf":             "hkdf-md5",
+	})
+	mustFail(instances[0], logical.UpdateOperation, "keys/agree/agree", map[string]interface{}{
+		"peer_public_key": bobPub,
+		"length":          16,
+	})
+
+	// Other key types cannot be used, and x25519 keys cannot be derived or
+	// used for signing and encryption
+	mustSucceed(instances[0], logical.UpdateOperation, "keys/aes", nil)
+	mustFail(instances[0], logical.UpdateOperation, "keys/aes/agree", map[string]interface{}{
+		"peer_public_key": bobPub,
+	})
+	mustFail(instances[0], logical.UpdateOperation, "keys/derived", map[string]interface{}{
+		"type":    "x25519",
+		"derived": true,
+	})
+	mustFail(instances[0], logical.UpdateOperation, "sign/agree", map[string]interface{}{
+		"input": "aGVsbG8=",
+	})
+	mustFail(instances[0], logical.UpdateOperation, "encrypt/agree", map[string]interface{}{
+		"plaintext": "aGVsbG8=",
+	})
+}
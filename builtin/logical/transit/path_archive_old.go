@@ -0,0 +1,86 @@
+package transit
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathArchiveOld() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/archive-old",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"older_than": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `Versions created longer ago than this are
+archived. Archived versions can still be used for
+decryption but are no longer listed when reading the
+key. The latest version is never archived.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathArchiveOldUpdate,
+		},
+
+		HelpSynopsis:    pathArchiveOldHelpSyn,
+		HelpDescription: pathArchiveOldHelpDesc,
+	}
+}
+
+func (b *backend) pathArchiveOldUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	olderThan := d.Get("older_than").(int)
+	if olderThan <= 0 {
+		return logical.ErrorResponse("older_than must be a positive duration"), logical.ErrInvalidRequest
+	}
+
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("invalid key name"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(true)
+	}
+	defer p.Unlock()
+
+	archived, err := p.ArchiveVersionsOlderThan(ctx, req.Storage, time.Now().Add(-time.Duration(olderThan)*time.Second))
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"archived_versions": archived,
+		},
+	}, nil
+}
+
+const pathArchiveOldHelpSyn = `Archive key versions older than a given age`
+
+const pathArchiveOldHelpDesc = `
+This path archives the versions of the named key that were created longer ago
+than older_than and are still decryptable. Unlike trimming, archiving keeps
+the versions usable for decryption; they are only left out of the versions
+listed when reading the key.
+`
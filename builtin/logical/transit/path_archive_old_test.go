@@ -0,0 +1,152 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_ArchiveOld(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	getPolicy := func() *keysutil.Policy {
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: s,
+			Name:    "key",
+		})
+		if err != nil || p == nil {
+			t.Fatalf("failed to load policy: %v", err)
+		}
+		return p
+	}
+	listedVersions := func() []string {
+		t.Helper()
+		resp := mustSucceed(logical.ReadOperation, "keys/key", nil)
+		var versions []string
+		for ver := range resp.Data["keys"].(map[string]int64) {
+			versions = append(versions, ver)
+		}
+		sort.Strings(versions)
+		return versions
+	}
+	archive := func(olderThan string) int {
+		t.Helper()
+		resp := mustSucceed(logical.UpdateOperation, "keys/key/archive-old", map[string]interface{}{
+			"older_than": olderThan,
+		})
+		return resp.Data["archived_versions"].(int)
+	}
+
+	plaintext := base64.StdEncoding.EncodeToString([]byte("the quick brown fox"))
+	var ciphertexts []string
+	mustSucceed(logical.UpdateOperation, "keys/key", nil)
+	for i := 1; i <= 4; i++ {
+		if i > 1 {
+			mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+		}
+		resp := mustSucceed(logical.UpdateOperation, "encrypt/key", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		ciphertexts = append(ciphertexts, resp.Data["ciphertext"].(string))
+	}
+
+	// Age every version, leaving version 3 just short of the cutoff
+	p := getPolicy()
+	for ver, age := range map[int]time.Duration{1: 72 * time.Hour, 2: 48 * time.Hour, 3: 23 * time.Hour, 4: 72 * time.Hour} {
+		entry := p.Keys[strconv.Itoa(ver)]
+		entry.CreationTime = time.Now().Add(-age)
+		p.Keys[strconv.Itoa(ver)] = entry
+	}
+
+	// Versions that can no longer be decrypted are not archived
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"min_decryption_version": 2,
+	})
+
+	mustFail(logical.UpdateOperation, "keys/key/archive-old", nil)
+	mustFail(logical.UpdateOperation, "keys/missing/archive-old", map[string]interface{}{
+		"older_than": "24h",
+	})
+
+	if archived := archive("24h"); archived != 1 {
+		t.Fatalf("expected 1 archived version, got %d", archived)
+	}
+	if archived := archive("24h"); archived != 0 {
+		t.Fatalf("expected no newly archived versions, got %d", archived)
+	}
+
+	// The latest version is kept even though it is old enough
+	versions := listedVersions()
+	if !reflect.DeepEqual(versions, []string{"3", "4"}) {
+		t.Fatalf("bad listed versions: %v", versions)
+	}
+	resp := mustSucceed(logical.ReadOperation, "keys/key", map[string]interface{}{
+		"page_size": 10,
+	})
+	if resp.Data["total_versions"] != 2 || len(resp.Data["versions"].(map[string]int64)) != 2 {
+		t.Fatalf("bad paged versions: %#v", resp.Data)
+	}
+
+	// Archived versions still decrypt, as do the others
+	for i, ciphertext := range ciphertexts[1:] {
+		resp := mustSucceed(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bad plaintext for version %d: %#v", i+2, resp.Data)
+		}
+	}
+
+	// The archive holds the archived mark, and the mark survives the key
+	// being loaded from storage again
+	p = getPolicy()
+	stored, err := p.LoadArchive(context.Background(), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Keys[2-p.MinAvailableVersion].ArchivedTime.IsZero() {
+		t.Fatal("version 2 is not marked as archived in the archive")
+	}
+	b.lm.InvalidatePolicy("key")
+	p = getPolicy()
+	if p.Keys["2"].ArchivedTime.IsZero() || !p.Keys["3"].ArchivedTime.IsZero() {
+		t.Fatalf("bad archived times after reload: %v %v", p.Keys["2"].ArchivedTime, p.Keys["3"].ArchivedTime)
+	}
+
+	if archived := archive("1h"); archived != 1 {
+		t.Fatalf("expected 1 archived version, got %d", archived)
+	}
+	if versions := listedVersions(); !reflect.DeepEqual(versions, []string{"4"}) {
+		t.Fatalf("bad listed versions: %v", versions)
+	}
+}
@@ -2,7 +2,9 @@ package transit
 
 import (
 	"context"
+	"fmt"
 
+	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -15,6 +17,24 @@ func (b *backend) pathBackup() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the key",
 			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"external_format": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the key material is returned in the
+standard format given by output_format instead of
+a Vault-specific backup.`,
+			},
+
+			"output_format": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "jwk",
+				Description: `The external format to use when
+external_format is set. Can be "jwk" or "pkcs8";
+"pkcs8" is only supported for asymmetric keys.
+Defaults to "jwk".`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -27,7 +47,22 @@ func (b *backend) pathBackup() *framework.Path {
 }
 
 func (b *backend) pathBackupRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	backup, err := b.lm.BackupPolicy(ctx, req.Storage, d.Get("name").(string))
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	var backup string
+	if d.Get("external_format").(bool) {
+		outputFormat := d.Get("output_format").(string)
+		format, ok := keysutil.ExternalFormatMap[outputFormat]
+		if !ok {
+			return logical.ErrorResponse(fmt.Sprintf("invalid output format %q", outputFormat)), logical.ErrInvalidRequest
+		}
+		backup, err = b.lm.BackupPolicyExternal(ctx, req.Storage, name, format)
+	} else {
+		backup, err = b.lm.BackupPolicy(ctx, req.Storage, name)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -1,10 +1,18 @@
 package transit
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/vault/logical"
+	jose "gopkg.in/square/go-jose.v2"
 )
 
 func TestTransit_BackupRestore(t *testing.T) {
@@ -149,6 +157,7 @@ func testBackupRestore(t *testing.T, keyType, feature string) {
 
 	// Delete the key
 	keyReq.Operation = logical.DeleteOperation
+	keyReq.Data = map[string]interface{}{"permanent": true}
 	resp, err = b.HandleRequest(context.Background(), keyReq)
 	if err != nil || (resp != nil && resp.IsError()) {
 		t.Fatalf("resp: %#v\nerr: %v", resp, err)
@@ -240,3 +249,547 @@ func testBackupRestore(t *testing.T, keyType, feature string) {
 	// Ensure that the restored key is functional
 	validationFunc("test1")
 }
+
+func TestTransit_BackupRestoreExternal(t *testing.T) {
+	testBackupRestoreExternal(t, "aes256-gcm96", "jwk", "encrypt-decrypt")
+	testBackupRestoreExternal(t, "chacha20-poly1305", "jwk", "encrypt-decrypt")
+	testBackupRestoreExternal(t, "rsa-2048", "jwk", "encrypt-decrypt")
+	testBackupRestoreExternal(t, "rsa-2048", "pkcs8", "encrypt-decrypt")
+
+	testBackupRestoreExternal(t, "ecdsa-p256", "jwk", "sign-verify")
+	testBackupRestoreExternal(t, "ecdsa-p256", "pkcs8", "sign-verify")
+	testBackupRestoreExternal(t, "ed25519", "jwk", "sign-verify")
+	testBackupRestoreExternal(t, "ed25519", "pkcs8", "sign-verify")
+	testBackupRestoreExternal(t, "rsa-2048", "jwk", "sign-verify")
+	testBackupRestoreExternal(t, "rsa-2048", "pkcs8", "sign-verify")
+}
+
+func testBackupRestoreExternal(t *testing.T, keyType, format, feature string) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("%s/%s: path:%s err:%v resp:%#v", keyType, format, path, err, resp)
+		}
+		return resp
+	}
+
+	doReq(logical.UpdateOperation, "keys/test", map[string]interface{}{
+		"type":       keyType,
+		"exportable": true,
+	})
+	doReq(logical.UpdateOperation, "keys/test/config", map[string]interface{}{
+		"allow_plaintext_backup": true,
+	})
+
+	// Produce output with two versions of the key
+	plaintextB64 := "dGhlIHF1aWNrIGJyb3duIGZveA==" // "the quick brown fox"
+	var outputs []string
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			doReq(logical.UpdateOperation, "keys/test/rotate", nil)
+		}
+		switch feature {
+		case "encrypt-decrypt":
+			resp := doReq(logical.UpdateOperation, "encrypt/test", map[string]interface{}{
+				"plaintext": plaintextB64,
+			})
+			outputs = append(outputs, resp.Data["ciphertext"].(string))
+		case "sign-verify":
+			resp := doReq(logical.UpdateOperation, "sign/test", map[string]interface{}{
+				"input": plaintextB64,
+			})
+			outputs = append(outputs, resp.Data["signature"].(string))
+		}
+	}
+
+	resp := doReq(logical.ReadOperation, "backup/test", map[string]interface{}{
+		"external_format": true,
+		"output_format":   format,
+	})
+	backup := resp.Data["backup"].(string)
+
+	if format == "jwk" {
+		var jwks jose.JSONWebKeySet
+		if err := json.Unmarshal([]byte(backup), &jwks); err != nil {
+			t.Fatalf("%s: failed to parse JWK set: %v", keyType, err)
+		}
+		var raw struct {
+			Keys []map[string]interface{} `json:"keys"`
+		}
+		if err := json.Unmarshal([]byte(backup), &raw); err != nil {
+			t.Fatal(err)
+		}
+		expectedKty := map[string]string{
+			"aes256-gcm96":      "oct",
+			"chacha20-poly1305": "oct",
+			"ecdsa-p256":        "EC",
+			"ed25519":           "OKP",
+			"rsa-2048":          "RSA",
+		}[keyType]
+		for _, key := range raw.Keys {
+			if key["kty"] != expectedKty {
+				t.Fatalf("%s: expected kty %q, got %v", keyType, expectedKty, key["kty"])
+			}
+		}
+		if len(jwks.Keys) != 2 {
+			t.Fatalf("%s: expected 2 keys, got %d", keyType, len(jwks.Keys))
+		}
+		for i, key := range jwks.Keys {
+			switch k := key.Key.(type) {
+			case []byte:
+				if len(k) != 32 {
+					t.Fatalf("%s: key %d has length %d", keyType, i, len(k))
+				}
+			default:
+				if !key.Valid() || key.IsPublic() {
+					t.Fatalf("%s: key %d is not a valid private key", keyType, i)
+				}
+			}
+			if expected := []string{"1", "2"}[i]; key.KeyID != expected {
+				t.Fatalf("%s: expected key ID %q, got %q", keyType, expected, key.KeyID)
+			}
+		}
+	}
+
+	doReq(logical.UpdateOperation, "restore/restored", map[string]interface{}{
+		"backup":          backup,
+		"external_format": true,
+	})
+
+	resp = doReq(logical.ReadOperation, "keys/restored", nil)
+	if resp.Data["type"] != keyType {
+		t.Fatalf("expected key type %s, got %v", keyType, resp.Data["type"])
+	}
+	if resp.Data["latest_version"] != 2 {
+		t.Fatalf("%s: expected latest version 2, got %v", keyType, resp.Data["latest_version"])
+	}
+
+	for _, output := range outputs {
+		switch feature {
+		case "encrypt-decrypt":
+			resp = doReq(logical.UpdateOperation, "decrypt/restored", map[string]interface{}{
+				"ciphertext": output,
+			})
+			if resp.Data["plaintext"] != plaintextB64 {
+				t.Fatalf("%s: bad plaintext: %v", keyType, resp.Data["plaintext"])
+			}
+		case "sign-verify":
+			resp = doReq(logical.UpdateOperation, "verify/restored", map[string]interface{}{
+				"input":     plaintextB64,
+				"signature": output,
+			})
+			if resp.Data["valid"] != true {
+				t.Fatalf("%s: signature %q did not verify", keyType, output)
+			}
+		}
+	}
+}
+
+func TestTransit_BackupExternalErrors(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		var op logical.Operation = logical.UpdateOperation
+		if _, ok := data["output_format"]; ok {
+			op = logical.ReadOperation
+		}
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	mustSucceed("keys/aes", map[string]interface{}{
+		"exportable": true,
+	})
+	mustSucceed("keys/derived", map[string]interface{}{
+		"exportable": true,
+		"derived":    true,
+	})
+	for _, name := range []string{"aes", "derived"} {
+		mustSucceed("keys/"+name+"/config", map[string]interface{}{
+			"allow_plaintext_backup": true,
+		})
+	}
+
+	// Symmetric keys have no PKCS#8 representation
+	mustFail("backup/aes", map[string]interface{}{
+		"external_format": true,
+		"output_format":   "pkcs8",
+	})
+	mustFail("backup/aes", map[string]interface{}{
+		"external_format": true,
+		"output_format":   "pem",
+	})
+	mustFail("backup/derived", map[string]interface{}{
+		"external_format": true,
+		"output_format":   "jwk",
+	})
+
+	mustFail("restore", map[string]interface{}{
+		"backup":          `{"keys":[]}`,
+		"external_format": true,
+	})
+	mustFail("restore/bad", map[string]interface{}{
+		"backup":          "not a key",
+		"external_format": true,
+	})
+}
+
+func TestTransit_RestoreExternalEntropyScore(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(logical.UpdateOperation, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	jwks := func(key []byte) string {
+		set, err := json.Marshal(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: key, KeyID: "1"}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(set)
+	}
+
+	// A zero-filled key is rejected by default
+	zeroKey := jwks(make([]byte, 32))
+	mustFail("restore/zero", map[string]interface{}{
+		"backup":          zeroKey,
+		"external_format": true,
+	})
+
+	// Four distinct byte values have a normalized entropy of 2/5
+	weak := make([]byte, 32)
+	for i := range weak {
+		weak[i] = byte(i % 4)
+	}
+	weakKey := jwks(weak)
+	mustFail("restore/weak", map[string]interface{}{
+		"backup":          weakKey,
+		"external_format": true,
+	})
+	mustFail("restore/weak", map[string]interface{}{
+		"backup":            weakKey,
+		"external_format":   true,
+		"min_entropy_score": "0.5",
+	})
+	// The key would also fail the chi-squared test, which is not under test
+	// here
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"max_key_chi_squared": "0",
+	})
+	mustSucceed(logical.UpdateOperation, "restore/weak", map[string]interface{}{
+		"backup":            weakKey,
+		"external_format":   true,
+		"min_entropy_score": "0.3",
+	})
+	resp := mustSucceed(logical.ReadOperation, "keys/weak", nil)
+	if score := resp.Data["entropy_score"].(float64); score != 0.4 {
+		t.Fatalf("expected entropy score 0.4, got %v", score)
+	}
+
+	// Invalid thresholds
+	for _, threshold := range []string{"-0.1", "1.5", "high"} {
+		mustFail("restore/weak", map[string]interface{}{
+			"backup":            weakKey,
+			"external_format":   true,
+			"force":             true,
+			"min_entropy_score": threshold,
+		})
+	}
+
+	// Random keys score near 1, whether generated or imported
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	mustSucceed(logical.UpdateOperation, "restore/random", map[string]interface{}{
+		"backup":          jwks(random),
+		"external_format": true,
+	})
+	for _, keyType := range []string{"aes256-gcm96", "ecdsa-p256", "ed25519", "rsa-2048"} {
+		mustSucceed(logical.UpdateOperation, "keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+	}
+	for _, name := range []string{"random", "aes256-gcm96", "ecdsa-p256", "ed25519", "rsa-2048"} {
+		resp := mustSucceed(logical.ReadOperation, "keys/"+name, nil)
+		if score := resp.Data["entropy_score"].(float64); score < 0.8 || score > 1 {
+			t.Fatalf("%s: expected entropy score near 1, got %v", name, score)
+		}
+	}
+}
+
+func TestTransit_RestoreExternalWeakKeys(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	restore := func(name string, key []byte, alg string) (*logical.Response, error) {
+		set, err := json.Marshal(jose.JSONWebKeySet{
+			Keys: []jose.JSONWebKey{{Key: key, KeyID: "1", Algorithm: alg}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The entropy score check is disabled so that only the weak key
+		// checks apply
+		return doReq(logical.UpdateOperation, "restore/"+name, map[string]interface{}{
+			"backup":            string(set),
+			"external_format":   true,
+			"min_entropy_score": "0",
+		})
+	}
+	mustRestore := func(name string, key []byte, alg string) {
+		resp, err := restore(name, key, alg)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("%s: err:%v resp:%#v", name, err, resp)
+		}
+	}
+	mustReject := func(name string, key []byte, alg string) {
+		resp, err := restore(name, key, alg)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("%s: expected key to be rejected", name)
+		}
+	}
+	repeated := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, 32)
+	}
+
+	resp := mustSucceed(logical.ReadOperation, "config/keys", nil)
+	if !reflect.DeepEqual(resp.Data["weak_key_patterns"], []string{"00", "01", "ff"}) || resp.Data["max_key_chi_squared"] != float64(512) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Known weak keys are rejected for both symmetric key types
+	for _, alg := range []string{"A256GCM", "C20P"} {
+		mustReject("zero", repeated(0x00), alg)
+		mustReject("one", repeated(0x01), alg)
+		mustReject("ff", repeated(0xff), alg)
+	}
+
+	// Randomly generated keys pass
+	for i := 0; i < 20; i++ {
+		random := make([]byte, 32)
+		if _, err := rand.Read(random); err != nil {
+			t.Fatal(err)
+		}
+		mustRestore(fmt.Sprintf("random-%d", i), random, "A256GCM")
+	}
+
+	// Two alternating bytes are not on the blocklist but fail the
+	// chi-squared test
+	alternating := bytes.Repeat([]byte{0x5a, 0xa5}, 16)
+	mustReject("alternating", alternating, "A256GCM")
+
+	// Both checks are configurable
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"weak_key_patterns":   "5aa5",
+		"max_key_chi_squared": "0",
+	})
+	mustReject("alternating", alternating, "A256GCM")
+	mustRestore("zero", repeated(0x00), "A256GCM")
+
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"weak_key_patterns":   "",
+		"max_key_chi_squared": "5000",
+	})
+	mustRestore("alternating", alternating, "A256GCM")
+
+	mustFail(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"weak_key_patterns": "zz",
+	})
+	mustFail(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"max_key_chi_squared": "-1",
+	})
+}
+
+func TestTransit_RestoreMergeVersions(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	// mustFail expects a user error, which is returned as a 400
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err != logical.ErrInvalidRequest || resp == nil || !resp.IsError() {
+			t.Fatalf("expected invalid request; path:%s data:%#v err:%v resp:%#v", path, data, err, resp)
+		}
+	}
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+
+	// encryptVersions returns a ciphertext for each of versions versions of
+	// the named key, rotating between them
+	encryptVersions := func(name string, versions int) []string {
+		var ciphertexts []string
+		for ver := 1; ver <= versions; ver++ {
+			if ver > 1 {
+				mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+			}
+			resp := mustSucceed(logical.UpdateOperation, "encrypt/"+name, map[string]interface{}{
+				"plaintext": plaintext,
+			})
+			ciphertexts = append(ciphertexts, resp.Data["ciphertext"].(string))
+		}
+		return ciphertexts
+	}
+	decrypt := func(name, ciphertext string) {
+		resp := mustSucceed(logical.UpdateOperation, "decrypt/"+name, map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bad: %#v", resp.Data)
+		}
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/src", map[string]interface{}{
+		"exportable": true,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/src/config", map[string]interface{}{
+		"allow_plaintext_backup": true,
+	})
+	srcCiphertexts := encryptVersions("src", 3)
+	resp := mustSucceed(logical.ReadOperation, "backup/src", nil)
+	backup := resp.Data["backup"].(string)
+
+	mustSucceed(logical.UpdateOperation, "keys/dst", nil)
+	dstCiphertexts := encryptVersions("dst", 2)
+
+	resp = mustSucceed(logical.UpdateOperation, "restore/dst", map[string]interface{}{
+		"backup":         backup,
+		"merge_versions": true,
+	})
+	mergedVersions := resp.Data["merged_versions"].(map[string]int)
+	if !reflect.DeepEqual(mergedVersions, map[string]int{"1": 3, "2": 4, "3": 5}) {
+		t.Fatalf("bad: %#v", mergedVersions)
+	}
+
+	resp = mustSucceed(logical.ReadOperation, "keys/dst", nil)
+	if resp.Data["latest_version"] != 5 || resp.Data["min_decryption_version"] != 1 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Every version of both keys decrypts, the merged ones under their new
+	// numbers
+	checkDecrypt := func() {
+		for _, ciphertext := range dstCiphertexts {
+			decrypt("dst", ciphertext)
+		}
+		for i, ciphertext := range srcCiphertexts {
+			relabeled := strings.Replace(ciphertext, fmt.Sprintf("vault:v%d:", i+1), fmt.Sprintf("vault:v%d:", mergedVersions[strconv.Itoa(i+1)]), 1)
+			decrypt("dst", relabeled)
+		}
+	}
+	checkDecrypt()
+
+	// The merged versions are archived like any other
+	mustSucceed(logical.UpdateOperation, "keys/dst/config", map[string]interface{}{
+		"min_decryption_version": 5,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/dst/config", map[string]interface{}{
+		"min_decryption_version": 1,
+	})
+	checkDecrypt()
+
+	// New encryptions use the latest merged version
+	resp = mustSucceed(logical.UpdateOperation, "encrypt/dst", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	if !strings.HasPrefix(resp.Data["ciphertext"].(string), "vault:v5:") {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Only keys of the same type can be merged, and the key must exist
+	mustSucceed(logical.UpdateOperation, "keys/ed", map[string]interface{}{
+		"type": "ed25519",
+	})
+	mustFail(logical.UpdateOperation, "restore/ed", map[string]interface{}{
+		"backup":         backup,
+		"merge_versions": true,
+	})
+	mustFail(logical.UpdateOperation, "restore/missing", map[string]interface{}{
+		"backup":         backup,
+		"merge_versions": true,
+	})
+	mustFail(logical.UpdateOperation, "restore/dst", map[string]interface{}{
+		"backup":         backup,
+		"merge_versions": true,
+		"force":          true,
+	})
+	mustFail(logical.UpdateOperation, "restore/dst", map[string]interface{}{
+		"backup":         "not a backup",
+		"merge_versions": true,
+	})
+}
@@ -3,8 +3,12 @@ package transit
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"time"
 
+	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -18,6 +22,8 @@ func (b *backend) pathConfig() *framework.Path {
 				Description: "Name of the key",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"min_decryption_version": &framework.FieldSchema{
 				Type: framework.TypeInt,
 				Description: `If set, the minimum version of the key allowed
@@ -33,11 +39,166 @@ to be used for signing. If set to zero, only
 the latest version of the key is allowed.`,
 			},
 
+			"auto_min_decryption_version_lag": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `If not negative, min_decryption_version is
+advanced automatically on each rotation so that this
+many versions prior to the latest remain decryptable.
+A lag of 0 allows only the latest version; -1
+disables the advancement.`,
+			},
+
+			"lifecycle_policy": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The name of a lifecycle policy to attach
+to the key. An empty string detaches the current
+policy.`,
+			},
+
+			"key_rotation_required": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, encryption fails once the latest
+version is older than the auto_rotate_period of
+the attached lifecycle policy, rather than using a
+key whose automatic rotation has not happened.`,
+			},
+
+			"rotation_quorum": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The number of approvers, counting the requester,
+needed to rotate the key through the rotate
+endpoint. Must be at least 1; above 1, rotation
+requests stay pending until approved through
+keys/<name>/approve-rotation.`,
+			},
+
+			"rotation_quorum_ttl": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `How long a pending rotation can collect
+approvals before it expires. Defaults to 24 hours.`,
+			},
+
+			"hsm_binding": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `Informational metadata recording the HSM
+slot that backs the key, such as slot_id, key_label
+and hsm_type. Values must be strings. An empty map
+clears the binding.`,
+			},
+
+			"allow_pkcs1v15_padding": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `Allows encryption and decryption with RSA keys
+using PKCS#1 v1.5 padding, which is vulnerable to
+padding oracle attacks. Only valid for RSA keys.`,
+			},
+
+			"nonce_tracking": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the nonces supplied to encrypt with the
+key are recorded and encryptions that supply an
+already used nonce are rejected. Only valid for
+aes256-gcm96 keys.`,
+			},
+
+			"quarantine_on_auth_failure": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the hashes of ciphertexts that fail
+authentication on decryption are recorded and can be
+read from quarantine/<name>. Only valid for
+aes256-gcm96 and chacha20-poly1305 keys.`,
+			},
+
+			"escrow_key_name": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of an rsa-2048, rsa-4096 or x25519 key in
+this mount under which each version of the key is
+escrowed when it is created. Setting it escrows the
+existing versions. The escrowed versions are read and
+recovered at escrow/<name>/<version>. An empty string
+stops escrowing new versions.`,
+			},
+
+			"hmac_before_encrypt": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of a key in this mount, which may be this
+key, whose HMAC key authenticates plaintexts before
+they are encrypted. The HMAC is stored with the
+plaintext inside the ciphertext and is verified and
+removed on decryption. Ciphertexts encrypted while it
+is unset cannot be decrypted while it is set, and
+the reverse. An empty string disables it.`,
+			},
+
+			"bound_hmac_key": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of a key in this mount, which may be this
+key, whose HMAC key computes an HMAC of each
+ciphertext that is appended to it. Decryption
+requires and verifies the HMAC. Ciphertexts encrypted
+while it is unset cannot be decrypted while it is
+set. An empty string disables it.`,
+			},
+
+			"external_hmac_key": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Name of a key in this mount, which may be this
+key, whose HMAC key verifies the external_hmac of
+decrypt requests. Decrypt requests cannot pass an
+external_hmac while it is unset. An empty string
+disables it.`,
+			},
+
+			"max_sign_uses": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The number of signatures each version of the key
+can make through the sign endpoint before it is
+disabled for signing. Disabled versions stay disabled
+but can still verify. 0 removes the limit. Only valid
+for keys that support signing.`,
+			},
+
+			"rate_limit_per_second": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The number of encrypt and decrypt requests the key
+serves each second. Requests over the limit fail with
+a 429 status and a retry_after value in seconds. 0
+removes the limit.`,
+			},
+
+			"hmac_rate_limit_per_second": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The number of HMAC and HMAC verification requests
+the key serves each second, limited independently of
+rate_limit_per_second. 0 removes the limit.`,
+			},
+
+			"audit_read": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, every read of the key is logged to
+the server log at INFO level.`,
+			},
+
+			"ciphertext_prefix": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Prefix that encrypt requests may ask for in
+place of "vault:". An empty value removes it.`,
+			},
+
 			"deletion_allowed": &framework.FieldSchema{
 				Type:        framework.TypeBool,
 				Description: "Whether to allow deletion of the key",
 			},
 
+			"deletion_grace_period": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `If set, deleting the key schedules its deletion
+for after this period instead of deleting it. The key
+stays usable until then, with a warning on every
+response. Disallowing deletion cancels a scheduled
+deletion. 0 deletes keys immediately.`,
+			},
+
 			"exportable": &framework.FieldSchema{
 				Type:        framework.TypeBool,
 				Description: `Enables export of the key. Once set, this cannot be disabled.`,
@@ -47,6 +208,61 @@ the latest version of the key is allowed.`,
 				Type:        framework.TypeBool,
 				Description: `Enables taking a backup of the named key in plaintext format. Once set, this cannot be disabled.`,
 			},
+
+			"exportable_after_rotation": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, only versions older than the latest
+can be exported, so the key must have been rotated
+at least once.`,
+			},
+
+			"status_webhook_url": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `An http or https URL that is sent a POST request
+whenever the key is rotated, its min decryption
+version advances, or it is deleted or recovered.
+An empty string disables the webhook.`,
+			},
+
+			"required_claims": &framework.FieldSchema{
+				Type: framework.TypeKVPairs,
+				Description: `Claims that the requesting entity must carry in
+its alias or entity metadata to encrypt or decrypt
+with the key, mapped to their required value or to
+an empty string to accept any value. The claims are
+authenticated with the ciphertext, so changing them
+leaves existing ciphertexts undecryptable. Only
+supported for AEAD keys without convergent
+encryption. An empty map removes the requirement.`,
+			},
+
+			"allowed_subjects": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Entity IDs or entity alias names allowed to use
+the key. Entries may have a leading or trailing "*"
+wildcard. If set, requests from other entities, or
+without an entity, are rejected. An empty list
+removes the restriction.`,
+			},
+
+			"allowed_encrypt_namespaces": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Paths of the Vault namespaces from which the key
+can be used to encrypt, with "root" for the root
+namespace. If set, encryption requests made from
+other namespaces are rejected. Decryption is governed
+by allowed_decrypt_namespaces. An empty list removes
+the restriction.`,
+			},
+
+			"allowed_decrypt_namespaces": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Paths of the Vault namespaces from which the key
+can be used to decrypt, with "root" for the root
+namespace. If set, decryption requests made from
+other namespaces are rejected. An empty list removes
+the restriction.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -59,7 +275,10 @@ the latest version of the key is allowed.`,
 }
 
 func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (resp *logical.Response, retErr error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 
 	// Check if the policy already exists before we lock everything
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
@@ -81,17 +300,74 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 
 	originalMinDecryptionVersion := p.MinDecryptionVersion
 	originalMinEncryptionVersion := p.MinEncryptionVersion
+	originalAutoMinDecryptionVersionLag := p.AutoMinDecryptionVersionLag
+	originalLifecyclePolicy := p.LifecyclePolicy
+	originalKeyRotationRequired := p.KeyRotationRequired
+	originalRotationQuorum := p.RotationQuorum
+	originalRotationQuorumTTL := p.RotationQuorumTTL
+	originalHSMBinding := p.HSMBinding
+	originalAllowPKCS1v15Padding := p.AllowPKCS1v15Padding
+	originalNonceTracking := p.NonceTracking
+	originalQuarantineOnAuthFailure := p.QuarantineOnAuthFailure
+	originalEscrowKeyName := p.EscrowKeyName
+	originalHMACBeforeEncrypt := p.HMACBeforeEncrypt
+	originalBoundHMACKey := p.BoundHMACKey
+	originalExternalHMACKey := p.ExternalHMACKey
+	originalMaxSignUses := p.MaxSignUses
+	originalRateLimitPerSecond := p.RateLimitPerSecond
+	originalHMACRateLimitPerSecond := p.HMACRateLimitPerSecond
+	originalAuditRead := p.AuditRead
+	originalCiphertextPrefix := p.CiphertextPrefix
 	originalDeletionAllowed := p.DeletionAllowed
+	originalDeletionGracePeriod := p.DeletionGracePeriod
+	originalDeletionScheduledAt := p.DeletionScheduledAt
+	originalDeletionScheduledPermanent := p.DeletionScheduledPermanent
 	originalExportable := p.Exportable
 	originalAllowPlaintextBackup := p.AllowPlaintextBackup
+	originalExportableAfterRotation := p.ExportableAfterRotation
+	originalStatusWebhookURL := p.StatusWebhookURL
+	originalRequiredClaims := p.RequiredClaims
+	originalAllowedSubjects := p.AllowedSubjects
+	originalAllowedEncryptNamespaces := p.AllowedEncryptNamespaces
+	originalAllowedDecryptNamespaces := p.AllowedDecryptNamespaces
+	originalStatus := p.Status
+	oldStatus := keyStatus(p)
 
 	defer func() {
 		if retErr != nil || (resp != nil && resp.IsError()) {
 			p.MinDecryptionVersion = originalMinDecryptionVersion
 			p.MinEncryptionVersion = originalMinEncryptionVersion
+			p.AutoMinDecryptionVersionLag = originalAutoMinDecryptionVersionLag
+			p.LifecyclePolicy = originalLifecyclePolicy
+			p.KeyRotationRequired = originalKeyRotationRequired
+			p.RotationQuorum = originalRotationQuorum
+			p.RotationQuorumTTL = originalRotationQuorumTTL
+			p.HSMBinding = originalHSMBinding
+			p.AllowPKCS1v15Padding = originalAllowPKCS1v15Padding
+			p.NonceTracking = originalNonceTracking
+			p.QuarantineOnAuthFailure = originalQuarantineOnAuthFailure
+			p.EscrowKeyName = originalEscrowKeyName
+			p.HMACBeforeEncrypt = originalHMACBeforeEncrypt
+			p.BoundHMACKey = originalBoundHMACKey
+			p.ExternalHMACKey = originalExternalHMACKey
+			p.MaxSignUses = originalMaxSignUses
+			p.RateLimitPerSecond = originalRateLimitPerSecond
+			p.HMACRateLimitPerSecond = originalHMACRateLimitPerSecond
+			p.AuditRead = originalAuditRead
+			p.CiphertextPrefix = originalCiphertextPrefix
 			p.DeletionAllowed = originalDeletionAllowed
+			p.DeletionGracePeriod = originalDeletionGracePeriod
+			p.DeletionScheduledAt = originalDeletionScheduledAt
+			p.DeletionScheduledPermanent = originalDeletionScheduledPermanent
 			p.Exportable = originalExportable
 			p.AllowPlaintextBackup = originalAllowPlaintextBackup
+			p.ExportableAfterRotation = originalExportableAfterRotation
+			p.StatusWebhookURL = originalStatusWebhookURL
+			p.RequiredClaims = originalRequiredClaims
+			p.AllowedSubjects = originalAllowedSubjects
+			p.AllowedEncryptNamespaces = originalAllowedEncryptNamespaces
+			p.AllowedDecryptNamespaces = originalAllowedDecryptNamespaces
+			p.Status = originalStatus
 		}
 	}()
 
@@ -117,6 +393,9 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 				return logical.ErrorResponse(
 					fmt.Sprintf("cannot set min decryption version of %d, latest key version is %d", minDecryptionVersion, p.LatestVersion)), nil
 			}
+			if minDecryptionVersion > p.MinDecryptionVersion {
+				p.Status = keyStatusMinDecryptionVersionAdvanced
+			}
 			p.MinDecryptionVersion = minDecryptionVersion
 			persistNeeded = true
 		}
@@ -148,6 +427,276 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 			fmt.Sprintf("cannot set min encryption/decryption values; min encryption version of %d must be greater than or equal to min decryption version of %d", p.MinEncryptionVersion, p.MinDecryptionVersion)), nil
 	}
 
+	autoMinDecryptionVersionLagRaw, ok := d.GetOk("auto_min_decryption_version_lag")
+	if ok {
+		autoMinDecryptionVersionLag := autoMinDecryptionVersionLagRaw.(int)
+
+		if autoMinDecryptionVersionLag < -1 {
+			return logical.ErrorResponse("auto min decryption version lag must be -1 or more"), nil
+		}
+
+		if autoMinDecryptionVersionLag != minDecryptionVersionLagSetting(p) {
+			p.AutoMinDecryptionVersionLag = nil
+			if autoMinDecryptionVersionLag >= 0 {
+				p.AutoMinDecryptionVersionLag = &autoMinDecryptionVersionLag
+			}
+			persistNeeded = true
+		}
+	}
+
+	lifecyclePolicyRaw, ok := d.GetOk("lifecycle_policy")
+	if ok {
+		lifecyclePolicyName := lifecyclePolicyRaw.(string)
+		if lifecyclePolicyName != "" {
+			b.lifecyclePolicyLock.RLock()
+			defer b.lifecyclePolicyLock.RUnlock()
+
+			lp, err := b.getLifecyclePolicy(ctx, req.Storage, lifecyclePolicyName)
+			if err != nil {
+				return nil, err
+			}
+			if lp == nil {
+				return logical.ErrorResponse(fmt.Sprintf("lifecycle policy %q not found", lifecyclePolicyName)), nil
+			}
+		}
+		if lifecyclePolicyName != p.LifecyclePolicy {
+			p.LifecyclePolicy = lifecyclePolicyName
+			persistNeeded = true
+		}
+	}
+
+	keyRotationRequiredRaw, ok := d.GetOk("key_rotation_required")
+	if ok {
+		keyRotationRequired := keyRotationRequiredRaw.(bool)
+		if keyRotationRequired != p.KeyRotationRequired {
+			p.KeyRotationRequired = keyRotationRequired
+			persistNeeded = true
+		}
+	}
+
+	rotationQuorumRaw, ok := d.GetOk("rotation_quorum")
+	if ok {
+		rotationQuorum := rotationQuorumRaw.(int)
+		if rotationQuorum < 1 {
+			return logical.ErrorResponse("rotation_quorum must be at least 1"), logical.ErrInvalidRequest
+		}
+		if rotationQuorum != p.RotationQuorum {
+			p.RotationQuorum = rotationQuorum
+			persistNeeded = true
+		}
+	}
+
+	rotationQuorumTTLRaw, ok := d.GetOk("rotation_quorum_ttl")
+	if ok {
+		rotationQuorumTTL := time.Duration(rotationQuorumTTLRaw.(int)) * time.Second
+		if rotationQuorumTTL <= 0 {
+			return logical.ErrorResponse("rotation_quorum_ttl must be positive"), logical.ErrInvalidRequest
+		}
+		if rotationQuorumTTL != p.RotationQuorumTTL {
+			p.RotationQuorumTTL = rotationQuorumTTL
+			persistNeeded = true
+		}
+	}
+
+	hsmBindingRaw, ok := d.GetOk("hsm_binding")
+	if ok {
+		hsmBinding, err := parseHSMBinding(hsmBindingRaw.(map[string]interface{}))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		if !reflect.DeepEqual(hsmBinding, p.HSMBinding) {
+			p.HSMBinding = hsmBinding
+			persistNeeded = true
+		}
+	}
+
+	allowPKCS1v15PaddingRaw, ok := d.GetOk("allow_pkcs1v15_padding")
+	if ok {
+		allowPKCS1v15Padding := allowPKCS1v15PaddingRaw.(bool)
+		switch p.Type {
+		case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("allow_pkcs1v15_padding is not valid for key type %v", p.Type)), nil
+		}
+		if allowPKCS1v15Padding != p.AllowPKCS1v15Padding {
+			p.AllowPKCS1v15Padding = allowPKCS1v15Padding
+			persistNeeded = true
+		}
+	}
+
+	nonceTrackingRaw, ok := d.GetOk("nonce_tracking")
+	if ok {
+		nonceTracking := nonceTrackingRaw.(bool)
+		if p.Type != keysutil.KeyType_AES256_GCM96 {
+			return logical.ErrorResponse(fmt.Sprintf("nonce_tracking is not valid for key type %v", p.Type)), nil
+		}
+		if nonceTracking != p.NonceTracking {
+			p.NonceTracking = nonceTracking
+			persistNeeded = true
+		}
+	}
+
+	quarantineOnAuthFailureRaw, ok := d.GetOk("quarantine_on_auth_failure")
+	if ok {
+		quarantineOnAuthFailure := quarantineOnAuthFailureRaw.(bool)
+		switch p.Type {
+		case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305:
+		default:
+			return logical.ErrorResponse(fmt.Sprintf("quarantine_on_auth_failure is not valid for key type %v", p.Type)), nil
+		}
+		if quarantineOnAuthFailure != p.QuarantineOnAuthFailure {
+			p.QuarantineOnAuthFailure = quarantineOnAuthFailure
+			persistNeeded = true
+		}
+	}
+
+	escrowNeeded := false
+	escrowKeyNameRaw, ok := d.GetOk("escrow_key_name")
+	if ok {
+		escrowKeyName := escrowKeyNameRaw.(string)
+		if escrowKeyName != p.EscrowKeyName {
+			if escrowKeyName != "" {
+				if err := b.validateEscrowKey(ctx, req.Storage, p, escrowKeyName); err != nil {
+					switch err.(type) {
+					case errutil.UserError:
+						return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+					default:
+						return nil, err
+					}
+				}
+				escrowNeeded = true
+			}
+			p.EscrowKeyName = escrowKeyName
+			persistNeeded = true
+		}
+	}
+
+	hmacBeforeEncryptRaw, ok := d.GetOk("hmac_before_encrypt")
+	if ok {
+		hmacBeforeEncrypt := hmacBeforeEncryptRaw.(string)
+		if hmacBeforeEncrypt != p.HMACBeforeEncrypt {
+			if hmacBeforeEncrypt != "" {
+				if !p.Type.EncryptionSupported() {
+					return logical.ErrorResponse(fmt.Sprintf("hmac_before_encrypt is not valid for key type %v", p.Type)), nil
+				}
+				if err := b.validateLinkedHMACKey(ctx, req.Storage, p, hmacBeforeEncrypt); err != nil {
+					switch err.(type) {
+					case errutil.UserError:
+						return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+					default:
+						return nil, err
+					}
+				}
+			}
+			p.HMACBeforeEncrypt = hmacBeforeEncrypt
+			persistNeeded = true
+		}
+	}
+
+	boundHMACKeyRaw, ok := d.GetOk("bound_hmac_key")
+	if ok {
+		boundHMACKey := boundHMACKeyRaw.(string)
+		if boundHMACKey != p.BoundHMACKey {
+			if boundHMACKey != "" {
+				if !p.Type.EncryptionSupported() {
+					return logical.ErrorResponse(fmt.Sprintf("bound_hmac_key is not valid for key type %v", p.Type)), nil
+				}
+				if err := b.validateLinkedHMACKey(ctx, req.Storage, p, boundHMACKey); err != nil {
+					switch err.(type) {
+					case errutil.UserError:
+						return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+					default:
+						return nil, err
+					}
+				}
+			}
+			p.BoundHMACKey = boundHMACKey
+			persistNeeded = true
+		}
+	}
+
+	externalHMACKeyRaw, ok := d.GetOk("external_hmac_key")
+	if ok {
+		externalHMACKey := externalHMACKeyRaw.(string)
+		if externalHMACKey != p.ExternalHMACKey {
+			if externalHMACKey != "" {
+				if !p.Type.DecryptionSupported() {
+					return logical.ErrorResponse(fmt.Sprintf("external_hmac_key is not valid for key type %v", p.Type)), nil
+				}
+				if err := b.validateLinkedHMACKey(ctx, req.Storage, p, externalHMACKey); err != nil {
+					switch err.(type) {
+					case errutil.UserError:
+						return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+					default:
+						return nil, err
+					}
+				}
+			}
+			p.ExternalHMACKey = externalHMACKey
+			persistNeeded = true
+		}
+	}
+
+	maxSignUsesRaw, ok := d.GetOk("max_sign_uses")
+	if ok {
+		maxSignUses := maxSignUsesRaw.(int)
+		if maxSignUses < 0 {
+			return logical.ErrorResponse("max_sign_uses cannot be negative"), nil
+		}
+		if maxSignUses > 0 && !p.Type.SigningSupported() {
+			return logical.ErrorResponse(fmt.Sprintf("max_sign_uses is not valid for key type %v", p.Type)), nil
+		}
+		if maxSignUses != p.MaxSignUses {
+			p.MaxSignUses = maxSignUses
+			persistNeeded = true
+		}
+	}
+
+	rateLimitRaw, ok := d.GetOk("rate_limit_per_second")
+	if ok {
+		rateLimit := rateLimitRaw.(int)
+		if rateLimit < 0 {
+			return logical.ErrorResponse("rate_limit_per_second cannot be negative"), nil
+		}
+		if rateLimit != p.RateLimitPerSecond {
+			p.RateLimitPerSecond = rateLimit
+			persistNeeded = true
+		}
+	}
+
+	hmacRateLimitRaw, ok := d.GetOk("hmac_rate_limit_per_second")
+	if ok {
+		hmacRateLimit := hmacRateLimitRaw.(int)
+		if hmacRateLimit < 0 {
+			return logical.ErrorResponse("hmac_rate_limit_per_second cannot be negative"), nil
+		}
+		if hmacRateLimit != p.HMACRateLimitPerSecond {
+			p.HMACRateLimitPerSecond = hmacRateLimit
+			persistNeeded = true
+		}
+	}
+
+	auditReadRaw, ok := d.GetOk("audit_read")
+	if ok {
+		auditRead := auditReadRaw.(bool)
+		if auditRead != p.AuditRead {
+			p.AuditRead = auditRead
+			persistNeeded = true
+		}
+	}
+
+	ciphertextPrefixRaw, ok := d.GetOk("ciphertext_prefix")
+	if ok {
+		ciphertextPrefix := ciphertextPrefixRaw.(string)
+		if err := validateCiphertextPrefix(ciphertextPrefix); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+		if ciphertextPrefix != p.CiphertextPrefix {
+			p.CiphertextPrefix = ciphertextPrefix
+			persistNeeded = true
+		}
+	}
+
 	allowDeletionInt, ok := d.GetOk("deletion_allowed")
 	if ok {
 		allowDeletion := allowDeletionInt.(bool)
@@ -155,6 +704,23 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 			p.DeletionAllowed = allowDeletion
 			persistNeeded = true
 		}
+		if !allowDeletion && !p.DeletionScheduledAt.IsZero() {
+			p.DeletionScheduledAt = time.Time{}
+			p.DeletionScheduledPermanent = false
+			persistNeeded = true
+		}
+	}
+
+	deletionGracePeriodRaw, ok := d.GetOk("deletion_grace_period")
+	if ok {
+		deletionGracePeriod := time.Duration(deletionGracePeriodRaw.(int)) * time.Second
+		if deletionGracePeriod < 0 {
+			return logical.ErrorResponse("deletion_grace_period cannot be negative"), nil
+		}
+		if deletionGracePeriod != p.DeletionGracePeriod {
+			p.DeletionGracePeriod = deletionGracePeriod
+			persistNeeded = true
+		}
 	}
 
 	// Add this as a guard here before persisting since we now require the min
@@ -185,6 +751,90 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 		}
 	}
 
+	exportableAfterRotationRaw, ok := d.GetOk("exportable_after_rotation")
+	if ok {
+		exportableAfterRotation := exportableAfterRotationRaw.(bool)
+		if exportableAfterRotation != p.ExportableAfterRotation {
+			p.ExportableAfterRotation = exportableAfterRotation
+			persistNeeded = true
+		}
+	}
+
+	statusWebhookURLRaw, ok := d.GetOk("status_webhook_url")
+	if ok {
+		statusWebhookURL := statusWebhookURLRaw.(string)
+		keysConfig, err := b.getKeysConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateStatusWebhookURL(statusWebhookURL, keysConfig.StatusWebhookAllowedHosts); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+		if statusWebhookURL != p.StatusWebhookURL {
+			p.StatusWebhookURL = statusWebhookURL
+			persistNeeded = true
+		}
+	}
+
+	requiredClaimsRaw, ok := d.GetOk("required_claims")
+	if ok {
+		requiredClaims := requiredClaimsRaw.(map[string]string)
+		if err := validateRequiredClaims(p, requiredClaims); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+		if len(requiredClaims) == 0 {
+			requiredClaims = nil
+		}
+		if !reflect.DeepEqual(requiredClaims, p.RequiredClaims) {
+			p.RequiredClaims = requiredClaims
+			persistNeeded = true
+		}
+	}
+
+	allowedSubjectsRaw, ok := d.GetOk("allowed_subjects")
+	if ok {
+		allowedSubjects := strutil.RemoveDuplicates(allowedSubjectsRaw.([]string), false)
+		if len(allowedSubjects) == 0 {
+			allowedSubjects = nil
+		}
+		if !reflect.DeepEqual(allowedSubjects, p.AllowedSubjects) {
+			p.AllowedSubjects = allowedSubjects
+			persistNeeded = true
+		}
+	}
+
+	allowedEncryptNamespacesRaw, ok := d.GetOk("allowed_encrypt_namespaces")
+	if ok {
+		var allowedEncryptNamespaces []string
+		for _, nsPath := range strutil.RemoveDuplicates(allowedEncryptNamespacesRaw.([]string), false) {
+			allowedEncryptNamespaces = append(allowedEncryptNamespaces, canonicalNamespacePath(nsPath))
+		}
+		allowedEncryptNamespaces = strutil.RemoveDuplicates(allowedEncryptNamespaces, false)
+		if len(allowedEncryptNamespaces) == 0 {
+			allowedEncryptNamespaces = nil
+		}
+		if !reflect.DeepEqual(allowedEncryptNamespaces, p.AllowedEncryptNamespaces) {
+			p.AllowedEncryptNamespaces = allowedEncryptNamespaces
+			persistNeeded = true
+		}
+	}
+
+	allowedDecryptNamespacesRaw, ok := d.GetOk("allowed_decrypt_namespaces")
+	if ok {
+		var allowedDecryptNamespaces []string
+		for _, nsPath := range strutil.RemoveDuplicates(allowedDecryptNamespacesRaw.([]string), false) {
+			allowedDecryptNamespaces = append(allowedDecryptNamespaces, canonicalNamespacePath(nsPath))
+		}
+		allowedDecryptNamespaces = strutil.RemoveDuplicates(allowedDecryptNamespaces, false)
+		if len(allowedDecryptNamespaces) == 0 {
+			allowedDecryptNamespaces = nil
+		}
+		if !reflect.DeepEqual(allowedDecryptNamespaces, p.AllowedDecryptNamespaces) {
+			p.AllowedDecryptNamespaces = allowedDecryptNamespaces
+			persistNeeded = true
+		}
+	}
+
 	if !persistNeeded {
 		return nil, nil
 	}
@@ -196,11 +846,49 @@ func (b *backend) pathConfigWrite(ctx context.Context, req *logical.Request, d *
 		return logical.ErrorResponse("min decryption version should not be less then min available version"), nil
 	}
 
+	if escrowNeeded {
+		if err := b.escrowAllVersions(ctx, req.Storage, p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.Persist(ctx, req.Storage); err != nil {
+		return nil, err
+	}
+	if p.Status != originalStatus {
+		b.notifyKeyStatus(ctx, req.Storage, p, oldStatus, p.Status)
+	}
+
 	if len(resp.Warnings) == 0 {
-		return nil, p.Persist(ctx, req.Storage)
+		return nil, nil
+	}
+	return resp, nil
+}
+
+// maxHSMBindingEntries is the maximum number of entries in the HSM binding
+// metadata of a key
+const maxHSMBindingEntries = 20
+
+// parseHSMBinding validates that the given HSM binding is a flat map of
+// strings. An empty map results in a nil binding.
+func parseHSMBinding(raw map[string]interface{}) (map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if len(raw) > maxHSMBindingEntries {
+		return nil, fmt.Errorf("hsm_binding cannot have more than %d entries", maxHSMBindingEntries)
+	}
+
+	hsmBinding := make(map[string]string, len(raw))
+	for k, v := range raw {
+		s, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("hsm_binding value for %q must be a string", k)
+		}
+		hsmBinding[k] = s
 	}
 
-	return resp, p.Persist(ctx, req.Storage)
+	return hsmBinding, nil
 }
 
 const pathConfigHelpSyn = `Configure a named encryption key`
@@ -0,0 +1,243 @@
+package transit
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const keysConfigPath = "config/keys"
+
+// Weak symmetric key patterns rejected by default: keys made up entirely of
+// zero, one or 0xff bytes
+var defaultWeakKeyPatterns = []string{"00", "01", "ff"}
+
+// defaultMaxKeyChiSquared leaves ample room above the statistic of uniformly
+// random 32-byte keys, which is around 255, while rejecting keys built from
+// only a handful of distinct bytes
+const defaultMaxKeyChiSquared = 512
+
+// defaultRecoveryWindow is how long a soft-deleted key can be undeleted
+const defaultRecoveryWindow = 30 * 24 * time.Hour
+
+// keysConfig holds settings that apply to every key in the mount
+type keysConfig struct {
+	// RequireSignatureContext rejects sign and verify requests that do not
+	// carry a signature context
+	RequireSignatureContext bool `json:"require_signature_context"`
+
+	// WeakKeyPatterns are hex-encoded byte patterns; imported symmetric keys
+	// that repeat one of them are rejected
+	WeakKeyPatterns []string `json:"weak_key_patterns"`
+
+	// MaxKeyChiSquared is the highest chi-squared statistic accepted for the
+	// byte distribution of imported symmetric keys. Zero disables the test.
+	MaxKeyChiSquared float64 `json:"max_key_chi_squared"`
+
+	// RecoveryWindow is how long a soft-deleted key can be undeleted before
+	// it is removed from storage
+	RecoveryWindow time.Duration `json:"recovery_window"`
+
+	// MaxKeyCount is the most keys the mount can hold. Zero means no limit.
+	MaxKeyCount int `json:"max_key_count"`
+
+	// StatusWebhookAllowedHosts are the lowercase host names that status
+	// webhooks of keys may call. Empty means status webhooks are disabled.
+	StatusWebhookAllowedHosts []string `json:"status_webhook_allowed_hosts"`
+}
+
+// weakKeyPatterns returns the decoded weak key patterns
+func (c *keysConfig) weakKeyPatterns() ([][]byte, error) {
+	patterns := make([][]byte, 0, len(c.WeakKeyPatterns))
+	for _, patternHex := range c.WeakKeyPatterns {
+		pattern, err := hex.DecodeString(patternHex)
+		if err != nil || len(pattern) == 0 {
+			return nil, fmt.Errorf("invalid weak key pattern %q, must be non-empty hex", patternHex)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (b *backend) pathConfigKeys() *framework.Path {
+	return &framework.Path{
+		Pattern: "config/keys",
+		Fields: map[string]*framework.FieldSchema{
+			"require_signature_context": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, sign and verify requests must
+provide a signature_context.`,
+			},
+
+			"weak_key_patterns": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Hex-encoded byte patterns. Imported symmetric
+keys made up entirely of repetitions of one of the
+patterns are rejected. Defaults to "00,01,ff".`,
+			},
+
+			"max_key_chi_squared": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Highest chi-squared statistic of the byte
+distribution accepted for imported symmetric keys.
+Defaults to 512; 0 disables the test.`,
+			},
+
+			"recovery_window": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `How long a soft-deleted key can be undeleted
+before it is removed from storage. Applies to keys
+deleted after it is set. Defaults to 30 days.`,
+			},
+
+			"max_key_count": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The most keys that can exist in the mount,
+counting soft-deleted keys. Creating a key beyond it
+is rejected. Defaults to 0, meaning no limit.`,
+			},
+
+			"status_webhook_allowed_hosts": &framework.FieldSchema{
+				Type: framework.TypeCommaStringSlice,
+				Description: `Host names that the status webhooks of keys
+may call. Keys cannot be given a webhook on any
+other host, and webhooks whose host is removed are
+no longer called. Defaults to none, which disables
+status webhooks.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathConfigKeysWrite,
+			logical.ReadOperation:   b.pathConfigKeysRead,
+		},
+
+		HelpSynopsis:    pathConfigKeysHelpSyn,
+		HelpDescription: pathConfigKeysHelpDesc,
+	}
+}
+
+// getKeysConfig returns the mount-wide key settings. Settings that have not
+// been written keep their defaults.
+func (b *backend) getKeysConfig(ctx context.Context, s logical.Storage) (*keysConfig, error) {
+	entry, err := s.Get(ctx, keysConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decoding reuses the backing array of the slice, so the defaults are
+	// copied rather than overwritten by a stored config
+	cfg := keysConfig{
+		WeakKeyPatterns:  append([]string(nil), defaultWeakKeyPatterns...),
+		MaxKeyChiSquared: defaultMaxKeyChiSquared,
+		RecoveryWindow:   defaultRecoveryWindow,
+	}
+	if entry == nil {
+		return &cfg, nil
+	}
+	if err := entry.DecodeJSON(&cfg); err != nil {
+		return nil, errwrap.Wrapf("failed to decode keys config: {{err}}", err)
+	}
+	return &cfg, nil
+}
+
+func (b *backend) pathConfigKeysRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cfg, err := b.getKeysConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"require_signature_context":    cfg.RequireSignatureContext,
+			"weak_key_patterns":            cfg.WeakKeyPatterns,
+			"max_key_chi_squared":          cfg.MaxKeyChiSquared,
+			"recovery_window":              int64(cfg.RecoveryWindow.Seconds()),
+			"max_key_count":                cfg.MaxKeyCount,
+			"status_webhook_allowed_hosts": cfg.StatusWebhookAllowedHosts,
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigKeysWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	cfg, err := b.getKeysConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	if requireSignatureContextRaw, ok := d.GetOk("require_signature_context"); ok {
+		cfg.RequireSignatureContext = requireSignatureContextRaw.(bool)
+	}
+
+	if weakKeyPatternsRaw, ok := d.GetOk("weak_key_patterns"); ok {
+		cfg.WeakKeyPatterns = weakKeyPatternsRaw.([]string)
+		if _, err := cfg.weakKeyPatterns(); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	}
+
+	if maxKeyChiSquaredRaw, ok := d.GetOk("max_key_chi_squared"); ok {
+		maxKeyChiSquared, err := strconv.ParseFloat(maxKeyChiSquaredRaw.(string), 64)
+		if err != nil || maxKeyChiSquared < 0 {
+			return logical.ErrorResponse(fmt.Sprintf("invalid max key chi-squared %q, must be a non-negative number", maxKeyChiSquaredRaw.(string))), logical.ErrInvalidRequest
+		}
+		cfg.MaxKeyChiSquared = maxKeyChiSquared
+	}
+
+	if recoveryWindowRaw, ok := d.GetOk("recovery_window"); ok {
+		recoveryWindow := time.Duration(recoveryWindowRaw.(int)) * time.Second
+		if recoveryWindow <= 0 {
+			return logical.ErrorResponse("recovery window must be positive"), logical.ErrInvalidRequest
+		}
+		cfg.RecoveryWindow = recoveryWindow
+	}
+
+	if maxKeyCountRaw, ok := d.GetOk("max_key_count"); ok {
+		maxKeyCount := maxKeyCountRaw.(int)
+		if maxKeyCount < 0 {
+			return logical.ErrorResponse("max key count cannot be negative"), logical.ErrInvalidRequest
+		}
+		cfg.MaxKeyCount = maxKeyCount
+	}
+
+	if allowedHostsRaw, ok := d.GetOk("status_webhook_allowed_hosts"); ok {
+		allowedHosts := allowedHostsRaw.([]string)
+		for i, host := range allowedHosts {
+			// IPv6 addresses are the only hosts that contain a colon
+			if host == "" || strings.Contains(host, "/") || (strings.Contains(host, ":") && net.ParseIP(host) == nil) {
+				return logical.ErrorResponse(fmt.Sprintf("invalid status webhook host %q, must be a host name without a scheme or port", host)), logical.ErrInvalidRequest
+			}
+			allowedHosts[i] = strings.ToLower(host)
+		}
+		cfg.StatusWebhookAllowedHosts = allowedHosts
+	}
+
+	entry, err := logical.StorageEntryJSON(keysConfigPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+const pathConfigKeysHelpSyn = `Configure settings that apply to all keys in the mount`
+
+const pathConfigKeysHelpDesc = `
+This path is used to configure settings that apply to every key in the
+mount. Setting require_signature_context makes a signature_context mandatory
+for all sign and verify requests. The weak_key_patterns and
+max_key_chi_squared settings control which symmetric keys are rejected when
+restoring from an external format. The recovery_window setting controls how
+long soft-deleted keys can be undeleted. The max_key_count setting limits the
+number of keys that can be created in the mount. The
+status_webhook_allowed_hosts setting lists the hosts that key status webhooks
+may call.
+`
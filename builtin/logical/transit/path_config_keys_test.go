@@ -0,0 +1,238 @@
+package transit
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_ConfigKeysRequireSignatureContext(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	verify := func(name string, data map[string]interface{}) bool {
+		resp := mustSucceed(logical.UpdateOperation, "verify/"+name, data)
+		return resp.Data["valid"].(bool)
+	}
+
+	input := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	sigContext := "Y29udGV4dA=="
+	otherContext := "b3RoZXI="
+
+	resp := mustSucceed(logical.ReadOperation, "config/keys", nil)
+	if resp.Data["require_signature_context"] != false {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	for _, keyType := range []string{"ed25519", "ecdsa-p256", "rsa-2048"} {
+		mustSucceed(logical.UpdateOperation, "keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		// Not enforced: signing works with or without a context
+		resp = mustSucceed(logical.UpdateOperation, "sign/"+keyType, map[string]interface{}{
+			"input": input,
+		})
+		plainSig := resp.Data["signature"].(string)
+		resp = mustSucceed(logical.UpdateOperation, "sign/"+keyType, map[string]interface{}{
+			"input":             input,
+			"signature_context": sigContext,
+		})
+		contextSig := resp.Data["signature"].(string)
+
+		if !verify(keyType, map[string]interface{}{"input": input, "signature": plainSig}) {
+			t.Fatalf("%s: expected signature without context to verify", keyType)
+		}
+		if !verify(keyType, map[string]interface{}{"input": input, "signature": contextSig, "signature_context": sigContext}) {
+			t.Fatalf("%s: expected signature with context to verify", keyType)
+		}
+
+		// The context is bound into the signature
+		if verify(keyType, map[string]interface{}{"input": input, "signature": contextSig}) {
+			t.Fatalf("%s: signature verified without its context", keyType)
+		}
+		if verify(keyType, map[string]interface{}{"input": input, "signature": contextSig, "signature_context": otherContext}) {
+			t.Fatalf("%s: signature verified under a different context", keyType)
+		}
+		if verify(keyType, map[string]interface{}{"input": input, "signature": plainSig, "signature_context": sigContext}) {
+			t.Fatalf("%s: signature without context verified with one", keyType)
+		}
+
+		mustFail(logical.UpdateOperation, "sign/"+keyType, map[string]interface{}{
+			"input":             input,
+			"signature_context": "not base64",
+		})
+
+		// Enforced: requests without a context are rejected
+		mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+			"require_signature_context": true,
+		})
+		resp = mustSucceed(logical.ReadOperation, "config/keys", nil)
+		if resp.Data["require_signature_context"] != true {
+			t.Fatalf("bad: %#v", resp.Data)
+		}
+
+		mustFail(logical.UpdateOperation, "sign/"+keyType, map[string]interface{}{
+			"input": input,
+		})
+		mustFail(logical.UpdateOperation, "verify/"+keyType, map[string]interface{}{
+			"input":     input,
+			"signature": plainSig,
+		})
+		mustSucceed(logical.UpdateOperation, "sign/"+keyType, map[string]interface{}{
+			"input":             input,
+			"signature_context": sigContext,
+		})
+		if !verify(keyType, map[string]interface{}{"input": input, "signature": contextSig, "signature_context": sigContext}) {
+			t.Fatalf("%s: expected signature with context to verify", keyType)
+		}
+
+		mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+			"require_signature_context": false,
+		})
+	}
+
+	// A context cannot be bound into prehashed input
+	mustFail(logical.UpdateOperation, "sign/ecdsa-p256", map[string]interface{}{
+		"input":             "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=",
+		"prehashed":         true,
+		"signature_context": sigContext,
+	})
+
+	// HMAC verification is not affected
+	mustSucceed(logical.UpdateOperation, "keys/hmac", nil)
+	resp = mustSucceed(logical.UpdateOperation, "hmac/hmac", map[string]interface{}{
+		"input": input,
+	})
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"require_signature_context": true,
+	})
+	if !verify("hmac", map[string]interface{}{"input": input, "hmac": resp.Data["hmac"]}) {
+		t.Fatal("expected hmac to verify")
+	}
+}
+
+func TestTransit_ConfigKeysMaxKeyCount(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	resp := mustSucceed(logical.ReadOperation, "config/keys", nil)
+	if resp.Data["max_key_count"] != 0 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	mustFail(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"max_key_count": -1,
+	})
+
+	mustSucceed(logical.UpdateOperation, "keys/one", nil)
+	mustSucceed(logical.UpdateOperation, "keys/two", map[string]interface{}{
+		"replication_scope": "local",
+	})
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"max_key_count": 3,
+	})
+	resp = mustSucceed(logical.ReadOperation, "config/keys", nil)
+	if resp.Data["max_key_count"] != 3 {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Below the limit keys can be created, including through encrypt
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed(logical.CreateOperation, "encrypt/three", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+
+	// At the limit new keys are rejected, while existing keys can still be
+	// written
+	mustFail(logical.UpdateOperation, "keys/four", nil)
+	mustFail(logical.CreateOperation, "encrypt/four", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/one", nil)
+	mustSucceed(logical.UpdateOperation, "encrypt/three", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+
+	resp = mustSucceed(logical.ListOperation, "keys/", nil)
+	if keys := resp.Data["keys"].([]string); len(keys) != 3 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+
+	// Raising the limit allows creation again
+	mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+		"max_key_count": 4,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/four", nil)
+	mustFail(logical.UpdateOperation, "keys/five", nil)
+
+	// Restoring and deriving keys are held to the same limit, while a
+	// restore over an existing key is still allowed
+	mustSucceed(logical.UpdateOperation, "keys/one/config", map[string]interface{}{
+		"exportable":             true,
+		"allow_plaintext_backup": true,
+	})
+	backup := mustSucceed(logical.ReadOperation, "backup/one", nil).Data["backup"].(string)
+	mustFail(logical.UpdateOperation, "restore/five", map[string]interface{}{
+		"backup": backup,
+	})
+	mustSucceed(logical.UpdateOperation, "restore/one", map[string]interface{}{
+		"backup": backup,
+		"force":  true,
+	})
+	mustSucceed(logical.UpdateOperation, "restore", map[string]interface{}{
+		"backup": backup,
+		"force":  true,
+	})
+	mustFail(logical.UpdateOperation, "keys/one/derive-child", map[string]interface{}{
+		"path":       "m/0",
+		"child_name": "five",
+	})
+	resp = mustSucceed(logical.ListOperation, "keys/", nil)
+	if keys := resp.Data["keys"].([]string); len(keys) != 4 {
+		t.Fatalf("bad keys: %v", keys)
+	}
+}
@@ -1,11 +1,14 @@
 package transit
 
 import (
+	"bytes"
 	"context"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
 
+	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/logical"
 )
 
@@ -215,3 +218,163 @@ func TestTransit_ConfigSettings(t *testing.T) {
 	testHMAC(3, true)
 	testHMAC(2, false)
 }
+
+func TestTransit_ConfigHSMBinding(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	doErrReq := func(data map[string]interface{}) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "keys/aes/config",
+			Data:      data,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; data:%#v", data)
+		}
+	}
+
+	doReq(logical.UpdateOperation, "keys/aes", nil)
+	resp := doReq(logical.ReadOperation, "keys/aes", nil)
+	if _, ok := resp.Data["hsm_binding"]; ok {
+		t.Fatalf("expected no hsm_binding, got %#v", resp.Data["hsm_binding"])
+	}
+
+	binding := map[string]string{
+		"slot_id":   "7",
+		"key_label": "prod-aes-1",
+		"hsm_type":  "safenet-luna",
+	}
+	doReq(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"hsm_binding": map[string]interface{}{
+			"slot_id":   "7",
+			"key_label": "prod-aes-1",
+			"hsm_type":  "safenet-luna",
+		},
+	})
+
+	// Evict the key so that it is read back from storage
+	b.lm.InvalidatePolicy("aes")
+	resp = doReq(logical.ReadOperation, "keys/aes", nil)
+	if !reflect.DeepEqual(resp.Data["hsm_binding"], binding) {
+		t.Fatalf("bad: expected %#v, got %#v", binding, resp.Data["hsm_binding"])
+	}
+
+	// Nested values and too many entries are rejected and leave the binding
+	// unchanged
+	doErrReq(map[string]interface{}{
+		"hsm_binding": map[string]interface{}{
+			"slot": map[string]interface{}{"id": "7"},
+		},
+	})
+	doErrReq(map[string]interface{}{
+		"hsm_binding": map[string]interface{}{
+			"slot_id": 7,
+		},
+	})
+	tooMany := make(map[string]interface{})
+	for i := 0; i <= maxHSMBindingEntries; i++ {
+		tooMany["key"+strconv.Itoa(i)] = "value"
+	}
+	doErrReq(map[string]interface{}{
+		"hsm_binding": tooMany,
+	})
+	resp = doReq(logical.ReadOperation, "keys/aes", nil)
+	if !reflect.DeepEqual(resp.Data["hsm_binding"], binding) {
+		t.Fatalf("bad: expected %#v, got %#v", binding, resp.Data["hsm_binding"])
+	}
+
+	// An empty map clears the binding
+	doReq(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"hsm_binding": map[string]interface{}{},
+	})
+	b.lm.InvalidatePolicy("aes")
+	resp = doReq(logical.ReadOperation, "keys/aes", nil)
+	if _, ok := resp.Data["hsm_binding"]; ok {
+		t.Fatalf("expected no hsm_binding, got %#v", resp.Data["hsm_binding"])
+	}
+}
+
+func TestTransit_ConfigAuditRead(t *testing.T) {
+	var buf bytes.Buffer
+	config := logical.TestBackendConfig()
+	config.StorageView = &logical.InmemStorage{}
+	config.Logger = log.New(&log.LoggerOptions{
+		Output: &buf,
+		Level:  log.Info,
+	})
+	b := Backend(config)
+	if err := b.Backend.Setup(context.Background(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			ID:                  "request-id",
+			Storage:             config.StorageView,
+			Operation:           op,
+			Path:                path,
+			Data:                data,
+			ClientTokenAccessor: "accessor",
+			EntityID:            "entity",
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	doReq(logical.UpdateOperation, "keys/foo", nil)
+	resp := doReq(logical.ReadOperation, "keys/foo", nil)
+	if resp.Data["audit_read"] != false {
+		t.Fatalf("bad: audit_read: %v", resp.Data["audit_read"])
+	}
+	if strings.Contains(buf.String(), "key read") {
+		t.Fatalf("unexpected key read log: %s", buf.String())
+	}
+
+	doReq(logical.UpdateOperation, "keys/foo/config", map[string]interface{}{
+		"audit_read": true,
+	})
+	buf.Reset()
+	resp = doReq(logical.ReadOperation, "keys/foo", nil)
+	if resp.Data["audit_read"] != true {
+		t.Fatalf("bad: audit_read: %v", resp.Data["audit_read"])
+	}
+	out := buf.String()
+	for _, expected := range []string{"[INFO]", "key read", "key=foo", "request_id=request-id", "client_token_accessor=accessor", "entity_id=entity"} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected %q in log output: %s", expected, out)
+		}
+	}
+
+	// Other operations on the key are not logged
+	buf.Reset()
+	doReq(logical.UpdateOperation, "encrypt/foo", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	if strings.Contains(buf.String(), "key read") {
+		t.Fatalf("unexpected key read log: %s", buf.String())
+	}
+
+	doReq(logical.UpdateOperation, "keys/foo/config", map[string]interface{}{
+		"audit_read": false,
+	})
+	buf.Reset()
+	doReq(logical.ReadOperation, "keys/foo", nil)
+	if strings.Contains(buf.String(), "key read") {
+		t.Fatalf("unexpected key read log: %s", buf.String())
+	}
+}
@@ -0,0 +1,168 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathConfigVersion() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/config-version/" + `(?P<version>\d+)`,
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: "Version of the key to configure",
+			},
+
+			"use_after": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `RFC3339 timestamp before which the key
+version cannot be used. An empty value or "0"
+removes the restriction.`,
+			},
+
+			"use_before": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `RFC3339 timestamp from which the key
+version can no longer be used. An empty value or
+"0" removes the restriction.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathConfigVersionWrite,
+			logical.ReadOperation:   b.pathConfigVersionRead,
+		},
+
+		HelpSynopsis:    pathConfigVersionHelpSyn,
+		HelpDescription: pathConfigVersionHelpDesc,
+	}
+}
+
+func (b *backend) pathConfigVersionRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	ver := d.Get("version").(int)
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, nil
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"use_after":  formatActivationTime(entry.UseAfter),
+			"use_before": formatActivationTime(entry.UseBefore),
+		},
+	}, nil
+}
+
+func (b *backend) pathConfigVersionWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	ver := d.Get("version").(int)
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse(
+				fmt.Sprintf("no existing key named %s could be found", name)),
+			logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(true)
+	}
+	defer p.Unlock()
+
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return logical.ErrorResponse(fmt.Sprintf("version %d of key %s does not exist", ver, name)), logical.ErrInvalidRequest
+	}
+
+	useAfter, useBefore := entry.UseAfter, entry.UseBefore
+	for field, t := range map[string]*time.Time{
+		"use_after":  &useAfter,
+		"use_before": &useBefore,
+	} {
+		raw, ok := d.GetOk(field)
+		if !ok {
+			continue
+		}
+		*t, err = parseActivationTime(raw.(string))
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid %s: %s", field, err)), logical.ErrInvalidRequest
+		}
+	}
+
+	err = p.SetActivationWindow(ctx, req.Storage, ver, useAfter, useBefore)
+	switch err.(type) {
+	case nil:
+		return nil, nil
+	case errutil.UserError:
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	default:
+		return nil, err
+	}
+}
+
+// parseActivationTime parses an RFC3339 timestamp. An empty value or "0"
+// results in the zero time, which leaves that side of the window open.
+func parseActivationTime(raw string) (time.Time, error) {
+	if raw == "" || raw == "0" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
+
+func formatActivationTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+const pathConfigVersionHelpSyn = `Configure a version of a named key`
+
+const pathConfigVersionHelpDesc = `
+This path is used to configure a single version of the named key. The
+use_after and use_before timestamps limit the time window in which the
+version can be used to encrypt, decrypt, sign and verify.
+`
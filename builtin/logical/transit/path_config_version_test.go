@@ -0,0 +1,153 @@
+package transit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_ConfigVersionActivationWindow(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	setWindow := func(name string, ver, useAfter, useBefore string) {
+		mustSucceed(logical.UpdateOperation, "keys/"+name+"/config-version/"+ver, map[string]interface{}{
+			"use_after":  useAfter,
+			"use_before": useBefore,
+		})
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	future := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	input := plaintext
+
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustSucceed(logical.UpdateOperation, "keys/ed", map[string]interface{}{
+		"type": "ed25519",
+	})
+
+	resp := mustSucceed(logical.UpdateOperation, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	resp = mustSucceed(logical.UpdateOperation, "sign/ed", map[string]interface{}{
+		"input": input,
+	})
+	signature := resp.Data["signature"].(string)
+
+	checkOps := func(active bool) {
+		t.Helper()
+		ops := []struct {
+			path string
+			data map[string]interface{}
+		}{
+			{"encrypt/aes", map[string]interface{}{"plaintext": plaintext}},
+			{"decrypt/aes", map[string]interface{}{"ciphertext": ciphertext}},
+			{"sign/ed", map[string]interface{}{"input": input}},
+			{"verify/ed", map[string]interface{}{"input": input, "signature": signature}},
+		}
+		for _, op := range ops {
+			if active {
+				resp := mustSucceed(logical.UpdateOperation, op.path, op.data)
+				if valid, ok := resp.Data["valid"]; ok && valid != true {
+					t.Fatalf("%s: expected valid signature", op.path)
+				}
+			} else {
+				mustFail(logical.UpdateOperation, op.path, op.data)
+			}
+		}
+	}
+
+	// Expired
+	setWindow("aes", "1", "", past)
+	setWindow("ed", "1", "", past)
+	checkOps(false)
+
+	// Not yet active
+	setWindow("aes", "1", future, "0")
+	setWindow("ed", "1", future, "0")
+	checkOps(false)
+
+	// Inside the window
+	setWindow("aes", "1", past, future)
+	setWindow("ed", "1", past, future)
+	checkOps(true)
+
+	// A zero use_before means no expiry
+	setWindow("aes", "1", past, "0")
+	setWindow("ed", "1", past, "0")
+	checkOps(true)
+	resp = mustSucceed(logical.ReadOperation, "keys/aes/config-version/1", nil)
+	if resp.Data["use_after"] != past || resp.Data["use_before"] != "" {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Fields that are not given are left unchanged
+	mustSucceed(logical.UpdateOperation, "keys/aes/config-version/1", map[string]interface{}{
+		"use_before": future,
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/aes/config-version/1", nil)
+	if resp.Data["use_after"] != past || resp.Data["use_before"] != future {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// The window applies to a single version
+	setWindow("aes", "1", "", past)
+	mustSucceed(logical.UpdateOperation, "keys/aes/rotate", nil)
+	mustSucceed(logical.UpdateOperation, "encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustFail(logical.UpdateOperation, "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+
+	// The window is kept when the version is archived and restored
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"min_decryption_version": 2,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"min_decryption_version": 1,
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/aes/config-version/1", nil)
+	if resp.Data["use_before"] != past {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Invalid settings
+	mustFail(logical.UpdateOperation, "keys/aes/config-version/1", map[string]interface{}{
+		"use_after":  future,
+		"use_before": past,
+	})
+	mustFail(logical.UpdateOperation, "keys/aes/config-version/1", map[string]interface{}{
+		"use_after": "next tuesday",
+	})
+	mustFail(logical.UpdateOperation, "keys/aes/config-version/3", map[string]interface{}{
+		"use_after": past,
+	})
+	mustFail(logical.UpdateOperation, "keys/missing/config-version/1", map[string]interface{}{
+		"use_after": past,
+	})
+}
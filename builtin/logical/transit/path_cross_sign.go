@@ -0,0 +1,121 @@
+package transit
+
+import (
+	"context"
+	"encoding/pem"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathCrossSignCert() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/cross-sign-cert",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"from_version": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The version of the key whose private key signs
+the certificate. Must be greater than or equal to
+the min_decryption_version configured on the key.`,
+			},
+
+			"to_version": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The version of the key whose public key is
+certified. Must be greater than from_version.`,
+			},
+
+			"ttl": &framework.FieldSchema{
+				Type:    framework.TypeDurationSecond,
+				Default: "720h",
+				Description: `The validity period of the certificate.
+Defaults to 720h.`,
+			},
+
+			"subject": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The common name used as both the subject and
+the issuer of the certificate. Defaults to the
+name of the key.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathCrossSignCertWrite,
+		},
+
+		HelpSynopsis:    pathCrossSignCertHelpSyn,
+		HelpDescription: pathCrossSignCertHelpDesc,
+	}
+}
+
+func (b *backend) pathCrossSignCertWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	subject := d.Get("subject").(string)
+	if subject == "" {
+		subject = name
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	fromVersion := d.Get("from_version").(int)
+	toVersion := d.Get("to_version").(int)
+	ttl := time.Duration(d.Get("ttl").(int)) * time.Second
+
+	der, err := p.CrossSignCertificate(fromVersion, toVersion, subject, ttl)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"certificate": strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: der,
+			}))),
+			"from_version": fromVersion,
+			"to_version":   toVersion,
+		},
+	}, nil
+}
+
+const pathCrossSignCertHelpSyn = `Certify a newer version of a key with an older one`
+
+const pathCrossSignCertHelpDesc = `
+This path returns a PEM encoded X.509 certificate for the public key of
+to_version, signed by the private key of from_version. Relying parties that
+trust the older version can use it to move to the newer one after a rotation.
+Only ECDSA and RSA keys are supported.
+`
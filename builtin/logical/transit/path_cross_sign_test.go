@@ -0,0 +1,154 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_CrossSignCert(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	publicKey := func(name, ver string) []byte {
+		t.Helper()
+		resp := mustSucceed(logical.ReadOperation, "keys/"+name, nil)
+		block, _ := pem.Decode([]byte(resp.Data["keys"].(map[string]map[string]interface{})[ver]["public_key"].(string)))
+		if block == nil {
+			t.Fatalf("no public key for version %s", ver)
+		}
+		return block.Bytes
+	}
+
+	for _, keyType := range []string{"ecdsa-p256", "rsa-2048"} {
+		name := "key-" + keyType
+		mustSucceed(logical.UpdateOperation, "keys/"+name, map[string]interface{}{
+			"type": keyType,
+		})
+		mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+		mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+
+		resp := mustSucceed(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 1,
+			"to_version":   3,
+			"ttl":          "1h",
+			"subject":      "example.com",
+		})
+		block, _ := pem.Decode([]byte(resp.Data["certificate"].(string)))
+		if block == nil || block.Type != "CERTIFICATE" {
+			t.Fatalf("bad certificate: %#v", resp.Data)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The certificate holds the new version's public key and is signed
+		// by the old version's
+		certPub, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(certPub, publicKey(name, "3")) {
+			t.Fatalf("%s: certificate is not for version 3", keyType)
+		}
+		fromPub, err := x509.ParsePKIXPublicKey(publicKey(name, "1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		issuer := &x509.Certificate{
+			PublicKey:             fromPub,
+			PublicKeyAlgorithm:    cert.PublicKeyAlgorithm,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}
+		if err := cert.CheckSignatureFrom(issuer); err != nil {
+			t.Fatalf("%s: signature does not validate with version 1: %v", keyType, err)
+		}
+		if cert.Subject.CommonName != "example.com" || cert.Issuer.CommonName != "example.com" {
+			t.Fatalf("bad names: %v %v", cert.Subject, cert.Issuer)
+		}
+		if ttl := cert.NotAfter.Sub(time.Now()); ttl <= 59*time.Minute || ttl > time.Hour {
+			t.Fatalf("bad validity period: %v", ttl)
+		}
+
+		// The signature must not validate with the certified key itself
+		wrongIssuer := &x509.Certificate{PublicKey: cert.PublicKey, PublicKeyAlgorithm: cert.PublicKeyAlgorithm}
+		if err := wrongIssuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err == nil {
+			t.Fatalf("%s: signature validated with version 3", keyType)
+		}
+
+		// The subject defaults to the key name
+		resp = mustSucceed(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 2,
+			"to_version":   3,
+		})
+		block, _ = pem.Decode([]byte(resp.Data["certificate"].(string)))
+		if cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+			t.Fatal(err)
+		}
+		if cert.Subject.CommonName != name {
+			t.Fatalf("bad subject: %v", cert.Subject)
+		}
+
+		mustFail(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 3,
+			"to_version":   2,
+		})
+		mustFail(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 1,
+			"to_version":   4,
+		})
+
+		// Versions which can no longer be decrypted cannot vouch for newer ones
+		mustSucceed(logical.UpdateOperation, "keys/"+name+"/config", map[string]interface{}{
+			"min_decryption_version": 2,
+		})
+		mustFail(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 1,
+			"to_version":   3,
+		})
+		mustSucceed(logical.UpdateOperation, "keys/"+name+"/cross-sign-cert", map[string]interface{}{
+			"from_version": 2,
+			"to_version":   3,
+		})
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustSucceed(logical.UpdateOperation, "keys/aes/rotate", nil)
+	mustFail(logical.UpdateOperation, "keys/aes/cross-sign-cert", map[string]interface{}{
+		"from_version": 1,
+		"to_version":   2,
+	})
+	mustFail(logical.UpdateOperation, "keys/missing/cross-sign-cert", map[string]interface{}{
+		"from_version": 1,
+		"to_version":   2,
+	})
+}
@@ -21,6 +21,8 @@ func (b *backend) pathDatakey() *framework.Path {
 				Description: "The backend key used for encrypting the data key",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"plaintext": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `"plaintext" will return the key in both plaintext and
@@ -32,6 +34,14 @@ ciphertext; "wrapped" will return the ciphertext only.`,
 				Description: "Context for key derivation. Required for derived keys.",
 			},
 
+			"context_json": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+JSON object used as the context for key derivation instead of "context". It is
+canonicalized and hashed with SHA-256, so key ordering does not matter. Only
+one of "context" and "context_json" may be set.`,
+			},
+
 			"nonce": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Nonce for when convergent encryption v1 is used (only in Vault 0.6.1)",
@@ -44,6 +54,22 @@ and 512 bits are supported. Defaults to 256.`,
 				Default: 256,
 			},
 
+			"key_length_bits": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Number of bits for the key. Any multiple of 8
+up to 1024 is supported, such as 192 for AES-192.
+If set, takes precedence over "bits".`,
+			},
+
+			"derivation_algorithm": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: keysutil.DerivationAlgorithmHKDFSHA256,
+				Description: `Hash used by HKDF to derive the key that
+encrypts the data key, for derived keys. Can be
+"hkdf-sha256" or "hkdf-sha512". Defaults to
+"hkdf-sha256".`,
+			},
+
 			"key_version": &framework.FieldSchema{
 				Type: framework.TypeInt,
 				Description: `The version of the Vault key to use for
@@ -51,6 +77,17 @@ encryption of the data key. Must be 0 (for latest)
 or a value greater than or equal to the
 min_encryption_version configured on the key.`,
 			},
+
+			"wrapping_algorithm": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: datakeyWrappingNative,
+				Description: `Algorithm used to wrap the data key. "native"
+encrypts it like any other plaintext, "rsa-oaep"
+does the same but requires an RSA key, and
+"aes-kw" and "aes-kwp" wrap it with the AES key
+wrap of RFC 3394 and RFC 5649 respectively, which
+requires an AES key. Defaults to "native".`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -63,7 +100,10 @@ min_encryption_version configured on the key.`,
 }
 
 func (b *backend) pathDatakeyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	ver := d.Get("key_version").(int)
 
 	plaintext := d.Get("plaintext").(string)
@@ -76,18 +116,39 @@ func (b *backend) pathDatakeyWrite(ctx context.Context, req *logical.Request, d
 		return logical.ErrorResponse("Invalid path, must be 'plaintext' or 'wrapped'"), logical.ErrInvalidRequest
 	}
 
-	var err error
-
 	// Decode the context if any
 	contextRaw := d.Get("context").(string)
+	contextJSON := d.Get("context_json").(map[string]interface{})
 	var context []byte
-	if len(contextRaw) != 0 {
+	switch {
+	case len(contextRaw) != 0 && len(contextJSON) != 0:
+		return logical.ErrorResponse("only one of context and context_json may be set"), logical.ErrInvalidRequest
+	case len(contextJSON) != 0:
+		context, err = canonicalContext(contextJSON)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	case len(contextRaw) != 0:
 		context, err = base64.StdEncoding.DecodeString(contextRaw)
 		if err != nil {
 			return logical.ErrorResponse("failed to base64-decode context"), logical.ErrInvalidRequest
 		}
 	}
 
+	derivationAlgorithm := d.Get("derivation_algorithm").(string)
+	switch derivationAlgorithm {
+	case keysutil.DerivationAlgorithmHKDFSHA256, keysutil.DerivationAlgorithmHKDFSHA512:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid derivation algorithm %q", derivationAlgorithm)), logical.ErrInvalidRequest
+	}
+
+	wrappingAlgorithm := d.Get("wrapping_algorithm").(string)
+	switch wrappingAlgorithm {
+	case datakeyWrappingNative, datakeyWrappingRSAOAEP, keysutil.KeyWrapAlgorithmAESKW, keysutil.KeyWrapAlgorithmAESKWP:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid wrapping algorithm %q", wrappingAlgorithm)), logical.ErrInvalidRequest
+	}
+
 	// Decode the nonce if any
 	nonceRaw := d.Get("nonce").(string)
 	var nonce []byte
@@ -114,23 +175,71 @@ func (b *backend) pathDatakeyWrite(ctx context.Context, req *logical.Request, d
 	}
 	defer p.Unlock()
 
-	newKey := make([]byte, 32)
-	bits := d.Get("bits").(int)
-	switch bits {
-	case 512:
-		newKey = make([]byte, 64)
-	case 256:
-	case 128:
-		newKey = make([]byte, 16)
-	default:
-		return logical.ErrorResponse("invalid bit length"), logical.ErrInvalidRequest
+	var newKey []byte
+	if keyLengthBitsRaw, ok := d.GetOk("key_length_bits"); ok {
+		keyLengthBits := keyLengthBitsRaw.(int)
+		if keyLengthBits <= 0 || keyLengthBits > maxDatakeyBits || keyLengthBits%8 != 0 {
+			return logical.ErrorResponse(fmt.Sprintf("key length must be a multiple of 8 bits no greater than %d", maxDatakeyBits)), logical.ErrInvalidRequest
+		}
+		newKey = make([]byte, keyLengthBits/8)
+	} else {
+		newKey = make([]byte, 32)
+		bits := d.Get("bits").(int)
+		switch bits {
+		case 512:
+			newKey = make([]byte, 64)
+		case 256:
+		case 128:
+			newKey = make([]byte, 16)
+		default:
+			return logical.ErrorResponse("invalid bit length"), logical.ErrInvalidRequest
+		}
 	}
 	_, err = rand.Read(newKey)
 	if err != nil {
 		return nil, err
 	}
 
-	ciphertext, err := p.Encrypt(ver, context, nonce, base64.StdEncoding.EncodeToString(newKey))
+	opts := &keysutil.CipherOptions{
+		DerivationAlgorithm: derivationAlgorithm,
+	}
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if resp, err := b.authorizeEncryptNamespace(ctx, p); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if resp, err := b.bindRequestClaims(p, req, opts); resp != nil || err != nil {
+		return resp, err
+	}
+
+	switch wrappingAlgorithm {
+	case datakeyWrappingRSAOAEP:
+		if p.Type != keysutil.KeyType_RSA2048 && p.Type != keysutil.KeyType_RSA4096 {
+			return logical.ErrorResponse(fmt.Sprintf("wrapping algorithm %q requires an RSA key", wrappingAlgorithm)), logical.ErrInvalidRequest
+		}
+		opts.PaddingMode = keysutil.PaddingModeOAEPSHA256
+
+	case keysutil.KeyWrapAlgorithmAESKW, keysutil.KeyWrapAlgorithmAESKWP:
+		return wrapDatakey(p, ver, context, newKey, wrappingAlgorithm, plaintextAllowed, opts)
+	}
+
+	plaintextKey := base64.StdEncoding.EncodeToString(newKey)
+	if p.HMACBeforeEncrypt != "" {
+		plaintextKey, err = b.framePolicyPlaintext(ctx, req, p, plaintextKey)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	ciphertext, err := p.EncryptWithOptions(ver, context, nonce, plaintextKey, opts)
 	if err != nil {
 		switch err.(type) {
 		case errutil.UserError:
@@ -146,6 +255,19 @@ func (b *backend) pathDatakeyWrite(ctx context.Context, req *logical.Request, d
 		return nil, fmt.Errorf("empty ciphertext returned")
 	}
 
+	if p.BoundHMACKey != "" {
+		ver, key, err := b.linkedHMACKey(ctx, req, p, p.BoundHMACKey, 0)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+		ciphertext = appendBoundHMAC(ciphertext, ver, key)
+	}
+
 	// Generate the response
 	resp := &logical.Response{
 		Data: map[string]interface{}{
@@ -160,6 +282,57 @@ func (b *backend) pathDatakeyWrite(ctx context.Context, req *logical.Request, d
 	return resp, nil
 }
 
+// wrapDatakey wraps a data key with AES key wrap rather than the key's native
+// encryption. The wrapped key carries no version prefix, so the version is
+// returned alongside it.
+func wrapDatakey(p *keysutil.Policy, ver int, context, newKey []byte, algorithm string, plaintextAllowed bool, opts *keysutil.CipherOptions) (*logical.Response, error) {
+	// Key wrap output is fixed by the RFCs, so there is no room for the
+	// plaintext HMAC or for associated data
+	if p.HMACBeforeEncrypt != "" {
+		return logical.ErrorResponse(fmt.Sprintf("wrapping algorithm %q cannot be used with hmac_before_encrypt", algorithm)), logical.ErrInvalidRequest
+	}
+	if len(opts.AssociatedData) != 0 {
+		return logical.ErrorResponse(fmt.Sprintf("wrapping algorithm %q cannot be used with bound claims", algorithm)), logical.ErrInvalidRequest
+	}
+
+	ver, wrapped, err := p.WrapKey(ver, context, newKey, algorithm, opts.DerivationAlgorithm)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"ciphertext":         base64.StdEncoding.EncodeToString(wrapped),
+			"key_version":        ver,
+			"wrapping_algorithm": algorithm,
+		},
+	}
+
+	if plaintextAllowed {
+		resp.Data["plaintext"] = base64.StdEncoding.EncodeToString(newKey)
+	}
+
+	return resp, nil
+}
+
+const (
+	// datakeyWrappingNative wraps data keys with the key's own encryption
+	datakeyWrappingNative = "native"
+
+	// datakeyWrappingRSAOAEP is the native encryption of RSA keys, named
+	// explicitly so that requests fail on keys of other types
+	datakeyWrappingRSAOAEP = "rsa-oaep"
+)
+
+// maxDatakeyBits is the largest data key that can be requested through
+// key_length_bits
+const maxDatakeyBits = 1024
+
 const pathDatakeyHelpSyn = `Generate a data key`
 
 const pathDatakeyHelpDesc = `
@@ -167,7 +340,8 @@ This path can be used to generate a data key: a random
 key of a certain length that can be used for encryption
 and decryption, protected by the named backend key. 128, 256,
 or 512 bits can be specified; if not specified, the default
-is 256 bits. Call with the the "wrapped" path to prevent the
+is 256 bits. Other lengths that are a multiple of 8 bits, up
+to 1024 bits, can be requested with key_length_bits. Call with the the "wrapped" path to prevent the
 (base64-encoded) plaintext key from being returned along with
 the encrypted key, the "plaintext" path returns both.
 `
@@ -3,6 +3,10 @@ package transit
 import (
 	"context"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"unicode/utf8"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/helper/errutil"
@@ -21,12 +25,21 @@ func (b *backend) pathDecrypt() *framework.Path {
 				Description: "Name of the policy",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"ciphertext": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
 The ciphertext to decrypt, provided as returned by encrypt.`,
 			},
 
+			"ciphertext_chunks": &framework.FieldSchema{
+				Type: framework.TypeStringSlice,
+				Description: `
+The ciphertext to decrypt as the chunks returned by encrypt with a chunk_size,
+in order. Cannot be combined with ciphertext.`,
+			},
+
 			"context": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
@@ -34,6 +47,68 @@ Base64 encoded context for key derivation. Required if key derivation is
 enabled.`,
 			},
 
+			"context_json": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+JSON object used as the context for key derivation instead of "context". It is
+canonicalized and hashed with SHA-256, so key ordering does not matter. Only
+one of "context" and "context_json" may be set.`,
+			},
+
+			"associated_data": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+Base64 encoded associated data provided during encryption. Its SHA-256 digest
+is returned as "aad_hash".`,
+			},
+
+			"padding_mode": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+The padding used during encryption with RSA keys: "oaep-sha256", "oaep-sha1" or
+"pkcs1v15". Defaults to "oaep-sha256".`,
+			},
+
+			"bind_to_entity": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+Must be set if bind_to_entity was set during encryption. Decryption only
+succeeds if the request is made by the same entity.`,
+			},
+
+			"include_key_commitment": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+Must be set if include_key_commitment was set during encryption. Decryption
+only succeeds under the key that encrypted the ciphertext.`,
+			},
+
+			"return_encoding": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "base64",
+				Description: `
+Encoding of the returned plaintext: "base64", "hex" or "utf8". With "utf8" the
+plaintext is returned as a string, and decryption fails if it is not valid
+UTF-8. Defaults to "base64".`,
+			},
+
+			"external_hmac": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+HMAC of the plaintext, in the format returned by the hmac endpoint, that must
+be verified before the plaintext is returned. It is verified with the HMAC key
+of the key's external_hmac_key, which must be configured. Not supported with
+batch_input.`,
+			},
+
+			"external_hmac_algorithm": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "sha2-256",
+				Description: `
+Hash algorithm of external_hmac: "sha2-224", "sha2-256", "sha2-384" or
+"sha2-512". Defaults to "sha2-256".`,
+			},
+
 			"nonce": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
@@ -52,10 +127,38 @@ Vault 0.6.1. Not required for keys created in 0.6.2+.`,
 	}
 }
 
+// encodePlaintext re-encodes a base64 encoded plaintext in the given return
+// encoding
+func encodePlaintext(plaintext, encoding string) (string, error) {
+	if encoding == "base64" {
+		return plaintext, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return "", err
+	}
+	switch encoding {
+	case "hex":
+		return hex.EncodeToString(decoded), nil
+	case "utf8":
+		if !utf8.Valid(decoded) {
+			return "", errors.New("plaintext is not valid UTF-8; use a return_encoding of base64 or hex")
+		}
+		return string(decoded), nil
+	}
+
+	return "", fmt.Errorf("invalid return encoding %q", encoding)
+}
+
 func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
 	batchInputRaw := d.Raw["batch_input"]
 	var batchInputItems []BatchRequestItem
-	var err error
 	if batchInputRaw != nil {
 		err = mapstructure.Decode(batchInputRaw, &batchInputItems)
 		if err != nil {
@@ -66,39 +169,51 @@ func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d
 			return logical.ErrorResponse("missing batch input to process"), logical.ErrInvalidRequest
 		}
 	} else {
-		ciphertext := d.Get("ciphertext").(string)
+		ciphertext, err := joinCiphertext(d.Get("ciphertext").(string), d.Get("ciphertext_chunks").([]string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
 		if len(ciphertext) == 0 {
 			return logical.ErrorResponse("missing ciphertext to decrypt"), logical.ErrInvalidRequest
 		}
 
 		batchInputItems = make([]BatchRequestItem, 1)
 		batchInputItems[0] = BatchRequestItem{
-			Ciphertext: ciphertext,
-			Context:    d.Get("context").(string),
-			Nonce:      d.Get("nonce").(string),
+			Ciphertext:     ciphertext,
+			Context:        d.Get("context").(string),
+			ContextJSON:    d.Get("context_json").(map[string]interface{}),
+			Nonce:          d.Get("nonce").(string),
+			AssociatedData: d.Get("associated_data").(string),
+			PaddingMode:    d.Get("padding_mode").(string),
 		}
 	}
 
 	batchResponseItems := make([]BatchResponseItem, len(batchInputItems))
-	contextSet := len(batchInputItems[0].Context) != 0
+	cipherOpts := make([]*keysutil.CipherOptions, len(batchInputItems))
+	contextSet := batchInputItems[0].hasContext()
+	bindEntity := d.Get("bind_to_entity").(bool)
+	keyCommitment := d.Get("include_key_commitment").(bool)
 
 	for i, item := range batchInputItems {
-		if (len(item.Context) == 0 && contextSet) || (len(item.Context) != 0 && !contextSet) {
+		if item.hasContext() != contextSet {
 			return logical.ErrorResponse("context should be set either in all the request blocks or in none"), logical.ErrInvalidRequest
 		}
 
-		if item.Ciphertext == "" {
+		batchInputItems[i].Ciphertext, err = joinCiphertext(item.Ciphertext, item.CiphertextChunks)
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
+		if batchInputItems[i].Ciphertext == "" {
 			batchResponseItems[i].Error = "missing ciphertext to decrypt"
 			continue
 		}
 
 		// Decode the context
-		if len(item.Context) != 0 {
-			batchInputItems[i].DecodedContext, err = base64.StdEncoding.DecodeString(item.Context)
-			if err != nil {
-				batchResponseItems[i].Error = err.Error()
-				continue
-			}
+		batchInputItems[i].DecodedContext, err = item.decodeContext()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
 		}
 
 		// Decode the nonce
@@ -109,12 +224,48 @@ func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d
 				continue
 			}
 		}
+
+		// Decode the associated data and padding mode
+		cipherOpts[i], err = batchInputItems[i].cipherOptions()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
+
+		if bindEntity {
+			if err := bindToEntity(cipherOpts[i], req.EntityID); err != nil {
+				batchResponseItems[i].Error = err.Error()
+				continue
+			}
+		}
+
+		if keyCommitment {
+			commitToKeyName(cipherOpts[i], name)
+		}
+	}
+
+	returnEncoding := d.Get("return_encoding").(string)
+	switch returnEncoding {
+	case "base64", "hex", "utf8":
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid return encoding %q", returnEncoding)), logical.ErrInvalidRequest
+	}
+
+	externalHMAC := d.Get("external_hmac").(string)
+	externalHMACAlgorithm := d.Get("external_hmac_algorithm").(string)
+	if externalHMAC != "" {
+		if batchInputRaw != nil {
+			return logical.ErrorResponse("external_hmac is not supported with batch_input"), logical.ErrInvalidRequest
+		}
+		if _, err := newHMAC(externalHMACAlgorithm, nil); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
 	}
 
 	// Get the policy
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
 		Storage: req.Storage,
-		Name:    d.Get("name").(string),
+		Name:    name,
 	})
 	if err != nil {
 		return nil, err
@@ -126,15 +277,60 @@ func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d
 		p.Lock(false)
 	}
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.authorizeDecryptNamespace(ctx, p); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.checkRateLimit(p, req, keysutil.RateLimitCipher); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.bindRequestClaims(p, req, cipherOpts...); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if externalHMAC != "" && p.ExternalHMACKey == "" {
+		p.Unlock()
+		return logical.ErrorResponse("external_hmac requires an external_hmac_key to be configured on the key"), logical.ErrInvalidRequest
+	}
+
 	for i, item := range batchInputItems {
 		if batchResponseItems[i].Error != "" {
 			continue
 		}
 
-		plaintext, err := p.Decrypt(item.DecodedContext, item.DecodedNonce, item.Ciphertext)
+		ciphertext := item.Ciphertext
+		if p.BoundHMACKey != "" {
+			// Verify and strip the bound HMAC before anything is decrypted
+			ciphertext, err = b.verifyBoundHMAC(ctx, req, p, ciphertext)
+			if err != nil {
+				switch err.(type) {
+				case errutil.UserError:
+					batchResponseItems[i].Error = err.Error()
+					continue
+				default:
+					p.Unlock()
+					return nil, err
+				}
+			}
+		}
+
+		ciphertext = decodeHexCiphertext(stripCiphertextPrefix(p, ciphertext))
+		plaintext, err := p.DecryptWithOptions(item.DecodedContext, item.DecodedNonce, ciphertext, cipherOpts[i])
 		if err != nil {
 			switch err.(type) {
 			case errutil.UserError:
+				if p.QuarantineOnAuthFailure && err.Error() == keysutil.ErrAuthenticationFailed {
+					b.quarantineCiphertext(ctx, req.Storage, name, item.Ciphertext)
+				}
 				batchResponseItems[i].Error = err.Error()
 				continue
 			default:
@@ -142,7 +338,43 @@ func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d
 				return nil, err
 			}
 		}
+		if p.HMACBeforeEncrypt != "" {
+			plaintext, err = b.unframePlaintext(ctx, req, p, plaintext)
+			if err != nil {
+				switch err.(type) {
+				case errutil.UserError:
+					batchResponseItems[i].Error = err.Error()
+					continue
+				default:
+					p.Unlock()
+					return nil, err
+				}
+			}
+		}
+		if externalHMAC != "" {
+			raw, err := base64.StdEncoding.DecodeString(plaintext)
+			if err != nil {
+				p.Unlock()
+				return nil, err
+			}
+			if err := b.verifyExternalHMAC(ctx, req, p, externalHMACAlgorithm, externalHMAC, raw); err != nil {
+				switch err.(type) {
+				case errutil.UserError:
+					batchResponseItems[i].Error = err.Error()
+					continue
+				default:
+					p.Unlock()
+					return nil, err
+				}
+			}
+		}
+		plaintext, err = encodePlaintext(plaintext, returnEncoding)
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
 		batchResponseItems[i].Plaintext = plaintext
+		batchResponseItems[i].AADHash = aadHash(item.DecodedAssociatedData)
 	}
 
 	resp := &logical.Response{}
@@ -158,6 +390,9 @@ func (b *backend) pathDecryptWrite(ctx context.Context, req *logical.Request, d
 		resp.Data = map[string]interface{}{
 			"plaintext": batchResponseItems[0].Plaintext,
 		}
+		if batchResponseItems[0].AADHash != "" {
+			resp.Data["aad_hash"] = batchResponseItems[0].AADHash
+		}
 	}
 
 	p.Unlock()
@@ -168,5 +403,6 @@ const pathDecryptHelpSyn = `Decrypt a ciphertext value using a named key`
 
 const pathDecryptHelpDesc = `
 This path uses the named key from the request path to decrypt a user
-provided ciphertext. The plaintext is returned base64 encoded.
+provided ciphertext. The plaintext is returned base64 encoded, unless another
+return_encoding is requested.
 `
@@ -2,6 +2,8 @@ package transit
 
 import (
 	"context"
+	"encoding/base64"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/vault/logical"
@@ -135,3 +137,217 @@ func TestTransit_BatchDecryption_DerivedKey(t *testing.T) {
 		}
 	}
 }
+
+func TestTransit_DecryptReturnEncoding(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	encrypt := func(plaintext []byte) string {
+		resp := mustSucceed("encrypt/key", map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		})
+		return resp.Data["ciphertext"].(string)
+	}
+
+	mustSucceed("keys/key", nil)
+	text := encrypt([]byte("h\u00e9llo, w\u00f6rld \u2603"))
+	binary := encrypt([]byte{0xde, 0xad, 0xbe, 0xef, 0xff})
+
+	for _, tc := range []struct {
+		ciphertext string
+		encoding   string
+		expected   string
+	}{
+		{text, "", "aMOpbGxvLCB3w7ZybGQg4piD"},
+		{text, "base64", "aMOpbGxvLCB3w7ZybGQg4piD"},
+		{text, "hex", "68c3a96c6c6f2c2077c3b6726c6420e29883"},
+		{text, "utf8", "h\u00e9llo, w\u00f6rld \u2603"},
+		{binary, "hex", "deadbeefff"},
+	} {
+		data := map[string]interface{}{
+			"ciphertext": tc.ciphertext,
+		}
+		if tc.encoding != "" {
+			data["return_encoding"] = tc.encoding
+		}
+		resp := mustSucceed("decrypt/key", data)
+		if resp.Data["plaintext"] != tc.expected {
+			t.Fatalf("%s: bad plaintext %q, expected %q", tc.encoding, resp.Data["plaintext"], tc.expected)
+		}
+	}
+
+	// Invalid UTF-8 is rejected rather than returned with replacement
+	// characters
+	resp, err := doReq("decrypt/key", map[string]interface{}{
+		"ciphertext":      binary,
+		"return_encoding": "utf8",
+	})
+	if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), "not valid UTF-8") {
+		t.Fatalf("expected UTF-8 error, got err:%v resp:%#v", err, resp)
+	}
+
+	// In batches, only the invalid item fails
+	resp = mustSucceed("decrypt/key", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": text},
+			map[string]interface{}{"ciphertext": binary},
+		},
+		"return_encoding": "utf8",
+	})
+	batchResults := resp.Data["batch_results"].([]BatchResponseItem)
+	if batchResults[0].Plaintext != "h\u00e9llo, w\u00f6rld \u2603" || batchResults[0].Error != "" {
+		t.Fatalf("bad first result: %#v", batchResults[0])
+	}
+	if batchResults[1].Plaintext != "" || !strings.Contains(batchResults[1].Error, "not valid UTF-8") {
+		t.Fatalf("bad second result: %#v", batchResults[1])
+	}
+
+	resp, err = doReq("decrypt/key", map[string]interface{}{
+		"ciphertext":      text,
+		"return_encoding": "base32",
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error for unknown return encoding, got %#v", resp)
+	}
+}
+
+func TestTransit_DecryptExternalHMAC(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}, expected string) {
+		resp, err := doReq(path, data)
+		if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), expected) {
+			t.Fatalf("expected error containing %q, got err:%v resp:%#v", expected, err, resp)
+		}
+		if _, ok := resp.Data["plaintext"]; ok {
+			t.Fatal("plaintext returned with failed HMAC verification")
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("keys/enc", nil)
+	mustSucceed("keys/gateway", nil)
+	resp := mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	resp = mustSucceed("hmac/gateway", map[string]interface{}{
+		"input": plaintext,
+	})
+	gatewayHMAC := resp.Data["hmac"].(string)
+	resp = mustSucceed("hmac/gateway/sha2-512", map[string]interface{}{
+		"input": plaintext,
+	})
+	gatewayHMAC512 := resp.Data["hmac"].(string)
+	resp = mustSucceed("hmac/gateway", map[string]interface{}{
+		"input": base64.StdEncoding.EncodeToString([]byte("tampered")),
+	})
+	tamperedHMAC := resp.Data["hmac"].(string)
+
+	resp = mustSucceed("hmac/enc", map[string]interface{}{
+		"input": plaintext,
+	})
+	encHMAC := resp.Data["hmac"].(string)
+
+	// The HMAC key must be configured on the key, not named by the request
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": gatewayHMAC,
+	}, "requires an external_hmac_key")
+	resp, err := doReq("keys/enc/config", map[string]interface{}{
+		"external_hmac_key": "missing",
+	})
+	if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), "not found") {
+		t.Fatalf("expected missing key error, got err:%v resp:%#v", err, resp)
+	}
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"external_hmac_key": "gateway",
+	})
+
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": gatewayHMAC,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %#v", resp.Data["plaintext"])
+	}
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext":              ciphertext,
+		"external_hmac":           gatewayHMAC512,
+		"external_hmac_algorithm": "sha2-512",
+		"return_encoding":         "utf8",
+	})
+	if resp.Data["plaintext"] != "the quick brown fox" {
+		t.Fatalf("bad plaintext: %#v", resp.Data["plaintext"])
+	}
+
+	// Mismatches are rejected without returning the plaintext
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": tamperedHMAC,
+	}, "external HMAC verification failed")
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": encHMAC,
+	}, "external HMAC verification failed")
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":              ciphertext,
+		"external_hmac":           gatewayHMAC,
+		"external_hmac_algorithm": "sha2-512",
+	}, "external HMAC verification failed")
+
+	// Malformed requests
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":              ciphertext,
+		"external_hmac":           gatewayHMAC,
+		"external_hmac_algorithm": "md5",
+	}, "unsupported algorithm")
+	mustFail("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": "not-an-hmac",
+	}, "invalid external HMAC")
+	mustFail("decrypt/enc", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": ciphertext},
+		},
+		"external_hmac": gatewayHMAC,
+	}, "not supported with batch_input")
+
+	// The key's own HMAC key can be configured
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"external_hmac_key": "enc",
+	})
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext":    ciphertext,
+		"external_hmac": encHMAC,
+	})
+}
@@ -0,0 +1,146 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// keyNameRegex matches the names accepted by framework.GenericNameRegex
+var keyNameRegex = regexp.MustCompile(`^\w(([\w-.]+)?\w)?$`)
+
+func (b *backend) pathDeriveChild() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/derive-child",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the parent key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"path": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `BIP32 derivation path of the child key, such as
+"m/44'/60'/0'/0/0". Hardened indexes are marked with
+a trailing ', h or H.`,
+			},
+
+			"child_name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the child key to create",
+			},
+
+			"key_version": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The version of the parent key whose material is
+used as the BIP32 seed. Defaults to the latest
+version.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathDeriveChildWrite,
+		},
+
+		HelpSynopsis:    pathDeriveChildHelpSyn,
+		HelpDescription: pathDeriveChildHelpDesc,
+	}
+}
+
+func (b *backend) pathDeriveChildWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	hdPath := d.Get("path").(string)
+	ver := d.Get("key_version").(int)
+
+	childName := d.Get("child_name").(string)
+	switch {
+	case childName == "":
+		return logical.ErrorResponse("missing child_name"), logical.ErrInvalidRequest
+	case !keyNameRegex.MatchString(childName):
+		return logical.ErrorResponse(fmt.Sprintf("invalid child name %q", childName)), logical.ErrInvalidRequest
+	}
+	// The child is created in the namespace of its parent
+	if namespace := d.Get("key_namespace").(string); namespace != "" {
+		childName += ":" + namespace
+	}
+	if childName == name {
+		return logical.ErrorResponse("child_name must differ from the parent key name"), logical.ErrInvalidRequest
+	}
+	if _, err := keysutil.ParseHDPath(hdPath); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	// Get the policy
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+
+	switch p.Type {
+	case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305:
+	default:
+		p.Unlock()
+		return logical.ErrorResponse(fmt.Sprintf("child keys cannot be derived from keys of type %v", p.Type)), logical.ErrInvalidRequest
+	}
+
+	if ver == 0 {
+		ver = p.LatestVersion
+	}
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		p.Unlock()
+		return logical.ErrorResponse(fmt.Sprintf("version %d of the key is not available", ver)), logical.ErrInvalidRequest
+	}
+	keyType, exportable := p.Type, p.Exportable
+	hdKey, err := keysutil.DeriveHDKey(entry.Key, hdPath)
+
+	// The parent must be unlocked before the child is created, as their
+	// locks may be shared when caching is disabled
+	p.Unlock()
+	if err == nil {
+		err = b.createKey(ctx, req.Storage, childName, func() error {
+			return b.lm.CreateHDChildPolicy(ctx, req.Storage, childName, keyType, hdKey.Key, exportable, name, hdPath)
+		})
+	}
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+const pathDeriveChildHelpSyn = `Derive a child key from a key using BIP32`
+
+const pathDeriveChildHelpDesc = `
+This path creates a new key whose material is derived from the named key
+along a BIP32 derivation path. The parent key material is used as the BIP32
+seed and the derived private key becomes the child key, which has the same
+type as the parent, is exportable if the parent is, and records the parent
+and path it came from. Only aes256-gcm96 and chacha20-poly1305 keys can be
+parents.
+`
@@ -0,0 +1,144 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_DeriveChild(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	exportKey := func(name string) []byte {
+		resp := mustSucceed(logical.ReadOperation, "export/encryption-key/"+name+"/1", nil)
+		key, err := base64.StdEncoding.DecodeString(resp.Data["keys"].(map[string]string)["1"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/parent", map[string]interface{}{
+		"exportable": true,
+	})
+	parentKey := exportKey("parent")
+
+	hdPath := "m/44'/60'/0'/0/0"
+	mustSucceed(logical.UpdateOperation, "keys/parent/derive-child", map[string]interface{}{
+		"path":       hdPath,
+		"child_name": "child",
+	})
+
+	// The child holds the BIP32 key derived from the parent material
+	expected, err := keysutil.DeriveHDKey(parentKey, hdPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	childKey := exportKey("child")
+	if !bytes.Equal(childKey, expected.Key) {
+		t.Fatalf("bad child key %x, expected %x", childKey, expected.Key)
+	}
+	if bytes.Equal(childKey, parentKey) {
+		t.Fatal("child key equals the parent key")
+	}
+
+	resp := mustSucceed(logical.ReadOperation, "keys/child", nil)
+	if resp.Data["type"] != "aes256-gcm96" || resp.Data["hd_parent"] != "parent" || resp.Data["hd_path"] != hdPath {
+		t.Fatalf("bad child key metadata: %#v", resp.Data)
+	}
+
+	// The child is a working key, and derivation is deterministic
+	resp = mustSucceed(logical.UpdateOperation, "encrypt/child", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/parent/derive-child", map[string]interface{}{
+		"path":       hdPath,
+		"child_name": "child-copy",
+	})
+	resp = mustSucceed(logical.UpdateOperation, "decrypt/child-copy", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	if resp.Data["plaintext"] != "dGhlIHF1aWNrIGJyb3duIGZveA==" {
+		t.Fatalf("bad plaintext: %#v", resp.Data["plaintext"])
+	}
+
+	// Other paths and parent versions give other keys
+	mustSucceed(logical.UpdateOperation, "keys/parent/derive-child", map[string]interface{}{
+		"path":       "m/44'/60'/0'/0/1",
+		"child_name": "sibling",
+	})
+	if bytes.Equal(exportKey("sibling"), childKey) {
+		t.Fatal("sibling key equals the child key")
+	}
+	mustSucceed(logical.UpdateOperation, "keys/parent/rotate", nil)
+	mustSucceed(logical.UpdateOperation, "keys/parent/derive-child", map[string]interface{}{
+		"path":        hdPath,
+		"child_name":  "child-v1",
+		"key_version": 1,
+	})
+	if !bytes.Equal(exportKey("child-v1"), childKey) {
+		t.Fatal("expected version 1 of the parent to give the same child")
+	}
+
+	// Children of non-exportable parents are not exportable
+	mustSucceed(logical.UpdateOperation, "keys/private", map[string]interface{}{
+		"type": "chacha20-poly1305",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/private/derive-child", map[string]interface{}{
+		"path":       "m/0",
+		"child_name": "private-child",
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/private-child", nil)
+	if resp.Data["type"] != "chacha20-poly1305" || resp.Data["exportable"] != false {
+		t.Fatalf("bad child key metadata: %#v", resp.Data)
+	}
+	mustFail(logical.ReadOperation, "export/encryption-key/private-child", nil)
+
+	for _, data := range []map[string]interface{}{
+		{"path": hdPath},
+		{"path": hdPath, "child_name": "parent"},
+		{"path": hdPath, "child_name": "child"},
+		{"path": hdPath, "child_name": "bad/name"},
+		{"path": "44'/0", "child_name": "other"},
+		{"path": "m/2147483648", "child_name": "other"},
+		{"path": hdPath, "child_name": "other", "key_version": 5},
+	} {
+		mustFail(logical.UpdateOperation, "keys/parent/derive-child", data)
+	}
+	mustSucceed(logical.UpdateOperation, "keys/signing", map[string]interface{}{
+		"type": "ed25519",
+	})
+	mustFail(logical.UpdateOperation, "keys/signing/derive-child", map[string]interface{}{
+		"path":       hdPath,
+		"child_name": "other",
+	})
+	mustFail(logical.UpdateOperation, "keys/missing/derive-child", map[string]interface{}{
+		"path":       hdPath,
+		"child_name": "other",
+	})
+}
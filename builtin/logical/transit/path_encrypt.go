@@ -2,8 +2,17 @@ package transit
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"runtime"
+	"strings"
+	"sync"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/helper/errutil"
@@ -13,12 +22,23 @@ import (
 	"github.com/mitchellh/mapstructure"
 )
 
+// nonceSizes holds the exact nonce length, in bytes, required by each key
+// type that accepts a caller-supplied nonce.
+var nonceSizes = map[keysutil.KeyType]int{
+	keysutil.KeyType_AES256_GCM96:      12,
+	keysutil.KeyType_ChaCha20_Poly1305: 12,
+}
+
 // BatchRequestItem represents a request item for batch processing
 type BatchRequestItem struct {
 	// Context for key derivation. This is required for derived keys.
 	Context string `json:"context" structs:"context" mapstructure:"context"`
 
-	// DecodedContext is the base64 decoded version of Context
+	// ContextJSON is a structured alternative to Context. It is canonicalized
+	// and hashed to produce the derivation context.
+	ContextJSON map[string]interface{} `json:"context_json" structs:"context_json" mapstructure:"context_json"`
+
+	// DecodedContext is the decoded version of Context or ContextJSON
 	DecodedContext []byte
 
 	// Plaintext for encryption
@@ -27,6 +47,10 @@ type BatchRequestItem struct {
 	// Ciphertext for decryption
 	Ciphertext string `json:"ciphertext" structs:"ciphertext" mapstructure:"ciphertext"`
 
+	// CiphertextChunks is a ciphertext for decryption split into chunks, as
+	// returned by encrypt with a chunk_size. The chunks are joined before use.
+	CiphertextChunks []string `json:"ciphertext_chunks" structs:"ciphertext_chunks" mapstructure:"ciphertext_chunks"`
+
 	// Nonce to be used when v1 convergent encryption is used
 	Nonce string `json:"nonce" structs:"nonce" mapstructure:"nonce"`
 
@@ -35,6 +59,16 @@ type BatchRequestItem struct {
 
 	// DecodedNonce is the base64 decoded version of Nonce
 	DecodedNonce []byte
+
+	// Base64 encoded associated data to authenticate along with the
+	// plaintext, for AEAD key types
+	AssociatedData string `json:"associated_data" structs:"associated_data" mapstructure:"associated_data"`
+
+	// DecodedAssociatedData is the base64 decoded version of AssociatedData
+	DecodedAssociatedData []byte
+
+	// The padding mode to use with RSA keys
+	PaddingMode string `json:"padding_mode" structs:"padding_mode" mapstructure:"padding_mode"`
 }
 
 // BatchResponseItem represents a response item for batch processing
@@ -43,15 +77,299 @@ type BatchResponseItem struct {
 	// request item
 	Ciphertext string `json:"ciphertext,omitempty" structs:"ciphertext" mapstructure:"ciphertext"`
 
+	// CiphertextChunks holds the ciphertext instead of Ciphertext when a
+	// chunk size was requested
+	CiphertextChunks []string `json:"ciphertext_chunks,omitempty" structs:"ciphertext_chunks" mapstructure:"ciphertext_chunks"`
+
 	// Plaintext for the ciphertext present in the corresponding batch
 	// request item
 	Plaintext string `json:"plaintext,omitempty" structs:"plaintext" mapstructure:"plaintext"`
 
+	// AADHash is the base64 encoded SHA-256 digest of the associated data
+	// of the corresponding batch request item, if any
+	AADHash string `json:"aad_hash,omitempty" structs:"aad_hash" mapstructure:"aad_hash"`
+
+	// PlaintextHash is the base64 encoded SHA-256 digest of the plaintext of
+	// the corresponding batch request item, if requested
+	PlaintextHash string `json:"plaintext_hash,omitempty" structs:"plaintext_hash" mapstructure:"plaintext_hash"`
+
+	// KeyVersion and KeyID identify the key version that encrypted the
+	// corresponding batch request item
+	KeyVersion int    `json:"key_version,omitempty" structs:"key_version" mapstructure:"key_version"`
+	KeyID      string `json:"key_id,omitempty" structs:"key_id" mapstructure:"key_id"`
+
+	// KeyFingerprint is the short fingerprint of the key version, if
+	// requested
+	KeyFingerprint string `json:"key_fingerprint,omitempty" structs:"key_fingerprint" mapstructure:"key_fingerprint"`
+
 	// Error, if set represents a failure encountered while encrypting a
 	// corresponding batch request item
 	Error string `json:"error,omitempty" structs:"error" mapstructure:"error"`
 }
 
+// hasContext reports whether either form of derivation context is set
+func (item BatchRequestItem) hasContext() bool {
+	return len(item.Context) != 0 || len(item.ContextJSON) != 0
+}
+
+// decodeContext returns the derivation context of the item, base64-decoding
+// Context or canonicalizing ContextJSON, whichever is set.
+func (item BatchRequestItem) decodeContext() ([]byte, error) {
+	switch {
+	case len(item.Context) != 0 && len(item.ContextJSON) != 0:
+		return nil, errors.New("only one of context and context_json may be set")
+	case len(item.ContextJSON) != 0:
+		return canonicalContext(item.ContextJSON)
+	case len(item.Context) != 0:
+		return base64.StdEncoding.DecodeString(item.Context)
+	}
+	return nil, nil
+}
+
+// canonicalContext returns the SHA-256 digest of the canonical JSON encoding
+// of a structured context. encoding/json writes map keys in sorted order and
+// without insignificant whitespace, so the digest does not depend on the
+// order in which the caller supplied the keys.
+func canonicalContext(raw map[string]interface{}) ([]byte, error) {
+	buf, err := json.Marshal(raw)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to encode context_json: {{err}}", err)
+	}
+	sum := sha256.Sum256(buf)
+	return sum[:], nil
+}
+
+// cipherOptions base64-decodes the associated data of the item, if any, and
+// returns the cipher options to use for it
+func (item *BatchRequestItem) cipherOptions() (*keysutil.CipherOptions, error) {
+	opts := &keysutil.CipherOptions{}
+
+	if len(item.AssociatedData) != 0 {
+		associatedData, err := base64.StdEncoding.DecodeString(item.AssociatedData)
+		if err != nil {
+			return nil, errors.New("failed to base64-decode associated data")
+		}
+		item.DecodedAssociatedData = associatedData
+		opts.AssociatedData = associatedData
+	}
+
+	if len(item.PaddingMode) != 0 {
+		paddingMode, ok := keysutil.PaddingModeMap[item.PaddingMode]
+		if !ok {
+			return nil, fmt.Errorf("invalid padding mode %q", item.PaddingMode)
+		}
+		opts.PaddingMode = paddingMode
+	}
+
+	return opts, nil
+}
+
+// ciphertextMarker is the start of every ciphertext, which a key's
+// registered ciphertext prefix replaces
+const ciphertextMarker = "vault:"
+
+// validateCiphertextPrefix checks that a prefix can be told apart from the
+// default marker when decrypting. An empty prefix is valid.
+func validateCiphertextPrefix(prefix string) error {
+	switch {
+	case strings.HasPrefix(prefix, ciphertextMarker):
+		return fmt.Errorf("ciphertext prefix cannot start with %q", ciphertextMarker)
+	case strings.ContainsAny(prefix, " \t\r\n"):
+		return fmt.Errorf("ciphertext prefix cannot contain whitespace")
+	case strings.Contains(prefix, boundHMACSeparator):
+		return fmt.Errorf("ciphertext prefix cannot contain %q", boundHMACSeparator)
+	}
+	return nil
+}
+
+// stripCiphertextPrefix restores the default marker on a ciphertext that
+// carries the key's registered prefix. Other ciphertexts are returned
+// unchanged.
+func stripCiphertextPrefix(p *keysutil.Policy, ciphertext string) string {
+	if p.CiphertextPrefix == "" || strings.HasPrefix(ciphertext, ciphertextMarker) {
+		return ciphertext
+	}
+	if !strings.HasPrefix(ciphertext, p.CiphertextPrefix) {
+		return ciphertext
+	}
+	return ciphertextMarker + strings.TrimPrefix(ciphertext, p.CiphertextPrefix)
+}
+
+// ciphertextPayload splits a ciphertext into everything up to and including
+// the last ':' and the encoded payload that follows, which never contains a
+// ':' in either encoding
+func ciphertextPayload(ciphertext string) (string, string) {
+	idx := strings.LastIndex(ciphertext, ":")
+	return ciphertext[:idx+1], ciphertext[idx+1:]
+}
+
+// hexEncodeCiphertext re-encodes the base64 payload of a ciphertext as hex
+func hexEncodeCiphertext(ciphertext string) (string, error) {
+	prefix, payload := ciphertextPayload(ciphertext)
+	decoded, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(decoded), nil
+}
+
+// chunkCiphertext splits a ciphertext into chunks of chunkSize bytes; the
+// last chunk may be shorter
+func chunkCiphertext(ciphertext string, chunkSize int) []string {
+	chunks := make([]string, 0, (len(ciphertext)+chunkSize-1)/chunkSize)
+	for len(ciphertext) > chunkSize {
+		chunks = append(chunks, ciphertext[:chunkSize])
+		ciphertext = ciphertext[chunkSize:]
+	}
+	return append(chunks, ciphertext)
+}
+
+// joinCiphertext returns the ciphertext of a decryption request, given either
+// flat or as chunks
+func joinCiphertext(ciphertext string, chunks []string) (string, error) {
+	if len(chunks) == 0 {
+		return ciphertext, nil
+	}
+	if ciphertext != "" {
+		return "", errors.New("only one of ciphertext and ciphertext_chunks may be set")
+	}
+	return strings.Join(chunks, ""), nil
+}
+
+// decodeHexCiphertext converts a ciphertext with a hex payload back to the
+// base64 form expected by the policy. A payload of an even number of
+// lowercase hex digits is taken to be hex; a base64 payload of a real
+// ciphertext almost never is, and if it were, decryption would fail
+// authentication rather than return a wrong plaintext. Other ciphertexts are
+// returned unchanged.
+func decodeHexCiphertext(ciphertext string) string {
+	prefix, payload := ciphertextPayload(ciphertext)
+	if payload == "" || len(payload)%2 != 0 || strings.Trim(payload, "0123456789abcdef") != "" {
+		return ciphertext
+	}
+	decoded, err := hex.DecodeString(payload)
+	if err != nil {
+		return ciphertext
+	}
+	return prefix + base64.StdEncoding.EncodeToString(decoded)
+}
+
+// aadSegment is a labeled part of composed associated data
+type aadSegment struct {
+	label string
+	value []byte
+}
+
+// composeAssociatedData encodes the segments, each label and value prefixed
+// by its length, so that no two different sets of segments encode to the
+// same associated data
+func composeAssociatedData(segments ...aadSegment) []byte {
+	var buf []byte
+	var length [4]byte
+	for _, segment := range segments {
+		binary.BigEndian.PutUint32(length[:], uint32(len(segment.label)))
+		buf = append(buf, length[:]...)
+		buf = append(buf, segment.label...)
+		binary.BigEndian.PutUint32(length[:], uint32(len(segment.value)))
+		buf = append(buf, length[:]...)
+		buf = append(buf, segment.value...)
+	}
+	return buf
+}
+
+// bindToEntity replaces the associated data in opts with one that also
+// authenticates the entity ID, so that a ciphertext only decrypts for
+// requests made by the same entity
+func bindToEntity(opts *keysutil.CipherOptions, entityID string) error {
+	if entityID == "" {
+		return errors.New("cannot bind to entity: request has no entity")
+	}
+	opts.AssociatedData = composeAssociatedData(
+		aadSegment{label: "entity_id", value: []byte(entityID)},
+		aadSegment{label: "associated_data", value: opts.AssociatedData},
+	)
+	return nil
+}
+
+// keyCommitmentLabel keys the HMAC of the key name used as a key commitment
+const keyCommitmentLabel = "transit key commitment"
+
+// commitToKeyName replaces the associated data in opts with one that also
+// authenticates an HMAC of the key name, so that a ciphertext fails to
+// decrypt under any other key, even one sharing its key material
+func commitToKeyName(opts *keysutil.CipherOptions, name string) {
+	mac := hmac.New(sha256.New, []byte(keyCommitmentLabel))
+	mac.Write([]byte(name))
+	opts.AssociatedData = composeAssociatedData(
+		aadSegment{label: "key_commitment", value: mac.Sum(nil)},
+		aadSegment{label: "associated_data", value: opts.AssociatedData},
+	)
+}
+
+// aadHash returns the base64 encoded SHA-256 digest of associated data. It
+// lets callers that lose the associated data check recovered candidates
+// without the digest revealing the data itself in responses.
+func aadHash(associatedData []byte) string {
+	if len(associatedData) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(associatedData)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// maxBatchParallelism is the largest number of workers a batch encrypt
+// request may use: half the available CPUs, leaving the rest for other
+// requests.
+func maxBatchParallelism() int {
+	if n := runtime.NumCPU() / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// processBatchItems calls fn for each index in [0, n) using up to
+// parallelism workers. fn must only write to the results of its own index,
+// which keeps results in input order regardless of scheduling. The error
+// returned is that of the lowest failing index.
+func processBatchItems(n, parallelism int, fn func(int) error) error {
+	if parallelism <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			if err := fn(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if parallelism > n {
+		parallelism = n
+	}
+
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < parallelism; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				errs[i] = fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (b *backend) pathEncrypt() *framework.Path {
 	return &framework.Path{
 		Pattern: "encrypt/" + framework.GenericNameRegex("name"),
@@ -61,6 +379,8 @@ func (b *backend) pathEncrypt() *framework.Path {
 				Description: "Name of the policy",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"plaintext": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Base64 encoded plaintext value to be encrypted",
@@ -71,6 +391,128 @@ func (b *backend) pathEncrypt() *framework.Path {
 				Description: "Base64 encoded context for key derivation. Required if key derivation is enabled",
 			},
 
+			"context_json": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+JSON object used as the context for key derivation instead of "context". It is
+canonicalized and hashed with SHA-256, so key ordering does not matter. Only
+one of "context" and "context_json" may be set.`,
+			},
+
+			"associated_data": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+Base64 encoded associated data that is authenticated, but not encrypted, along
+with the plaintext. The same value must be provided on decryption. Only
+supported for AEAD key types without convergent encryption. The response
+includes its SHA-256 digest as "aad_hash".`,
+			},
+
+			"padding_mode": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+The padding to use with RSA keys: "oaep-sha256", "oaep-sha1" or "pkcs1v15".
+Defaults to "oaep-sha256". "pkcs1v15" requires allow_pkcs1v15_padding to be
+set on the key. The same value must be provided on decryption.`,
+			},
+
+			"bind_to_entity": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, the entity ID of the request is authenticated along with the plaintext,
+so the ciphertext can only be decrypted by requests from the same entity with
+bind_to_entity set. Only supported for AEAD key types without convergent
+encryption.`,
+			},
+
+			"include_key_commitment": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, an HMAC of the key name is authenticated along with the plaintext, so
+the ciphertext fails to decrypt under any other key, even one with the same
+key material. Decryption must set include_key_commitment as well. Only
+supported for AEAD key types without convergent encryption.`,
+			},
+
+			"output_encoding": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "base64",
+				Description: `
+Encoding of the ciphertext after the version prefix. Can be "base64" or
+"hex". Decryption detects the encoding. Defaults to "base64".`,
+			},
+
+			"chunk_size": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `
+If set, the ciphertext is split into chunks of this many bytes, the last of
+which may be shorter, and returned as ciphertext_chunks instead of ciphertext.
+Decryption accepts the chunks in the same order.`,
+			},
+
+			"compress_before_encrypt": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, the plaintext is gzip-compressed before it is encrypted. This is
+recorded and authenticated in the ciphertext, and decryption decompresses the
+plaintext automatically. Plaintexts that do not compress are encrypted as is.
+Only supported for AEAD key types.`,
+			},
+
+			"compression_level": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: keysutil.DefaultCompressionLevel,
+				Description: `
+The gzip compression level to use when compress_before_encrypt is set, from 1
+(fastest) to 9 (smallest). Defaults to 6.`,
+			},
+
+			"pad_plaintext_to": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `
+If set, each plaintext is padded to this many bytes with PKCS#7 padding before
+it is encrypted, so that the ciphertext does not reveal the plaintext length.
+Plaintexts must be shorter than this length, which can be at most 255. This is
+recorded and authenticated in the ciphertext, and decryption strips the padding
+automatically. Only supported for AEAD key types. Cannot be combined with
+compress_before_encrypt.`,
+			},
+
+			"ciphertext_prefix": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `
+Prefix to use in place of "vault:" at the start of each ciphertext. Must match
+the ciphertext_prefix registered on the key.`,
+			},
+
+			"return_integrity_hash": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, the base64 encoded SHA-256 digest of each plaintext is returned as
+plaintext_hash, so identical plaintexts can be detected without decrypting.
+The digest is taken before compression and encryption. Not supported with
+convergent encryption, whose ciphertexts already reveal identical plaintexts.`,
+			},
+
+			"return_key_fingerprint": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, the fingerprint of the key version that encrypted each plaintext is
+returned as key_fingerprint: the hex encoded first 8 bytes of the SHA-256 of
+"vault-key-fingerprint" and a zero byte followed by its key material.`,
+			},
+
+			"preview_only": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `
+If set, nothing is encrypted. Instead, the key version that an encryption
+with the given key_version would use is returned along with the key's
+algorithm and the version's key ID. The request is checked as an encryption
+would be, but no plaintext is required. The key ID is a hash of the version's
+key material, so the key material is read to compute it, but nothing is
+encrypted with it.`,
+			},
+
 			"nonce": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `
@@ -111,6 +553,15 @@ will severely impact the ciphertext's security.`,
 Must be 0 (for latest) or a value greater than or equal
 to the min_encryption_version configured on the key.`,
 			},
+
+			"parallelism": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: 1,
+				Description: `The number of batch items to encrypt concurrently.
+Values above half the number of CPUs are lowered to
+that limit. Results are returned in input order.
+Defaults to 1.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -126,7 +577,11 @@ to the min_encryption_version configured on the key.`,
 }
 
 func (b *backend) pathEncryptExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		// Reported by the write handler
+		return false, nil
+	}
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
 		Storage: req.Storage,
 		Name:    name,
@@ -142,8 +597,14 @@ func (b *backend) pathEncryptExistenceCheck(ctx context.Context, req *logical.Re
 }
 
 func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
-	var err error
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	if d.Get("preview_only").(bool) {
+		return b.pathEncryptPreview(ctx, req, d, name)
+	}
 
 	batchInputRaw := d.Raw["batch_input"]
 	var batchInputItems []BatchRequestItem
@@ -164,22 +625,44 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 
 		batchInputItems = make([]BatchRequestItem, 1)
 		batchInputItems[0] = BatchRequestItem{
-			Plaintext:  valueRaw.(string),
-			Context:    d.Get("context").(string),
-			Nonce:      d.Get("nonce").(string),
-			KeyVersion: d.Get("key_version").(int),
+			Plaintext:      valueRaw.(string),
+			Context:        d.Get("context").(string),
+			ContextJSON:    d.Get("context_json").(map[string]interface{}),
+			Nonce:          d.Get("nonce").(string),
+			KeyVersion:     d.Get("key_version").(int),
+			AssociatedData: d.Get("associated_data").(string),
+			PaddingMode:    d.Get("padding_mode").(string),
 		}
 	}
 
 	batchResponseItems := make([]BatchResponseItem, len(batchInputItems))
-	contextSet := len(batchInputItems[0].Context) != 0
+	cipherOpts := make([]*keysutil.CipherOptions, len(batchInputItems))
+	contextSet := batchInputItems[0].hasContext()
+	bindEntity := d.Get("bind_to_entity").(bool)
+	keyCommitment := d.Get("include_key_commitment").(bool)
+
+	var compressionLevel int
+	if d.Get("compress_before_encrypt").(bool) {
+		compressionLevel = d.Get("compression_level").(int)
+		if compressionLevel < 1 || compressionLevel > 9 {
+			return logical.ErrorResponse("compression_level must be between 1 and 9"), logical.ErrInvalidRequest
+		}
+	}
+
+	padTo := d.Get("pad_plaintext_to").(int)
+	switch {
+	case padTo < 0 || padTo > keysutil.MaxPadPlaintextTo:
+		return logical.ErrorResponse(fmt.Sprintf("pad_plaintext_to must be between 1 and %d", keysutil.MaxPadPlaintextTo)), logical.ErrInvalidRequest
+	case padTo != 0 && compressionLevel != 0:
+		return logical.ErrorResponse("pad_plaintext_to cannot be combined with compress_before_encrypt"), logical.ErrInvalidRequest
+	}
 
 	// Before processing the batch request items, get the policy. If the
 	// policy is supposed to be upserted, then determine if 'derived' is to
 	// be set or not, based on the presence of 'context' field in all the
 	// input items.
 	for i, item := range batchInputItems {
-		if (len(item.Context) == 0 && contextSet) || (len(item.Context) != 0 && !contextSet) {
+		if item.hasContext() != contextSet {
 			return logical.ErrorResponse("context should be set either in all the request blocks or in none"), logical.ErrInvalidRequest
 		}
 
@@ -190,12 +673,10 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 		}
 
 		// Decode the context
-		if len(item.Context) != 0 {
-			batchInputItems[i].DecodedContext, err = base64.StdEncoding.DecodeString(item.Context)
-			if err != nil {
-				batchResponseItems[i].Error = err.Error()
-				continue
-			}
+		batchInputItems[i].DecodedContext, err = item.decodeContext()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
 		}
 
 		// Decode the nonce
@@ -206,6 +687,47 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 				continue
 			}
 		}
+
+		// Decode the associated data and padding mode
+		cipherOpts[i], err = batchInputItems[i].cipherOptions()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
+
+		if bindEntity {
+			if err := bindToEntity(cipherOpts[i], req.EntityID); err != nil {
+				batchResponseItems[i].Error = err.Error()
+				continue
+			}
+		}
+
+		if keyCommitment {
+			commitToKeyName(cipherOpts[i], name)
+		}
+
+		cipherOpts[i].CompressionLevel = compressionLevel
+		cipherOpts[i].PadTo = padTo
+	}
+
+	outputEncoding := d.Get("output_encoding").(string)
+	switch outputEncoding {
+	case "base64", "hex":
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid output encoding %q", outputEncoding)), logical.ErrInvalidRequest
+	}
+
+	chunkSize := d.Get("chunk_size").(int)
+	if chunkSize < 0 {
+		return logical.ErrorResponse("chunk_size cannot be negative"), logical.ErrInvalidRequest
+	}
+
+	parallelism := d.Get("parallelism").(int)
+	if parallelism < 1 {
+		return logical.ErrorResponse("parallelism must be at least 1"), logical.ErrInvalidRequest
+	}
+	if max := maxBatchParallelism(); parallelism > max {
+		parallelism = max
 	}
 
 	// Get the policy
@@ -243,43 +765,190 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 			Name:    name,
 		}
 	}
-	p, upserted, err = b.lm.GetPolicy(ctx, polReq)
+	if polReq.Upsert {
+		p, upserted, err = b.upsertPolicy(ctx, polReq)
+	} else {
+		p, upserted, err = b.lm.GetPolicy(ctx, polReq)
+	}
 	if err != nil {
-		return nil, err
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
 	}
 	if p == nil {
 		return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
 	}
+	if upserted {
+		b.notifyKeyStatus(ctx, req.Storage, p, "", keyStatusCreated)
+	}
 	if !b.System().CachingDisabled() {
 		p.Lock(false)
 	}
 
+	if resp, err := b.checkEncryptRequest(ctx, req, d, p); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	returnHash := d.Get("return_integrity_hash").(bool)
+	returnFingerprint := d.Get("return_key_fingerprint").(bool)
+	ciphertextPrefix := d.Get("ciphertext_prefix").(string)
+
+	if resp, err := b.checkRateLimit(p, req, keysutil.RateLimitCipher); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.bindRequestClaims(p, req, cipherOpts...); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	var boundHMACVersion int
+	var boundHMACKey []byte
+	if p.BoundHMACKey != "" {
+		boundHMACVersion, boundHMACKey, err = b.linkedHMACKey(ctx, req, p, p.BoundHMACKey, 0)
+		if err != nil {
+			p.Unlock()
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	var plaintextHMACVersion int
+	var plaintextHMACKey []byte
+	if p.HMACBeforeEncrypt != "" {
+		plaintextHMACVersion, plaintextHMACKey, err = b.plaintextHMACKey(ctx, req, p, 0)
+		if err != nil {
+			p.Unlock()
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	var tracker *nonceTracker
+	if p.NonceTracking {
+		tracker = b.newNonceTracker(ctx, req.Storage, name)
+		defer tracker.release()
+	}
+
 	// Process batch request items. If encryption of any request
 	// item fails, respectively mark the error in the response
 	// collection and continue to process other items.
-	for i, item := range batchInputItems {
+	encryptItem := func(i int) error {
+		item := batchInputItems[i]
 		if batchResponseItems[i].Error != "" {
-			continue
+			return nil
+		}
+
+		if tracker != nil {
+			cipherOpts[i].TrackNonce = tracker.trackFunc(item.DecodedContext)
 		}
 
-		ciphertext, err := p.Encrypt(item.KeyVersion, item.DecodedContext, item.DecodedNonce, item.Plaintext)
+		// Only keys that use the caller's nonce check it; others ignore it
+		if len(item.DecodedNonce) != 0 && p.UsesCallerNonce(item.KeyVersion) {
+			if size, ok := nonceSizes[p.Type]; ok && len(item.DecodedNonce) != size {
+				batchResponseItems[i].Error = fmt.Sprintf("nonce must be exactly %d bytes for %s", size, p.Type)
+				return nil
+			}
+		}
+
+		plaintext := item.Plaintext
+		if plaintextHMACKey != nil {
+			var err error
+			plaintext, err = framePlaintext(plaintext, plaintextHMACVersion, plaintextHMACKey)
+			if err != nil {
+				batchResponseItems[i].Error = err.Error()
+				return nil
+			}
+		}
+
+		ciphertext, err := p.EncryptWithOptions(item.KeyVersion, item.DecodedContext, item.DecodedNonce, plaintext, cipherOpts[i])
 		if err != nil {
 			switch err.(type) {
 			case errutil.UserError:
 				batchResponseItems[i].Error = err.Error()
-				continue
+				return nil
 			default:
-				p.Unlock()
-				return nil, err
+				return err
 			}
 		}
 
 		if ciphertext == "" {
-			p.Unlock()
-			return nil, fmt.Errorf("empty ciphertext returned for input item %d", i)
+			return fmt.Errorf("empty ciphertext returned for input item %d", i)
+		}
+
+		keyVersion := item.KeyVersion
+		if keyVersion == 0 {
+			keyVersion = p.LatestVersion
+		}
+		keyID, err := p.KeyID(keyVersion)
+		if err != nil {
+			return err
+		}
+
+		if outputEncoding == "hex" {
+			ciphertext, err = hexEncodeCiphertext(ciphertext)
+			if err != nil {
+				return err
+			}
+		}
+
+		if ciphertextPrefix != "" {
+			ciphertext = ciphertextPrefix + strings.TrimPrefix(ciphertext, ciphertextMarker)
 		}
 
-		batchResponseItems[i].Ciphertext = ciphertext
+		if boundHMACKey != nil {
+			ciphertext = appendBoundHMAC(ciphertext, boundHMACVersion, boundHMACKey)
+		}
+
+		if chunkSize > 0 {
+			batchResponseItems[i].CiphertextChunks = chunkCiphertext(ciphertext, chunkSize)
+		} else {
+			batchResponseItems[i].Ciphertext = ciphertext
+		}
+		batchResponseItems[i].AADHash = aadHash(item.DecodedAssociatedData)
+		batchResponseItems[i].KeyVersion = keyVersion
+		batchResponseItems[i].KeyID = keyID
+		if returnFingerprint {
+			batchResponseItems[i].KeyFingerprint, err = p.KeyFingerprint(keyVersion)
+			if err != nil {
+				return err
+			}
+		}
+		if returnHash {
+			plaintext, err := base64.StdEncoding.DecodeString(item.Plaintext)
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(plaintext)
+			batchResponseItems[i].PlaintextHash = base64.StdEncoding.EncodeToString(sum[:])
+		}
+		return nil
+	}
+	if err := processBatchItems(len(batchInputItems), parallelism, encryptItem); err != nil {
+		p.Unlock()
+		return nil, err
+	}
+
+	// The nonces of the whole batch are recorded at once. If that fails, no
+	// ciphertext is returned, as its nonce could be used again.
+	if tracker != nil {
+		if err := tracker.persist(); err != nil {
+			p.Unlock()
+			return nil, err
+		}
 	}
 
 	resp := &logical.Response{}
@@ -292,8 +961,22 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 			p.Unlock()
 			return logical.ErrorResponse(batchResponseItems[0].Error), logical.ErrInvalidRequest
 		}
-		resp.Data = map[string]interface{}{
-			"ciphertext": batchResponseItems[0].Ciphertext,
+		resp.Data = map[string]interface{}{}
+		if chunkSize > 0 {
+			resp.Data["ciphertext_chunks"] = batchResponseItems[0].CiphertextChunks
+		} else {
+			resp.Data["ciphertext"] = batchResponseItems[0].Ciphertext
+		}
+		if batchResponseItems[0].AADHash != "" {
+			resp.Data["aad_hash"] = batchResponseItems[0].AADHash
+		}
+		if returnHash {
+			resp.Data["plaintext_hash"] = batchResponseItems[0].PlaintextHash
+		}
+		resp.Data["key_version"] = batchResponseItems[0].KeyVersion
+		resp.Data["key_id"] = batchResponseItems[0].KeyID
+		if returnFingerprint {
+			resp.Data["key_fingerprint"] = batchResponseItems[0].KeyFingerprint
 		}
 	}
 
@@ -305,6 +988,93 @@ func (b *backend) pathEncryptWrite(ctx context.Context, req *logical.Request, d
 	return resp, nil
 }
 
+// checkEncryptRequest runs the checks of an encrypt request against the key
+// that do not depend on the plaintexts, so that previews are refused whenever
+// an encryption would be. The caller must hold the policy's lock.
+func (b *backend) checkEncryptRequest(ctx context.Context, req *logical.Request, d *framework.FieldData, p *keysutil.Policy) (*logical.Response, error) {
+	if err := b.checkRotationOverdue(ctx, req.Storage, p); err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	if d.Get("return_integrity_hash").(bool) && p.ConvergentEncryption {
+		return logical.ErrorResponse("return_integrity_hash is not supported with convergent encryption"), logical.ErrInvalidRequest
+	}
+
+	ciphertextPrefix := d.Get("ciphertext_prefix").(string)
+	if ciphertextPrefix != "" && ciphertextPrefix != p.CiphertextPrefix {
+		return logical.ErrorResponse(fmt.Sprintf("ciphertext prefix %q is not registered on the key", ciphertextPrefix)), logical.ErrInvalidRequest
+	}
+
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	return b.authorizeEncryptNamespace(ctx, p)
+}
+
+// pathEncryptPreview reports the key version an encryption request would use
+// without encrypting anything. It neither creates the key nor counts against
+// its rate limit.
+func (b *backend) pathEncryptPreview(ctx context.Context, req *logical.Request, d *framework.FieldData, name string) (*logical.Response, error) {
+	if d.Raw["batch_input"] != nil {
+		return logical.ErrorResponse("preview_only cannot be combined with batch_input"), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	if resp, err := b.checkEncryptRequest(ctx, req, d, p); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if !p.Type.EncryptionSupported() {
+		return logical.ErrorResponse(fmt.Sprintf("key type %v does not support encryption", p.Type)), logical.ErrInvalidRequest
+	}
+
+	ver := d.Get("key_version").(int)
+	switch {
+	case ver == 0:
+		ver = p.LatestVersion
+	case ver < 0:
+		return logical.ErrorResponse("requested version for encryption is negative"), logical.ErrInvalidRequest
+	case ver > p.LatestVersion:
+		return logical.ErrorResponse("requested version for encryption is higher than the latest key version"), logical.ErrInvalidRequest
+	}
+	if ver < p.MinEncryptionVersion {
+		return logical.ErrorResponse("requested version for encryption is less than the minimum encryption key version"), logical.ErrInvalidRequest
+	}
+
+	keyID, err := p.KeyID(ver)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"key_version": ver,
+			"algorithm":   p.Type.String(),
+			"key_id":      keyID,
+		},
+	}, nil
+}
+
 const pathEncryptHelpSyn = `Encrypt a plaintext value or a batch of plaintext
 blocks using a named key`
 
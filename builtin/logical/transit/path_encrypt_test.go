@@ -2,8 +2,18 @@ package transit
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/mitchellh/mapstructure"
 )
@@ -546,3 +556,1977 @@ func TestTransit_BatchEncryptionCase12(t *testing.T) {
 		t.Fatalf("expected an error")
 	}
 }
+
+// useCallerNonces downgrades the named convergent key to the first convergent
+// encryption version, the only one that uses caller-supplied nonces
+func useCallerNonces(t *testing.T, b *backend, s logical.Storage, name string) {
+	t.Helper()
+	p, err := keysutil.LoadPolicy(context.Background(), s, "policy/"+name)
+	if err != nil || p == nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	p.ConvergentVersion = 1
+	key := p.Keys[strconv.Itoa(p.LatestVersion)]
+	key.ConvergentVersion = 0
+	p.Keys[strconv.Itoa(p.LatestVersion)] = key
+	if err := p.Persist(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	b.invalidate(context.Background(), "policy/"+name)
+}
+
+func TestTransit_EncryptNonceLength(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA==" // "the quick brown fox"
+
+	cases := []struct {
+		keyType string
+		nonce   string
+		err     string
+	}{
+		{"aes256-gcm96", "Zm9vIGJhcg==", "nonce must be exactly 12 bytes for aes256-gcm96"},
+		{"aes256-gcm96", "b25ldHdvdGhyZWVmb3Vy", "nonce must be exactly 12 bytes for aes256-gcm96"},
+		{"aes256-gcm96", "b25ldHdvdGhyZWVl", ""},
+		{"chacha20-poly1305", "Zm9vIGJhcg==", "nonce must be exactly 12 bytes for chacha20-poly1305"},
+		{"chacha20-poly1305", "b25ldHdvdGhyZWVmb3Vy", "nonce must be exactly 12 bytes for chacha20-poly1305"},
+		{"chacha20-poly1305", "b25ldHdvdGhyZWVl", ""},
+	}
+
+	for _, keyType := range []string{"aes256-gcm96", "chacha20-poly1305"} {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "keys/" + keyType,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"type":                  keyType,
+				"derived":               true,
+				"convergent_encryption": true,
+			},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		useCallerNonces(t, b, s, keyType)
+	}
+
+	for _, tc := range cases {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt/" + tc.keyType,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"plaintext": plaintext,
+				"context":   "dmlzaGFsCg==",
+				"nonce":     tc.nonce,
+			},
+		})
+		if tc.err == "" {
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("%s: err:%v resp:%#v", tc.keyType, err, resp)
+			}
+			continue
+		}
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("%s: expected error for nonce %q", tc.keyType, tc.nonce)
+		}
+		if resp.Data["error"] != tc.err {
+			t.Fatalf("%s: bad error: %v", tc.keyType, resp.Data["error"])
+		}
+	}
+
+	// Keys that generate or derive their nonces ignore the one supplied
+	for name, data := range map[string]map[string]interface{}{
+		"random": nil,
+		"convergent": {
+			"derived":               true,
+			"convergent_encryption": true,
+		},
+	} {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "keys/" + name,
+			Storage:   s,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "encrypt/" + name,
+			Storage:   s,
+			Data: map[string]interface{}{
+				"plaintext": plaintext,
+				"context":   "dmlzaGFsCg==",
+				"nonce":     "Zm9vIGJhcg==",
+			},
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("%s: err:%v resp:%#v", name, err, resp)
+		}
+	}
+}
+
+func TestTransit_CanonicalContext(t *testing.T) {
+	cases := []struct {
+		inputs []string
+		digest string
+	}{
+		{
+			[]string{
+				`{"user_id": "abc", "tenant": "xyz"}`,
+				`{"tenant":"xyz","user_id":"abc"}`,
+			},
+			"cf709ae89f780b6e36c27c4d166018f2b5236949ba1afd55cd428cd3653005aa",
+		},
+		{
+			[]string{
+				`{"z": "y", "a": [1, "two", {"c": true, "b": null}]}`,
+				`{"a":[1,"two",{"b":null,"c":true}],"z":"y"}`,
+			},
+			"1a0b5a4247f9fedbb7bbb8b5cf9f88b02070e89d35ea04c3a5dd28d60f59c324",
+		},
+	}
+
+	for _, tc := range cases {
+		for _, input := range tc.inputs {
+			var raw map[string]interface{}
+			if err := json.Unmarshal([]byte(input), &raw); err != nil {
+				t.Fatal(err)
+			}
+			digest, err := canonicalContext(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hex.EncodeToString(digest) != tc.digest {
+				t.Fatalf("bad digest for %s: %x", input, digest)
+			}
+		}
+	}
+}
+
+func TestTransit_EncryptContextJSON(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA==" // "the quick brown fox"
+
+	var contextA, contextB map[string]interface{}
+	if err := json.Unmarshal([]byte(`{"user_id": "abc", "tenant": "xyz"}`), &contextA); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(`{"tenant": "xyz", "user_id": "abc"}`), &contextB); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"derived": true,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"plaintext":    plaintext,
+			"context_json": contextA,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	ciphertext := resp.Data["ciphertext"]
+
+	// The same object with different key ordering must derive the same key
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ciphertext":   ciphertext,
+			"context_json": contextB,
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad: plaintext. Expected: %q, Actual: %q", plaintext, resp.Data["plaintext"])
+	}
+
+	// The digest used as raw context must be interchangeable
+	digest, err := canonicalContext(contextA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"ciphertext": ciphertext,
+			"context":    base64.StdEncoding.EncodeToString(digest),
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad: plaintext. Expected: %q, Actual: %q", plaintext, resp.Data["plaintext"])
+	}
+
+	// Supplying both forms is an error
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"plaintext":    plaintext,
+			"context":      "dmlzaGFsCg==",
+			"context_json": contextA,
+		},
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error, got resp:%#v", resp)
+	}
+
+	// Batch items may use context_json as well
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "decrypt/derived",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"batch_input": []interface{}{
+				map[string]interface{}{"ciphertext": ciphertext, "context_json": contextB},
+			},
+		},
+	})
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+	batchResponseItems := resp.Data["batch_results"].([]BatchResponseItem)
+	if batchResponseItems[0].Plaintext != plaintext {
+		t.Fatalf("bad: batch result: %#v", batchResponseItems[0])
+	}
+}
+
+// Case13: Each batch item may override the key version used for encryption
+func TestTransit_BatchEncryptionCase13(t *testing.T) {
+	var resp *logical.Response
+	var err error
+
+	b, s := createBackendWithStorage(t)
+
+	policyReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/existing_key",
+		Storage:   s,
+	}
+	resp, err = b.HandleRequest(context.Background(), policyReq)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	rotateReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/existing_key/rotate",
+		Storage:   s,
+	}
+	for i := 0; i < 3; i++ {
+		resp, err = b.HandleRequest(context.Background(), rotateReq)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+	}
+
+	configReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "keys/existing_key/config",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"min_encryption_version": 2,
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), configReq)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	batchInput := []interface{}{
+		map[string]interface{}{"plaintext": plaintext},
+		map[string]interface{}{"plaintext": plaintext, "key_version": 2},
+		map[string]interface{}{"plaintext": plaintext, "key_version": 3},
+		map[string]interface{}{"plaintext": plaintext, "key_version": 1},
+		map[string]interface{}{"plaintext": plaintext, "key_version": 5},
+		map[string]interface{}{"plaintext": plaintext, "key_version": 4},
+	}
+	batchReq := &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "encrypt/existing_key",
+		Storage:   s,
+		Data: map[string]interface{}{
+			"batch_input": batchInput,
+		},
+	}
+	resp, err = b.HandleRequest(context.Background(), batchReq)
+	if err != nil || (resp != nil && resp.IsError()) {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	batchResponseItems := resp.Data["batch_results"].([]BatchResponseItem)
+	if len(batchResponseItems) != len(batchInput) {
+		t.Fatalf("bad: number of batch results: %d", len(batchResponseItems))
+	}
+
+	expected := []struct {
+		prefix string
+		err    bool
+	}{
+		{"vault:v4:", false},
+		{"vault:v2:", false},
+		{"vault:v3:", false},
+		{"", true},
+		{"", true},
+		{"vault:v4:", false},
+	}
+	for i, item := range batchResponseItems {
+		if expected[i].err {
+			if item.Error == "" || item.Ciphertext != "" {
+				t.Fatalf("item %d: expected error, got %#v", i, item)
+			}
+			continue
+		}
+		if item.Error != "" {
+			t.Fatalf("item %d: unexpected error: %s", i, item.Error)
+		}
+		if !strings.HasPrefix(item.Ciphertext, expected[i].prefix) {
+			t.Fatalf("item %d: expected prefix %q, got %q", i, expected[i].prefix, item.Ciphertext)
+		}
+
+		decReq := &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "decrypt/existing_key",
+			Storage:   s,
+			Data: map[string]interface{}{
+				"ciphertext": item.Ciphertext,
+			},
+		}
+		resp, err = b.HandleRequest(context.Background(), decReq)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("item %d: bad plaintext: %v", i, resp.Data["plaintext"])
+		}
+	}
+}
+
+func TestTransit_EncryptAssociatedData(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	aad := []byte("record-id:1234")
+	aadB64 := base64.StdEncoding.EncodeToString(aad)
+	sum := sha256.Sum256(aad)
+	expectedHash := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, keyType := range []string{"aes256-gcm96", "chacha20-poly1305"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		resp := mustSucceed("encrypt/"+keyType, map[string]interface{}{
+			"plaintext":       plaintext,
+			"associated_data": aadB64,
+		})
+		if resp.Data["aad_hash"] != expectedHash {
+			t.Fatalf("%s: expected aad_hash %q, got %v", keyType, expectedHash, resp.Data["aad_hash"])
+		}
+		ciphertext := resp.Data["ciphertext"].(string)
+
+		resp = mustSucceed("decrypt/"+keyType, map[string]interface{}{
+			"ciphertext":      ciphertext,
+			"associated_data": aadB64,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("%s: bad plaintext: %v", keyType, resp.Data["plaintext"])
+		}
+		if resp.Data["aad_hash"] != expectedHash {
+			t.Fatalf("%s: expected aad_hash %q, got %v", keyType, expectedHash, resp.Data["aad_hash"])
+		}
+
+		// Missing or different associated data fails authentication
+		mustFail("decrypt/"+keyType, map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		mustFail("decrypt/"+keyType, map[string]interface{}{
+			"ciphertext":      ciphertext,
+			"associated_data": base64.StdEncoding.EncodeToString([]byte("record-id:1235")),
+		})
+
+		// No hash is returned without associated data
+		resp = mustSucceed("encrypt/"+keyType, map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		if _, ok := resp.Data["aad_hash"]; ok {
+			t.Fatalf("%s: unexpected aad_hash", keyType)
+		}
+	}
+
+	// Batch items carry their own associated data
+	resp := mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext, "associated_data": aadB64},
+			map[string]interface{}{"plaintext": plaintext},
+			map[string]interface{}{"plaintext": plaintext, "associated_data": "not base64"},
+		},
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].AADHash != expectedHash || results[0].Error != "" {
+		t.Fatalf("bad: %#v", results[0])
+	}
+	if results[1].AADHash != "" || results[1].Error != "" {
+		t.Fatalf("bad: %#v", results[1])
+	}
+	if results[2].Error == "" {
+		t.Fatalf("expected error: %#v", results[2])
+	}
+
+	resp = mustSucceed("decrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": results[0].Ciphertext, "associated_data": aadB64},
+			map[string]interface{}{"ciphertext": results[1].Ciphertext},
+			map[string]interface{}{"ciphertext": results[1].Ciphertext, "associated_data": aadB64},
+		},
+	})
+	decrypted := resp.Data["batch_results"].([]BatchResponseItem)
+	if decrypted[0].Plaintext != plaintext || decrypted[0].AADHash != expectedHash {
+		t.Fatalf("bad: %#v", decrypted[0])
+	}
+	if decrypted[1].Plaintext != plaintext {
+		t.Fatalf("bad: %#v", decrypted[1])
+	}
+	if decrypted[2].Error == "" {
+		t.Fatalf("expected error: %#v", decrypted[2])
+	}
+
+	// Unsupported key configurations
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":       plaintext,
+		"associated_data": aadB64,
+	})
+	mustSucceed("keys/convergent", map[string]interface{}{
+		"derived":               true,
+		"convergent_encryption": true,
+	})
+	mustFail("encrypt/convergent", map[string]interface{}{
+		"plaintext":       plaintext,
+		"context":         "dGVzdA==",
+		"associated_data": aadB64,
+	})
+}
+
+func TestTransit_EncryptRSAPaddingMode(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+
+	// PKCS#1 v1.5 padding requires an opt-in on the key
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":    plaintext,
+		"padding_mode": "pkcs1v15",
+	})
+	mustSucceed("keys/rsa/config", map[string]interface{}{
+		"allow_pkcs1v15_padding": true,
+	})
+
+	ciphertexts := make(map[string]string)
+	for _, mode := range []string{"", "oaep-sha256", "oaep-sha1", "pkcs1v15"} {
+		resp := mustSucceed("encrypt/rsa", map[string]interface{}{
+			"plaintext":    plaintext,
+			"padding_mode": mode,
+		})
+		ciphertext := resp.Data["ciphertext"].(string)
+		ciphertexts[mode] = ciphertext
+
+		resp = mustSucceed("decrypt/rsa", map[string]interface{}{
+			"ciphertext":   ciphertext,
+			"padding_mode": mode,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("%q: bad plaintext: %v", mode, resp.Data["plaintext"])
+		}
+	}
+
+	// The default is OAEP with SHA-256
+	resp := mustSucceed("decrypt/rsa", map[string]interface{}{
+		"ciphertext":   ciphertexts[""],
+		"padding_mode": "oaep-sha256",
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+	resp = mustSucceed("decrypt/rsa", map[string]interface{}{
+		"ciphertext": ciphertexts["oaep-sha256"],
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// Decrypting with a different padding mode fails
+	mustFail("decrypt/rsa", map[string]interface{}{
+		"ciphertext":   ciphertexts["oaep-sha1"],
+		"padding_mode": "oaep-sha256",
+	})
+
+	// Disabling the opt-in rejects PKCS#1 v1.5 for both operations
+	mustSucceed("keys/rsa/config", map[string]interface{}{
+		"allow_pkcs1v15_padding": false,
+	})
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":    plaintext,
+		"padding_mode": "pkcs1v15",
+	})
+	mustFail("decrypt/rsa", map[string]interface{}{
+		"ciphertext":   ciphertexts["pkcs1v15"],
+		"padding_mode": "pkcs1v15",
+	})
+
+	// Invalid modes and non-RSA keys
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":    plaintext,
+		"padding_mode": "oaep-md5",
+	})
+	mustSucceed("keys/aes", nil)
+	mustFail("encrypt/aes", map[string]interface{}{
+		"plaintext":    plaintext,
+		"padding_mode": "oaep-sha256",
+	})
+	mustFail("keys/aes/config", map[string]interface{}{
+		"allow_pkcs1v15_padding": true,
+	})
+}
+
+func TestTransit_EncryptBoundHMAC(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFailWith := func(path string, data map[string]interface{}, msg string) {
+		resp, err := doReq(path, data)
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+		if errMsg := resp.Data["error"].(string); !strings.Contains(errMsg, msg) {
+			t.Fatalf("expected error containing %q, got %q", msg, errMsg)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("keys/enc", nil)
+	mustSucceed("keys/mac", nil)
+
+	// Ciphertexts of keys without a bound HMAC key are unaffected
+	resp := mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	unbound := resp.Data["ciphertext"].(string)
+	if strings.Contains(unbound, "|hmac:") {
+		t.Fatalf("unexpected bound HMAC: %s", unbound)
+	}
+
+	mustFailWith("keys/enc/config", map[string]interface{}{
+		"bound_hmac_key": "missing",
+	}, "not found")
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"bound_hmac_key": "mac",
+	})
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   s,
+		Operation: logical.ReadOperation,
+		Path:      "keys/enc",
+	})
+	if err != nil || resp.Data["bound_hmac_key"] != "mac" {
+		t.Fatalf("bad key read: %v %#v", err, resp)
+	}
+
+	resp = mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	idx := strings.Index(ciphertext, "|hmac:v1:")
+	if !strings.HasPrefix(ciphertext, "vault:v1:") || idx == -1 {
+		t.Fatalf("bad ciphertext: %s", ciphertext)
+	}
+
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// The HMAC cannot be stripped
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": unbound,
+	}, "bound HMAC is missing")
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext[:idx],
+	}, "bound HMAC is missing")
+
+	// Tampering with the ciphertext is caught by the HMAC rather than by
+	// the GCM tag
+	tampered := []byte(ciphertext)
+	if tampered[len("vault:v1:")] == 'A' {
+		tampered[len("vault:v1:")] = 'B'
+	} else {
+		tampered[len("vault:v1:")] = 'A'
+	}
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": string(tampered),
+	}, "bound HMAC verification failed")
+
+	// So is tampering with the HMAC itself
+	mac, err := base64.StdEncoding.DecodeString(ciphertext[idx+len("|hmac:v1:"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac[0] ^= 0xff
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext[:idx] + "|hmac:v1:" + base64.StdEncoding.EncodeToString(mac),
+	}, "bound HMAC verification failed")
+
+	// The ciphertext cannot name another HMAC key
+	mustSucceed("keys/other", nil)
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": strings.Replace(ciphertext, "|hmac:", "|hmac:other:", 1),
+	}, "invalid bound HMAC")
+
+	// The HMAC key version is recorded, so rotation does not break
+	// existing ciphertexts
+	mustSucceed("keys/mac/rotate", nil)
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	resp = mustSucceed("encrypt/enc", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext},
+			map[string]interface{}{"plaintext": plaintext},
+		},
+	})
+	var batchItems []interface{}
+	for _, item := range resp.Data["batch_results"].([]BatchResponseItem) {
+		if !strings.Contains(item.Ciphertext, "|hmac:v2:") {
+			t.Fatalf("bad ciphertext: %s", item.Ciphertext)
+		}
+		batchItems = append(batchItems, map[string]interface{}{"ciphertext": item.Ciphertext})
+	}
+	batchItems = append(batchItems, map[string]interface{}{"ciphertext": string(tampered)})
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"batch_input": batchItems,
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].Plaintext != plaintext || results[1].Plaintext != plaintext {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+	if results[2].Error != "bound HMAC verification failed" {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+
+	// Data keys are bound too, and rewrapping binds the new ciphertext with
+	// the latest version of the HMAC key
+	resp = mustSucceed("datakey/wrapped/enc", nil)
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	resp = mustSucceed("rewrap/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	rewrapped := resp.Data["ciphertext"].(string)
+	if !strings.Contains(rewrapped, "|hmac:v2:") {
+		t.Fatalf("bad ciphertext: %s", rewrapped)
+	}
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": rewrapped,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+	mustFailWith("rewrap/enc", map[string]interface{}{
+		"ciphertext": string(tampered),
+	}, "bound HMAC verification failed")
+
+	// The key's own HMAC key can be bound
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"bound_hmac_key": "enc",
+	})
+	resp = mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	}, "bound HMAC verification failed")
+
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"bound_hmac_key": "",
+	})
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": unbound,
+	})
+}
+
+func TestTransit_EncryptBindToEntity(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(entityID, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			EntityID:  entityID,
+		})
+	}
+	mustSucceed := func(entityID, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(entityID, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(entityID, path string, data map[string]interface{}) {
+		resp, err := doReq(entityID, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	associatedData := base64.StdEncoding.EncodeToString([]byte("record-42"))
+	mustSucceed("entity-a", "keys/aes", nil)
+
+	resp := mustSucceed("entity-a", "encrypt/aes", map[string]interface{}{
+		"plaintext":      plaintext,
+		"bind_to_entity": true,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+
+	resp = mustSucceed("entity-a", "decrypt/aes", map[string]interface{}{
+		"ciphertext":     ciphertext,
+		"bind_to_entity": true,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// Another entity, or no binding, cannot decrypt
+	mustFail("entity-b", "decrypt/aes", map[string]interface{}{
+		"ciphertext":     ciphertext,
+		"bind_to_entity": true,
+	})
+	mustFail("entity-a", "decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	mustFail("", "decrypt/aes", map[string]interface{}{
+		"ciphertext":     ciphertext,
+		"bind_to_entity": true,
+	})
+
+	// Binding composes with caller-supplied associated data
+	resp = mustSucceed("entity-a", "encrypt/aes", map[string]interface{}{
+		"plaintext":       plaintext,
+		"associated_data": associatedData,
+		"bind_to_entity":  true,
+	})
+	ciphertext = resp.Data["ciphertext"].(string)
+	mustSucceed("entity-a", "decrypt/aes", map[string]interface{}{
+		"ciphertext":      ciphertext,
+		"associated_data": associatedData,
+		"bind_to_entity":  true,
+	})
+	mustFail("entity-b", "decrypt/aes", map[string]interface{}{
+		"ciphertext":      ciphertext,
+		"associated_data": associatedData,
+		"bind_to_entity":  true,
+	})
+	mustFail("entity-a", "decrypt/aes", map[string]interface{}{
+		"ciphertext":     ciphertext,
+		"bind_to_entity": true,
+	})
+
+	// Requests without an entity cannot bind
+	mustFail("", "encrypt/aes", map[string]interface{}{
+		"plaintext":      plaintext,
+		"bind_to_entity": true,
+	})
+}
+
+func TestTransit_EncryptCiphertextPrefix(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFailWith := func(path string, data map[string]interface{}, msg string) {
+		resp, err := doReq(path, data)
+		if err == nil || resp == nil || !resp.IsError() {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+		if errMsg := resp.Data["error"].(string); !strings.Contains(errMsg, msg) {
+			t.Fatalf("expected error containing %q, got %q", msg, errMsg)
+		}
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("keys/enc", nil)
+
+	// The prefix must be registered on the key first
+	mustFailWith("encrypt/enc", map[string]interface{}{
+		"plaintext":         plaintext,
+		"ciphertext_prefix": "enc_",
+	}, "not registered")
+
+	for _, prefix := range []string{"vault:enc_", "enc prefix", "enc|hmac:"} {
+		mustFailWith("keys/enc/config", map[string]interface{}{
+			"ciphertext_prefix": prefix,
+		}, "ciphertext prefix cannot")
+	}
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"ciphertext_prefix": "enc_",
+	})
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   s,
+		Operation: logical.ReadOperation,
+		Path:      "keys/enc",
+	})
+	if err != nil || resp.Data["ciphertext_prefix"] != "enc_" {
+		t.Fatalf("err:%v resp:%#v", err, resp)
+	}
+
+	mustFailWith("encrypt/enc", map[string]interface{}{
+		"plaintext":         plaintext,
+		"ciphertext_prefix": "other_",
+	}, "not registered")
+
+	resp = mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext":         plaintext,
+		"ciphertext_prefix": "enc_",
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	if !strings.HasPrefix(ciphertext, "enc_v1:") {
+		t.Fatalf("expected prefixed ciphertext, got %q", ciphertext)
+	}
+
+	// The registered prefix is stripped on decryption
+	resp = mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Ciphertexts without the prefix, or with another one, are rejected
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": strings.TrimPrefix(ciphertext, "enc_"),
+	}, "invalid ciphertext")
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": "other_" + strings.TrimPrefix(ciphertext, "enc_"),
+	}, "invalid ciphertext")
+
+	// The prefix is only used when requested, and both forms decrypt
+	resp = mustSucceed("encrypt/enc", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	mustSucceed("decrypt/enc", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+
+	// A prefix is a property of the key that produced the ciphertext
+	mustSucceed("keys/other", nil)
+	mustFailWith("decrypt/other", map[string]interface{}{
+		"ciphertext": ciphertext,
+	}, "invalid ciphertext")
+
+	// Once the prefix is removed from the key, prefixed ciphertexts no longer
+	// decrypt
+	mustSucceed("keys/enc/config", map[string]interface{}{
+		"ciphertext_prefix": "",
+	})
+	mustFailWith("decrypt/enc", map[string]interface{}{
+		"ciphertext": ciphertext,
+	}, "invalid ciphertext")
+}
+
+func TestTransit_EncryptOutputEncoding(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	for _, keyType := range []string{"aes256-gcm96", "chacha20-poly1305", "rsa-2048"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		for _, encoding := range []string{"base64", "hex"} {
+			resp := mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":       plaintext,
+				"output_encoding": encoding,
+			})
+			ciphertext := resp.Data["ciphertext"].(string)
+			if !strings.HasPrefix(ciphertext, "vault:v1:") {
+				t.Fatalf("%s: bad ciphertext %q", keyType, ciphertext)
+			}
+			payload := strings.TrimPrefix(ciphertext, "vault:v1:")
+
+			switch encoding {
+			case "base64":
+				if _, err := base64.StdEncoding.DecodeString(payload); err != nil {
+					t.Fatalf("%s: expected base64 payload, got %q: %v", keyType, payload, err)
+				}
+			case "hex":
+				if _, err := hex.DecodeString(payload); err != nil {
+					t.Fatalf("%s: expected hex payload, got %q: %v", keyType, payload, err)
+				}
+			}
+
+			// Both encodings are detected on decryption and rewrap
+			resp = mustSucceed("decrypt/"+keyType, map[string]interface{}{
+				"ciphertext": ciphertext,
+			})
+			if resp.Data["plaintext"] != plaintext {
+				t.Fatalf("%s/%s: bad plaintext: %#v", keyType, encoding, resp.Data)
+			}
+			if keyType != "rsa-2048" {
+				mustSucceed("rewrap/"+keyType, map[string]interface{}{
+					"ciphertext": ciphertext,
+				})
+			}
+		}
+	}
+
+	// Hex applies to every item of a batch
+	resp := mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"output_encoding": "hex",
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext},
+			map[string]interface{}{"plaintext": plaintext},
+		},
+	})
+	var batchInput []interface{}
+	for _, item := range resp.Data["batch_results"].([]BatchResponseItem) {
+		if _, err := hex.DecodeString(strings.TrimPrefix(item.Ciphertext, "vault:v1:")); err != nil {
+			t.Fatalf("expected hex payload, got %q", item.Ciphertext)
+		}
+		batchInput = append(batchInput, map[string]interface{}{"ciphertext": item.Ciphertext})
+	}
+	resp = mustSucceed("decrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": batchInput,
+	})
+	for _, item := range resp.Data["batch_results"].([]BatchResponseItem) {
+		if item.Error != "" || item.Plaintext != plaintext {
+			t.Fatalf("bad: %#v", item)
+		}
+	}
+
+	resp, err := doReq("encrypt/aes256-gcm96", map[string]interface{}{
+		"plaintext":       plaintext,
+		"output_encoding": "base32",
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error; resp:%#v", resp)
+	}
+}
+
+func TestTransit_ProcessBatchItems(t *testing.T) {
+	const n = 100
+	for _, parallelism := range []int{1, 4, 16, 200} {
+		results := make([]int, n)
+		err := processBatchItems(n, parallelism, func(i int) error {
+			// Finish items out of order
+			time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+			results[i] = i * i
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, v := range results {
+			if v != i*i {
+				t.Fatalf("parallelism %d: result %d is %d", parallelism, i, v)
+			}
+		}
+
+		// The lowest failing index determines the error
+		err = processBatchItems(n, parallelism, func(i int) error {
+			if i%30 == 29 {
+				return fmt.Errorf("item %d", i)
+			}
+			return nil
+		})
+		if err == nil || err.Error() != "item 29" {
+			t.Fatalf("parallelism %d: bad error %v", parallelism, err)
+		}
+	}
+}
+
+func TestTransit_BatchEncryptParallelism(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	mustSucceed("keys/parallel", nil)
+
+	const n = 500
+	batchInput := make([]interface{}, n)
+	for i := range batchInput {
+		plaintext := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("item-%d", i)))
+		if i == 123 {
+			plaintext = "not base64"
+		}
+		batchInput[i] = map[string]interface{}{"plaintext": plaintext}
+	}
+
+	// Well above the limit, which lowers it rather than failing
+	resp := mustSucceed("encrypt/parallel", map[string]interface{}{
+		"batch_input": batchInput,
+		"parallelism": 1024,
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if len(results) != n {
+		t.Fatalf("expected %d results, got %d", n, len(results))
+	}
+	for i, item := range results {
+		if i == 123 {
+			if item.Error == "" || item.Ciphertext != "" {
+				t.Fatalf("expected an error for item %d: %#v", i, item)
+			}
+			continue
+		}
+		if item.Error != "" {
+			t.Fatalf("item %d: %s", i, item.Error)
+		}
+		resp = mustSucceed("decrypt/parallel", map[string]interface{}{
+			"ciphertext": item.Ciphertext,
+		})
+		plaintext, _ := base64.StdEncoding.DecodeString(resp.Data["plaintext"].(string))
+		if string(plaintext) != fmt.Sprintf("item-%d", i) {
+			t.Fatalf("result %d decrypted to %q", i, plaintext)
+		}
+	}
+
+	resp, err := doReq("encrypt/parallel", map[string]interface{}{
+		"batch_input": batchInput,
+		"parallelism": 0,
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected error for zero parallelism")
+	}
+}
+
+func TestTransit_EncryptCompression(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	var doc []string
+	for i := 0; i < 100; i++ {
+		doc = append(doc, fmt.Sprintf(`{"id":%d,"name":"user-%d","active":true}`, i, i))
+	}
+	compressible := base64.StdEncoding.EncodeToString([]byte("[" + strings.Join(doc, ",") + "]"))
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	incompressible := base64.StdEncoding.EncodeToString(random)
+
+	for _, keyType := range []string{"aes256-gcm96", "chacha20-poly1305"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		for _, encoding := range []string{"base64", "hex"} {
+			// Compressible plaintexts give shorter, labeled ciphertexts that
+			// decrypt to the original plaintext
+			resp := mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":       compressible,
+				"output_encoding": encoding,
+			})
+			plain := resp.Data["ciphertext"].(string)
+			resp = mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":               compressible,
+				"output_encoding":         encoding,
+				"compress_before_encrypt": true,
+				"compression_level":       9,
+			})
+			compressed := resp.Data["ciphertext"].(string)
+			if !strings.HasPrefix(compressed, "vault:v1:gzip:") || len(compressed) >= len(plain)/2 {
+				t.Fatalf("%s: bad compressed ciphertext of length %d, uncompressed length %d", keyType, len(compressed), len(plain))
+			}
+			resp = mustSucceed("decrypt/"+keyType, map[string]interface{}{
+				"ciphertext": compressed,
+			})
+			if resp.Data["plaintext"] != compressible {
+				t.Fatalf("%s: bad plaintext after decompression", keyType)
+			}
+
+			// Incompressible plaintexts are encrypted as is, so the
+			// ciphertext is no larger than without compression
+			resp = mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":               incompressible,
+				"output_encoding":         encoding,
+				"compress_before_encrypt": true,
+			})
+			ciphertext := resp.Data["ciphertext"].(string)
+			if strings.Contains(ciphertext, "gzip:") {
+				t.Fatalf("%s: incompressible plaintext was compressed: %q", keyType, ciphertext[:20])
+			}
+			resp = mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":       incompressible,
+				"output_encoding": encoding,
+			})
+			if len(ciphertext) != len(resp.Data["ciphertext"].(string)) {
+				t.Fatalf("%s: incompressible ciphertext length %d, expected %d", keyType, len(ciphertext), len(resp.Data["ciphertext"].(string)))
+			}
+			resp = mustSucceed("decrypt/"+keyType, map[string]interface{}{
+				"ciphertext": ciphertext,
+			})
+			if resp.Data["plaintext"] != incompressible {
+				t.Fatalf("%s: bad plaintext", keyType)
+			}
+		}
+	}
+
+	// Compression applies to every batch item
+	resp := mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": compressible},
+			map[string]interface{}{"plaintext": incompressible},
+		},
+		"compress_before_encrypt": true,
+	})
+	batchResults := resp.Data["batch_results"].([]BatchResponseItem)
+	if !strings.HasPrefix(batchResults[0].Ciphertext, "vault:v1:gzip:") || strings.Contains(batchResults[1].Ciphertext, "gzip:") {
+		t.Fatalf("bad batch results: %#v", batchResults)
+	}
+	resp = mustSucceed("decrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": batchResults[0].Ciphertext},
+			map[string]interface{}{"ciphertext": batchResults[1].Ciphertext},
+		},
+	})
+	decryptResults := resp.Data["batch_results"].([]BatchResponseItem)
+	if decryptResults[0].Plaintext != compressible || decryptResults[1].Plaintext != incompressible {
+		t.Fatal("bad batch plaintexts")
+	}
+
+	// The level is only checked when compression is requested
+	mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"plaintext":         compressible,
+		"compression_level": 0,
+	})
+	for _, level := range []int{0, 10} {
+		resp, err := doReq("encrypt/aes256-gcm96", map[string]interface{}{
+			"plaintext":               compressible,
+			"compress_before_encrypt": true,
+			"compression_level":       level,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error for compression level %d", level)
+		}
+	}
+
+	// The label is authenticated, so it can neither be stripped, even with
+	// associated data that mimics it, nor added
+	compressed := batchResults[0].Ciphertext
+	stripped := strings.Replace(compressed, "vault:v1:gzip:", "vault:v1:", 1)
+	added := strings.Replace(batchResults[1].Ciphertext, "vault:v1:", "vault:v1:gzip:", 1)
+	for _, data := range []map[string]interface{}{
+		{"ciphertext": stripped},
+		{"ciphertext": stripped, "associated_data": base64.StdEncoding.EncodeToString([]byte("vault-ciphertext-labels\x00gzip\x00"))},
+		{"ciphertext": added},
+	} {
+		resp, err := doReq("decrypt/aes256-gcm96", data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error decrypting %#v", data)
+		}
+	}
+
+	// Only AEAD key types authenticate the label
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	resp, err := doReq("encrypt/rsa", map[string]interface{}{
+		"plaintext":               compressible,
+		"compress_before_encrypt": true,
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected error compressing with an RSA key")
+	}
+}
+
+func TestTransit_EncryptIntegrityHash(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	plaintext := []byte("the quick brown fox")
+	sum := sha256.Sum256(plaintext)
+	expected := base64.StdEncoding.EncodeToString(sum[:])
+	plaintextB64 := base64.StdEncoding.EncodeToString(plaintext)
+
+	mustSucceed("keys/aes", nil)
+	resp := mustSucceed("encrypt/aes", map[string]interface{}{
+		"plaintext": plaintextB64,
+	})
+	if _, ok := resp.Data["plaintext_hash"]; ok {
+		t.Fatal("plaintext_hash returned without return_integrity_hash")
+	}
+
+	// The hash is the digest of the plaintext, the same on every call even
+	// though the ciphertexts differ, and is taken before compression
+	var ciphertexts []string
+	for _, compress := range []bool{false, false, true} {
+		resp = mustSucceed("encrypt/aes", map[string]interface{}{
+			"plaintext":               plaintextB64,
+			"return_integrity_hash":   true,
+			"compress_before_encrypt": compress,
+		})
+		if resp.Data["plaintext_hash"] != expected {
+			t.Fatalf("bad plaintext hash %v, expected %s", resp.Data["plaintext_hash"], expected)
+		}
+		ciphertexts = append(ciphertexts, resp.Data["ciphertext"].(string))
+	}
+	if ciphertexts[0] == ciphertexts[1] {
+		t.Fatal("expected different ciphertexts")
+	}
+
+	resp = mustSucceed("encrypt/aes", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintextB64},
+			map[string]interface{}{"plaintext": ""},
+			map[string]interface{}{"plaintext": "not base64"},
+		},
+		"return_integrity_hash": true,
+	})
+	emptySum := sha256.Sum256(nil)
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].PlaintextHash != expected || results[1].PlaintextHash != base64.StdEncoding.EncodeToString(emptySum[:]) {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+	if results[2].Error == "" || results[2].PlaintextHash != "" {
+		t.Fatalf("expected an error without a hash: %#v", results[2])
+	}
+
+	// Convergent ciphertexts already reveal identical plaintexts
+	mustSucceed("keys/convergent", map[string]interface{}{
+		"derived":               true,
+		"convergent_encryption": true,
+	})
+	resp, err := doReq("encrypt/convergent", map[string]interface{}{
+		"plaintext":             plaintextB64,
+		"context":               "YWJjZA==",
+		"return_integrity_hash": true,
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error for a convergent key; err:%v resp:%#v", err, resp)
+	}
+}
+
+func TestTransit_EncryptKeyCommitment(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		var op logical.Operation = logical.UpdateOperation
+		if data == nil {
+			op = logical.ReadOperation
+		}
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	// Key b is restored from a backup of key a, so both have the same
+	// key material
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	mustSucceed("keys/a", map[string]interface{}{
+		"exportable":             true,
+		"allow_plaintext_backup": true,
+	})
+	backup := mustSucceed("backup/a", nil).Data["backup"].(string)
+	mustSucceed("restore/b", map[string]interface{}{
+		"backup": backup,
+	})
+
+	// Without the commitment, key b decrypts a ciphertext of key a
+	resp := mustSucceed("encrypt/a", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	resp = mustSucceed("decrypt/b", map[string]interface{}{
+		"ciphertext": resp.Data["ciphertext"],
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// With it, only key a does
+	resp = mustSucceed("encrypt/a", map[string]interface{}{
+		"plaintext":              plaintext,
+		"include_key_commitment": true,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	resp = mustSucceed("decrypt/a", map[string]interface{}{
+		"ciphertext":             ciphertext,
+		"include_key_commitment": true,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %v", resp.Data["plaintext"])
+	}
+	mustFail("decrypt/b", map[string]interface{}{
+		"ciphertext":             ciphertext,
+		"include_key_commitment": true,
+	})
+	mustFail("decrypt/a", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+
+	// The commitment composes with caller-supplied associated data
+	associatedData := base64.StdEncoding.EncodeToString([]byte("record-42"))
+	resp = mustSucceed("encrypt/a", map[string]interface{}{
+		"plaintext":              plaintext,
+		"associated_data":        associatedData,
+		"include_key_commitment": true,
+	})
+	ciphertext = resp.Data["ciphertext"].(string)
+	mustSucceed("decrypt/a", map[string]interface{}{
+		"ciphertext":             ciphertext,
+		"associated_data":        associatedData,
+		"include_key_commitment": true,
+	})
+	mustFail("decrypt/b", map[string]interface{}{
+		"ciphertext":             ciphertext,
+		"associated_data":        associatedData,
+		"include_key_commitment": true,
+	})
+
+	// Non-AEAD keys cannot commit
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":              plaintext,
+		"include_key_commitment": true,
+	})
+}
+
+func TestTransit_EncryptPadPlaintext(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	plaintextOfLength := func(n int) string {
+		return base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", n)))
+	}
+
+	const padTo = 32
+	for _, keyType := range []string{"aes256-gcm96", "chacha20-poly1305"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		// The shortest and longest plaintexts allowed give ciphertexts of
+		// the same length, which decrypt to the unpadded plaintexts
+		var ciphertexts []string
+		for _, n := range []int{1, padTo - 1} {
+			resp := mustSucceed("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":        plaintextOfLength(n),
+				"pad_plaintext_to": padTo,
+			})
+			ciphertext := resp.Data["ciphertext"].(string)
+			if !strings.HasPrefix(ciphertext, "vault:v1:pkcs7:") {
+				t.Fatalf("%s: padding is not recorded: %q", keyType, ciphertext)
+			}
+			ciphertexts = append(ciphertexts, ciphertext)
+
+			resp = mustSucceed("decrypt/"+keyType, map[string]interface{}{
+				"ciphertext": ciphertext,
+			})
+			if resp.Data["plaintext"] != plaintextOfLength(n) {
+				t.Fatalf("%s: bad plaintext for length %d: %#v", keyType, n, resp.Data)
+			}
+		}
+		if len(ciphertexts[0]) != len(ciphertexts[1]) {
+			t.Fatalf("%s: ciphertext lengths %d and %d differ", keyType, len(ciphertexts[0]), len(ciphertexts[1]))
+		}
+
+		// The padding needs at least one byte
+		for _, n := range []int{padTo, padTo + 1} {
+			mustFail("encrypt/"+keyType, map[string]interface{}{
+				"plaintext":        plaintextOfLength(n),
+				"pad_plaintext_to": padTo,
+			})
+		}
+	}
+
+	// Empty plaintexts are padded too, and padding applies to every batch
+	// item
+	resp := mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": ""},
+			map[string]interface{}{"plaintext": plaintextOfLength(padTo - 1)},
+			map[string]interface{}{"plaintext": plaintextOfLength(padTo)},
+		},
+		"pad_plaintext_to": padTo,
+	})
+	batchResults := resp.Data["batch_results"].([]BatchResponseItem)
+	if len(batchResults[0].Ciphertext) != len(batchResults[1].Ciphertext) || batchResults[2].Error == "" {
+		t.Fatalf("bad batch results: %#v", batchResults)
+	}
+	resp = mustSucceed("decrypt/aes256-gcm96", map[string]interface{}{
+		"ciphertext": batchResults[0].Ciphertext,
+	})
+	if resp.Data["plaintext"] != "" {
+		t.Fatalf("bad plaintext: %#v", resp.Data)
+	}
+
+	for _, padTo := range []int{-1, keysutil.MaxPadPlaintextTo + 1} {
+		mustFail("encrypt/aes256-gcm96", map[string]interface{}{
+			"plaintext":        plaintextOfLength(1),
+			"pad_plaintext_to": padTo,
+		})
+	}
+
+	// At the largest length, both the longest and the empty plaintext round
+	// trip, the latter being padded by the full length
+	for _, length := range []int{keysutil.MaxPadPlaintextTo - 1, 0} {
+		resp = mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+			"plaintext":        plaintextOfLength(length),
+			"pad_plaintext_to": keysutil.MaxPadPlaintextTo,
+		})
+		resp = mustSucceed("decrypt/aes256-gcm96", map[string]interface{}{
+			"ciphertext": resp.Data["ciphertext"],
+		})
+		if resp.Data["plaintext"] != plaintextOfLength(length) {
+			t.Fatalf("plaintext of %d bytes did not round trip: %#v", length, resp.Data)
+		}
+	}
+	mustFail("encrypt/aes256-gcm96", map[string]interface{}{
+		"plaintext":               plaintextOfLength(1),
+		"pad_plaintext_to":        padTo,
+		"compress_before_encrypt": true,
+	})
+
+	// The label is authenticated, so it can neither be stripped nor added
+	resp = mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"plaintext":        plaintextOfLength(1),
+		"pad_plaintext_to": padTo,
+	})
+	mustFail("decrypt/aes256-gcm96", map[string]interface{}{
+		"ciphertext": strings.Replace(resp.Data["ciphertext"].(string), "vault:v1:pkcs7:", "vault:v1:", 1),
+	})
+	resp = mustSucceed("encrypt/aes256-gcm96", map[string]interface{}{
+		"plaintext": plaintextOfLength(1),
+	})
+	mustFail("decrypt/aes256-gcm96", map[string]interface{}{
+		"ciphertext": strings.Replace(resp.Data["ciphertext"].(string), "vault:v1:", "vault:v1:pkcs7:", 1),
+	})
+
+	// Only AEAD key types authenticate the label
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustFail("encrypt/rsa", map[string]interface{}{
+		"plaintext":        plaintextOfLength(1),
+		"pad_plaintext_to": padTo,
+	})
+}
+
+func TestTransit_EncryptChunkedCiphertext(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := base64.StdEncoding.EncodeToString([]byte("the quick brown fox jumps over the lazy dog"))
+	mustSucceed("keys/key", nil)
+	mustFail("encrypt/key", map[string]interface{}{
+		"plaintext":  plaintext,
+		"chunk_size": -1,
+	})
+
+	// Re-joining the chunks gives back the ciphertext
+	resp := mustSucceed("encrypt/key", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	for _, chunkSize := range []int{1, 7, len(ciphertext) - 1, len(ciphertext), len(ciphertext) + 1} {
+		chunks := chunkCiphertext(ciphertext, chunkSize)
+		if strings.Join(chunks, "") != ciphertext {
+			t.Fatalf("chunks of size %d do not join to the ciphertext: %v", chunkSize, chunks)
+		}
+		for i, chunk := range chunks {
+			if len(chunk) > chunkSize || (i < len(chunks)-1 && len(chunk) != chunkSize) {
+				t.Fatalf("bad chunk %d of size %d: %q", i, chunkSize, chunk)
+			}
+		}
+	}
+
+	const chunkSize = 16
+	resp = mustSucceed("encrypt/key", map[string]interface{}{
+		"plaintext":  plaintext,
+		"chunk_size": chunkSize,
+	})
+	if _, ok := resp.Data["ciphertext"]; ok {
+		t.Fatalf("chunked response has a flat ciphertext: %#v", resp.Data)
+	}
+	chunks := resp.Data["ciphertext_chunks"].([]string)
+	if len(chunks) < 2 || len(chunks[0]) != chunkSize || !strings.HasPrefix(chunks[0], "vault:v1:") {
+		t.Fatalf("bad chunks: %v", chunks)
+	}
+
+	// Decryption accepts the chunks or the joined ciphertext, but not both
+	for _, data := range []map[string]interface{}{
+		{"ciphertext_chunks": chunks},
+		{"ciphertext": strings.Join(chunks, "")},
+	} {
+		resp = mustSucceed("decrypt/key", data)
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bad plaintext: %#v", resp.Data)
+		}
+	}
+	mustFail("decrypt/key", map[string]interface{}{
+		"ciphertext":        ciphertext,
+		"ciphertext_chunks": chunks,
+	})
+	mustFail("decrypt/key", map[string]interface{}{
+		"ciphertext_chunks": chunks[1:],
+	})
+
+	// Batch items are chunked and decrypted the same way
+	resp = mustSucceed("encrypt/key", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext},
+			map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString([]byte("a"))},
+		},
+		"chunk_size": chunkSize,
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	resp = mustSucceed("decrypt/key", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext_chunks": results[0].CiphertextChunks},
+			map[string]interface{}{"ciphertext": strings.Join(results[1].CiphertextChunks, "")},
+			map[string]interface{}{"ciphertext": ciphertext, "ciphertext_chunks": results[1].CiphertextChunks},
+		},
+	})
+	decrypted := resp.Data["batch_results"].([]BatchResponseItem)
+	if decrypted[0].Plaintext != plaintext || decrypted[1].Plaintext != base64.StdEncoding.EncodeToString([]byte("a")) || decrypted[2].Error == "" {
+		t.Fatalf("bad batch results: %#v", decrypted)
+	}
+}
+
+func TestTransit_EncryptKeyFingerprint(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	fingerprint := func(material []byte) string {
+		sum := sha256.Sum256(append([]byte("vault-key-fingerprint\x00"), material...))
+		return hex.EncodeToString(sum[:8])
+	}
+
+	plaintext := base64.StdEncoding.EncodeToString([]byte("the quick brown fox"))
+	doReq("keys/aes", nil)
+	doReq("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	doReq("keys/aes/rotate", nil)
+
+	p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+		Storage: s,
+		Name:    "aes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int]string{
+		1: fingerprint(p.Keys["1"].Key),
+		2: fingerprint(p.Keys["2"].Key),
+	}
+	if expected[1] == expected[2] {
+		t.Fatal("expected versions to have distinct fingerprints")
+	}
+
+	// The fingerprint is only returned on request
+	resp := doReq("encrypt/aes", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	if _, ok := resp.Data["key_fingerprint"]; ok {
+		t.Fatalf("unexpected fingerprint: %#v", resp.Data)
+	}
+
+	for i := 0; i < 2; i++ {
+		resp = doReq("encrypt/aes", map[string]interface{}{
+			"plaintext":              plaintext,
+			"return_key_fingerprint": true,
+		})
+		if resp.Data["key_fingerprint"] != expected[2] {
+			t.Fatalf("expected fingerprint %s, got %v", expected[2], resp.Data["key_fingerprint"])
+		}
+		if strings.Contains(resp.Data["key_id"].(string), expected[2]) {
+			t.Fatalf("expected fingerprint to be distinct from key ID %v", resp.Data["key_id"])
+		}
+	}
+
+	resp = doReq("encrypt/aes", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"plaintext": plaintext, "key_version": 1},
+			map[string]interface{}{"plaintext": plaintext},
+		},
+		"return_key_fingerprint": true,
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].KeyFingerprint != expected[1] || results[1].KeyFingerprint != expected[2] {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+
+	// Asymmetric keys fingerprint their private material
+	p, _, err = b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+		Storage: s,
+		Name:    "rsa",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = doReq("encrypt/rsa", map[string]interface{}{
+		"plaintext":              plaintext,
+		"return_key_fingerprint": true,
+	})
+	if resp.Data["key_fingerprint"] != fingerprint(p.Keys["1"].RSAKey.D.Bytes()) {
+		t.Fatalf("bad RSA fingerprint %v", resp.Data["key_fingerprint"])
+	}
+}
+
+func TestTransit_EncryptPreview(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	// Previewing does not create the key
+	resp, err := doReq("encrypt/aes", map[string]interface{}{
+		"preview_only": true,
+	})
+	if err != logical.ErrInvalidRequest || resp == nil || !resp.IsError() {
+		t.Fatalf("expected missing key error, got err:%v resp:%#v", err, resp)
+	}
+	keys, err := s.List(context.Background(), "policy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+
+	mustSucceed("keys/aes", nil)
+	mustSucceed("keys/aes/rotate", nil)
+	mustSucceed("keys/aes/rotate", nil)
+	mustSucceed("keys/aes/config", map[string]interface{}{
+		"min_encryption_version": 2,
+		"rate_limit_per_second":  1,
+	})
+
+	p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+		Storage: s,
+		Name:    "aes",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Previews neither count against the rate limit nor persist anything
+	before, err := s.Get(context.Background(), "policy/aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		resp = mustSucceed("encrypt/aes", map[string]interface{}{
+			"preview_only": true,
+		})
+		if resp.Data["key_version"] != p.LatestVersion || p.LatestVersion != 3 {
+			t.Fatalf("expected version %d, got %v", p.LatestVersion, resp.Data["key_version"])
+		}
+		if resp.Data["algorithm"] != "aes256-gcm96" {
+			t.Fatalf("bad algorithm %v", resp.Data["algorithm"])
+		}
+		if _, ok := resp.Data["ciphertext"]; ok {
+			t.Fatalf("unexpected ciphertext: %#v", resp.Data)
+		}
+	}
+	after, err := s.Get(context.Background(), "policy/aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before.Value) != string(after.Value) {
+		t.Fatal("preview modified the stored key")
+	}
+
+	enc := mustSucceed("encrypt/aes", map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte("the quick brown fox")),
+	})
+	if enc.Data["key_version"] != resp.Data["key_version"] || enc.Data["key_id"] != resp.Data["key_id"] {
+		t.Fatalf("preview %#v does not match encryption %#v", resp.Data, enc.Data)
+	}
+
+	// Explicit versions are checked against the encryption bounds
+	resp = mustSucceed("encrypt/aes", map[string]interface{}{
+		"preview_only": true,
+		"key_version":  2,
+	})
+	keyID, err := p.KeyID(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Data["key_version"] != 2 || resp.Data["key_id"] != keyID {
+		t.Fatalf("bad preview of version 2: %#v", resp.Data)
+	}
+	for _, ver := range []int{1, 4, -1} {
+		resp, err = doReq("encrypt/aes", map[string]interface{}{
+			"preview_only": true,
+			"key_version":  ver,
+		})
+		if err != logical.ErrInvalidRequest || resp == nil || !resp.IsError() {
+			t.Fatalf("expected error previewing version %d, got err:%v resp:%#v", ver, err, resp)
+		}
+	}
+
+	// Request options are checked as they would be by an encryption
+	resp, err = doReq("encrypt/aes", map[string]interface{}{
+		"preview_only":      true,
+		"ciphertext_prefix": "unregistered:",
+	})
+	if err != logical.ErrInvalidRequest || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error previewing with an unregistered prefix, got err:%v resp:%#v", err, resp)
+	}
+}
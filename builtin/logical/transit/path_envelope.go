@@ -0,0 +1,291 @@
+package transit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// envelopeDEKBytes is the size of the data encryption keys generated for
+// envelope encryption, for AES-256-GCM
+const envelopeDEKBytes = 32
+
+func (b *backend) pathEnvelopeEncrypt() *framework.Path {
+	return &framework.Path{
+		Pattern: "envelope/" + framework.GenericNameRegex("name") + "/encrypt",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key that wraps the data key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"plaintext": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Base64 encoded plaintext value to be encrypted",
+			},
+
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Base64 encoded context for key derivation. Required if key derivation is enabled",
+			},
+
+			"key_version": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The version of the key to use for wrapping the
+data key. Must be 0 (for latest) or a value greater
+than or equal to the min_encryption_version configured
+on the key.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathEnvelopeEncryptWrite,
+		},
+
+		HelpSynopsis:    pathEnvelopeEncryptHelpSyn,
+		HelpDescription: pathEnvelopeEncryptHelpDesc,
+	}
+}
+
+func (b *backend) pathEnvelopeDecrypt() *framework.Path {
+	return &framework.Path{
+		Pattern: "envelope/" + framework.GenericNameRegex("name") + "/decrypt",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key that wrapped the data key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"wrapped_dek": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The wrapped data key returned by envelope encryption",
+			},
+
+			"ciphertext": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The ciphertext returned by envelope encryption",
+			},
+
+			"context": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Base64 encoded context for key derivation. Required if key derivation is enabled",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathEnvelopeDecryptWrite,
+		},
+
+		HelpSynopsis:    pathEnvelopeDecryptHelpSyn,
+		HelpDescription: pathEnvelopeDecryptHelpDesc,
+	}
+}
+
+func (b *backend) pathEnvelopeEncryptWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	ver := d.Get("key_version").(int)
+
+	plaintext, err := base64.StdEncoding.DecodeString(d.Get("plaintext").(string))
+	if err != nil {
+		return logical.ErrorResponse("failed to base64-decode plaintext"), logical.ErrInvalidRequest
+	}
+	context, err := base64.StdEncoding.DecodeString(d.Get("context").(string))
+	if err != nil {
+		return logical.ErrorResponse("failed to base64-decode context"), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if resp, err := b.authorizeEncryptNamespace(ctx, p); resp != nil || err != nil {
+		return resp, err
+	}
+
+	opts := &keysutil.CipherOptions{}
+	if resp, err := b.bindRequestClaims(p, req, opts); resp != nil || err != nil {
+		return resp, err
+	}
+
+	dek := make([]byte, envelopeDEKBytes)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+
+	encodedDEK := base64.StdEncoding.EncodeToString(dek)
+	if p.HMACBeforeEncrypt != "" {
+		encodedDEK, err = b.framePolicyPlaintext(ctx, req, p, encodedDEK)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	wrappedDEK, err := p.EncryptWithOptions(ver, context, nil, encodedDEK, opts)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+	if wrappedDEK == "" {
+		return nil, fmt.Errorf("empty ciphertext returned")
+	}
+
+	ciphertext, err := aesGCMSeal(dek, plaintext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"wrapped_dek": wrappedDEK,
+			"ciphertext":  base64.StdEncoding.EncodeToString(ciphertext),
+		},
+	}, nil
+}
+
+func (b *backend) pathEnvelopeDecryptWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	wrappedDEK := d.Get("wrapped_dek").(string)
+	if wrappedDEK == "" {
+		return logical.ErrorResponse("missing wrapped_dek"), logical.ErrInvalidRequest
+	}
+	ciphertextRaw := d.Get("ciphertext").(string)
+	if ciphertextRaw == "" {
+		return logical.ErrorResponse("missing ciphertext"), logical.ErrInvalidRequest
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(ciphertextRaw)
+	if err != nil {
+		return logical.ErrorResponse("failed to base64-decode ciphertext"), logical.ErrInvalidRequest
+	}
+	context, err := base64.StdEncoding.DecodeString(d.Get("context").(string))
+	if err != nil {
+		return logical.ErrorResponse("failed to base64-decode context"), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
+	if resp, err := b.authorizeDecryptNamespace(ctx, p); resp != nil || err != nil {
+		return resp, err
+	}
+
+	opts := &keysutil.CipherOptions{}
+	if resp, err := b.bindRequestClaims(p, req, opts); resp != nil || err != nil {
+		return resp, err
+	}
+
+	dekRaw, err := p.DecryptWithOptions(context, nil, decodeHexCiphertext(stripCiphertextPrefix(p, wrappedDEK)), opts)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+	if p.HMACBeforeEncrypt != "" {
+		dekRaw, err = b.unframePlaintext(ctx, req, p, dekRaw)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+	dek, err := base64.StdEncoding.DecodeString(dekRaw)
+	if err != nil {
+		return nil, err
+	}
+	if len(dek) != envelopeDEKBytes {
+		return logical.ErrorResponse("wrapped_dek does not hold an envelope data key"), logical.ErrInvalidRequest
+	}
+
+	plaintext, err := aesGCMOpen(dek, ciphertext, nil)
+	if err != nil {
+		return logical.ErrorResponse("failed to decrypt the ciphertext with the data key"), logical.ErrInvalidRequest
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		},
+	}, nil
+}
+
+const pathEnvelopeEncryptHelpSyn = `Encrypt a plaintext value under a new data key wrapped by a named key`
+
+const pathEnvelopeEncryptHelpDesc = `
+This path generates a 256-bit data key, encrypts the plaintext with it using
+AES-256-GCM and encrypts the data key with the named key, in a single call.
+It returns the wrapped data key as wrapped_dek and the encrypted plaintext as
+ciphertext; neither the data key nor the plaintext is stored. The wrapped
+data key is an ordinary ciphertext of the named key, so it can be rewrapped
+after the key is rotated without touching the data.
+`
+
+const pathEnvelopeDecryptHelpSyn = `Decrypt a value encrypted by envelope encryption`
+
+const pathEnvelopeDecryptHelpDesc = `
+This path decrypts the wrapped_dek returned by envelope encryption with the
+named key and uses the data key to decrypt the ciphertext, returning the
+base64 encoded plaintext.
+`
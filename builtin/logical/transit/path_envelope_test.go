@@ -0,0 +1,128 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_Envelope(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	plaintext := base64.StdEncoding.EncodeToString([]byte("the quick brown fox"))
+	keyContext := base64.StdEncoding.EncodeToString([]byte("context"))
+
+	mustSucceed("keys/aes", nil)
+	mustSucceed("keys/derived", map[string]interface{}{
+		"derived": true,
+	})
+	mustSucceed("keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+
+	for _, name := range []string{"aes", "derived", "rsa"} {
+		resp := mustSucceed("envelope/"+name+"/encrypt", map[string]interface{}{
+			"plaintext": plaintext,
+			"context":   keyContext,
+		})
+		wrappedDEK := resp.Data["wrapped_dek"].(string)
+		ciphertext := resp.Data["ciphertext"].(string)
+
+		resp = mustSucceed("envelope/"+name+"/decrypt", map[string]interface{}{
+			"wrapped_dek": wrappedDEK,
+			"ciphertext":  ciphertext,
+			"context":     keyContext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("%s: bad plaintext: %v", name, resp.Data["plaintext"])
+		}
+
+		// The wrapped data key is an ordinary ciphertext of the key
+		resp = mustSucceed("decrypt/"+name, map[string]interface{}{
+			"ciphertext": wrappedDEK,
+			"context":    keyContext,
+		})
+		dek, err := base64.StdEncoding.DecodeString(resp.Data["plaintext"].(string))
+		if err != nil || len(dek) != envelopeDEKBytes {
+			t.Fatalf("%s: bad data key: %v", name, err)
+		}
+
+		// Tampered ciphertexts fail to decrypt
+		raw, err := base64.StdEncoding.DecodeString(ciphertext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw[len(raw)-1] ^= 1
+		mustFail("envelope/"+name+"/decrypt", map[string]interface{}{
+			"wrapped_dek": wrappedDEK,
+			"ciphertext":  base64.StdEncoding.EncodeToString(raw),
+			"context":     keyContext,
+		})
+	}
+
+	// Each encryption uses a fresh data key
+	first := mustSucceed("envelope/aes/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	second := mustSucceed("envelope/aes/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	if first.Data["wrapped_dek"] == second.Data["wrapped_dek"] || first.Data["ciphertext"] == second.Data["ciphertext"] {
+		t.Fatal("expected distinct data keys and ciphertexts")
+	}
+
+	// A data key from one encryption cannot open another's ciphertext
+	mustFail("envelope/aes/decrypt", map[string]interface{}{
+		"wrapped_dek": first.Data["wrapped_dek"],
+		"ciphertext":  second.Data["ciphertext"],
+	})
+
+	// The data key survives rotation and rewrapping
+	mustSucceed("keys/aes/rotate", nil)
+	resp := mustSucceed("rewrap/aes", map[string]interface{}{
+		"ciphertext": first.Data["wrapped_dek"],
+	})
+	resp = mustSucceed("envelope/aes/decrypt", map[string]interface{}{
+		"wrapped_dek": resp.Data["ciphertext"],
+		"ciphertext":  first.Data["ciphertext"],
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext after rewrap: %v", resp.Data["plaintext"])
+	}
+
+	mustFail("envelope/aes/decrypt", map[string]interface{}{
+		"ciphertext": first.Data["ciphertext"],
+	})
+	mustFail("envelope/aes/decrypt", map[string]interface{}{
+		"wrapped_dek": first.Data["wrapped_dek"],
+	})
+	mustFail("envelope/missing/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+}
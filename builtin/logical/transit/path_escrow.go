@@ -0,0 +1,496 @@
+package transit
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const escrowPrefix = "escrow/"
+
+// escrowKDFInfo prefixes the HKDF info used to derive the wrapping key from
+// an X25519 agreement with an escrow key
+const escrowKDFInfo = "vault-transit-escrow"
+
+// escrowEntry is the escrowed copy of one version of a key. The material is
+// sealed with AES-GCM under a random key that is either encrypted with an RSA
+// escrow key or derived from an agreement with an X25519 escrow key.
+type escrowEntry struct {
+	KeyType            string    `json:"key_type"`
+	EscrowKeyName      string    `json:"escrow_key_name"`
+	EscrowKeyVersion   int       `json:"escrow_key_version"`
+	WrappedKey         string    `json:"wrapped_key,omitempty"`
+	EphemeralPublicKey []byte    `json:"ephemeral_public_key,omitempty"`
+	Ciphertext         []byte    `json:"ciphertext"`
+	CreationTime       time.Time `json:"creation_time"`
+}
+
+// escrowMaterial is the sealed content of an escrow entry, in the same
+// encodings as the export endpoint
+type escrowMaterial struct {
+	Key     string `json:"key"`
+	HMACKey string `json:"hmac_key,omitempty"`
+}
+
+func (b *backend) pathEscrow() *framework.Path {
+	return &framework.Path{
+		Pattern: "escrow/" + framework.GenericNameRegex("name") + "/" + framework.GenericNameRegex("version"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the escrowed key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"version": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Version of the escrowed key",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation:   b.pathEscrowRead,
+			logical.UpdateOperation: b.pathEscrowDecrypt,
+		},
+
+		HelpSynopsis:    pathEscrowHelpSyn,
+		HelpDescription: pathEscrowHelpDesc,
+	}
+}
+
+// validateEscrowKey checks that the named key can escrow the given policy
+func (b *backend) validateEscrowKey(ctx context.Context, s logical.Storage, p *keysutil.Policy, name string) error {
+	if name == p.Name {
+		return errutil.UserError{Err: "a key cannot be its own escrow key"}
+	}
+
+	escrowPolicy, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: s,
+		Name:    name,
+	})
+	if err != nil {
+		return err
+	}
+	if escrowPolicy == nil {
+		return errutil.UserError{Err: fmt.Sprintf("escrow key %q not found", name)}
+	}
+	if b.System().CachingDisabled() {
+		defer escrowPolicy.Unlock()
+	}
+
+	switch escrowPolicy.Type {
+	case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096, keysutil.KeyType_X25519:
+	default:
+		return errutil.UserError{Err: fmt.Sprintf("escrow key must be an RSA or x25519 key, not %v", escrowPolicy.Type)}
+	}
+
+	// Escrow keys are not escrowed themselves, which also keeps a rotation
+	// from having to lock more than one other key
+	if escrowPolicy.EscrowKeyName != "" {
+		return errutil.UserError{Err: "the escrow key has an escrow key of its own"}
+	}
+
+	return nil
+}
+
+// escrowKeyVersion seals the material of the given version of the policy
+// under its escrow key and stores it at escrow/<name>/<version>. It is a
+// no-op if the policy has no escrow key. The caller must hold the policy's
+// lock.
+func (b *backend) escrowKeyVersion(ctx context.Context, s logical.Storage, p *keysutil.Policy, ver int) error {
+	if p.EscrowKeyName == "" {
+		return nil
+	}
+	if p.EscrowKeyName == p.Name {
+		return errutil.UserError{Err: "a key cannot be its own escrow key"}
+	}
+
+	key, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return fmt.Errorf("version %d of the key is not available for escrow", ver)
+	}
+	material, err := escrowKeyMaterial(p.Type, &key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(material)
+	if err != nil {
+		return err
+	}
+
+	escrowPolicy, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: s,
+		Name:    p.EscrowKeyName,
+	})
+	if err != nil {
+		return err
+	}
+	if escrowPolicy == nil {
+		return fmt.Errorf("escrow key %q not found", p.EscrowKeyName)
+	}
+	if !b.System().CachingDisabled() {
+		escrowPolicy.Lock(false)
+	}
+	defer escrowPolicy.Unlock()
+
+	entry := &escrowEntry{
+		KeyType:          p.Type.String(),
+		EscrowKeyName:    escrowPolicy.Name,
+		EscrowKeyVersion: escrowPolicy.LatestVersion,
+		CreationTime:     time.Now().UTC(),
+	}
+
+	var sealKey []byte
+	switch escrowPolicy.Type {
+	case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+		sealKey = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, sealKey); err != nil {
+			return err
+		}
+		entry.WrappedKey, err = escrowPolicy.EncryptWithOptions(entry.EscrowKeyVersion, nil, nil, base64.StdEncoding.EncodeToString(sealKey), nil)
+		if err != nil {
+			return err
+		}
+
+	case keysutil.KeyType_X25519:
+		escrowKey := escrowPolicy.Keys[strconv.Itoa(entry.EscrowKeyVersion)]
+		escrowPublicKey, err := base64.StdEncoding.DecodeString(escrowKey.FormattedPublicKey)
+		if err != nil {
+			return err
+		}
+
+		var ephemeral, ephemeralPublic [32]byte
+		if _, err := io.ReadFull(rand.Reader, ephemeral[:]); err != nil {
+			return err
+		}
+		curve25519.ScalarBaseMult(&ephemeralPublic, &ephemeral)
+		entry.EphemeralPublicKey = ephemeralPublic[:]
+
+		sealKey, err = escrowAgreementKey(ephemeral[:], escrowPublicKey, entry.EphemeralPublicKey, escrowPublicKey)
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("escrow key type %v is not supported", escrowPolicy.Type)
+	}
+
+	entry.Ciphertext, err = aesGCMSeal(sealKey, plaintext, escrowAAD(p.Name, ver))
+	if err != nil {
+		return err
+	}
+
+	storageEntry, err := logical.StorageEntryJSON(escrowPath(p.Name, ver), entry)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, storageEntry)
+}
+
+// escrowAllVersions escrows every version of the policy that is still held
+// in memory. It is used when an escrow key is first configured so that
+// versions created before it are recoverable too.
+func (b *backend) escrowAllVersions(ctx context.Context, s logical.Storage, p *keysutil.Policy) error {
+	for k := range p.Keys {
+		ver, err := strconv.Atoi(k)
+		if err != nil {
+			return err
+		}
+		if err := b.escrowKeyVersion(ctx, s, p, ver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backend) pathEscrowRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, ver, err := escrowPathParams(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	entry, err := getEscrowEntry(ctx, req.Storage, name, ver)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":               name,
+			"version":            ver,
+			"type":               entry.KeyType,
+			"escrow_key_name":    entry.EscrowKeyName,
+			"escrow_key_version": entry.EscrowKeyVersion,
+			"ciphertext":         base64.StdEncoding.EncodeToString(entry.Ciphertext),
+			"creation_time":      entry.CreationTime,
+		},
+	}
+	if entry.WrappedKey != "" {
+		resp.Data["wrapped_key"] = entry.WrappedKey
+	}
+	if len(entry.EphemeralPublicKey) != 0 {
+		resp.Data["ephemeral_public_key"] = base64.StdEncoding.EncodeToString(entry.EphemeralPublicKey)
+	}
+	return resp, nil
+}
+
+func (b *backend) pathEscrowDecrypt(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, ver, err := escrowPathParams(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	entry, err := getEscrowEntry(ctx, req.Storage, name, ver)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return logical.ErrorResponse("escrowed key version not found"), logical.ErrInvalidRequest
+	}
+
+	escrowPolicy, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    entry.EscrowKeyName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if escrowPolicy == nil {
+		return logical.ErrorResponse(fmt.Sprintf("escrow key %q not found", entry.EscrowKeyName)), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		escrowPolicy.Lock(false)
+	}
+	defer escrowPolicy.Unlock()
+
+	material, err := openEscrowEntry(escrowPolicy, entry, name, ver)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"name":    name,
+			"version": ver,
+			"type":    entry.KeyType,
+			"key":     material.Key,
+		},
+	}
+	if material.HMACKey != "" {
+		resp.Data["hmac_key"] = material.HMACKey
+	}
+	return resp, nil
+}
+
+// openEscrowEntry recovers the material of an escrow entry with the escrow
+// key. The caller must hold the escrow policy's lock.
+func openEscrowEntry(escrowPolicy *keysutil.Policy, entry *escrowEntry, name string, ver int) (*escrowMaterial, error) {
+	if entry.EscrowKeyVersion < escrowPolicy.MinDecryptionVersion {
+		return nil, errutil.UserError{Err: "escrow key version is below the escrow key's minimum decryption version"}
+	}
+
+	var sealKey []byte
+	switch escrowPolicy.Type {
+	case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+		encoded, err := escrowPolicy.DecryptWithOptions(nil, nil, entry.WrappedKey, nil)
+		if err != nil {
+			return nil, err
+		}
+		sealKey, err = base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+	case keysutil.KeyType_X25519:
+		escrowKey, ok := escrowPolicy.Keys[strconv.Itoa(entry.EscrowKeyVersion)]
+		if !ok {
+			return nil, errutil.UserError{Err: "escrow key version is not available"}
+		}
+		escrowPublicKey, err := base64.StdEncoding.DecodeString(escrowKey.FormattedPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		sealKey, err = escrowAgreementKey(escrowKey.Key, entry.EphemeralPublicKey, entry.EphemeralPublicKey, escrowPublicKey)
+		if err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errutil.UserError{Err: fmt.Sprintf("escrow key type %v is not supported", escrowPolicy.Type)}
+	}
+
+	plaintext, err := aesGCMOpen(sealKey, entry.Ciphertext, escrowAAD(name, ver))
+	if err != nil {
+		return nil, errutil.UserError{Err: "failed to decrypt the escrowed key material"}
+	}
+
+	var material escrowMaterial
+	if err := json.Unmarshal(plaintext, &material); err != nil {
+		return nil, err
+	}
+	return &material, nil
+}
+
+// escrowKeyMaterial encodes a key version's material as the export endpoint
+// would
+func escrowKeyMaterial(keyType keysutil.KeyType, key *keysutil.KeyEntry) (*escrowMaterial, error) {
+	material := &escrowMaterial{}
+	if len(key.HMACKey) != 0 {
+		material.HMACKey = base64.StdEncoding.EncodeToString(key.HMACKey)
+	}
+
+	switch keyType {
+	case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305, keysutil.KeyType_ED25519, keysutil.KeyType_X25519:
+		material.Key = base64.StdEncoding.EncodeToString(key.Key)
+
+	case keysutil.KeyType_ECDSA_P256:
+		ecKey, err := keyEntryToECPrivateKey(key, elliptic.P256())
+		if err != nil {
+			return nil, err
+		}
+		material.Key = ecKey
+
+	case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+		material.Key = encodeRSAPrivateKey(key.RSAKey)
+
+	default:
+		return nil, fmt.Errorf("unknown key type %v", keyType)
+	}
+
+	return material, nil
+}
+
+// escrowAgreementKey derives the sealing key of an X25519 escrow entry from
+// the agreement between a private key and a public key, binding both the
+// ephemeral and the escrow public keys
+func escrowAgreementKey(private, peerPublic, ephemeralPublic, escrowPublic []byte) ([]byte, error) {
+	if len(private) != 32 || len(peerPublic) != 32 {
+		return nil, errors.New("invalid x25519 key length")
+	}
+
+	var pri, peer, shared, zero [32]byte
+	copy(pri[:], private)
+	copy(peer[:], peerPublic)
+	curve25519.ScalarMult(&shared, &pri, &peer)
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errors.New("x25519 agreement produced a low-order point")
+	}
+
+	info := append([]byte(escrowKDFInfo), ephemeralPublic...)
+	info = append(info, escrowPublic...)
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// escrowAAD binds an escrow entry to the key name and version it was made
+// for, so that entries cannot be swapped between paths
+func escrowAAD(name string, ver int) []byte {
+	return []byte(name + "/" + strconv.Itoa(ver))
+}
+
+func aesGCMSeal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := aesGCMCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func aesGCMOpen(key, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := aesGCMCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("escrow ciphertext too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], aad)
+}
+
+func aesGCMCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func escrowPath(name string, ver int) string {
+	return escrowPrefix + name + "/" + strconv.Itoa(ver)
+}
+
+func escrowPathParams(d *framework.FieldData) (string, int, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return "", 0, err
+	}
+	ver, err := strconv.Atoi(strings.TrimPrefix(d.Get("version").(string), "v"))
+	if err != nil || ver < 1 {
+		return "", 0, errors.New("invalid key version")
+	}
+	return name, ver, nil
+}
+
+func getEscrowEntry(ctx context.Context, s logical.Storage, name string, ver int) (*escrowEntry, error) {
+	raw, err := s.Get(ctx, escrowPath(name, ver))
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	var entry escrowEntry
+	if err := raw.DecodeJSON(&entry); err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+const pathEscrowHelpSyn = `Read or recover an escrowed version of a key`
+
+const pathEscrowHelpDesc = `
+When a key has an escrow_key_name, each of its versions is encrypted under
+the escrow key when it is created, and the result is stored separately from
+the key. Reading this path returns the escrowed ciphertext of a version for
+recovery outside of Vault. Writing to it decrypts the escrowed material with
+the escrow key and returns it in the encoding of the export endpoint. The
+material is returned whether or not the key is exportable and even if the
+key has been deleted, so access to this path should be granted only to the
+escrow holder.
+`
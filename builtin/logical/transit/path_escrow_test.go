@@ -0,0 +1,277 @@
+package transit
+
+import (
+	"context"
+	"crypto/elliptic"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_KeyEscrow(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	keyEntry := func(name string, ver int) keysutil.KeyEntry {
+		t.Helper()
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: s,
+			Name:    name,
+		})
+		if err != nil || p == nil {
+			t.Fatalf("failed to load key %s: %v", name, err)
+		}
+		return p.Keys[strconv.Itoa(ver)]
+	}
+
+	for _, escrowType := range []string{"rsa-2048", "x25519"} {
+		t.Run(escrowType, func(t *testing.T) {
+			escrowName := "escrow-" + escrowType
+			name := "key-" + escrowType
+			mustSucceed(logical.UpdateOperation, "keys/"+escrowName, map[string]interface{}{
+				"type": escrowType,
+			})
+			mustSucceed(logical.UpdateOperation, "keys/"+name, nil)
+
+			// Versions are not escrowed until the key is configured
+			mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+			if resp := mustSucceed(logical.ReadOperation, "escrow/"+name+"/2", nil); resp != nil {
+				t.Fatalf("unexpected escrow entry: %#v", resp.Data)
+			}
+
+			mustSucceed(logical.UpdateOperation, "keys/"+name+"/config", map[string]interface{}{
+				"escrow_key_name": escrowName,
+			})
+			resp := mustSucceed(logical.ReadOperation, "keys/"+name, nil)
+			if resp.Data["escrow_key_name"] != escrowName {
+				t.Fatalf("bad escrow key name: %#v", resp.Data)
+			}
+
+			// Configuring the escrow key escrows the existing versions and
+			// every rotation escrows the new one
+			mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+			for ver := 1; ver <= 3; ver++ {
+				path := "escrow/" + name + "/" + strconv.Itoa(ver)
+				raw, err := s.Get(context.Background(), escrowPrefix+name+"/"+strconv.Itoa(ver))
+				if err != nil || raw == nil {
+					t.Fatalf("missing escrow entry for version %d: %v", ver, err)
+				}
+
+				resp = mustSucceed(logical.ReadOperation, path, nil)
+				if resp.Data["escrow_key_name"] != escrowName || resp.Data["escrow_key_version"] != 1 || resp.Data["ciphertext"] == "" {
+					t.Fatalf("bad escrow entry: %#v", resp.Data)
+				}
+
+				key := keyEntry(name, ver)
+				resp = mustSucceed(logical.UpdateOperation, path, nil)
+				if resp.Data["key"] != base64.StdEncoding.EncodeToString(key.Key) ||
+					resp.Data["hmac_key"] != base64.StdEncoding.EncodeToString(key.HMACKey) {
+					t.Fatalf("escrowed material of version %d does not match the key", ver)
+				}
+			}
+
+			// Entries are bound to their path
+			raw, err := s.Get(context.Background(), escrowPrefix+name+"/1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			raw.Key = escrowPrefix + name + "/2"
+			if err := s.Put(context.Background(), raw); err != nil {
+				t.Fatal(err)
+			}
+			mustFail(logical.UpdateOperation, "escrow/"+name+"/2", nil)
+
+			// Entries made before the escrow key rotates are still
+			// recoverable afterwards
+			mustSucceed(logical.UpdateOperation, "keys/"+escrowName+"/rotate", nil)
+			mustSucceed(logical.UpdateOperation, "keys/"+name+"/rotate", nil)
+			resp = mustSucceed(logical.ReadOperation, "escrow/"+name+"/4", nil)
+			if resp.Data["escrow_key_version"] != 2 {
+				t.Fatalf("bad escrow key version: %#v", resp.Data)
+			}
+			mustSucceed(logical.UpdateOperation, "escrow/"+name+"/1", nil)
+			mustSucceed(logical.UpdateOperation, "escrow/"+name+"/4", nil)
+		})
+	}
+
+	// Escrow keys must exist, be RSA or X25519 keys other than the key and
+	// not have an escrow key of their own
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustSucceed(logical.UpdateOperation, "keys/ecdsa", map[string]interface{}{
+		"type": "ecdsa-p256",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/rsa/config", map[string]interface{}{
+		"escrow_key_name": "escrow-x25519",
+	})
+	for _, escrowName := range []string{"missing", "ecdsa", "key-rsa-2048", "aes", "rsa"} {
+		mustFail(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+			"escrow_key_name": escrowName,
+		})
+	}
+	if _, ok := mustSucceed(logical.ReadOperation, "keys/aes", nil).Data["escrow_key_name"]; ok {
+		t.Fatal("escrow key name was set by a failed update")
+	}
+
+	// Signing keys are escrowed in their export encoding
+	mustSucceed(logical.UpdateOperation, "keys/ecdsa/config", map[string]interface{}{
+		"escrow_key_name": "escrow-x25519",
+	})
+	key := keyEntry("ecdsa", 1)
+	pem, err := keyEntryToECPrivateKey(&key, elliptic.P256())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := mustSucceed(logical.UpdateOperation, "escrow/ecdsa/1", nil)
+	if resp.Data["key"] != pem || resp.Data["type"] != "ecdsa-p256" {
+		t.Fatalf("bad escrowed signing key: %#v", resp.Data)
+	}
+
+	// Clearing the escrow key stops new versions from being escrowed
+	mustSucceed(logical.UpdateOperation, "keys/ecdsa/config", map[string]interface{}{
+		"escrow_key_name": "",
+	})
+	mustSucceed(logical.UpdateOperation, "keys/ecdsa/rotate", nil)
+	if resp := mustSucceed(logical.ReadOperation, "escrow/ecdsa/2", nil); resp != nil {
+		t.Fatalf("unexpected escrow entry: %#v", resp.Data)
+	}
+
+	// A key whose new version cannot be escrowed is not rotated
+	mustSucceed(logical.UpdateOperation, "keys/escrow-rsa-2048/config", map[string]interface{}{
+		"deletion_allowed": true,
+	})
+	mustSucceed(logical.DeleteOperation, "keys/escrow-rsa-2048", map[string]interface{}{
+		"permanent": true,
+	})
+	mustFail(logical.UpdateOperation, "keys/key-rsa-2048/rotate", nil)
+	resp = mustSucceed(logical.ReadOperation, "keys/key-rsa-2048", nil)
+	if resp.Data["latest_version"] != 4 {
+		t.Fatalf("expected latest version 4, got %v", resp.Data["latest_version"])
+	}
+}
+
+func TestTransit_KeyEscrowSelf(t *testing.T) {
+	sysView := logical.TestSystemView()
+	sysView.CachingDisabledVal = true
+	s := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: s,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		t.Helper()
+		type result struct {
+			resp *logical.Response
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   s,
+				Operation: op,
+				Path:      path,
+				Data:      data,
+			})
+			done <- result{resp, err}
+		}()
+		select {
+		case r := <-done:
+			return r.resp, r.err
+		case <-time.After(10 * time.Second):
+			t.Fatalf("path:%s timed out", path)
+			return nil, nil
+		}
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	resp, err := doReq(logical.UpdateOperation, "keys/rsa/config", map[string]interface{}{
+		"escrow_key_name": "rsa",
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected a key to be rejected as its own escrow key")
+	}
+
+	// A key restored under the name of its escrow key is rejected
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"escrow_key_name":        "rsa",
+		"allow_plaintext_backup": true,
+		"exportable":             true,
+	})
+	backup := mustSucceed(logical.ReadOperation, "backup/aes", nil).Data["backup"]
+	resp, err = doReq(logical.UpdateOperation, "restore/rsa", map[string]interface{}{
+		"backup": backup,
+		"force":  true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "own escrow key") {
+		t.Fatalf("expected restore to be rejected, got err:%v resp:%#v", err, resp)
+	}
+
+	// A key that escrows itself in storage is reported by rotate-check and
+	// fails to rotate, rather than locking itself twice
+	p, err := keysutil.LoadPolicy(context.Background(), s, "policy/rsa")
+	if err != nil || p == nil {
+		t.Fatalf("failed to load policy: %v", err)
+	}
+	p.EscrowKeyName = "rsa"
+	if err := p.Persist(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	resp = mustSucceed(logical.UpdateOperation, "keys/rsa/rotate-check", nil)
+	issues, _ := resp.Data["issues"].([]string)
+	if resp.Data["ok"] != false || len(issues) != 1 || !strings.Contains(issues[0], "own escrow key") {
+		t.Fatalf("expected a self escrow issue, got %#v", resp.Data)
+	}
+	resp, err = doReq(logical.UpdateOperation, "keys/rsa/rotate", nil)
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected rotation of a self escrowed key to fail")
+	}
+	resp = mustSucceed(logical.ReadOperation, "keys/rsa", nil)
+	if resp.Data["latest_version"] != 1 {
+		t.Fatalf("expected latest version 1, got %v", resp.Data["latest_version"])
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -24,6 +25,11 @@ const (
 	exportTypeHMACKey       = "hmac-key"
 )
 
+const (
+	exportFormatPKCS12 = "pkcs12"
+	exportFormatJWKS   = "jwks"
+)
+
 func (b *backend) pathExportKeys() *framework.Path {
 	return &framework.Path{
 		Pattern: "export/" + framework.GenericNameRegex("type") + "/" + framework.GenericNameRegex("name") + framework.OptionalParamRegex("version"),
@@ -36,10 +42,27 @@ func (b *backend) pathExportKeys() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the key",
 			},
+
+			"key_namespace": keyNamespaceSchema,
 			"version": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Version of the key",
 			},
+			"output_format": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Format of the export. If empty, each version is returned
+individually. "pkcs12" returns a password-protected PKCS#12 archive of an
+aes256-gcm96 or chacha20-poly1305 key and "jwks" returns a JWK Set of an
+ecdsa-p256, ed25519 or rsa key.`,
+			},
+			"pkcs12_password": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Password protecting the PKCS#12 archive. Required for the pkcs12 format.",
+			},
+			"include_private": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "Whether the JWK Set includes the private keys rather than only the public keys.",
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -53,8 +76,12 @@ func (b *backend) pathExportKeys() *framework.Path {
 
 func (b *backend) pathPolicyExportRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	exportType := d.Get("type").(string)
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	version := d.Get("version").(string)
+	outputFormat := d.Get("output_format").(string)
 
 	switch exportType {
 	case exportTypeEncryptionKey:
@@ -64,6 +91,16 @@ func (b *backend) pathPolicyExportRead(ctx context.Context, req *logical.Request
 		return logical.ErrorResponse(fmt.Sprintf("invalid export type: %s", exportType)), logical.ErrInvalidRequest
 	}
 
+	switch outputFormat {
+	case "":
+	case exportFormatPKCS12, exportFormatJWKS:
+		if exportType == exportTypeHMACKey {
+			return logical.ErrorResponse(fmt.Sprintf("output format %s is not supported for HMAC keys", outputFormat)), logical.ErrInvalidRequest
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid output format: %s", outputFormat)), logical.ErrInvalidRequest
+	}
+
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
 		Storage: req.Storage,
 		Name:    name,
@@ -79,6 +116,10 @@ func (b *backend) pathPolicyExportRead(ctx context.Context, req *logical.Request
 	}
 	defer p.Unlock()
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		return resp, err
+	}
+
 	if !p.Exportable {
 		return logical.ErrorResponse("key is not exportable"), nil
 	}
@@ -94,16 +135,25 @@ func (b *backend) pathPolicyExportRead(ctx context.Context, req *logical.Request
 		}
 	}
 
-	retKeys := map[string]string{}
+	if p.ExportableAfterRotation && p.LatestVersion <= 1 {
+		return logical.ErrorResponse("key must be rotated before it can be exported"), logical.ErrInvalidRequest
+	}
+
+	var versions []int
 	switch version {
 	case "":
-		for k, v := range p.Keys {
-			exportKey, err := getExportKey(p, &v, exportType)
+		for k := range p.Keys {
+			ver, err := strconv.Atoi(k)
 			if err != nil {
 				return nil, err
 			}
-			retKeys[k] = exportKey
+			// The latest version is left out rather than failing the export
+			if p.ExportableAfterRotation && ver == p.LatestVersion {
+				continue
+			}
+			versions = append(versions, ver)
 		}
+		sort.Ints(versions)
 
 	default:
 		var versionValue int
@@ -120,17 +170,51 @@ func (b *backend) pathPolicyExportRead(ctx context.Context, req *logical.Request
 		if versionValue < p.MinDecryptionVersion {
 			return logical.ErrorResponse("version for export is below minimum decryption version"), logical.ErrInvalidRequest
 		}
-		key, ok := p.Keys[strconv.Itoa(versionValue)]
-		if !ok {
+		if p.ExportableAfterRotation && versionValue == p.LatestVersion {
+			return logical.ErrorResponse("the latest version of the key cannot be exported"), logical.ErrInvalidRequest
+		}
+		if _, ok := p.Keys[strconv.Itoa(versionValue)]; !ok {
 			return logical.ErrorResponse("version does not exist or cannot be found"), logical.ErrInvalidRequest
 		}
+		versions = []int{versionValue}
+	}
 
+	switch outputFormat {
+	case exportFormatPKCS12:
+		archive, err := p.PKCS12(versions, d.Get("pkcs12_password").(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"name":   p.Name,
+				"type":   p.Type.String(),
+				"pkcs12": base64.StdEncoding.EncodeToString(archive),
+			},
+		}, nil
+
+	case exportFormatJWKS:
+		jwks, err := p.JWKS(versions, d.Get("include_private").(bool))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"name": p.Name,
+				"type": p.Type.String(),
+				"jwks": jwks,
+			},
+		}, nil
+	}
+
+	retKeys := map[string]string{}
+	for _, ver := range versions {
+		key := p.Keys[strconv.Itoa(ver)]
 		exportKey, err := getExportKey(p, &key, exportType)
 		if err != nil {
 			return nil, err
 		}
-
-		retKeys[strconv.Itoa(versionValue)] = exportKey
+		retKeys[strconv.Itoa(ver)] = exportKey
 	}
 
 	resp := &logical.Response{
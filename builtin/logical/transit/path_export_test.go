@@ -2,12 +2,17 @@ package transit
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strconv"
 	"testing"
 
 	"github.com/hashicorp/vault/logical"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/pkcs12"
+	jose "gopkg.in/square/go-jose.v2"
 )
 
 func TestTransit_Export_KeyVersion_ExportsCorrectVersion(t *testing.T) {
@@ -366,3 +371,180 @@ func TestTransit_Export_EncryptionKey_DoesNotExportHMACKey(t *testing.T) {
 		t.Fatal("Encryption key data matched hmac key data")
 	}
 }
+
+func TestTransit_Export_ExportableAfterRotation(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string) {
+		resp, err := doReq(logical.ReadOperation, path, nil)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s", path)
+		}
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/foo", map[string]interface{}{
+		"exportable": true,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/foo/config", map[string]interface{}{
+		"exportable_after_rotation": true,
+	})
+	resp := mustSucceed(logical.ReadOperation, "keys/foo", nil)
+	if resp.Data["exportable_after_rotation"] != true {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// A key that was never rotated cannot be exported at all
+	for _, path := range []string{
+		"export/encryption-key/foo",
+		"export/encryption-key/foo/1",
+		"export/encryption-key/foo/latest",
+		"export/hmac-key/foo",
+	} {
+		mustFail(path)
+	}
+
+	// After rotation the older version can be exported, but not the latest
+	mustSucceed(logical.UpdateOperation, "keys/foo/rotate", nil)
+	resp = mustSucceed(logical.ReadOperation, "export/encryption-key/foo/1", nil)
+	if _, ok := resp.Data["keys"].(map[string]string)["1"]; !ok {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	mustFail("export/encryption-key/foo/2")
+	mustFail("export/encryption-key/foo/latest")
+
+	resp = mustSucceed(logical.ReadOperation, "export/encryption-key/foo", nil)
+	keys := resp.Data["keys"].(map[string]string)
+	if _, ok := keys["1"]; !ok || len(keys) != 1 {
+		t.Fatalf("expected only version 1, got %#v", keys)
+	}
+
+	// Clearing the flag allows the latest version again
+	mustSucceed(logical.UpdateOperation, "keys/foo/config", map[string]interface{}{
+		"exportable_after_rotation": false,
+	})
+	mustSucceed(logical.ReadOperation, "export/encryption-key/foo/latest", nil)
+}
+
+func TestTransit_Export_OutputFormats(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(logical.ReadOperation, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	for _, keyType := range []string{"aes256-gcm96", "ecdsa-p256", "ed25519", "rsa-2048"} {
+		mustSucceed(logical.UpdateOperation, "keys/"+keyType, map[string]interface{}{
+			"type":       keyType,
+			"exportable": true,
+		})
+		mustSucceed(logical.UpdateOperation, "keys/"+keyType+"/rotate", nil)
+	}
+
+	mustFail("export/encryption-key/aes256-gcm96", map[string]interface{}{"output_format": "pem"})
+	mustFail("export/hmac-key/aes256-gcm96", map[string]interface{}{"output_format": "jwks"})
+	mustFail("export/encryption-key/aes256-gcm96", map[string]interface{}{"output_format": "jwks"})
+	mustFail("export/signing-key/ed25519", map[string]interface{}{"output_format": "pkcs12", "pkcs12_password": "secret"})
+	mustFail("export/encryption-key/aes256-gcm96", map[string]interface{}{"output_format": "pkcs12"})
+
+	// The archive of all versions opens only with the correct password. The
+	// decoder cannot parse the AES keys themselves, so it fails afterwards.
+	resp := mustSucceed(logical.ReadOperation, "export/encryption-key/aes256-gcm96", map[string]interface{}{
+		"output_format":   "pkcs12",
+		"pkcs12_password": "secret",
+	})
+	if _, ok := resp.Data["keys"]; ok {
+		t.Fatalf("unexpected keys: %#v", resp.Data)
+	}
+	archive, err := base64.StdEncoding.DecodeString(resp.Data["pkcs12"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pkcs12.ToPEM(archive, "wrong"); err != pkcs12.ErrIncorrectPassword {
+		t.Fatalf("expected incorrect password error, got %v", err)
+	}
+	if _, err := pkcs12.ToPEM(archive, "secret"); err == nil || err == pkcs12.ErrIncorrectPassword {
+		t.Fatalf("expected the password to be accepted, got %v", err)
+	}
+
+	// JWK Sets hold the public keys unless the private keys are requested
+	for _, keyType := range []string{"ecdsa-p256", "ed25519", "rsa-2048"} {
+		for _, includePrivate := range []bool{false, true} {
+			resp := mustSucceed(logical.ReadOperation, "export/signing-key/"+keyType, map[string]interface{}{
+				"output_format":   "jwks",
+				"include_private": includePrivate,
+			})
+			var jwks jose.JSONWebKeySet
+			if err := json.Unmarshal([]byte(resp.Data["jwks"].(string)), &jwks); err != nil {
+				t.Fatalf("%s: %v", keyType, err)
+			}
+			if len(jwks.Keys) != 2 || jwks.Keys[0].KeyID != "1" || jwks.Keys[1].KeyID != "2" {
+				t.Fatalf("%s: bad keys: %#v", keyType, jwks.Keys)
+			}
+			for _, jwk := range jwks.Keys {
+				if !jwk.Valid() || jwk.IsPublic() == includePrivate {
+					t.Fatalf("%s: bad key, include_private %t: %#v", keyType, includePrivate, jwk)
+				}
+			}
+		}
+	}
+
+	// The private keys match the individually exported versions
+	resp = mustSucceed(logical.ReadOperation, "export/signing-key/ed25519", map[string]interface{}{
+		"output_format":   "jwks",
+		"include_private": true,
+	})
+	var jwks jose.JSONWebKeySet
+	if err := json.Unmarshal([]byte(resp.Data["jwks"].(string)), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	keys := mustSucceed(logical.ReadOperation, "export/signing-key/ed25519", nil).Data["keys"].(map[string]string)
+	for _, jwk := range jwks.Keys {
+		if base64.StdEncoding.EncodeToString(jwk.Key.(ed25519.PrivateKey)) != keys[jwk.KeyID] {
+			t.Fatalf("key version %s does not match the export", jwk.KeyID)
+		}
+	}
+
+	// A single version can be exported in either format
+	resp = mustSucceed(logical.ReadOperation, "export/signing-key/rsa-2048/2", map[string]interface{}{
+		"output_format": "jwks",
+	})
+	if err := json.Unmarshal([]byte(resp.Data["jwks"].(string)), &jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != "2" {
+		t.Fatalf("bad keys: %#v", jwks.Keys)
+	}
+}
@@ -0,0 +1,178 @@
+package transit
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	keyHealthOK       = "ok"
+	keyHealthDegraded = "degraded"
+	keyHealthError    = "error"
+)
+
+var (
+	// healthCheckValue is the base64-encoded test value encrypted or signed
+	// by the health check
+	healthCheckValue = base64.StdEncoding.EncodeToString([]byte("vault transit health check"))
+
+	// healthCheckContext and healthCheckNonce are used with derived and
+	// convergent keys, which require them
+	healthCheckContext = []byte("vault transit health check")
+	healthCheckNonce   = make([]byte, 12)
+
+	// x25519BasePoint is the u-coordinate of the X25519 base point. The
+	// shared secret of a key with it is the public key of the key.
+	x25519BasePoint = append([]byte{9}, make([]byte, 31)...)
+)
+
+func (b *backend) pathKeyHealth() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/health",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathKeyHealthRead,
+		},
+
+		HelpSynopsis:    pathKeyHealthHelpSyn,
+		HelpDescription: pathKeyHealthHelpDesc,
+	}
+}
+
+func (b *backend) pathKeyHealthRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	// The key is read from storage rather than the cache, so that problems
+	// with the stored material are found before the cached policy is evicted
+	start := time.Now()
+	p, err := keysutil.LoadPolicyFromStorage(ctx, req.Storage, name)
+	if err != nil {
+		return keyHealthResponse(keyHealthError, 0, start, err), nil
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if len(p.Keys) == 0 && len(p.Key) != 0 {
+		p.MigrateKeyToKeysMap()
+	}
+
+	if err := checkKeyHealth(p); err != nil {
+		return keyHealthResponse(keyHealthDegraded, p.LatestVersion, start, err), nil
+	}
+
+	return keyHealthResponse(keyHealthOK, p.LatestVersion, start, nil), nil
+}
+
+func keyHealthResponse(status string, version int, start time.Time, err error) *logical.Response {
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"status":     status,
+			"version":    version,
+			"latency_ms": int64(time.Since(start) / time.Millisecond),
+		},
+	}
+	if err != nil {
+		resp.Data["message"] = err.Error()
+	}
+	return resp
+}
+
+// checkKeyHealth uses the latest version of the key on a test value: it is
+// encrypted and decrypted, signed and verified or, for key agreement keys,
+// used to recompute the public key
+func checkKeyHealth(p *keysutil.Policy) (retErr error) {
+	// Corrupted material can make some of the primitives panic, such as
+	// ed25519 with a private key of the wrong length
+	defer func() {
+		if r := recover(); r != nil {
+			retErr = fmt.Errorf("key operation failed: %v", r)
+		}
+	}()
+
+	ver := p.LatestVersion
+	var context []byte
+	if p.Derived {
+		context = healthCheckContext
+	}
+
+	switch {
+	case p.Type.EncryptionSupported():
+		ciphertext, err := p.Encrypt(ver, context, healthCheckNonce, healthCheckValue)
+		if err != nil {
+			return err
+		}
+		plaintext, err := p.Decrypt(context, healthCheckNonce, ciphertext)
+		if err != nil {
+			return err
+		}
+		if plaintext != healthCheckValue {
+			return fmt.Errorf("decrypted test value does not match")
+		}
+
+	case p.Type.SigningSupported():
+		input, _ := base64.StdEncoding.DecodeString(healthCheckValue)
+		if p.Type.HashSignatureInput() {
+			hf := keysutil.HashFuncMap[keysutil.HashTypeSHA2256]()
+			hf.Write(input)
+			input = hf.Sum(nil)
+		}
+		sig, err := p.Sign(ver, context, input, keysutil.HashTypeSHA2256, "", keysutil.MarshalingTypeASN1)
+		if err != nil {
+			return err
+		}
+		valid, err := p.VerifySignature(context, input, keysutil.HashTypeSHA2256, "", keysutil.MarshalingTypeASN1, sig.Signature)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return fmt.Errorf("signature of test value does not verify")
+		}
+
+	case p.Type.KeyAgreementSupported():
+		publicKey, err := base64.StdEncoding.DecodeString(p.Keys[strconv.Itoa(ver)].FormattedPublicKey)
+		if err != nil {
+			return err
+		}
+		secret, err := p.SharedSecret(ver, x25519BasePoint)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(secret, publicKey) {
+			return fmt.Errorf("key does not match its public key")
+		}
+
+	default:
+		return fmt.Errorf("health checks are not supported for key type %v", p.Type)
+	}
+
+	return nil
+}
+
+const pathKeyHealthHelpSyn = `Check that a key can be read from storage and used`
+
+const pathKeyHealthHelpDesc = `
+This path reads the named key from storage, bypassing the cache, and uses
+the latest version of the key on a test value. The status is "ok" if both
+succeed, "degraded" if the key was read but could not be used, for instance
+because its material is corrupted, and "error" if it could not be read. The
+version checked and the time taken in milliseconds are returned as well.
+`
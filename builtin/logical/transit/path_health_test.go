@@ -0,0 +1,111 @@
+package transit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// failingGetStorage fails every read of the given key
+type failingGetStorage struct {
+	logical.Storage
+	key string
+}
+
+func (s *failingGetStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if key == s.key {
+		return nil, errors.New("storage unavailable")
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+func TestTransit_KeyHealth(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(storage logical.Storage, path string, data map[string]interface{}) *logical.Response {
+		var op logical.Operation = logical.UpdateOperation
+		if data == nil {
+			op = logical.ReadOperation
+		}
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	checkStatus := func(storage logical.Storage, name, status string, version int) {
+		t.Helper()
+		resp := doReq(storage, "keys/"+name+"/health", nil)
+		if resp.Data["status"] != status || resp.Data["version"] != version {
+			t.Fatalf("%s: bad health: %#v", name, resp.Data)
+		}
+		if _, ok := resp.Data["latency_ms"].(int64); !ok {
+			t.Fatalf("%s: bad latency: %#v", name, resp.Data["latency_ms"])
+		}
+	}
+
+	keys := map[string]map[string]interface{}{
+		"aes":        {"type": "aes256-gcm96"},
+		"chacha":     {"type": "chacha20-poly1305"},
+		"convergent": {"type": "aes256-gcm96", "derived": true, "convergent_encryption": true},
+		"ecdsa":      {"type": "ecdsa-p256"},
+		"ed25519":    {"type": "ed25519"},
+		"rsa":        {"type": "rsa-2048"},
+		"x25519":     {"type": "x25519"},
+	}
+	for name, data := range keys {
+		doReq(s, "keys/"+name, data)
+		checkStatus(s, name, "ok", 1)
+	}
+	doReq(s, "keys/aes/rotate", map[string]interface{}{})
+	checkStatus(s, "aes", "ok", 2)
+
+	// Corrupt the latest key material in storage; the cached policy is left
+	// untouched, so only a check that reads storage notices
+	corrupt := func(name string) {
+		entry, err := s.Get(context.Background(), "policy/"+name)
+		if err != nil || entry == nil {
+			t.Fatalf("err:%v entry:%#v", err, entry)
+		}
+		var policy map[string]interface{}
+		if err := json.Unmarshal(entry.Value, &policy); err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range policy["keys"].(map[string]interface{}) {
+			key.(map[string]interface{})["key"] = "c2hvcnQ="
+		}
+		entry.Value, err = json.Marshal(policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, version := range map[string]int{"aes": 2, "ed25519": 1} {
+		corrupt(name)
+		checkStatus(s, name, "degraded", version)
+	}
+	doReq(s, "encrypt/aes", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+
+	checkStatus(&failingGetStorage{Storage: s, key: "policy/chacha"}, "chacha", "error", 0)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   s,
+		Operation: logical.ReadOperation,
+		Path:      "keys/missing/health",
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error for a missing key; err:%v resp:%#v", err, resp)
+	}
+}
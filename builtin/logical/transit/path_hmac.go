@@ -5,12 +5,16 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/sha512"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"hash"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -25,6 +29,8 @@ func (b *backend) pathHMAC() *framework.Path {
 				Description: "The key to use for the HMAC function",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"input": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "The base64-encoded input data",
@@ -48,12 +54,40 @@ Defaults to "sha2-256".`,
 				Description: `Algorithm to use (POST URL parameter)`,
 			},
 
+			"timestamp_nonce": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the current time, truncated to a
+30-second window, is included in the HMAC input so
+the HMAC only verifies within that window and the
+ones next to it.`,
+			},
+
 			"key_version": &framework.FieldSchema{
 				Type: framework.TypeInt,
 				Description: `The version of the key to use for generating the HMAC.
 Must be 0 (for latest) or a value greater than or equal
 to the min_encryption_version configured on the key.`,
 			},
+
+			"session_id": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The ID of a session started with the window-init
+endpoint. The input is appended to the session data
+and the HMAC is computed over a window of it.`,
+			},
+
+			"window_size": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The size in bytes of the window of session data
+the HMAC is computed over. Required with session_id.`,
+			},
+
+			"window_index": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `The index of the window, counted in multiples of
+window_size from the start of the session data. If
+not set, the last window_size bytes are used.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -66,7 +100,10 @@ to the min_encryption_version configured on the key.`,
 }
 
 func (b *backend) pathHMACWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	ver := d.Get("key_version").(int)
 	inputB64 := d.Get("input").(string)
 	algorithm := d.Get("urlalgorithm").(string)
@@ -79,6 +116,18 @@ func (b *backend) pathHMACWrite(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse(fmt.Sprintf("unable to decode input as base64: %s", err)), logical.ErrInvalidRequest
 	}
 
+	sessionID := d.Get("session_id").(string)
+	windowIndex := -1
+	if rawWindowIndex, ok := d.GetOk("window_index"); ok {
+		windowIndex = rawWindowIndex.(int)
+		if windowIndex < 0 {
+			return logical.ErrorResponse("window_index must not be negative"), logical.ErrInvalidRequest
+		}
+	}
+	if sessionID == "" && (d.Get("window_size").(int) != 0 || windowIndex >= 0) {
+		return logical.ErrorResponse("window_size and window_index require a session_id"), logical.ErrInvalidRequest
+	}
+
 	// Get the policy
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
 		Storage: req.Storage,
@@ -94,6 +143,16 @@ func (b *backend) pathHMACWrite(ctx context.Context, req *logical.Request, d *fr
 		p.Lock(false)
 	}
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.checkRateLimit(p, req, keysutil.RateLimitHMAC); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
 	switch {
 	case ver == 0:
 		// Allowed, will use latest; set explicitly here to ensure the string
@@ -116,19 +175,27 @@ func (b *backend) pathHMACWrite(ctx context.Context, req *logical.Request, d *fr
 		return nil, fmt.Errorf("HMAC key value could not be computed")
 	}
 
-	var hf hash.Hash
-	switch algorithm {
-	case "sha2-224":
-		hf = hmac.New(sha256.New224, key)
-	case "sha2-256":
-		hf = hmac.New(sha256.New, key)
-	case "sha2-384":
-		hf = hmac.New(sha512.New384, key)
-	case "sha2-512":
-		hf = hmac.New(sha512.New, key)
-	default:
+	hf, err := newHMAC(algorithm, key)
+	if err != nil {
 		p.Unlock()
-		return logical.ErrorResponse(fmt.Sprintf("unsupported algorithm %s", algorithm)), nil
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	// The session is only updated once the key is known to be usable, so
+	// that a failed request does not leave its input behind
+	if sessionID != "" {
+		input, err = b.hmacSessionWindow(ctx, req.Storage, sessionID, name, input, d.Get("window_size").(int), windowIndex)
+		if err != nil {
+			p.Unlock()
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+	if d.Get("timestamp_nonce").(bool) {
+		input = timestampedHMACInput(input, time.Now())
 	}
 	hf.Write(input)
 	retBytes := hf.Sum(nil)
@@ -148,7 +215,10 @@ func (b *backend) pathHMACWrite(ctx context.Context, req *logical.Request, d *fr
 }
 
 func (b *backend) pathHMACVerify(ctx context.Context, req *logical.Request, d *framework.FieldData, verificationHMAC string) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	inputB64 := d.Get("input").(string)
 	algorithm := d.Get("urlalgorithm").(string)
 	if algorithm == "" {
@@ -195,6 +265,16 @@ func (b *backend) pathHMACVerify(ctx context.Context, req *logical.Request, d *f
 		p.Lock(false)
 	}
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.checkRateLimit(p, req, keysutil.RateLimitHMAC); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
 	if ver > p.LatestVersion {
 		p.Unlock()
 		return logical.ErrorResponse("invalid HMAC: version is too new"), logical.ErrInvalidRequest
@@ -215,31 +295,213 @@ func (b *backend) pathHMACVerify(ctx context.Context, req *logical.Request, d *f
 		return nil, fmt.Errorf("HMAC key value could not be computed")
 	}
 
-	var hf hash.Hash
-	switch algorithm {
-	case "sha2-224":
-		hf = hmac.New(sha256.New224, key)
-	case "sha2-256":
-		hf = hmac.New(sha256.New, key)
-	case "sha2-384":
-		hf = hmac.New(sha512.New384, key)
-	case "sha2-512":
-		hf = hmac.New(sha512.New, key)
-	default:
+	hf, err := newHMAC(algorithm, key)
+	if err != nil {
 		p.Unlock()
-		return logical.ErrorResponse(fmt.Sprintf("unsupported algorithm %s", algorithm)), nil
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	equal := hmac.Equal
+	if d.Get("constant_time_verify").(bool) {
+		equal = constantTimeHMACEqual
+	}
+	valid := false
+	if d.Get("timestamp_nonce").(bool) {
+		// Accept the current window and the ones on either side of it, to
+		// allow for clock skew and requests that cross a window boundary
+		now := time.Now()
+		for _, offset := range []time.Duration{-hmacTimestampWindow, 0, hmacTimestampWindow} {
+			hf.Reset()
+			hf.Write(timestampedHMACInput(input, now.Add(offset)))
+			if equal(hf.Sum(nil), verBytes) {
+				valid = true
+			}
+		}
+	} else {
+		hf.Write(input)
+		valid = equal(hf.Sum(nil), verBytes)
 	}
-	hf.Write(input)
-	retBytes := hf.Sum(nil)
 
 	p.Unlock()
 	return &logical.Response{
 		Data: map[string]interface{}{
-			"valid": hmac.Equal(retBytes, verBytes),
+			"valid": valid,
 		},
 	}, nil
 }
 
+// constantTimeHMACEqual reports whether the given HMAC equals the expected
+// one. Unlike hmac.Equal, it does not return early when the lengths differ:
+// the given HMAC is padded or truncated to the expected length and compared
+// in full, so the time taken only depends on the length of the expected HMAC.
+func constantTimeHMACEqual(expected, given []byte) bool {
+	padded := make([]byte, len(expected))
+	copy(padded, given)
+	lengthsEqual := subtle.ConstantTimeEq(int32(len(given)), int32(len(expected)))
+	return subtle.ConstantTimeCompare(expected, padded)&lengthsEqual == 1
+}
+
+// hmacTimestampWindow is the granularity of the timestamps included in HMACs
+// generated with timestamp_nonce
+const hmacTimestampWindow = 30 * time.Second
+
+// timestampedHMACInput prepends the Unix time at the start of the timestamp
+// window containing t to the input, as an 8-byte big-endian integer
+func timestampedHMACInput(input []byte, t time.Time) []byte {
+	window := int64(hmacTimestampWindow / time.Second)
+	buf := make([]byte, 8, 8+len(input))
+	binary.BigEndian.PutUint64(buf, uint64(t.Unix()-t.Unix()%window))
+	return append(buf, input...)
+}
+
+// newHMAC returns an HMAC using the hash named by algorithm
+func newHMAC(algorithm string, key []byte) (hash.Hash, error) {
+	switch algorithm {
+	case "sha2-224":
+		return hmac.New(sha256.New224, key), nil
+	case "sha2-256":
+		return hmac.New(sha256.New, key), nil
+	case "sha2-384":
+		return hmac.New(sha512.New384, key), nil
+	case "sha2-512":
+		return hmac.New(sha512.New, key), nil
+	}
+	return nil, fmt.Errorf("unsupported algorithm %s", algorithm)
+}
+
+// boundHMACSeparator separates a ciphertext from the HMAC appended to it when
+// the key has a bound_hmac_key. It cannot occur in the base64 encoded HMAC
+// that follows it.
+const boundHMACSeparator = "|hmac:"
+
+// hmacKeyVersion returns the given version of the HMAC key of the named key,
+// or the latest version if ver is 0, along with the version used. The
+// requesting entity must be allowed to use the key.
+func (b *backend) hmacKeyVersion(ctx context.Context, req *logical.Request, name string, ver int) (int, []byte, error) {
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if p == nil {
+		return 0, nil, errutil.UserError{Err: fmt.Sprintf("HMAC key %q not found", name)}
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	if err := b.checkAllowedSubjects(p, req.EntityID); err != nil {
+		return 0, nil, err
+	}
+
+	return policyHMACKeyVersion(p, ver)
+}
+
+// policyHMACKeyVersion returns the given version of the policy's HMAC key, or
+// the latest version if ver is 0, along with the version used. The caller
+// must hold the policy's lock.
+func policyHMACKeyVersion(p *keysutil.Policy, ver int) (int, []byte, error) {
+	switch {
+	case ver == 0:
+		ver = p.LatestVersion
+	case ver > p.LatestVersion:
+		return 0, nil, errutil.UserError{Err: "invalid HMAC: version is too new"}
+	case p.MinDecryptionVersion > 0 && ver < p.MinDecryptionVersion:
+		return 0, nil, errutil.UserError{Err: "invalid HMAC: version is disallowed by policy (too old)"}
+	}
+
+	key, err := p.HMACKey(ver)
+	if err != nil {
+		return 0, nil, errutil.UserError{Err: err.Error()}
+	}
+	return ver, key, nil
+}
+
+// appendBoundHMAC appends the HMAC-SHA256 of the ciphertext, computed with the
+// given version of the bound HMAC key, to the ciphertext
+func appendBoundHMAC(ciphertext string, ver int, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ciphertext))
+	return fmt.Sprintf("%s%sv%d:%s", ciphertext, boundHMACSeparator, ver, base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+}
+
+// verifyBoundHMAC checks the HMAC that appendBoundHMAC appended to a
+// ciphertext of a key with a bound_hmac_key and returns the ciphertext
+// without it. The HMAC key is always the one configured on the key, never
+// one named by the ciphertext. The caller must hold the policy's lock and
+// have authorized the request.
+func (b *backend) verifyBoundHMAC(ctx context.Context, req *logical.Request, p *keysutil.Policy, ciphertext string) (string, error) {
+	idx := strings.LastIndex(ciphertext, boundHMACSeparator)
+	if idx == -1 {
+		return "", errutil.UserError{Err: "bound HMAC is missing"}
+	}
+	ciphertext, suffix := ciphertext[:idx], ciphertext[idx+len(boundHMACSeparator):]
+
+	fields := strings.Split(suffix, ":")
+	if len(fields) != 2 || !strings.HasPrefix(fields[0], "v") {
+		return "", errutil.UserError{Err: "invalid bound HMAC: wrong number of fields"}
+	}
+	ver, err := strconv.Atoi(strings.TrimPrefix(fields[0], "v"))
+	if err != nil || ver < 1 {
+		return "", errutil.UserError{Err: "invalid bound HMAC: version number could not be decoded"}
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return "", errutil.UserError{Err: "invalid bound HMAC: could not be base64 decoded"}
+	}
+
+	_, key, err := b.linkedHMACKey(ctx, req, p, p.BoundHMACKey, ver)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(ciphertext))
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return "", errutil.UserError{Err: "bound HMAC verification failed"}
+	}
+
+	return ciphertext, nil
+}
+
+// verifyExternalHMAC checks an HMAC in the format returned by the hmac
+// endpoint, computed over input by the policy's external_hmac_key, in
+// constant time. The caller must hold the policy's lock.
+func (b *backend) verifyExternalHMAC(ctx context.Context, req *logical.Request, p *keysutil.Policy, algorithm, externalHMAC string, input []byte) error {
+	if !strings.HasPrefix(externalHMAC, "vault:v") {
+		return errutil.UserError{Err: "invalid external HMAC: no prefix"}
+	}
+	fields := strings.SplitN(strings.TrimPrefix(externalHMAC, "vault:v"), ":", 2)
+	if len(fields) != 2 {
+		return errutil.UserError{Err: "invalid external HMAC: wrong number of fields"}
+	}
+	ver, err := strconv.Atoi(fields[0])
+	if err != nil || ver < 1 {
+		return errutil.UserError{Err: "invalid external HMAC: version number could not be decoded"}
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return errutil.UserError{Err: "invalid external HMAC: could not be base64 decoded"}
+	}
+
+	_, key, err := b.linkedHMACKey(ctx, req, p, p.ExternalHMACKey, ver)
+	if err != nil {
+		return err
+	}
+	mac, err := newHMAC(algorithm, key)
+	if err != nil {
+		return errutil.UserError{Err: err.Error()}
+	}
+	mac.Write(input)
+	if !hmac.Equal(mac.Sum(nil), expected) {
+		return errutil.UserError{Err: "external HMAC verification failed"}
+	}
+
+	return nil
+}
+
 const pathHMACHelpSyn = `Generate an HMAC for input data using the named key`
 
 const pathHMACHelpDesc = `
@@ -0,0 +1,203 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	hmacSessionPrefix = "hmac-sessions/"
+
+	// maxHMACSessionBytes bounds the data buffered by an HMAC session
+	maxHMACSessionBytes = 1 << 20
+)
+
+// hmacSession buffers the data that windowed HMACs are computed over. It is
+// bound to the key it was started with.
+type hmacSession struct {
+	KeyName string `json:"key_name"`
+	Buffer  []byte `json:"buffer"`
+}
+
+func (b *backend) pathHMACWindowInit() *framework.Path {
+	return &framework.Path{
+		Pattern: "hmac/" + framework.GenericNameRegex("name") + "/window-init",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The key to use for the HMAC function",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"input": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The base64-encoded data the session starts with",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathHMACWindowInitWrite,
+		},
+
+		HelpSynopsis:    pathHMACWindowInitHelpSyn,
+		HelpDescription: pathHMACWindowInitHelpDesc,
+	}
+}
+
+func (b *backend) pathHMACSessions() *framework.Path {
+	return &framework.Path{
+		Pattern: hmacSessionPrefix + framework.GenericNameRegex("session_id"),
+		Fields: map[string]*framework.FieldSchema{
+			"session_id": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The ID of the HMAC session",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.DeleteOperation: b.pathHMACSessionDelete,
+		},
+
+		HelpSynopsis:    pathHMACSessionsHelpSyn,
+		HelpDescription: pathHMACSessionsHelpDesc,
+	}
+}
+
+func (b *backend) pathHMACWindowInitWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	input, err := base64.StdEncoding.DecodeString(d.Get("input").(string))
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("unable to decode input as base64: %s", err)), logical.ErrInvalidRequest
+	}
+	if len(input) > maxHMACSessionBytes {
+		return logical.ErrorResponse(fmt.Sprintf("input is larger than the maximum of %d bytes", maxHMACSessionBytes)), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	resp, err := b.authorizeSubject(p, req)
+	p.Unlock()
+	if resp != nil || err != nil {
+		return resp, err
+	}
+
+	sessionID, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	entry, err := logical.StorageEntryJSON(hmacSessionPrefix+sessionID, &hmacSession{
+		KeyName: name,
+		Buffer:  input,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := req.Storage.Put(ctx, entry); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"session_id": sessionID,
+		},
+	}, nil
+}
+
+func (b *backend) pathHMACSessionDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	b.hmacSessionsLock.Lock()
+	defer b.hmacSessionsLock.Unlock()
+
+	return nil, req.Storage.Delete(ctx, hmacSessionPrefix+d.Get("session_id").(string))
+}
+
+// hmacSessionWindow appends input to the buffer of the given session and
+// returns the window of the buffer to compute the HMAC over: the window at
+// windowIndex if one is given, otherwise the last windowSize bytes. A negative
+// windowIndex means none was given.
+func (b *backend) hmacSessionWindow(ctx context.Context, s logical.Storage, sessionID, name string, input []byte, windowSize, windowIndex int) ([]byte, error) {
+	if windowSize <= 0 {
+		return nil, errutil.UserError{Err: "window_size must be positive when a session_id is given"}
+	}
+
+	b.hmacSessionsLock.Lock()
+	defer b.hmacSessionsLock.Unlock()
+
+	entry, err := s.Get(ctx, hmacSessionPrefix+sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, errutil.UserError{Err: fmt.Sprintf("HMAC session %q not found", sessionID)}
+	}
+	var session hmacSession
+	if err := entry.DecodeJSON(&session); err != nil {
+		return nil, err
+	}
+	if session.KeyName != name {
+		return nil, errutil.UserError{Err: fmt.Sprintf("HMAC session %q was not started with key %q", sessionID, name)}
+	}
+	if len(session.Buffer)+len(input) > maxHMACSessionBytes {
+		return nil, errutil.UserError{Err: fmt.Sprintf("HMAC session would exceed the maximum of %d bytes", maxHMACSessionBytes)}
+	}
+
+	buffer := append(session.Buffer, input...)
+	if windowSize > len(buffer) || windowIndex > (len(buffer)-windowSize)/windowSize {
+		return nil, errutil.UserError{Err: fmt.Sprintf("the requested window is outside the %d bytes of session data", len(buffer))}
+	}
+	start := len(buffer) - windowSize
+	if windowIndex >= 0 {
+		start = windowIndex * windowSize
+	}
+
+	if len(input) > 0 {
+		session.Buffer = buffer
+		entry, err := logical.StorageEntryJSON(hmacSessionPrefix+sessionID, &session)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Put(ctx, entry); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer[start : start+windowSize], nil
+}
+
+const pathHMACWindowInitHelpSyn = `Start a session for windowed HMACs`
+
+const pathHMACWindowInitHelpDesc = `
+This path starts a session holding the given input and returns its ID. Passing
+the ID as session_id to the hmac endpoint appends that request's input to the
+session and computes the HMAC over a window of the session data selected with
+window_size and window_index.
+`
+
+const pathHMACSessionsHelpSyn = `Delete an HMAC session`
+
+const pathHMACSessionsHelpDesc = `
+This path deletes an HMAC session started with the window-init endpoint,
+along with the data buffered in it.
+`
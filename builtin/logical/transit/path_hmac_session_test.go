@@ -0,0 +1,141 @@
+package transit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_HMACSessionWindows(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"exportable": true,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/other", nil)
+	resp := mustSucceed(logical.ReadOperation, "export/hmac-key/key/1", nil)
+	hmacKey, err := base64.StdEncoding.DecodeString(resp.Data["keys"].(map[string]string)["1"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The expected values are computed offline from the exported key, as
+	// hmac.new(key, window, hashlib.sha256) would
+	expected := func(window string) string {
+		mac := hmac.New(sha256.New, hmacKey)
+		mac.Write([]byte(window))
+		return "vault:v1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	resp = mustSucceed(logical.UpdateOperation, "hmac/key/window-init", map[string]interface{}{
+		"input": b64("abcdefgh"),
+	})
+	sessionID := resp.Data["session_id"].(string)
+
+	windowHMAC := func(data map[string]interface{}) string {
+		t.Helper()
+		data["session_id"] = sessionID
+		return mustSucceed(logical.UpdateOperation, "hmac/key", data).Data["hmac"].(string)
+	}
+
+	cases := []struct {
+		input       string
+		windowSize  int
+		windowIndex interface{}
+		window      string
+	}{
+		{"", 4, 1, "efgh"},
+		{"", 4, 0, "abcd"},
+		{"", 3, nil, "fgh"},
+		// Updates slide the window over the new data
+		{"ij", 4, nil, "ghij"},
+		{"", 2, 4, "ij"},
+		{"klm", 5, nil, "ijklm"},
+		{"", 13, 0, "abcdefghijklm"},
+		{"", 5, 1, "fghij"},
+	}
+	for _, c := range cases {
+		data := map[string]interface{}{
+			"input":       b64(c.input),
+			"window_size": c.windowSize,
+		}
+		if c.windowIndex != nil {
+			data["window_index"] = c.windowIndex
+		}
+		if got := windowHMAC(data); got != expected(c.window) {
+			t.Fatalf("bad HMAC for window %q: %s", c.window, got)
+		}
+	}
+
+	// The windows must lie within the session data
+	for _, data := range []map[string]interface{}{
+		{"window_size": 14},
+		{"window_size": 5, "window_index": 2},
+		{"window_size": 4, "window_index": -1},
+		{"window_size": 0},
+	} {
+		data["session_id"] = sessionID
+		mustFail(logical.UpdateOperation, "hmac/key", data)
+	}
+
+	// A failed request does not add its input to the session
+	mustFail(logical.UpdateOperation, "hmac/key", map[string]interface{}{
+		"session_id":  sessionID,
+		"input":       b64("nop"),
+		"window_size": 4,
+		"key_version": 2,
+	})
+	if got := windowHMAC(map[string]interface{}{"window_size": 4}); got != expected("jklm") {
+		t.Fatalf("bad HMAC after failed update: %s", got)
+	}
+
+	// Sessions are bound to their key, and windows need a session
+	mustFail(logical.UpdateOperation, "hmac/other", map[string]interface{}{
+		"session_id":  sessionID,
+		"window_size": 4,
+	})
+	mustFail(logical.UpdateOperation, "hmac/key", map[string]interface{}{
+		"input":       b64("abcd"),
+		"window_size": 4,
+	})
+	mustFail(logical.UpdateOperation, "hmac/missing/window-init", map[string]interface{}{
+		"input": b64("abcd"),
+	})
+
+	mustSucceed(logical.DeleteOperation, "hmac-sessions/"+sessionID, nil)
+	mustFail(logical.UpdateOperation, "hmac/key", map[string]interface{}{
+		"session_id":  sessionID,
+		"window_size": 4,
+	})
+}
@@ -1,11 +1,17 @@
 package transit
 
 import (
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
@@ -180,3 +186,189 @@ func TestTransit_HMAC(t *testing.T) {
 		t.Fatalf("expected invalid request error, got %v", err)
 	}
 }
+
+func TestTransit_HMACTimestampNonce(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	verify := func(hmacValue string, timestampNonce bool) bool {
+		resp := doReq("verify/foo", map[string]interface{}{
+			"input":           "dGhlIHF1aWNrIGJyb3duIGZveA==",
+			"hmac":            hmacValue,
+			"timestamp_nonce": timestampNonce,
+		})
+		return resp.Data["valid"].(bool)
+	}
+
+	doReq("keys/foo", nil)
+	p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+		Storage: storage,
+		Name:    "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := p.HMACKey(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hmacAt computes the HMAC that timestamp_nonce would have produced at
+	// the given time
+	hmacAt := func(at time.Time) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(timestampedHMACInput([]byte("the quick brown fox"), at))
+		return "vault:v1:" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	}
+
+	resp := doReq("hmac/foo", map[string]interface{}{
+		"input":           "dGhlIHF1aWNrIGJyb3duIGZveA==",
+		"timestamp_nonce": true,
+	})
+	timestamped := resp.Data["hmac"].(string)
+	resp = doReq("hmac/foo", map[string]interface{}{
+		"input": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	plain := resp.Data["hmac"].(string)
+	if timestamped == plain {
+		t.Fatal("timestamp did not change the HMAC")
+	}
+
+	// The endpoint's HMAC and HMACs from adjacent windows verify
+	if !verify(timestamped, true) {
+		t.Fatal("expected timestamped HMAC to verify")
+	}
+	// Stay clear of a window boundary so the handler sees the same window
+	if time.Now().Unix()%30 == 29 {
+		time.Sleep(2 * time.Second)
+	}
+	now := time.Now()
+	for _, offset := range []time.Duration{-hmacTimestampWindow, 0, hmacTimestampWindow} {
+		if !verify(hmacAt(now.Add(offset)), true) {
+			t.Fatalf("expected HMAC from offset %s to verify", offset)
+		}
+	}
+
+	// Replays from further away are rejected
+	for _, offset := range []time.Duration{-3 * hmacTimestampWindow, -10 * time.Minute, 3 * hmacTimestampWindow} {
+		if verify(hmacAt(now.Add(offset)), true) {
+			t.Fatalf("expected HMAC from offset %s to be rejected", offset)
+		}
+	}
+
+	// The flag must match on both sides
+	if verify(timestamped, false) || verify(plain, true) || !verify(plain, false) {
+		t.Fatal("expected timestamp_nonce to be required on both sides")
+	}
+
+	// Inputs within a window share a timestamp
+	start := time.Unix(1500000000, 0)
+	if !bytes.Equal(timestampedHMACInput(nil, start), timestampedHMACInput(nil, start.Add(29*time.Second))) {
+		t.Fatal("expected the same timestamp within a window")
+	}
+	if bytes.Equal(timestampedHMACInput(nil, start), timestampedHMACInput(nil, start.Add(30*time.Second))) {
+		t.Fatal("expected different timestamps in different windows")
+	}
+}
+
+func TestTransit_HMACConstantTimeVerify(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	doReq("keys/foo", nil)
+	resp := doReq("hmac/foo", map[string]interface{}{
+		"input": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	valid := resp.Data["hmac"].(string)
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(valid, "vault:v1:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	flipped := append([]byte(nil), raw...)
+	flipped[0] ^= 1
+
+	cases := map[string]bool{
+		valid: true,
+		"vault:v1:" + base64.StdEncoding.EncodeToString(flipped):          false,
+		"vault:v1:" + base64.StdEncoding.EncodeToString(raw[:len(raw)-1]): false,
+		"vault:v1:" + base64.StdEncoding.EncodeToString(append(raw, 0)):   false,
+	}
+	for hmacValue, expected := range cases {
+		for _, constantTime := range []bool{true, false} {
+			resp := doReq("verify/foo", map[string]interface{}{
+				"input":                "dGhlIHF1aWNrIGJyb3duIGZveA==",
+				"hmac":                 hmacValue,
+				"constant_time_verify": constantTime,
+			})
+			if resp.Data["valid"] != expected {
+				t.Fatalf("bad verification of %s with constant_time_verify=%t: %#v", hmacValue, constantTime, resp.Data)
+			}
+		}
+	}
+}
+
+func TestTransit_ConstantTimeHMACEqualTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	expected := bytes.Repeat([]byte{0xab}, sha256.Size)
+	firstByte := append([]byte{0xac}, expected[1:]...)
+	lastByte := append(append([]byte(nil), expected[:sha256.Size-1]...), 0xac)
+
+	// medianDuration returns the median time of a single comparison, taken
+	// over batches of comparisons to stay above the timer resolution
+	const batches, perBatch = 201, 1000
+	medianDuration := func(given []byte) time.Duration {
+		durations := make([]time.Duration, batches)
+		for i := range durations {
+			start := time.Now()
+			for j := 0; j < perBatch; j++ {
+				constantTimeHMACEqual(expected, given)
+			}
+			durations[i] = time.Since(start) / perBatch
+		}
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		return durations[batches/2]
+	}
+
+	matching := medianDuration(expected)
+	for name, given := range map[string][]byte{
+		"first byte differs": firstByte,
+		"last byte differs":  lastByte,
+		"shorter":            expected[:4],
+		"longer":             append(append([]byte(nil), expected...), expected...),
+		"empty":              nil,
+	} {
+		nonMatching := medianDuration(given)
+		diff := nonMatching - matching
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff > time.Microsecond {
+			t.Fatalf("%s: comparison took %s against %s for a match", name, nonMatching, matching)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathImportCheck() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/import-check",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name the key would be imported as",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"backup": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Key material to check, as a JWK set or PEM-encoded PKCS#8 keys.",
+			},
+
+			"force": &framework.FieldSchema{
+				Type:        framework.TypeBool,
+				Description: "If set, an existing key of the same name is not reported, as the import would override it.",
+			},
+
+			"min_entropy_score": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "0.7",
+				Description: `Minimum entropy score, between 0 and 1, of
+the key material. Keys with a lower score are
+reported.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathImportCheckWrite,
+		},
+
+		HelpSynopsis:    pathImportCheckHelpSyn,
+		HelpDescription: pathImportCheckHelpDesc,
+	}
+}
+
+func (b *backend) pathImportCheckWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	backup := d.Get("backup").(string)
+	force := d.Get("force").(bool)
+	if backup == "" {
+		return logical.ErrorResponse("'backup' must be supplied"), logical.ErrInvalidRequest
+	}
+
+	opts, err := b.externalRestoreOptions(ctx, req.Storage, d.Get("min_entropy_score").(string), force)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	// Material that cannot be parsed is reported like any other issue
+	issues := []string{}
+	keyType, keyIssues, parseErr := keysutil.CheckExternalKeys(backup, opts)
+	if parseErr != nil {
+		issues = append(issues, parseErr.Error())
+	}
+	for _, issue := range keyIssues {
+		issues = append(issues, issue.Error())
+	}
+
+	if !force {
+		p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil {
+			issues = append(issues, fmt.Sprintf("key %q already exists", name))
+		}
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"valid":  len(issues) == 0,
+			"issues": issues,
+		},
+	}
+	if parseErr == nil {
+		resp.Data["type"] = keyType.String()
+	}
+	return resp, nil
+}
+
+const pathImportCheckHelpSyn = `Check key material before importing it`
+
+const pathImportCheckHelpDesc = `
+This path checks key material in an external format as a restore with
+external_format set would, without writing anything to storage. It returns
+whether the import would succeed and the reasons it would not.
+`
@@ -0,0 +1,127 @@
+package transit
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_ImportCheck(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	symmetricJWKS := func(key []byte) string {
+		return fmt.Sprintf(`{"keys":[{"kty":"oct","kid":"1","alg":"A256GCM","k":%q}]}`, base64.RawURLEncoding.EncodeToString(key))
+	}
+	check := func(name string, data map[string]interface{}, keyType string, issues ...string) {
+		t.Helper()
+		resp := doReq("keys/"+name+"/import-check", data)
+		got := resp.Data["issues"].([]string)
+		if len(got) != len(issues) {
+			t.Fatalf("expected issues %q, got %q", issues, got)
+		}
+		for i := range issues {
+			if !strings.Contains(got[i], issues[i]) {
+				t.Fatalf("expected issues %q, got %q", issues, got)
+			}
+		}
+		if resp.Data["valid"] != (len(issues) == 0) {
+			t.Fatalf("bad validity: %#v", resp.Data)
+		}
+		if typ, ok := resp.Data["type"]; (keyType == "" && ok) || (keyType != "" && typ != keyType) {
+			t.Fatalf("expected type %q: %#v", keyType, resp.Data)
+		}
+	}
+
+	goodKey := make([]byte, 32)
+	if _, err := rand.Read(goodKey); err != nil {
+		t.Fatal(err)
+	}
+	weakKey := make([]byte, 32)
+
+	smallRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(smallRSAKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smallRSAPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	doReq("keys/existing", nil)
+	before, err := s.List(context.Background(), "policy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check("new", map[string]interface{}{"backup": symmetricJWKS(goodKey)}, "aes256-gcm96")
+
+	// Every check the key material fails is reported
+	check("new", map[string]interface{}{"backup": symmetricJWKS(weakKey)}, "aes256-gcm96",
+		"entropy score", "weak key pattern 00")
+	check("new", map[string]interface{}{
+		"backup":            symmetricJWKS(weakKey),
+		"min_entropy_score": "0",
+	}, "aes256-gcm96", "weak key pattern 00")
+
+	// Material that cannot be parsed or has an unsupported type
+	check("new", map[string]interface{}{"backup": "not a key"}, "", "neither a JWK set nor PEM-encoded PKCS#8")
+	check("new", map[string]interface{}{"backup": `{"keys":[]}`}, "", "no keys found")
+	check("new", map[string]interface{}{"backup": smallRSAPEM}, "", "unsupported RSA key size 1024")
+	check("new", map[string]interface{}{"backup": `{"keys":[{"kty":"oct","kid":"1","k":"c2hvcnQ"}]}`}, "", "must be 32 bytes")
+
+	// An existing key is only reported without force
+	check("existing", map[string]interface{}{"backup": symmetricJWKS(goodKey)}, "aes256-gcm96", `key "existing" already exists`)
+	check("existing", map[string]interface{}{
+		"backup": symmetricJWKS(goodKey),
+		"force":  true,
+	}, "aes256-gcm96")
+	check("existing", map[string]interface{}{"backup": symmetricJWKS(weakKey)}, "aes256-gcm96",
+		"entropy score", "weak key pattern 00", "already exists")
+
+	// Nothing was written
+	after, err := s.List(context.Background(), "policy/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("storage changed from %q to %q", before, after)
+	}
+
+	// The checked material imports as reported
+	doReq("restore/new", map[string]interface{}{
+		"backup":          symmetricJWKS(goodKey),
+		"external_format": true,
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   s,
+		Operation: logical.UpdateOperation,
+		Path:      "keys/new/import-check",
+		Data:      map[string]interface{}{"backup": symmetricJWKS(goodKey), "min_entropy_score": "2"},
+	})
+	if err == nil || resp == nil || !resp.IsError() {
+		t.Fatalf("expected error for an invalid min entropy score; err:%v resp:%#v", err, resp)
+	}
+}
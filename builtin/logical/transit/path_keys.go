@@ -6,19 +6,65 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/ed25519"
 
 	"github.com/fatih/structs"
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
 
+// maxKeyNamespaceLength is the maximum length of a key_namespace in bytes
+const maxKeyNamespaceLength = 128
+
+// keyNamespaceSchema is the key_namespace field shared by the paths that
+// address a key by name
+var keyNamespaceSchema = &framework.FieldSchema{
+	Type: framework.TypeString,
+	Description: `Namespace of the key, so that the same key name can
+address independent keys for different tenants.
+The key is stored as "<name>:<namespace>".`,
+}
+
+// keyName returns the name of the key addressed by the request. If a
+// key_namespace is given it is appended to the name after a ':', which
+// cannot occur in the names of keys without a namespace, so namespaced
+// keys never collide with other keys.
+func keyName(d *framework.FieldData) (string, error) {
+	name := d.Get("name").(string)
+	namespace := d.Get("key_namespace").(string)
+	if namespace == "" {
+		return name, nil
+	}
+	if name == "" {
+		return "", errors.New("key_namespace requires a key name")
+	}
+	if err := validateKeyNamespace(namespace); err != nil {
+		return "", err
+	}
+	return name + ":" + namespace, nil
+}
+
+func validateKeyNamespace(namespace string) error {
+	if len(namespace) > maxKeyNamespaceLength {
+		return fmt.Errorf("key_namespace cannot be longer than %d bytes", maxKeyNamespaceLength)
+	}
+	if !keyNameRegex.MatchString(namespace) {
+		return fmt.Errorf("invalid key_namespace %q", namespace)
+	}
+	return nil
+}
+
 func (b *backend) pathListKeys() *framework.Path {
 	return &framework.Path{
 		Pattern: "keys/?$",
@@ -32,6 +78,47 @@ func (b *backend) pathListKeys() *framework.Path {
 	}
 }
 
+func (b *backend) pathListNamespacedKeys() *framework.Path {
+	return &framework.Path{
+		Pattern: "key-namespaces/" + framework.GenericNameRegex("key_namespace") + "/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"key_namespace": keyNamespaceSchema,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathNamespacedKeysList,
+		},
+
+		HelpSynopsis:    pathListNamespacedKeysHelpSyn,
+		HelpDescription: pathListNamespacedKeysHelpDesc,
+	}
+}
+
+func (b *backend) pathBulkDeleteKeys() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/bulk-delete$",
+		Fields: map[string]*framework.FieldSchema{
+			"key_names": &framework.FieldSchema{
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of the keys to delete",
+			},
+
+			"permanent": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `Remove the keys from storage at once instead of
+soft-deleting them, as with deleting a single key.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathKeysBulkDelete,
+		},
+
+		HelpSynopsis:    pathBulkDeleteHelpSyn,
+		HelpDescription: pathBulkDeleteHelpDesc,
+	}
+}
+
 func (b *backend) pathKeys() *framework.Path {
 	return &framework.Path{
 		Pattern: "keys/" + framework.GenericNameRegex("name"),
@@ -41,13 +128,16 @@ func (b *backend) pathKeys() *framework.Path {
 				Description: "Name of the key",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"type": &framework.FieldSchema{
 				Type:    framework.TypeString,
 				Default: "aes256-gcm96",
 				Description: `
 The type of key to create. Currently, "aes256-gcm96" (symmetric), "ecdsa-p256"
 (asymmetric), 'ed25519' (asymmetric), 'rsa-2048' (asymmetric), 'rsa-4096'
-(asymmetric) are supported.  Defaults to "aes256-gcm96".
+(asymmetric) and 'x25519' (key agreement) are supported.  Defaults to
+"aes256-gcm96".
 `,
 			},
 
@@ -88,6 +178,31 @@ key in plaintext format. Once set,
 this cannot be disabled.`,
 			},
 
+			"lifecycle_policy": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `The name of a lifecycle policy to attach
+to the key. The policy controls automatic rotation
+and the number of decryptable versions.`,
+			},
+
+			"status_webhook_url": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `An http or https URL that is sent a POST request
+when the key is created and whenever its status
+changes afterwards.`,
+			},
+
+			"replication_scope": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: keysutil.ReplicationScopeCluster,
+				Description: `The clusters the key is replicated to.
+"cluster" replicates the key everywhere. "local"
+keeps it in local storage, which is not replicated
+to performance secondaries but is replicated to
+disaster recovery secondaries. Cannot be changed
+after the key is created.`,
+			},
+
 			"context": &framework.FieldSchema{
 				Type: framework.TypeString,
 				Description: `Base64 encoded context for key derivation.
@@ -95,6 +210,30 @@ When reading a key with key derivation enabled,
 if the key type supports public keys, this will
 return the public key for the given context.`,
 			},
+
+			"page_size": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `When reading, the maximum number of key versions to
+return. If set, the versions are returned under
+"versions" in ascending order, along with
+"total_versions" and a "next_page_token" to pass as
+"page" to read the next page. Defaults to returning
+all versions under "keys".`,
+			},
+
+			"page": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `When reading with page_size, the next_page_token of
+the previous page. Defaults to the first page.`,
+			},
+
+			"permanent": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `When deleting, remove the key from storage at once
+instead of soft-deleting it. A soft-deleted key can be
+recovered with the undelete endpoint until the
+recovery window set in config/keys has passed.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -109,26 +248,88 @@ return the public key for the given context.`,
 }
 
 func (b *backend) pathKeysList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	entries, err := req.Storage.List(ctx, "policy/")
+	return b.listKeys(ctx, req, "")
+}
+
+func (b *backend) pathNamespacedKeysList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	namespace := d.Get("key_namespace").(string)
+	if err := validateKeyNamespace(namespace); err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	return b.listKeys(ctx, req, namespace)
+}
+
+// listKeys lists the names of the keys in the given namespace, or of the keys
+// without a namespace if it is empty
+func (b *backend) listKeys(ctx context.Context, req *logical.Request, namespace string) (*logical.Response, error) {
+	entries, err := keysutil.ListPolicies(ctx, req.Storage)
 	if err != nil {
 		return nil, err
 	}
 
-	return logical.ListResponse(entries), nil
+	// Namespaced keys are stored as "<name>:<namespace>", which cannot be
+	// used as a name in paths, so they are listed by name per namespace
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		i := strings.LastIndex(entry, ":")
+		switch {
+		case namespace == "" && i == -1:
+			names = append(names, entry)
+		case namespace != "" && i != -1 && entry[i+1:] == namespace:
+			names = append(names, entry[:i])
+		}
+	}
+
+	return logical.ListResponse(names), nil
 }
 
 func (b *backend) pathPolicyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	derived := d.Get("derived").(bool)
 	convergent := d.Get("convergent_encryption").(bool)
 	keyType := d.Get("type").(string)
 	exportable := d.Get("exportable").(bool)
 	allowPlaintextBackup := d.Get("allow_plaintext_backup").(bool)
+	lifecyclePolicyName := d.Get("lifecycle_policy").(string)
+	replicationScope := d.Get("replication_scope").(string)
+	statusWebhookURL := d.Get("status_webhook_url").(string)
 
 	if !derived && convergent {
 		return logical.ErrorResponse("convergent encryption requires derivation to be enabled"), nil
 	}
 
+	switch replicationScope {
+	case keysutil.ReplicationScopeCluster, keysutil.ReplicationScopeLocal:
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("unknown replication scope %q", replicationScope)), logical.ErrInvalidRequest
+	}
+
+	if lifecyclePolicyName != "" {
+		b.lifecyclePolicyLock.RLock()
+		defer b.lifecyclePolicyLock.RUnlock()
+
+		lp, err := b.getLifecyclePolicy(ctx, req.Storage, lifecyclePolicyName)
+		if err != nil {
+			return nil, err
+		}
+		if lp == nil {
+			return logical.ErrorResponse(fmt.Sprintf("lifecycle policy %q not found", lifecyclePolicyName)), logical.ErrInvalidRequest
+		}
+	}
+
+	if statusWebhookURL != "" {
+		keysConfig, err := b.getKeysConfig(ctx, req.Storage)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateStatusWebhookURL(statusWebhookURL, keysConfig.StatusWebhookAllowedHosts); err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	}
+
 	polReq := keysutil.PolicyRequest{
 		Upsert:               true,
 		Storage:              req.Storage,
@@ -137,6 +338,9 @@ func (b *backend) pathPolicyWrite(ctx context.Context, req *logical.Request, d *
 		Convergent:           convergent,
 		Exportable:           exportable,
 		AllowPlaintextBackup: allowPlaintextBackup,
+		LifecyclePolicy:      lifecyclePolicyName,
+		ReplicationScope:     replicationScope,
+		StatusWebhookURL:     statusWebhookURL,
 	}
 	switch keyType {
 	case "aes256-gcm96":
@@ -151,17 +355,27 @@ func (b *backend) pathPolicyWrite(ctx context.Context, req *logical.Request, d *
 		polReq.KeyType = keysutil.KeyType_RSA2048
 	case "rsa-4096":
 		polReq.KeyType = keysutil.KeyType_RSA4096
+	case "x25519":
+		polReq.KeyType = keysutil.KeyType_X25519
 	default:
 		return logical.ErrorResponse(fmt.Sprintf("unknown key type %v", keyType)), logical.ErrInvalidRequest
 	}
 
-	p, upserted, err := b.lm.GetPolicy(ctx, polReq)
+	p, upserted, err := b.upsertPolicy(ctx, polReq)
 	if err != nil {
-		return nil, err
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
 	}
 	if p == nil {
 		return nil, fmt.Errorf("error generating key: returned policy was nil")
 	}
+	if upserted {
+		b.notifyKeyStatus(ctx, req.Storage, p, "", keyStatusCreated)
+	}
 	if b.System().CachingDisabled() {
 		p.Unlock()
 	}
@@ -174,6 +388,45 @@ func (b *backend) pathPolicyWrite(ctx context.Context, req *logical.Request, d *
 	return nil, nil
 }
 
+// upsertPolicy loads the policy for polReq, creating it if it does not exist
+// and the mount holds fewer keys than its max_key_count
+func (b *backend) upsertPolicy(ctx context.Context, polReq keysutil.PolicyRequest) (*keysutil.Policy, bool, error) {
+	var p *keysutil.Policy
+	var upserted bool
+	err := b.createKey(ctx, polReq.Storage, polReq.Name, func() error {
+		var err error
+		p, upserted, err = b.lm.GetPolicy(ctx, polReq)
+		return err
+	})
+	return p, upserted, err
+}
+
+// createKey calls create, which stores the named key, unless the key does not
+// exist yet and the mount already holds max_key_count keys. Every path that
+// creates keys goes through it.
+func (b *backend) createKey(ctx context.Context, s logical.Storage, name string, create func() error) error {
+	cfg, err := b.getKeysConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if cfg.MaxKeyCount == 0 {
+		return create()
+	}
+
+	b.keyCreationLock.Lock()
+	defer b.keyCreationLock.Unlock()
+
+	names, err := keysutil.ListPolicies(ctx, s)
+	if err != nil {
+		return err
+	}
+	if len(names) >= cfg.MaxKeyCount && !strutil.StrListContains(names, name) {
+		return errutil.UserError{Err: fmt.Sprintf("the mount already holds the maximum of %d keys", cfg.MaxKeyCount)}
+	}
+
+	return create()
+}
+
 // Built-in helper type for returning asymmetric keys
 type asymKey struct {
 	Name         string    `json:"name" structs:"name" mapstructure:"name"`
@@ -182,11 +435,15 @@ type asymKey struct {
 }
 
 func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
-		Storage: req.Storage,
-		Name:    name,
+		Storage:          req.Storage,
+		Name:             name,
+		AllowSoftDeleted: true,
 	})
 	if err != nil {
 		return nil, err
@@ -199,26 +456,107 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 	}
 	defer p.Unlock()
 
+	if p.AuditRead {
+		b.Logger().Info("key read", "key", name, "request_id", req.ID, "client_token_accessor", req.ClientTokenAccessor, "entity_id", req.EntityID)
+	}
+
 	// Return the response
 	resp := &logical.Response{
 		Data: map[string]interface{}{
-			"name":                   p.Name,
-			"type":                   p.Type.String(),
-			"derived":                p.Derived,
-			"deletion_allowed":       p.DeletionAllowed,
-			"min_available_version":  p.MinAvailableVersion,
-			"min_decryption_version": p.MinDecryptionVersion,
-			"min_encryption_version": p.MinEncryptionVersion,
-			"latest_version":         p.LatestVersion,
-			"exportable":             p.Exportable,
-			"allow_plaintext_backup": p.AllowPlaintextBackup,
-			"supports_encryption":    p.Type.EncryptionSupported(),
-			"supports_decryption":    p.Type.DecryptionSupported(),
-			"supports_signing":       p.Type.SigningSupported(),
-			"supports_derivation":    p.Type.DerivationSupported(),
+			"name":                            p.Name,
+			"type":                            p.Type.String(),
+			"derived":                         p.Derived,
+			"deletion_allowed":                p.DeletionAllowed,
+			"min_available_version":           p.MinAvailableVersion,
+			"min_decryption_version":          p.MinDecryptionVersion,
+			"min_encryption_version":          p.MinEncryptionVersion,
+			"auto_min_decryption_version_lag": minDecryptionVersionLagSetting(p),
+			"lifecycle_policy":                p.LifecyclePolicy,
+			"key_rotation_required":           p.KeyRotationRequired,
+			"rotation_quorum":                 rotationQuorum(p),
+			"max_sign_uses":                   p.MaxSignUses,
+			"rate_limit_per_second":           p.RateLimitPerSecond,
+			"hmac_rate_limit_per_second":      p.HMACRateLimitPerSecond,
+			"deletion_grace_period":           int64(p.DeletionGracePeriod.Seconds()),
+			"rotation_quorum_ttl":             int64(rotationQuorumTTL(p).Seconds()),
+			"replication_scope":               keysutil.ReplicationScopeCluster,
+			"latest_version":                  p.LatestVersion,
+			"exportable":                      p.Exportable,
+			"allow_plaintext_backup":          p.AllowPlaintextBackup,
+			"exportable_after_rotation":       p.ExportableAfterRotation,
+			"audit_read":                      p.AuditRead,
+			"soft_deleted":                    p.SoftDeleted,
+			"supports_encryption":             p.Type.EncryptionSupported(),
+			"supports_decryption":             p.Type.DecryptionSupported(),
+			"supports_signing":                p.Type.SigningSupported(),
+			"supports_derivation":             p.Type.DerivationSupported(),
 		},
 	}
 
+	if p.ReplicationScope != "" {
+		resp.Data["replication_scope"] = p.ReplicationScope
+	}
+	if len(p.HSMBinding) > 0 {
+		resp.Data["hsm_binding"] = p.HSMBinding
+	}
+	if p.CiphertextPrefix != "" {
+		resp.Data["ciphertext_prefix"] = p.CiphertextPrefix
+	}
+	if p.StatusWebhookURL != "" {
+		resp.Data["status_webhook_url"] = p.StatusWebhookURL
+	}
+	if len(p.RequiredClaims) != 0 {
+		resp.Data["required_claims"] = p.RequiredClaims
+	}
+	if len(p.AllowedSubjects) != 0 {
+		resp.Data["allowed_subjects"] = p.AllowedSubjects
+	}
+	if len(p.AllowedEncryptNamespaces) != 0 {
+		resp.Data["allowed_encrypt_namespaces"] = p.AllowedEncryptNamespaces
+	}
+	if len(p.AllowedDecryptNamespaces) != 0 {
+		resp.Data["allowed_decrypt_namespaces"] = p.AllowedDecryptNamespaces
+	}
+	if p.HMACBeforeEncrypt != "" {
+		resp.Data["hmac_before_encrypt"] = p.HMACBeforeEncrypt
+	}
+	if p.BoundHMACKey != "" {
+		resp.Data["bound_hmac_key"] = p.BoundHMACKey
+	}
+	if p.ExternalHMACKey != "" {
+		resp.Data["external_hmac_key"] = p.ExternalHMACKey
+	}
+	if p.EscrowKeyName != "" {
+		resp.Data["escrow_key_name"] = p.EscrowKeyName
+	}
+	if p.SoftDeleted {
+		resp.Data["recovery_deadline"] = p.RecoveryDeadline
+	}
+	if !p.DeletionScheduledAt.IsZero() {
+		resp.Data["deletion_scheduled_at"] = p.DeletionScheduledAt
+	}
+	if p.HDParent != "" {
+		resp.Data["hd_parent"] = p.HDParent
+		resp.Data["hd_path"] = p.HDPath
+	}
+
+	// Keys created before entropy scores were recorded have none
+	if entry, ok := p.Keys[strconv.Itoa(p.LatestVersion)]; ok && entry.EntropyScore > 0 {
+		resp.Data["entropy_score"] = entry.EntropyScore
+	}
+
+	switch p.Type {
+	case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+		resp.Data["allow_pkcs1v15_padding"] = p.AllowPKCS1v15Padding
+	case keysutil.KeyType_AES256_GCM96:
+		resp.Data["nonce_tracking"] = p.NonceTracking
+	}
+
+	switch p.Type {
+	case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305:
+		resp.Data["quarantine_on_auth_failure"] = p.QuarantineOnAuthFailure
+	}
+
 	if p.BackupInfo != nil {
 		resp.Data["backup_info"] = map[string]interface{}{
 			"time":    p.BackupInfo.Time,
@@ -246,6 +584,11 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 		}
 	}
 
+	versions, nextPageToken, err := keyVersionsPage(p, d.Get("page_size").(int), d.Get("page").(string))
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
 	contextRaw := d.Get("context").(string)
 	var context []byte
 	if len(contextRaw) != 0 {
@@ -255,17 +598,19 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 		}
 	}
 
+	var keys interface{}
 	switch p.Type {
 	case keysutil.KeyType_AES256_GCM96, keysutil.KeyType_ChaCha20_Poly1305:
 		retKeys := map[string]int64{}
-		for k, v := range p.Keys {
-			retKeys[k] = v.DeprecatedCreationTime
+		for _, k := range versions {
+			retKeys[k] = p.Keys[k].DeprecatedCreationTime
 		}
-		resp.Data["keys"] = retKeys
+		keys = retKeys
 
-	case keysutil.KeyType_ECDSA_P256, keysutil.KeyType_ED25519, keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
+	case keysutil.KeyType_ECDSA_P256, keysutil.KeyType_ED25519, keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096, keysutil.KeyType_X25519:
 		retKeys := map[string]map[string]interface{}{}
-		for k, v := range p.Keys {
+		for _, k := range versions {
+			v := p.Keys[k]
 			key := asymKey{
 				PublicKey:    v.FormattedPublicKey,
 				CreationTime: v.CreationTime,
@@ -295,6 +640,8 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 					}
 				}
 				key.Name = "ed25519"
+			case keysutil.KeyType_X25519:
+				key.Name = "x25519"
 			case keysutil.KeyType_RSA2048, keysutil.KeyType_RSA4096:
 				key.Name = "rsa-2048"
 				if p.Type == keysutil.KeyType_RSA4096 {
@@ -319,25 +666,273 @@ func (b *backend) pathPolicyRead(ctx context.Context, req *logical.Request, d *f
 			}
 
 			retKeys[k] = structs.New(key).Map()
+			if p.MaxSignUses > 0 || v.SignDisabled {
+				retKeys[k]["sign_uses"] = v.SignUses
+				retKeys[k]["sign_disabled"] = v.SignDisabled
+			}
+		}
+		keys = retKeys
+	}
+
+	keyIDs := map[string]string{}
+	for _, k := range versions {
+		ver, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("invalid version %q: {{err}}", k), err)
 		}
-		resp.Data["keys"] = retKeys
+		keyID, err := p.KeyID(ver)
+		if err != nil {
+			return nil, err
+		}
+		keyIDs[k] = keyID
+	}
+	resp.Data["key_ids"] = keyIDs
+
+	if d.Get("page_size").(int) > 0 {
+		resp.Data["versions"] = keys
+		resp.Data["total_versions"] = unarchivedVersions(p)
+		resp.Data["next_page_token"] = nextPageToken
+	} else if keys != nil {
+		resp.Data["keys"] = keys
 	}
 
 	return resp, nil
 }
 
+// unarchivedVersions returns the number of versions in the policy that have
+// not been archived
+func unarchivedVersions(p *keysutil.Policy) int {
+	count := 0
+	for _, entry := range p.Keys {
+		if entry.ArchivedTime.IsZero() {
+			count++
+		}
+	}
+	return count
+}
+
+// keyVersionsPage returns the key versions of the policy to include in a
+// read, in ascending order, leaving out archived versions. If pageSize is zero all versions are returned.
+// Otherwise at most pageSize versions are returned, starting at the version
+// encoded in pageToken, along with the token of the next page, which is
+// empty on the last page.
+func keyVersionsPage(p *keysutil.Policy, pageSize int, pageToken string) ([]string, string, error) {
+	if pageSize < 0 {
+		return nil, "", fmt.Errorf("page_size cannot be negative")
+	}
+
+	start := 0
+	if pageToken != "" {
+		if pageSize == 0 {
+			return nil, "", fmt.Errorf("page requires page_size to be set")
+		}
+		var err error
+		start, err = strconv.Atoi(pageToken)
+		if err != nil || start < 1 {
+			return nil, "", fmt.Errorf("invalid page token %q", pageToken)
+		}
+	}
+
+	var versions []int
+	for k, entry := range p.Keys {
+		ver, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid key version %q", k)
+		}
+		if ver >= start && entry.ArchivedTime.IsZero() {
+			versions = append(versions, ver)
+		}
+	}
+	sort.Ints(versions)
+
+	var nextPageToken string
+	if pageSize > 0 && len(versions) > pageSize {
+		nextPageToken = strconv.Itoa(versions[pageSize])
+		versions = versions[:pageSize]
+	}
+
+	ret := make([]string, 0, len(versions))
+	for _, ver := range versions {
+		ret = append(ret, strconv.Itoa(ver))
+	}
+	return ret, nextPageToken, nil
+}
+
 func (b *backend) pathPolicyDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 
-	// Delete does its own locking
-	err := b.lm.DeletePolicy(ctx, req.Storage, name)
+	// The status webhook of the key is read before it is deleted
+	p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, name)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("error deleting policy %s: %s", name, err)), err
+		return nil, err
 	}
 
+	schedule, permanent := deletionRules(p, d.Get("permanent").(bool))
+	if schedule {
+		scheduledAt, err := b.lm.ScheduleDeletion(ctx, req.Storage, name, permanent)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("error deleting policy %s: %s", name, err)), err
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"deletion_scheduled_at": scheduledAt,
+			},
+		}, nil
+	}
+
+	if err := b.deleteKey(ctx, req.Storage, name, p, permanent); err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error deleting policy %s: %s", name, err)), err
+	}
 	return nil, nil
 }
 
+// deletionRules returns whether a request to delete the key, whose metadata
+// is p, only schedules its deletion because its deletion grace period has not
+// passed, and whether the key is to be deleted permanently
+func deletionRules(p *keysutil.Policy, permanent bool) (bool, bool) {
+	if p == nil || p.DeletionGracePeriod == 0 || p.SoftDeleted {
+		return false, permanent
+	}
+	if p.DeletionScheduledAt.IsZero() || time.Now().Before(p.DeletionScheduledAt) {
+		return true, permanent
+	}
+	return false, permanent || p.DeletionScheduledPermanent
+}
+
+// deleteKey deletes the named key, soft-deleting it unless permanent is set,
+// and notifies its status webhook. p holds the key's metadata as read before
+// the deletion, if it exists.
+func (b *backend) deleteKey(ctx context.Context, s logical.Storage, name string, p *keysutil.Policy, permanent bool) error {
+	if permanent {
+		// Delete does its own locking
+		if err := b.lm.DeletePolicy(ctx, s, name); err != nil {
+			return err
+		}
+		if err := b.deleteNonceFilters(ctx, s, name); err != nil {
+			return err
+		}
+		if p != nil {
+			b.notifyKeyStatus(ctx, s, p, keyStatus(p), keyStatusDeleted)
+		}
+		return nil
+	}
+
+	keysConfig, err := b.getKeysConfig(ctx, s)
+	if err != nil {
+		return err
+	}
+	if err := b.lm.SoftDeletePolicy(ctx, s, name, keysConfig.RecoveryWindow); err != nil {
+		return err
+	}
+	if p != nil {
+		b.notifyKeyStatus(ctx, s, p, keyStatus(p), keyStatusScheduledForDeletion)
+	}
+	return nil
+}
+
+func (b *backend) pathKeysBulkDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names := strutil.RemoveDuplicates(d.Get("key_names").([]string), false)
+	if len(names) == 0 {
+		return logical.ErrorResponse("missing key names to delete"), logical.ErrInvalidRequest
+	}
+	permanent := d.Get("permanent").(bool)
+
+	// Every key is checked before any is deleted, so that either all of them
+	// are deleted or none. The status webhooks of the keys are read here too.
+	policies := make(map[string]*keysutil.Policy, len(names))
+	failedReasons := make(map[string]string)
+	for _, name := range names {
+		p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case p == nil:
+			failedReasons[name] = "could not delete key; not found"
+		case !p.DeletionAllowed:
+			failedReasons[name] = "deletion is not allowed for this key"
+		case p.SoftDeleted && !permanent:
+			failedReasons[name] = "key has already been soft-deleted"
+		}
+		policies[name] = p
+	}
+
+	// The keys are deleted following the same rules as a single key: keys
+	// with a deletion grace period are only scheduled for deletion, and the
+	// others are soft-deleted unless they are to be deleted permanently
+	var scheduleNames, softNames, permanentNames []string
+	if len(failedReasons) == 0 {
+		for _, name := range names {
+			schedule, keyPermanent := deletionRules(policies[name], permanent)
+			switch {
+			case schedule:
+				scheduleNames = append(scheduleNames, name)
+			case keyPermanent:
+				permanentNames = append(permanentNames, name)
+			default:
+				softNames = append(softNames, name)
+			}
+		}
+	}
+
+	if len(permanentNames) != 0 {
+		// Delete does its own locking
+		failed, err := b.lm.DeletePolicies(ctx, req.Storage, permanentNames)
+		if err != nil {
+			return nil, err
+		}
+		for name, err := range failed {
+			failedReasons[name] = err.Error()
+		}
+		if len(failed) == 0 {
+			for _, name := range permanentNames {
+				if err := b.deleteNonceFilters(ctx, req.Storage, name); err != nil {
+					return nil, err
+				}
+				p := policies[name]
+				b.notifyKeyStatus(ctx, req.Storage, p, keyStatus(p), keyStatusDeleted)
+			}
+		}
+	}
+	if len(failedReasons) != 0 {
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"deleted": []string{},
+				"failed":  failedReasons,
+			},
+		}, nil
+	}
+
+	for _, name := range softNames {
+		if err := b.deleteKey(ctx, req.Storage, name, policies[name], false); err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error deleting key %q: {{err}}", name), err)
+		}
+	}
+	scheduled := make(map[string]time.Time, len(scheduleNames))
+	for _, name := range scheduleNames {
+		scheduledAt, err := b.lm.ScheduleDeletion(ctx, req.Storage, name, permanent)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("error scheduling deletion of key %q: {{err}}", name), err)
+		}
+		scheduled[name] = scheduledAt
+	}
+
+	deleted := append(permanentNames, softNames...)
+	if deleted == nil {
+		deleted = []string{}
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"deleted":               deleted,
+			"deletion_scheduled_at": scheduled,
+			"failed":                failedReasons,
+		},
+	}, nil
+}
+
 const pathPolicyHelpSyn = `Managed named encryption keys`
 
 const pathPolicyHelpDesc = `
@@ -345,3 +940,22 @@ This path is used to manage the named keys that are available.
 Doing a write with no value against a new named key will create
 it using a randomly generated key.
 `
+
+const pathBulkDeleteHelpSyn = `Delete several named keys at once`
+
+const pathBulkDeleteHelpDesc = `
+This path deletes all of the given keys or none of them. Every key must exist
+and have deletion allowed; otherwise the keys that could not be deleted are
+returned under "failed" and no key is deleted. Keys are deleted as they would
+be one at a time: they are soft-deleted unless permanent is set, and keys with
+a deletion grace period are only scheduled for deletion, which is returned
+under "deletion_scheduled_at".
+`
+
+const pathListNamespacedKeysHelpSyn = `List the keys in a key namespace`
+
+const pathListNamespacedKeysHelpDesc = `
+This path lists the names of the keys in the given key_namespace. The names
+can be used together with key_namespace on the paths that address a key.
+Listing keys/ only returns keys without a namespace.
+`
@@ -0,0 +1,356 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const lifecyclePolicyPrefix = "lifecycle-policy/"
+
+// lifecyclePolicy is a named set of rotation and retention settings that can
+// be attached to any number of keys. Keys look the policy up whenever it is
+// needed, so updates apply to every attached key.
+type lifecyclePolicy struct {
+	// AutoRotatePeriod is the maximum age of the latest key version before
+	// the key is rotated automatically. Zero disables automatic rotation.
+	AutoRotatePeriod time.Duration `json:"auto_rotate_period"`
+
+	// MaxVersions is the number of most recent key versions that remain
+	// decryptable after a rotation. Zero means no limit.
+	MaxVersions int `json:"max_versions"`
+
+	// AutoMinDecryptionVersionLag has the same meaning as the key setting of
+	// the same name. A negative value leaves it unmanaged.
+	AutoMinDecryptionVersionLag int `json:"auto_min_decryption_version_lag"`
+}
+
+func (b *backend) pathListLifecyclePolicies() *framework.Path {
+	return &framework.Path{
+		Pattern: "lifecycle-policies/?$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ListOperation: b.pathLifecyclePoliciesList,
+		},
+
+		HelpSynopsis:    pathLifecyclePolicyHelpSyn,
+		HelpDescription: pathLifecyclePolicyHelpDesc,
+	}
+}
+
+func (b *backend) pathLifecyclePolicies() *framework.Path {
+	return &framework.Path{
+		Pattern: "lifecycle-policies/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the lifecycle policy",
+			},
+
+			"auto_rotate_period": &framework.FieldSchema{
+				Type: framework.TypeDurationSecond,
+				Description: `Maximum age of the latest version of an
+attached key before it is rotated automatically.
+Zero disables automatic rotation.`,
+			},
+
+			"max_versions": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `Number of most recent versions of an
+attached key that remain decryptable after a
+rotation. Zero means no limit.`,
+			},
+
+			"auto_min_decryption_version_lag": &framework.FieldSchema{
+				Type:    framework.TypeInt,
+				Default: -1,
+				Description: `Number of versions prior to the latest
+that remain decryptable after a rotation of an
+attached key. Negative values leave the key's own
+setting in effect.`,
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathLifecyclePolicyWrite,
+			logical.DeleteOperation: b.pathLifecyclePolicyDelete,
+			logical.ReadOperation:   b.pathLifecyclePolicyRead,
+		},
+
+		HelpSynopsis:    pathLifecyclePolicyHelpSyn,
+		HelpDescription: pathLifecyclePolicyHelpDesc,
+	}
+}
+
+func (b *backend) getLifecyclePolicy(ctx context.Context, s logical.Storage, name string) (*lifecyclePolicy, error) {
+	entry, err := s.Get(ctx, lifecyclePolicyPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var lp lifecyclePolicy
+	if err := entry.DecodeJSON(&lp); err != nil {
+		return nil, errwrap.Wrapf("failed to decode lifecycle policy: {{err}}", err)
+	}
+	return &lp, nil
+}
+
+func (b *backend) pathLifecyclePoliciesList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entries, err := req.Storage.List(ctx, lifecyclePolicyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return logical.ListResponse(entries), nil
+}
+
+func (b *backend) pathLifecyclePolicyRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	lp, err := b.getLifecyclePolicy(ctx, req.Storage, d.Get("name").(string))
+	if err != nil {
+		return nil, err
+	}
+	if lp == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"auto_rotate_period":              int64(lp.AutoRotatePeriod.Seconds()),
+			"max_versions":                    lp.MaxVersions,
+			"auto_min_decryption_version_lag": lp.AutoMinDecryptionVersionLag,
+		},
+	}, nil
+}
+
+func (b *backend) pathLifecyclePolicyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	lp, err := b.getLifecyclePolicy(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+	if lp == nil {
+		lp = &lifecyclePolicy{
+			AutoMinDecryptionVersionLag: -1,
+		}
+	}
+
+	if autoRotatePeriodRaw, ok := d.GetOk("auto_rotate_period"); ok {
+		lp.AutoRotatePeriod = time.Duration(autoRotatePeriodRaw.(int)) * time.Second
+	}
+	if maxVersionsRaw, ok := d.GetOk("max_versions"); ok {
+		lp.MaxVersions = maxVersionsRaw.(int)
+	}
+	if lagRaw, ok := d.GetOk("auto_min_decryption_version_lag"); ok {
+		lp.AutoMinDecryptionVersionLag = lagRaw.(int)
+	}
+
+	switch {
+	case lp.AutoRotatePeriod < 0:
+		return logical.ErrorResponse("auto rotate period cannot be negative"), logical.ErrInvalidRequest
+	case lp.AutoRotatePeriod > 0 && lp.AutoRotatePeriod < time.Hour:
+		return logical.ErrorResponse("auto rotate period must be at least one hour"), logical.ErrInvalidRequest
+	case lp.MaxVersions < 0:
+		return logical.ErrorResponse("max versions cannot be negative"), logical.ErrInvalidRequest
+	}
+
+	entry, err := logical.StorageEntryJSON(lifecyclePolicyPrefix+name, lp)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, req.Storage.Put(ctx, entry)
+}
+
+func (b *backend) pathLifecyclePolicyDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	// Keys cannot be attached to the policy until it is deleted
+	b.lifecyclePolicyLock.Lock()
+	defer b.lifecyclePolicyLock.Unlock()
+
+	keys, err := keysutil.ListPolicies(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, key)
+		if err != nil {
+			return nil, err
+		}
+		if p != nil && p.LifecyclePolicy == name {
+			return logical.ErrorResponse(fmt.Sprintf("lifecycle policy is still attached to key %q", key)), logical.ErrInvalidRequest
+		}
+	}
+
+	return nil, req.Storage.Delete(ctx, lifecyclePolicyPrefix+name)
+}
+
+// minDecryptionVersionLagSetting returns the auto_min_decryption_version_lag
+// setting of the key, -1 if it is not set
+func minDecryptionVersionLagSetting(p *keysutil.Policy) int {
+	if p.AutoMinDecryptionVersionLag == nil {
+		return -1
+	}
+	return *p.AutoMinDecryptionVersionLag
+}
+
+// minDecryptionVersionLag returns the number of versions prior to the latest
+// that must remain decryptable after the key is rotated, taking an attached
+// lifecycle policy into account. The boolean is false if the min decryption
+// version of the key is not managed automatically.
+func (b *backend) minDecryptionVersionLag(ctx context.Context, s logical.Storage, p *keysutil.Policy) (int, bool, error) {
+	var lag int
+	var ok bool
+	if p.AutoMinDecryptionVersionLag != nil {
+		lag, ok = *p.AutoMinDecryptionVersionLag, true
+	}
+	if p.LifecyclePolicy == "" {
+		return lag, ok, nil
+	}
+
+	lp, err := b.getLifecyclePolicy(ctx, s, p.LifecyclePolicy)
+	if err != nil {
+		return 0, false, err
+	}
+	if lp == nil {
+		return lag, ok, nil
+	}
+
+	if lp.AutoMinDecryptionVersionLag >= 0 {
+		lag, ok = lp.AutoMinDecryptionVersionLag, true
+	}
+	if lp.MaxVersions > 0 && (!ok || lp.MaxVersions-1 < lag) {
+		lag, ok = lp.MaxVersions-1, true
+	}
+
+	return lag, ok, nil
+}
+
+// autoRotateKeys rotates every key whose lifecycle policy has an auto rotate
+// period that the latest key version has outlived.
+func (b *backend) autoRotateKeys(ctx context.Context, s logical.Storage) error {
+	names, err := s.List(ctx, lifecyclePolicyPrefix)
+	if err != nil {
+		return err
+	}
+
+	periods := make(map[string]time.Duration, len(names))
+	for _, name := range names {
+		lp, err := b.getLifecyclePolicy(ctx, s, name)
+		if err != nil {
+			return err
+		}
+		if lp != nil && lp.AutoRotatePeriod > 0 {
+			periods[name] = lp.AutoRotatePeriod
+		}
+	}
+	if len(periods) == 0 {
+		return nil
+	}
+
+	keys, err := keysutil.ListPolicies(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	for _, key := range keys {
+		// Only keys attached to a policy with an auto rotate period are
+		// loaded with their key material and locked
+		metadata, err := keysutil.LoadPolicyMetadata(ctx, s, key)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if metadata == nil {
+			continue
+		}
+		if _, ok := periods[metadata.LifecyclePolicy]; !ok {
+			continue
+		}
+
+		p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+			Storage: s,
+			Name:    key,
+		})
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if !b.System().CachingDisabled() {
+			p.Lock(true)
+		}
+
+		if err := b.autoRotateKey(ctx, s, p, periods); err != nil {
+			errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to rotate key %q: {{err}}", key), err))
+		}
+		p.Unlock()
+	}
+
+	return errs.ErrorOrNil()
+}
+
+func (b *backend) autoRotateKey(ctx context.Context, s logical.Storage, p *keysutil.Policy, periods map[string]time.Duration) error {
+	period, ok := periods[p.LifecyclePolicy]
+	if !ok {
+		return nil
+	}
+
+	latest, ok := p.Keys[strconv.Itoa(p.LatestVersion)]
+	if !ok || time.Since(latest.CreationTime) < period {
+		return nil
+	}
+
+	return b.rotateKey(ctx, s, p)
+}
+
+// checkRotationOverdue returns an error if the key requires rotation and its
+// latest version has outlived the auto rotate period of its lifecycle policy
+func (b *backend) checkRotationOverdue(ctx context.Context, s logical.Storage, p *keysutil.Policy) error {
+	if !p.KeyRotationRequired || p.LifecyclePolicy == "" {
+		return nil
+	}
+
+	lp, err := b.getLifecyclePolicy(ctx, s, p.LifecyclePolicy)
+	if err != nil {
+		return err
+	}
+	if lp == nil || lp.AutoRotatePeriod <= 0 {
+		return nil
+	}
+
+	latest, ok := p.Keys[strconv.Itoa(p.LatestVersion)]
+	if !ok {
+		return nil
+	}
+	if age := time.Since(latest.CreationTime); age >= lp.AutoRotatePeriod {
+		return errutil.UserError{Err: fmt.Sprintf("key is overdue for rotation: latest version is %s old, auto rotate period is %s", age.Round(time.Second), lp.AutoRotatePeriod)}
+	}
+
+	return nil
+}
+
+const pathLifecyclePolicyHelpSyn = `Manage lifecycle policies that can be attached to keys`
+
+const pathLifecyclePolicyHelpDesc = `
+This path is used to manage named lifecycle policies. A lifecycle policy
+controls the automatic rotation period and the number of versions that
+remain decryptable for every key it is attached to. Keys reference a policy
+through their lifecycle_policy setting, and changes to the policy apply to
+all attached keys.
+`
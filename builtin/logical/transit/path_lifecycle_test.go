@@ -0,0 +1,317 @@
+package transit
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_LifecyclePolicy(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	doErrReq := func(op logical.Operation, path string, data map[string]interface{}) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	readMin := func(name string) int {
+		resp := doReq(logical.ReadOperation, "keys/"+name, nil)
+		return resp.Data["min_decryption_version"].(int)
+	}
+
+	// Attaching a policy that does not exist fails
+	doErrReq(logical.UpdateOperation, "keys/foo", map[string]interface{}{
+		"lifecycle_policy": "pci",
+	})
+
+	doReq(logical.UpdateOperation, "lifecycle-policies/pci", map[string]interface{}{
+		"max_versions": 3,
+	})
+	resp := doReq(logical.ReadOperation, "lifecycle-policies/pci", nil)
+	expected := map[string]interface{}{
+		"auto_rotate_period":              int64(0),
+		"max_versions":                    3,
+		"auto_min_decryption_version_lag": -1,
+	}
+	if !reflect.DeepEqual(resp.Data, expected) {
+		t.Fatalf("bad: expected %#v, got %#v", expected, resp.Data)
+	}
+
+	resp = doReq(logical.ListOperation, "lifecycle-policies/", nil)
+	if !reflect.DeepEqual(resp.Data["keys"], []string{"pci"}) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Attach at creation time and through config
+	doReq(logical.UpdateOperation, "keys/foo", map[string]interface{}{
+		"lifecycle_policy": "pci",
+	})
+	doReq(logical.UpdateOperation, "keys/bar", nil)
+	doReq(logical.UpdateOperation, "keys/bar/config", map[string]interface{}{
+		"lifecycle_policy": "pci",
+	})
+	resp = doReq(logical.ReadOperation, "keys/bar", nil)
+	if resp.Data["lifecycle_policy"] != "pci" {
+		t.Fatalf("bad: lifecycle_policy: %v", resp.Data["lifecycle_policy"])
+	}
+
+	for i := 0; i < 4; i++ {
+		doReq(logical.UpdateOperation, "keys/foo/rotate", nil)
+		doReq(logical.UpdateOperation, "keys/bar/rotate", nil)
+	}
+	// Latest version 5, three versions kept
+	for _, name := range []string{"foo", "bar"} {
+		if min := readMin(name); min != 3 {
+			t.Fatalf("%s: expected min decryption version 3, got %d", name, min)
+		}
+	}
+
+	// Updating the policy propagates to every attached key
+	doReq(logical.UpdateOperation, "lifecycle-policies/pci", map[string]interface{}{
+		"auto_min_decryption_version_lag": 0,
+	})
+	doReq(logical.UpdateOperation, "keys/foo/rotate", nil)
+	doReq(logical.UpdateOperation, "keys/bar/rotate", nil)
+	for _, name := range []string{"foo", "bar"} {
+		if min := readMin(name); min != 6 {
+			t.Fatalf("%s: expected min decryption version 6, got %d", name, min)
+		}
+	}
+
+	// A policy in use cannot be deleted
+	doErrReq(logical.DeleteOperation, "lifecycle-policies/pci", nil)
+
+	// Detached keys are no longer managed
+	doReq(logical.UpdateOperation, "keys/bar/config", map[string]interface{}{
+		"lifecycle_policy": "",
+	})
+	doReq(logical.UpdateOperation, "keys/bar/rotate", nil)
+	if min := readMin("bar"); min != 6 {
+		t.Fatalf("expected min decryption version 6, got %d", min)
+	}
+
+	doReq(logical.UpdateOperation, "keys/foo/config", map[string]interface{}{
+		"lifecycle_policy": "",
+	})
+	doReq(logical.DeleteOperation, "lifecycle-policies/pci", nil)
+	resp = doReq(logical.ReadOperation, "lifecycle-policies/pci", nil)
+	if resp != nil {
+		t.Fatalf("expected nil response after delete, got %#v", resp)
+	}
+
+	// Invalid settings
+	doErrReq(logical.UpdateOperation, "lifecycle-policies/bad", map[string]interface{}{
+		"max_versions": -1,
+	})
+	doErrReq(logical.UpdateOperation, "lifecycle-policies/bad", map[string]interface{}{
+		"auto_rotate_period": "10m",
+	})
+}
+
+func TestTransit_LifecyclePolicyAutoRotate(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+	}
+
+	doReq("lifecycle-policies/daily", map[string]interface{}{
+		"auto_rotate_period": "24h",
+		"max_versions":       2,
+	})
+	doReq("keys/foo", map[string]interface{}{
+		"lifecycle_policy": "daily",
+	})
+	doReq("keys/bar", nil)
+
+	getPolicy := func(name string) *keysutil.Policy {
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: storage,
+			Name:    name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	// Nothing is due yet
+	if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+		t.Fatal(err)
+	}
+	if p := getPolicy("foo"); p.LatestVersion != 1 {
+		t.Fatalf("expected latest version 1, got %d", p.LatestVersion)
+	}
+
+	// Age both keys past the rotation period
+	for _, name := range []string{"foo", "bar"} {
+		p := getPolicy(name)
+		entry := p.Keys[strconv.Itoa(p.LatestVersion)]
+		entry.CreationTime = time.Now().Add(-25 * time.Hour)
+		p.Keys[strconv.Itoa(p.LatestVersion)] = entry
+	}
+
+	for i := 2; i <= 3; i++ {
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: storage}); err != nil {
+			t.Fatal(err)
+		}
+		p := getPolicy("foo")
+		if p.LatestVersion != i {
+			t.Fatalf("expected latest version %d, got %d", i, p.LatestVersion)
+		}
+		entry := p.Keys[strconv.Itoa(p.LatestVersion)]
+		entry.CreationTime = time.Now().Add(-25 * time.Hour)
+		p.Keys[strconv.Itoa(p.LatestVersion)] = entry
+	}
+
+	p := getPolicy("foo")
+	if p.MinDecryptionVersion != 2 {
+		t.Fatalf("expected min decryption version 2, got %d", p.MinDecryptionVersion)
+	}
+
+	// Keys without a lifecycle policy are left alone, and are not even
+	// locked, so a key held by a long request does not stall the others
+	bar := getPolicy("bar")
+	if bar.LatestVersion != 1 {
+		t.Fatalf("expected latest version 1, got %d", bar.LatestVersion)
+	}
+	bar.Lock(true)
+	done := make(chan error, 1)
+	go func() {
+		done <- b.periodicFunc(context.Background(), &logical.Request{Storage: storage})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("automatic rotation waited on a key without a lifecycle policy")
+	}
+	bar.Unlock()
+}
+
+func TestTransit_KeyRotationRequired(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	encrypt := map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	}
+	ageLatestVersion := func(name string) {
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: storage,
+			Name:    name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry := p.Keys[strconv.Itoa(p.LatestVersion)]
+		entry.CreationTime = time.Now().Add(-25 * time.Hour)
+		p.Keys[strconv.Itoa(p.LatestVersion)] = entry
+	}
+
+	mustSucceed("lifecycle-policies/daily", map[string]interface{}{
+		"auto_rotate_period": "24h",
+	})
+	mustSucceed("keys/strict", map[string]interface{}{
+		"lifecycle_policy": "daily",
+	})
+	mustSucceed("keys/strict/config", map[string]interface{}{
+		"key_rotation_required": true,
+	})
+	mustSucceed("keys/lenient", map[string]interface{}{
+		"lifecycle_policy": "daily",
+	})
+
+	// Current keys encrypt
+	mustSucceed("encrypt/strict", encrypt)
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.ReadOperation,
+		Path:      "keys/strict",
+	})
+	if err != nil || resp.Data["key_rotation_required"] != true {
+		t.Fatalf("expected key_rotation_required to be set: err:%v resp:%#v", err, resp)
+	}
+
+	// Once rotation is overdue, only the key that requires it fails
+	ageLatestVersion("strict")
+	ageLatestVersion("lenient")
+	resp, err = doReq("encrypt/strict", encrypt)
+	if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), "overdue for rotation") {
+		t.Fatalf("expected overdue rotation error, got err:%v resp:%#v", err, resp)
+	}
+	resp, err = doReq("encrypt/strict", map[string]interface{}{
+		"preview_only": true,
+	})
+	if err == nil || resp == nil || !strings.Contains(resp.Error().Error(), "overdue for rotation") {
+		t.Fatalf("expected overdue rotation error on preview, got err:%v resp:%#v", err, resp)
+	}
+	mustSucceed("encrypt/lenient", encrypt)
+
+	// Rotating the key clears the condition
+	mustSucceed("keys/strict/rotate", nil)
+	mustSucceed("encrypt/strict", encrypt)
+
+	// Without an auto rotate period there is nothing to be overdue for
+	ageLatestVersion("strict")
+	mustSucceed("lifecycle-policies/daily", map[string]interface{}{
+		"auto_rotate_period": 0,
+	})
+	mustSucceed("encrypt/strict", encrypt)
+
+	mustSucceed("lifecycle-policies/daily", map[string]interface{}{
+		"auto_rotate_period": "24h",
+	})
+	mustSucceed("keys/strict/config", map[string]interface{}{
+		"key_rotation_required": false,
+	})
+	mustSucceed("encrypt/strict", encrypt)
+}
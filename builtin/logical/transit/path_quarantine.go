@@ -0,0 +1,143 @@
+package transit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/hashicorp/vault/helper/consts"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const quarantinePrefix = "quarantine/"
+
+// maxQuarantineEntries is the largest number of ciphertexts quarantined per
+// key. Failures of other ciphertexts are not recorded once it is reached, so
+// that callers cannot fill storage by submitting forged ciphertexts.
+const maxQuarantineEntries = 1000
+
+// quarantineEntry records a ciphertext that failed authentication. Only the
+// hash of the ciphertext is kept.
+type quarantineEntry struct {
+	CiphertextHash string    `json:"ciphertext_hash"`
+	Time           time.Time `json:"time"`
+}
+
+func (b *backend) pathQuarantine() *framework.Path {
+	return &framework.Path{
+		Pattern: "quarantine/" + framework.GenericNameRegex("name"),
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathQuarantineRead,
+		},
+
+		HelpSynopsis:    pathQuarantineHelpSyn,
+		HelpDescription: pathQuarantineHelpDesc,
+	}
+}
+
+// quarantineCiphertext records that the ciphertext failed authentication
+// with the named key. Repeated failures of the same ciphertext update the
+// time of the existing entry. Nothing is recorded on nodes that cannot write
+// to storage or once the key has maxQuarantineEntries entries. Failures are
+// logged rather than returned, so that they never change the decryption
+// error.
+func (b *backend) quarantineCiphertext(ctx context.Context, s logical.Storage, name, ciphertext string) {
+	if !b.System().LocalMount() && b.System().ReplicationState().HasState(consts.ReplicationPerformanceSecondary|consts.ReplicationPerformanceStandby) {
+		return
+	}
+
+	sum := sha256.Sum256([]byte(ciphertext))
+	hash := hex.EncodeToString(sum[:])
+	prefix := quarantinePrefix + name + "/"
+
+	b.quarantineLock.Lock()
+	defer b.quarantineLock.Unlock()
+
+	existing, err := s.Get(ctx, prefix+hash)
+	if err != nil {
+		b.Logger().Error("failed to quarantine ciphertext", "key", name, "error", err)
+		return
+	}
+	if existing == nil {
+		hashes, err := s.List(ctx, prefix)
+		if err != nil {
+			b.Logger().Error("failed to quarantine ciphertext", "key", name, "error", err)
+			return
+		}
+		if len(hashes) >= maxQuarantineEntries {
+			return
+		}
+	}
+
+	entry, err := logical.StorageEntryJSON(prefix+hash, &quarantineEntry{
+		CiphertextHash: hash,
+		Time:           time.Now().UTC(),
+	})
+	if err != nil {
+		b.Logger().Error("failed to quarantine ciphertext", "key", name, "error", err)
+		return
+	}
+	if err := s.Put(ctx, entry); err != nil {
+		b.Logger().Error("failed to quarantine ciphertext", "key", name, "error", err)
+	}
+}
+
+func (b *backend) pathQuarantineRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	prefix := quarantinePrefix + name + "/"
+	hashes, err := req.Storage.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]map[string]interface{}, 0, len(hashes))
+	for _, hash := range hashes {
+		raw, err := req.Storage.Get(ctx, prefix+hash)
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			continue
+		}
+		var entry quarantineEntry
+		if err := raw.DecodeJSON(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, map[string]interface{}{
+			"ciphertext_hash": entry.CiphertextHash,
+			"time":            entry.Time.Format(time.RFC3339Nano),
+		})
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"entries": entries,
+		},
+	}, nil
+}
+
+const pathQuarantineHelpSyn = `List the quarantined ciphertexts of a key`
+
+const pathQuarantineHelpDesc = `
+This path returns the ciphertexts that failed authentication when decrypted
+with the named key while its quarantine_on_auth_failure setting was enabled.
+Each entry holds the hex-encoded SHA-256 hash of the ciphertext as submitted
+and the time of its latest failure; the ciphertexts themselves are not kept.
+At most 1000 ciphertexts are recorded per key, and performance standbys and
+secondaries record none.
+`
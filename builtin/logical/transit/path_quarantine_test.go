@@ -0,0 +1,171 @@
+package transit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/consts"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_QuarantineOnAuthFailure(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	quarantined := func() []map[string]interface{} {
+		t.Helper()
+		resp := mustSucceed(logical.ReadOperation, "quarantine/key", nil)
+		return resp.Data["entries"].([]map[string]interface{})
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/rsa", map[string]interface{}{
+		"type": "rsa-2048",
+	})
+	mustFail(logical.UpdateOperation, "keys/rsa/config", map[string]interface{}{
+		"quarantine_on_auth_failure": true,
+	})
+
+	mustSucceed(logical.UpdateOperation, "keys/key", nil)
+	resp := mustSucceed(logical.UpdateOperation, "encrypt/key", map[string]interface{}{
+		"plaintext": base64.StdEncoding.EncodeToString([]byte("the quick brown fox")),
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+
+	// Flip a bit of the tag
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, "vault:v1:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	tampered := "vault:v1:" + base64.StdEncoding.EncodeToString(raw)
+
+	// Nothing is recorded until the key is configured
+	mustFail(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"ciphertext": tampered,
+	})
+	if entries := quarantined(); len(entries) != 0 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"quarantine_on_auth_failure": true,
+	})
+	resp = mustSucceed(logical.ReadOperation, "keys/key", nil)
+	if resp.Data["quarantine_on_auth_failure"] != true {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Valid ciphertexts and ciphertexts that fail before authentication, here
+	// for their malformed version, are not quarantined
+	mustSucceed(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	mustFail(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"ciphertext": "vault:vx:" + base64.StdEncoding.EncodeToString(raw),
+	})
+	if entries := quarantined(); len(entries) != 0 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+
+	resp = mustSucceed(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": ciphertext},
+			map[string]interface{}{"ciphertext": tampered},
+		},
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].Error != "" || results[1].Error == "" {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+
+	entries := quarantined()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %#v", entries)
+	}
+	sum := sha256.Sum256([]byte(tampered))
+	if entries[0]["ciphertext_hash"] != hex.EncodeToString(sum[:]) || entries[0]["time"] == "" {
+		t.Fatalf("bad entry: %#v", entries[0])
+	}
+
+	// The same ciphertext failing again keeps a single entry
+	mustFail(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"ciphertext": tampered,
+	})
+	if entries := quarantined(); len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %#v", entries)
+	}
+
+	// Once the key has the most entries allowed, other ciphertexts fail as
+	// before but are not recorded
+	for i := 1; i < maxQuarantineEntries; i++ {
+		entry, err := logical.StorageEntryJSON(fmt.Sprintf("%skey/filler-%d", quarantinePrefix, i), &quarantineEntry{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put(context.Background(), entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	raw[len(raw)-2] ^= 1
+	resp, err = doReq(logical.UpdateOperation, "decrypt/key", map[string]interface{}{
+		"ciphertext": "vault:v1:" + base64.StdEncoding.EncodeToString(raw),
+	})
+	if err != logical.ErrInvalidRequest || resp == nil || resp.Data["error"] != keysutil.ErrAuthenticationFailed {
+		t.Fatalf("expected authentication failure, got resp:%#v err:%v", resp, err)
+	}
+	if entries := quarantined(); len(entries) != maxQuarantineEntries {
+		t.Fatalf("expected %d entries, got %d", maxQuarantineEntries, len(entries))
+	}
+}
+
+func TestTransit_QuarantinePerfStandby(t *testing.T) {
+	sysView := logical.TestSystemView()
+	sysView.ReplicationStateVal = consts.ReplicationPerformanceStandby
+	storage := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: storage,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nodes that cannot write to storage skip quarantining
+	b.quarantineCiphertext(context.Background(), storage, "key", "vault:v1:AAAA")
+	keys, err := storage.List(context.Background(), quarantinePrefix+"key/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("unexpected entries: %#v", keys)
+	}
+}
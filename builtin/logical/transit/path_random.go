@@ -2,14 +2,28 @@ package transit
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"strconv"
 
 	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/namespace"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// namespaceSeedInfo is the HKDF info used when mixing the namespace
+	// fingerprint into random bytes
+	namespaceSeedInfo = "transit-random-namespace-seed"
+
+	// maxNamespaceSeedBytes is the largest output HKDF-SHA256 can produce
+	maxNamespaceSeedBytes = 255 * sha256.Size
 )
 
 func (b *backend) pathRandom() *framework.Path {
@@ -32,6 +46,31 @@ func (b *backend) pathRandom() *framework.Path {
 				Default:     "base64",
 				Description: `Encoding format to use. Can be "hex" or "base64". Defaults to "base64".`,
 			},
+
+			"namespace_seed": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, a fingerprint of the namespace of the
+request is mixed into the random bytes, so that output for
+different namespaces is independent. Limited to 8160 bytes.`,
+			},
+
+			"output_template": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `If set, a string is returned as "random_string"
+in place of random bytes. Each {rN} placeholder in the
+template is replaced with N random bits written in the
+charset; other text is copied as is. For example,
+"{r24}-{r24}-{r24}".`,
+			},
+
+			"charset": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "base62",
+				Description: `Alphabet used for the placeholders of
+output_template: "base62", "base58", "base32", "hex",
+"numeric", or the characters of a custom alphabet.
+Defaults to "base62".`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -57,6 +96,25 @@ func (b *backend) pathRandomWrite(ctx context.Context, req *logical.Request, d *
 	}
 	format := d.Get("format").(string)
 
+	if outputTemplate := d.Get("output_template").(string); outputTemplate != "" {
+		if d.Get("namespace_seed").(bool) {
+			return logical.ErrorResponse(`"namespace_seed" is not supported with "output_template"`), nil
+		}
+		alphabet, err := templateAlphabet(d.Get("charset").(string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		randomString, err := renderRandomTemplate(outputTemplate, alphabet, randomTemplateReader)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"random_string": randomString,
+			},
+		}, nil
+	}
+
 	if bytes < 1 {
 		return logical.ErrorResponse(`"bytes" cannot be less than 1`), nil
 	}
@@ -68,11 +126,27 @@ func (b *backend) pathRandomWrite(ctx context.Context, req *logical.Request, d *
 		return logical.ErrorResponse(fmt.Sprintf("unsupported encoding format %s; must be \"hex\" or \"base64\"", format)), nil
 	}
 
+	namespaceSeed := d.Get("namespace_seed").(bool)
+	if namespaceSeed && bytes > maxNamespaceSeedBytes {
+		return logical.ErrorResponse(fmt.Sprintf(`"bytes" cannot be more than %d when "namespace_seed" is set`, maxNamespaceSeedBytes)), nil
+	}
+
 	randBytes, err := uuid.GenerateRandomBytes(bytes)
 	if err != nil {
 		return nil, err
 	}
 
+	if namespaceSeed {
+		ns, err := namespace.FromContext(ctx)
+		if err != nil {
+			ns = namespace.RootNamespace
+		}
+		randBytes, err = mixNamespaceSeed(randBytes, ns.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	var retStr string
 	switch format {
 	case "hex":
@@ -90,6 +164,26 @@ func (b *backend) pathRandomWrite(ctx context.Context, req *logical.Request, d *
 	return resp, nil
 }
 
+// mixNamespaceSeed XORs a keystream derived with HKDF from the random bytes
+// and an HMAC fingerprint of the namespace ID into the random bytes. Output
+// for different namespaces is independent even if the system random source
+// were to return the same bytes for both.
+func mixNamespaceSeed(randBytes []byte, namespaceID string) ([]byte, error) {
+	fingerprint := hmac.New(sha256.New, []byte(namespaceID))
+	fingerprint.Write([]byte(namespaceSeedInfo))
+
+	stream := make([]byte, len(randBytes))
+	reader := hkdf.New(sha256.New, randBytes, fingerprint.Sum(nil), []byte(namespaceSeedInfo))
+	if _, err := io.ReadFull(reader, stream); err != nil {
+		return nil, err
+	}
+
+	for i := range stream {
+		stream[i] ^= randBytes[i]
+	}
+	return stream, nil
+}
+
 const pathRandomHelpSyn = `Generate random bytes`
 
 const pathRandomHelpDesc = `
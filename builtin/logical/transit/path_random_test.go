@@ -1,12 +1,17 @@
 package transit
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/hex"
+	"io"
 	"reflect"
+	"regexp"
 	"testing"
 
+	"github.com/hashicorp/vault/helper/namespace"
 	"github.com/hashicorp/vault/logical"
 )
 
@@ -97,3 +102,180 @@ func TestTransit_Random(t *testing.T) {
 	req.Data["bytes"] = -1
 	doRequest(req, true, "", 0)
 }
+
+func TestTransit_RandomNamespaceSeed(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	// The same raw randomness yields different output per namespace
+	randBytes := bytes.Repeat([]byte{0x42}, 64)
+	outputs := make(map[string][]byte)
+	for _, nsID := range []string{"root", "ns1", "ns2"} {
+		out, err := mixNamespaceSeed(randBytes, nsID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != len(randBytes) {
+			t.Fatalf("expected %d bytes, got %d", len(randBytes), len(out))
+		}
+		if bytes.Equal(out, randBytes) {
+			t.Fatalf("%s: output equals input", nsID)
+		}
+		for other, otherOut := range outputs {
+			if bytes.Equal(out, otherOut) {
+				t.Fatalf("%s and %s produced identical output", nsID, other)
+			}
+		}
+		outputs[nsID] = out
+
+		again, err := mixNamespaceSeed(randBytes, nsID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, again) {
+			t.Fatalf("%s: output is not deterministic", nsID)
+		}
+	}
+
+	doReq := func(ctx context.Context, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "random",
+			Data:      data,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	ctx := namespace.ContextWithNamespace(context.Background(), &namespace.Namespace{
+		ID:   "ns1",
+		Path: "ns1/",
+	})
+	for _, reqCtx := range []context.Context{context.Background(), ctx} {
+		resp := doReq(reqCtx, map[string]interface{}{
+			"bytes":          48,
+			"namespace_seed": true,
+		})
+		if resp.IsError() {
+			t.Fatalf("bad: %#v", resp)
+		}
+		out, err := base64.StdEncoding.DecodeString(resp.Data["random_bytes"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 48 {
+			t.Fatalf("expected 48 bytes, got %d", len(out))
+		}
+	}
+
+	resp := doReq(ctx, map[string]interface{}{
+		"bytes":          maxNamespaceSeedBytes + 1,
+		"namespace_seed": true,
+	})
+	if !resp.IsError() {
+		t.Fatalf("expected error, got %#v", resp)
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func TestTransit_RandomOutputTemplate(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      "random",
+			Data:      data,
+		})
+		if err != nil || resp == nil {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		return resp
+	}
+
+	// Entropy comes from crypto/rand
+	if randomTemplateReader != rand.Reader {
+		t.Fatal("output templates must draw from crypto/rand")
+	}
+	counter := &countingReader{r: rand.Reader}
+	randomTemplateReader = counter
+	defer func() { randomTemplateReader = rand.Reader }()
+
+	for _, tc := range []struct {
+		template, charset string
+		pattern           string
+		bytesRead         int
+	}{
+		// 24 bits need 5 base62 characters, as 62^4 < 2^24
+		{"{r24}-{r24}-{r24}", "", `^[0-9A-Za-z]{5}-[0-9A-Za-z]{5}-[0-9A-Za-z]{5}$`, 9},
+		{"INV-{r10}", "numeric", `^INV-[0-9]{4}$`, 2},
+		{"{r40}", "base32", `^[A-Z2-7]{8}$`, 5},
+		{"{r64}", "base58", `^[1-9A-HJ-NP-Za-km-z]{11}$`, 8},
+		{"{r8}", "ab", `^[ab]{8}$`, 1},
+		{"{r16}", "ünî", `^[ünî]{11}$`, 2},
+	} {
+		counter.n = 0
+		data := map[string]interface{}{"output_template": tc.template}
+		if tc.charset != "" {
+			data["charset"] = tc.charset
+		}
+		resp := doReq(data)
+		if resp.IsError() {
+			t.Fatalf("%s: %#v", tc.template, resp)
+		}
+		if _, ok := resp.Data["random_bytes"]; ok {
+			t.Fatalf("%s: unexpected random bytes", tc.template)
+		}
+		out := resp.Data["random_string"].(string)
+		if !regexp.MustCompile(tc.pattern).MatchString(out) {
+			t.Fatalf("%s: %q does not match %s", tc.template, out, tc.pattern)
+		}
+		if counter.n != tc.bytesRead {
+			t.Fatalf("%s: read %d random bytes, expected %d", tc.template, counter.n, tc.bytesRead)
+		}
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"output_template": "no placeholders"},
+		{"output_template": "{x8}"},
+		{"output_template": "{r8"},
+		{"output_template": "{r0}"},
+		{"output_template": "{r-8}"},
+		{"output_template": "{r8192}{r1}"},
+		{"output_template": "{r8}", "charset": "a"},
+		{"output_template": "{r8}", "charset": "abca"},
+		{"output_template": "{r8}", "namespace_seed": true},
+	} {
+		if resp := doReq(data); !resp.IsError() {
+			t.Fatalf("expected error for %#v, got %#v", data, resp)
+		}
+	}
+
+	// The bits of each placeholder are written in full, most significant
+	// digit first
+	alphabet, err := templateAlphabet("hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := renderRandomTemplate("{r12}:{r1}:{r16}", alphabet, bytes.NewReader([]byte{0xff, 0xff, 0xff, 0x00, 0x2a}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "fff:1:002a" {
+		t.Fatalf("bad output: %q", out)
+	}
+}
@@ -2,7 +2,13 @@ package transit
 
 import (
 	"context"
+	"encoding/base64"
+	"fmt"
+	"strconv"
 
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/jsonutil"
+	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -19,11 +25,35 @@ func (b *backend) pathRestore() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "If set, this will be the name of the restored key.",
 			},
+
+			"key_namespace": keyNamespaceSchema,
 			"force": &framework.FieldSchema{
 				Type:        framework.TypeBool,
 				Description: "If set and a key by the given name exists, force the restore operation and override the key.",
 				Default:     false,
 			},
+
+			"merge_versions": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the versions of the backed up key are
+appended to the history of the existing key of the
+same name, renumbered to follow its latest version.`,
+			},
+
+			"external_format": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the backup is a JWK set or PEM-encoded
+PKCS#8 keys rather than the output of the 'backup/'
+endpoint. A name must be given.`,
+			},
+
+			"min_entropy_score": &framework.FieldSchema{
+				Type:    framework.TypeString,
+				Default: "0.7",
+				Description: `Minimum entropy score, between 0 and 1, of
+the key material restored from an external format.
+Keys with a lower score are rejected.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -36,13 +66,123 @@ func (b *backend) pathRestore() *framework.Path {
 }
 
 func (b *backend) pathRestoreUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
 	backupB64 := d.Get("backup").(string)
 	force := d.Get("force").(bool)
 	if backupB64 == "" {
 		return logical.ErrorResponse("'backup' must be supplied"), nil
 	}
 
-	return nil, b.lm.RestorePolicy(ctx, req.Storage, d.Get("name").(string), backupB64, force)
+	if d.Get("merge_versions").(bool) {
+		if force || d.Get("external_format").(bool) {
+			return logical.ErrorResponse("merge_versions cannot be combined with force or external_format"), logical.ErrInvalidRequest
+		}
+
+		versionMap, err := b.lm.MergePolicyVersions(ctx, req.Storage, name, backupB64)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+
+		// Ciphertexts and signatures of the backed up key name their old
+		// version, so callers need the mapping to relabel them
+		mergedVersions := make(map[string]int, len(versionMap))
+		for oldVer, newVer := range versionMap {
+			mergedVersions[strconv.Itoa(oldVer)] = newVer
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"merged_versions": mergedVersions,
+			},
+		}, nil
+	}
+
+	restoredName := restoredKeyName(name, backupB64)
+	restore := func() error {
+		return b.lm.RestorePolicy(ctx, req.Storage, name, backupB64, force)
+	}
+	if d.Get("external_format").(bool) {
+		if name == "" {
+			return logical.ErrorResponse("a name is required when restoring from an external format"), nil
+		}
+
+		opts, err := b.externalRestoreOptions(ctx, req.Storage, d.Get("min_entropy_score").(string), force)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+
+		restore = func() error {
+			return b.lm.RestorePolicyExternal(ctx, req.Storage, name, backupB64, opts)
+		}
+	}
+
+	if err := b.createKey(ctx, req.Storage, restoredName, restore); err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// restoredKeyName returns the name the backup is restored under: the given
+// name, or else the name recorded in the backup. An empty name is returned
+// for a malformed backup, which the restore itself rejects.
+func restoredKeyName(name, backupB64 string) string {
+	if name != "" {
+		return name
+	}
+	backupBytes, err := base64.StdEncoding.DecodeString(backupB64)
+	if err != nil {
+		return ""
+	}
+	var keyData keysutil.KeyData
+	if err := jsonutil.DecodeJSON(backupBytes, &keyData); err != nil || keyData.Policy == nil {
+		return ""
+	}
+	return keyData.Policy.Name
+}
+
+// externalRestoreOptions returns the options that key material restored from
+// an external format is validated with, combining the requested minimum
+// entropy score with the mount's key configuration
+func (b *backend) externalRestoreOptions(ctx context.Context, storage logical.Storage, minEntropyScoreRaw string, force bool) (keysutil.ExternalRestoreOptions, error) {
+	minEntropyScore, err := strconv.ParseFloat(minEntropyScoreRaw, 64)
+	if err != nil || minEntropyScore < 0 || minEntropyScore > 1 {
+		return keysutil.ExternalRestoreOptions{}, errutil.UserError{Err: fmt.Sprintf("invalid min entropy score %q, must be a number between 0 and 1", minEntropyScoreRaw)}
+	}
+
+	keysConfig, err := b.getKeysConfig(ctx, storage)
+	if err != nil {
+		return keysutil.ExternalRestoreOptions{}, err
+	}
+	weakKeyPatterns, err := keysConfig.weakKeyPatterns()
+	if err != nil {
+		return keysutil.ExternalRestoreOptions{}, err
+	}
+
+	return keysutil.ExternalRestoreOptions{
+		Force:           force,
+		MinEntropyScore: minEntropyScore,
+		WeakKeyPatterns: weakKeyPatterns,
+		MaxChiSquared:   keysConfig.MaxKeyChiSquared,
+	}, nil
 }
 
 const pathRestoreHelpSyn = `Restore the named key`
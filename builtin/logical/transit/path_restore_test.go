@@ -73,6 +73,7 @@ func TestTransit_Restore(t *testing.T) {
 
 	// Delete the key to start test cases with clean slate
 	keyReq.Operation = logical.DeleteOperation
+	keyReq.Data = map[string]interface{}{"permanent": true}
 	resp, err = b.HandleRequest(context.Background(), keyReq)
 	if err != nil || (resp != nil && resp.IsError()) {
 		t.Fatalf("resp: %#v\nerr: %v", resp, err)
@@ -186,6 +187,7 @@ func TestTransit_Restore(t *testing.T) {
 
 			// cleanup / delete key after each run
 			keyReq.Operation = logical.DeleteOperation
+			keyReq.Data = map[string]interface{}{"permanent": true}
 			resp, err = b.HandleRequest(context.Background(), keyReq)
 			if err != nil || (resp != nil && resp.IsError()) {
 				t.Fatalf("resp: %#v\nerr: %v", resp, err)
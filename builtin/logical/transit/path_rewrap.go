@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"strings"
 
 	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/helper/errutil"
@@ -22,16 +23,61 @@ func (b *backend) pathRewrap() *framework.Path {
 				Description: "Name of the key",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"ciphertext": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Ciphertext value to rewrap",
 			},
 
+			"ciphertext_chunks": &framework.FieldSchema{
+				Type: framework.TypeStringSlice,
+				Description: `The ciphertext to rewrap as the chunks returned by
+encrypt with a chunk_size, in order. Cannot be
+combined with ciphertext.`,
+			},
+
 			"context": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Base64 encoded context for key derivation. Required for derived keys.",
 			},
 
+			"context_json": &framework.FieldSchema{
+				Type: framework.TypeMap,
+				Description: `
+JSON object used as the context for key derivation instead of "context". It is
+canonicalized and hashed with SHA-256, so key ordering does not matter. Only
+one of "context" and "context_json" may be set.`,
+			},
+
+			"associated_data": &framework.FieldSchema{
+				Type: framework.TypeString,
+				Description: `Base64 encoded associated data provided during
+encryption. It is authenticated along with the new
+ciphertext as well.`,
+			},
+
+			"bind_to_entity": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `Must be set if bind_to_entity was set during
+encryption. The new ciphertext is bound to the same
+entity.`,
+			},
+
+			"include_key_commitment": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `Must be set if include_key_commitment was set
+during encryption. The new ciphertext commits to the
+key as well.`,
+			},
+
+			"chunk_size": &framework.FieldSchema{
+				Type: framework.TypeInt,
+				Description: `If set, the new ciphertext is split into chunks
+of this many bytes and returned as ciphertext_chunks
+instead of ciphertext, as with encrypt.`,
+			},
+
 			"nonce": &framework.FieldSchema{
 				Type:        framework.TypeString,
 				Description: "Nonce for when convergent encryption is used",
@@ -43,6 +89,24 @@ func (b *backend) pathRewrap() *framework.Path {
 Must be 0 (for latest) or a value greater than or equal
 to the min_encryption_version configured on the key.`,
 			},
+
+			"force_latest_version": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the key is loaded again after the
+ciphertext is decrypted so that encryption uses the
+latest version even if the key was rotated while the
+request was being processed.`,
+			},
+
+			"dry_run": &framework.FieldSchema{
+				Type: framework.TypeBool,
+				Description: `If set, the ciphertext is decrypted to check
+that it is still valid, but is not re-encrypted.
+Returns whether it is valid, the version it was
+encrypted with, the latest version of the key and
+whether it needs to be rewrapped. No plaintext or
+ciphertext is returned.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -54,10 +118,23 @@ to the min_encryption_version configured on the key.`,
 	}
 }
 
+// rewrapDryRunItem reports on a ciphertext checked by a dry run rewrap
+type rewrapDryRunItem struct {
+	Valid                bool   `json:"valid" structs:"valid" mapstructure:"valid"`
+	DecryptableVersion   int    `json:"decryptable_version,omitempty" structs:"decryptable_version" mapstructure:"decryptable_version"`
+	CurrentLatestVersion int    `json:"current_latest_version" structs:"current_latest_version" mapstructure:"current_latest_version"`
+	NeedsRewrap          bool   `json:"needs_rewrap" structs:"needs_rewrap" mapstructure:"needs_rewrap"`
+	Error                string `json:"error,omitempty" structs:"error" mapstructure:"error"`
+}
+
 func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
 	batchInputRaw := d.Raw["batch_input"]
 	var batchInputItems []BatchRequestItem
-	var err error
 	if batchInputRaw != nil {
 		err = mapstructure.Decode(batchInputRaw, &batchInputItems)
 		if err != nil {
@@ -68,40 +145,62 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 			return logical.ErrorResponse("missing batch input to process"), logical.ErrInvalidRequest
 		}
 	} else {
-		ciphertext := d.Get("ciphertext").(string)
+		ciphertext, err := joinCiphertext(d.Get("ciphertext").(string), d.Get("ciphertext_chunks").([]string))
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
 		if len(ciphertext) == 0 {
 			return logical.ErrorResponse("missing ciphertext to decrypt"), logical.ErrInvalidRequest
 		}
 
 		batchInputItems = make([]BatchRequestItem, 1)
 		batchInputItems[0] = BatchRequestItem{
-			Ciphertext: ciphertext,
-			Context:    d.Get("context").(string),
-			Nonce:      d.Get("nonce").(string),
-			KeyVersion: d.Get("key_version").(int),
+			Ciphertext:     ciphertext,
+			Context:        d.Get("context").(string),
+			ContextJSON:    d.Get("context_json").(map[string]interface{}),
+			Nonce:          d.Get("nonce").(string),
+			KeyVersion:     d.Get("key_version").(int),
+			AssociatedData: d.Get("associated_data").(string),
 		}
 	}
 
+	chunkSize := d.Get("chunk_size").(int)
+	if chunkSize < 0 {
+		return logical.ErrorResponse("chunk_size cannot be negative"), logical.ErrInvalidRequest
+	}
+
 	batchResponseItems := make([]BatchResponseItem, len(batchInputItems))
-	contextSet := len(batchInputItems[0].Context) != 0
+	contextSet := batchInputItems[0].hasContext()
+	bindEntity := d.Get("bind_to_entity").(bool)
+	keyCommitment := d.Get("include_key_commitment").(bool)
+
+	// The padding, compression and derivation algorithm recorded in each
+	// ciphertext are carried over to its new ciphertext, which authenticates
+	// the same associated data, entity and key commitment
+	decryptOpts := make([]*keysutil.CipherOptions, len(batchInputItems))
+	encryptOpts := make([]*keysutil.CipherOptions, len(batchInputItems))
+	recordedOpts := make([]*keysutil.CipherOptions, len(batchInputItems))
 
 	for i, item := range batchInputItems {
-		if (len(item.Context) == 0 && contextSet) || (len(item.Context) != 0 && !contextSet) {
+		if item.hasContext() != contextSet {
 			return logical.ErrorResponse("context should be set either in all the request blocks or in none"), logical.ErrInvalidRequest
 		}
 
-		if item.Ciphertext == "" {
+		batchInputItems[i].Ciphertext, err = joinCiphertext(item.Ciphertext, item.CiphertextChunks)
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
+		if batchInputItems[i].Ciphertext == "" {
 			batchResponseItems[i].Error = "missing ciphertext to decrypt"
 			continue
 		}
 
 		// Decode the context
-		if len(item.Context) != 0 {
-			batchInputItems[i].DecodedContext, err = base64.StdEncoding.DecodeString(item.Context)
-			if err != nil {
-				batchResponseItems[i].Error = err.Error()
-				continue
-			}
+		batchInputItems[i].DecodedContext, err = item.decodeContext()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
 		}
 
 		// Decode the nonce
@@ -112,13 +211,43 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 				continue
 			}
 		}
+
+		// Decode the associated data
+		opts, err := batchInputItems[i].cipherOptions()
+		if err != nil {
+			batchResponseItems[i].Error = err.Error()
+			continue
+		}
+
+		if bindEntity {
+			if err := bindToEntity(opts, req.EntityID); err != nil {
+				batchResponseItems[i].Error = err.Error()
+				continue
+			}
+		}
+
+		if keyCommitment {
+			commitToKeyName(opts, name)
+		}
+
+		recordedOpts[i] = &keysutil.CipherOptions{}
+		decryptOpts[i] = &keysutil.CipherOptions{
+			AssociatedData: opts.AssociatedData,
+			PaddingMode:    opts.PaddingMode,
+			Recorded:       recordedOpts[i],
+		}
+		encryptOpts[i] = &keysutil.CipherOptions{
+			AssociatedData: opts.AssociatedData,
+			PaddingMode:    opts.PaddingMode,
+		}
 	}
 
 	// Get the policy
-	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+	polReq := keysutil.PolicyRequest{
 		Storage: req.Storage,
-		Name:    d.Get("name").(string),
-	})
+		Name:    name,
+	}
+	p, _, err := b.lm.GetPolicy(ctx, polReq)
 	if err != nil {
 		return nil, err
 	}
@@ -129,12 +258,55 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 		p.Lock(false)
 	}
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.authorizeDecryptNamespace(ctx, p); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	if resp, err := b.bindRequestClaims(p, req, decryptOpts...); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	// The bound HMAC and the registered prefix are taken off each ciphertext
+	// and the encoding of its payload is noted, so that the new ciphertext
+	// is returned in the same form
+	ciphertexts := make([]string, len(batchInputItems))
+	prefixed := make([]bool, len(batchInputItems))
+	hexEncoded := make([]bool, len(batchInputItems))
+	plaintexts := make([]string, len(batchInputItems))
 	for i, item := range batchInputItems {
 		if batchResponseItems[i].Error != "" {
 			continue
 		}
 
-		plaintext, err := p.Decrypt(item.DecodedContext, item.DecodedNonce, item.Ciphertext)
+		ciphertext := item.Ciphertext
+		if p.BoundHMACKey != "" {
+			// Verify and strip the bound HMAC before anything is decrypted
+			ciphertext, err = b.verifyBoundHMAC(ctx, req, p, ciphertext)
+			if err != nil {
+				switch err.(type) {
+				case errutil.UserError:
+					batchResponseItems[i].Error = err.Error()
+					continue
+				default:
+					p.Unlock()
+					return nil, err
+				}
+			}
+		}
+
+		stripped := stripCiphertextPrefix(p, ciphertext)
+		prefixed[i] = stripped != ciphertext
+		ciphertexts[i] = decodeHexCiphertext(stripped)
+		hexEncoded[i] = ciphertexts[i] != stripped
+
+		plaintexts[i], err = p.DecryptWithOptions(item.DecodedContext, item.DecodedNonce, ciphertexts[i], decryptOpts[i])
 		if err != nil {
 			switch err.(type) {
 			case errutil.UserError:
@@ -145,8 +317,114 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 				return nil, err
 			}
 		}
+	}
+
+	if d.Get("dry_run").(bool) {
+		results := make([]rewrapDryRunItem, len(batchInputItems))
+		for i := range batchInputItems {
+			results[i] = rewrapDryRunItem{
+				CurrentLatestVersion: p.LatestVersion,
+				Error:                batchResponseItems[i].Error,
+			}
+			if results[i].Error != "" {
+				continue
+			}
+
+			// The ciphertext decrypted, so its version is known to be good
+			ver, err := p.CiphertextVersion(ciphertexts[i])
+			if err != nil {
+				p.Unlock()
+				return nil, err
+			}
+			results[i].Valid = true
+			results[i].DecryptableVersion = ver
+			results[i].NeedsRewrap = ver < p.LatestVersion
+		}
+		p.Unlock()
+
+		if batchInputRaw != nil {
+			return &logical.Response{
+				Data: map[string]interface{}{
+					"batch_results": results,
+				},
+			}, nil
+		}
+		data := map[string]interface{}{
+			"valid":                  results[0].Valid,
+			"current_latest_version": results[0].CurrentLatestVersion,
+			"needs_rewrap":           results[0].NeedsRewrap,
+		}
+		if results[0].Valid {
+			data["decryptable_version"] = results[0].DecryptableVersion
+		} else {
+			data["error"] = results[0].Error
+		}
+		return &logical.Response{Data: data}, nil
+	}
+
+	if d.Get("force_latest_version").(bool) {
+		// Release the key and load it again so that a rotation which
+		// completed while the ciphertexts were being decrypted is picked up
+		// by the encryption step
+		p.Unlock()
+
+		p, _, err = b.lm.GetPolicy(ctx, polReq)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return logical.ErrorResponse("encryption key not found"), logical.ErrInvalidRequest
+		}
+		if !b.System().CachingDisabled() {
+			p.Lock(false)
+		}
+	}
+
+	// The key may have been reloaded, so its allowed subjects and namespaces
+	// are checked and its claims are bound again
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+	if resp, err := b.authorizeEncryptNamespace(ctx, p); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	for i := range batchInputItems {
+		if encryptOpts[i] != nil {
+			encryptOpts[i].PadTo = recordedOpts[i].PadTo
+			encryptOpts[i].CompressionLevel = recordedOpts[i].CompressionLevel
+			encryptOpts[i].DerivationAlgorithm = recordedOpts[i].DerivationAlgorithm
+		}
+	}
+	if resp, err := b.bindRequestClaims(p, req, encryptOpts...); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
+	// New ciphertexts are bound with the latest version of the HMAC key
+	var boundHMACVersion int
+	var boundHMACKey []byte
+	if p.BoundHMACKey != "" {
+		boundHMACVersion, boundHMACKey, err = b.linkedHMACKey(ctx, req, p, p.BoundHMACKey, 0)
+		if err != nil {
+			p.Unlock()
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+	}
+
+	for i, item := range batchInputItems {
+		if batchResponseItems[i].Error != "" {
+			continue
+		}
 
-		ciphertext, err := p.Encrypt(item.KeyVersion, item.DecodedContext, item.DecodedNonce, plaintext)
+		ciphertext, err := p.EncryptWithOptions(item.KeyVersion, item.DecodedContext, item.DecodedNonce, plaintexts[i], encryptOpts[i])
 		if err != nil {
 			switch err.(type) {
 			case errutil.UserError:
@@ -166,7 +444,28 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 			return nil, fmt.Errorf("empty ciphertext returned for input item %d", i)
 		}
 
-		batchResponseItems[i].Ciphertext = ciphertext
+		if hexEncoded[i] {
+			ciphertext, err = hexEncodeCiphertext(ciphertext)
+			if err != nil {
+				p.Unlock()
+				return nil, err
+			}
+		}
+
+		if prefixed[i] {
+			ciphertext = p.CiphertextPrefix + strings.TrimPrefix(ciphertext, ciphertextMarker)
+		}
+
+		if boundHMACKey != nil {
+			ciphertext = appendBoundHMAC(ciphertext, boundHMACVersion, boundHMACKey)
+		}
+
+		if chunkSize > 0 {
+			batchResponseItems[i].CiphertextChunks = chunkCiphertext(ciphertext, chunkSize)
+		} else {
+			batchResponseItems[i].Ciphertext = ciphertext
+		}
+		batchResponseItems[i].AADHash = aadHash(batchInputItems[i].DecodedAssociatedData)
 	}
 
 	resp := &logical.Response{}
@@ -179,8 +478,14 @@ func (b *backend) pathRewrapWrite(ctx context.Context, req *logical.Request, d *
 			p.Unlock()
 			return logical.ErrorResponse(batchResponseItems[0].Error), logical.ErrInvalidRequest
 		}
-		resp.Data = map[string]interface{}{
-			"ciphertext": batchResponseItems[0].Ciphertext,
+		resp.Data = map[string]interface{}{}
+		if chunkSize > 0 {
+			resp.Data["ciphertext_chunks"] = batchResponseItems[0].CiphertextChunks
+		} else {
+			resp.Data["ciphertext"] = batchResponseItems[0].Ciphertext
+		}
+		if batchResponseItems[0].AADHash != "" {
+			resp.Data["aad_hash"] = batchResponseItems[0].AADHash
 		}
 	}
 
@@ -194,5 +499,8 @@ const pathRewrapHelpDesc = `
 After key rotation, this function can be used to rewrap the given ciphertext or
 a batch of given ciphertext blocks with the latest version of the named key.
 If the given ciphertext is already using the latest version of the key, this
-function is a no-op.
+function is a no-op. The ciphertext is accepted in any form decrypt accepts,
+and the new ciphertext keeps its form: its prefix, payload encoding and bound
+HMAC, as well as the padding, compression, derivation algorithm, associated
+data, entity binding and key commitment it was encrypted with.
 `
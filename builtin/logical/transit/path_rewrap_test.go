@@ -2,9 +2,12 @@ package transit
 
 import (
 	"context"
+	"encoding/base64"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 )
 
@@ -293,3 +296,350 @@ func TestTransit_BatchRewrapCase3(t *testing.T) {
 		}
 	}
 }
+
+// rotatingStorage rotates the named key in storage right before the given
+// read of its policy, counting from 1
+type rotatingStorage struct {
+	logical.Storage
+	name         string
+	rotateOnRead int
+	reads        int
+	rotated      bool
+}
+
+func (s *rotatingStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if key == "policy/"+s.name {
+		s.reads++
+		if s.reads == s.rotateOnRead {
+			p, err := keysutil.LoadPolicyFromStorage(ctx, s.Storage, s.name)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.Rotate(ctx, s.Storage); err != nil {
+				return nil, err
+			}
+			s.rotated = true
+		}
+	}
+	return s.Storage.Get(ctx, key)
+}
+
+// Ensure that force_latest_version picks up a rotation that happens while the
+// rewrap is in progress
+func TestTransit_RewrapForceLatestVersion(t *testing.T) {
+	// With caching disabled the key is read from storage each time it is
+	// loaded, so the storage can rotate it between the decryption and the
+	// reload for encryption
+	sysView := logical.TestSystemView()
+	sysView.CachingDisabledVal = true
+	s := &logical.InmemStorage{}
+	conf := &logical.BackendConfig{
+		StorageView: s,
+		System:      sysView,
+	}
+	b := Backend(conf)
+	if err := b.Backend.Setup(context.Background(), conf); err != nil {
+		t.Fatal(err)
+	}
+
+	doReq := func(storage logical.Storage, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Storage:   storage,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		return resp
+	}
+
+	doReq(s, "keys/foo", nil)
+	resp := doReq(s, "encrypt/foo", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	ciphertext := resp.Data["ciphertext"].(string)
+	doReq(s, "keys/foo/rotate", nil)
+
+	resp = doReq(s, "rewrap/foo", map[string]interface{}{
+		"ciphertext": ciphertext,
+	})
+	if !strings.HasPrefix(resp.Data["ciphertext"].(string), "vault:v2:") {
+		t.Fatalf("bad: ciphertext version: expected: 'vault:v2', actual: %s", resp.Data["ciphertext"])
+	}
+
+	// Simulate a rotation racing with the rewrap: the key is rotated right
+	// after it is first loaded for decryption
+	rs := &rotatingStorage{
+		Storage:      s,
+		name:         "foo",
+		rotateOnRead: 2,
+	}
+	resp = doReq(rs, "rewrap/foo", map[string]interface{}{
+		"ciphertext":           ciphertext,
+		"force_latest_version": true,
+	})
+	if !rs.rotated {
+		t.Fatal("expected the key to be rotated during the rewrap")
+	}
+	if !strings.HasPrefix(resp.Data["ciphertext"].(string), "vault:v3:") {
+		t.Fatalf("bad: ciphertext version: expected: 'vault:v3', actual: %s", resp.Data["ciphertext"])
+	}
+}
+
+func TestTransit_RewrapDryRun(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	doReq("keys/foo", nil)
+	resp := doReq("encrypt/foo", map[string]interface{}{
+		"plaintext": "dGhlIHF1aWNrIGJyb3duIGZveA==",
+	})
+	v1Ciphertext := resp.Data["ciphertext"].(string)
+
+	// A ciphertext on the latest version is valid and needs no rewrap
+	resp = doReq("rewrap/foo", map[string]interface{}{
+		"ciphertext": v1Ciphertext,
+		"dry_run":    true,
+	})
+	expected := map[string]interface{}{
+		"valid":                  true,
+		"decryptable_version":    1,
+		"current_latest_version": 1,
+		"needs_rewrap":           false,
+	}
+	if !reflect.DeepEqual(resp.Data, expected) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// After rotation it needs a rewrap
+	doReq("keys/foo/rotate", nil)
+	resp = doReq("rewrap/foo", map[string]interface{}{
+		"ciphertext": v1Ciphertext,
+		"dry_run":    true,
+	})
+	expected["current_latest_version"] = 2
+	expected["needs_rewrap"] = true
+	if !reflect.DeepEqual(resp.Data, expected) {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// A tampered ciphertext is reported as invalid
+	payload := []byte(v1Ciphertext)
+	payload[len(payload)-5] ^= 0x01
+	resp = doReq("rewrap/foo", map[string]interface{}{
+		"ciphertext": string(payload),
+		"dry_run":    true,
+	})
+	if resp.Data["valid"] != false || resp.Data["error"] == "" || resp.Data["needs_rewrap"] != false {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+	if _, ok := resp.Data["decryptable_version"]; ok {
+		t.Fatalf("bad: %#v", resp.Data)
+	}
+
+	// Batches report on each item
+	resp = doReq("rewrap/foo", map[string]interface{}{
+		"dry_run": true,
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": v1Ciphertext},
+			map[string]interface{}{"ciphertext": string(payload)},
+		},
+	})
+	results := resp.Data["batch_results"].([]rewrapDryRunItem)
+	if !results[0].Valid || !results[0].NeedsRewrap || results[0].DecryptableVersion != 1 ||
+		results[1].Valid || results[1].Error == "" || results[1].CurrentLatestVersion != 2 {
+		t.Fatalf("bad: %#v", results)
+	}
+
+}
+
+func TestTransit_RewrapPreservesLabels(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	b64 := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	derivationContext := b64("context")
+
+	doReq("keys/foo", map[string]interface{}{
+		"derived": true,
+	})
+
+	padded := doReq("encrypt/foo", map[string]interface{}{
+		"plaintext":        b64("short"),
+		"context":          derivationContext,
+		"pad_plaintext_to": 64,
+	}).Data["ciphertext"].(string)
+	compressible := b64(strings.Repeat("the quick brown fox ", 50))
+	compressed := doReq("encrypt/foo", map[string]interface{}{
+		"plaintext":               compressible,
+		"context":                 derivationContext,
+		"compress_before_encrypt": true,
+	}).Data["ciphertext"].(string)
+	resp := doReq("datakey/plaintext/foo", map[string]interface{}{
+		"context":              derivationContext,
+		"derivation_algorithm": "hkdf-sha512",
+	})
+	datakey := resp.Data["plaintext"].(string)
+	derived := resp.Data["ciphertext"].(string)
+
+	doReq("keys/foo/rotate", nil)
+
+	cases := []struct {
+		ciphertext string
+		plaintext  string
+		prefix     string
+	}{
+		{padded, b64("short"), "vault:v2:pkcs7:"},
+		{compressed, compressible, "vault:v2:gzip:"},
+		{derived, datakey, "vault:v2:hkdf-sha512:"},
+	}
+	for _, tc := range cases {
+		rewrapped := doReq("rewrap/foo", map[string]interface{}{
+			"ciphertext": tc.ciphertext,
+			"context":    derivationContext,
+		}).Data["ciphertext"].(string)
+		if !strings.HasPrefix(rewrapped, tc.prefix) {
+			t.Fatalf("expected rewrapped ciphertext to start with %q, got %q", tc.prefix, rewrapped)
+		}
+		resp := doReq("decrypt/foo", map[string]interface{}{
+			"ciphertext": rewrapped,
+			"context":    derivationContext,
+		})
+		if resp.Data["plaintext"] != tc.plaintext {
+			t.Fatalf("bad plaintext for %q: %#v", tc.prefix, resp.Data)
+		}
+	}
+
+	// The padded length is kept, so the rewrapped ciphertext still hides
+	// the plaintext length
+	rewrapped := doReq("rewrap/foo", map[string]interface{}{
+		"ciphertext": padded,
+		"context":    derivationContext,
+	}).Data["ciphertext"].(string)
+	if len(rewrapped) != len(padded) {
+		t.Fatalf("expected rewrapped length %d, got %d", len(padded), len(rewrapped))
+	}
+}
+
+func TestTransit_RewrapPreservesForm(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+			EntityID:  "entity",
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	associatedData := base64.StdEncoding.EncodeToString([]byte("header"))
+	mustSucceed("keys/foo", nil)
+	mustSucceed("keys/foo/config", map[string]interface{}{
+		"ciphertext_prefix": "enc_",
+	})
+
+	chunks := mustSucceed("encrypt/foo", map[string]interface{}{
+		"plaintext":              plaintext,
+		"associated_data":        associatedData,
+		"bind_to_entity":         true,
+		"include_key_commitment": true,
+		"ciphertext_prefix":      "enc_",
+		"output_encoding":        "hex",
+		"chunk_size":             16,
+	}).Data["ciphertext_chunks"].([]string)
+
+	mustSucceed("keys/foo/rotate", nil)
+
+	// The associated data, entity binding and key commitment must be given
+	// as they would be to decrypt
+	rewrapData := map[string]interface{}{
+		"ciphertext_chunks":      chunks,
+		"associated_data":        associatedData,
+		"bind_to_entity":         true,
+		"include_key_commitment": true,
+	}
+	for _, field := range []string{"associated_data", "bind_to_entity", "include_key_commitment"} {
+		data := make(map[string]interface{})
+		for k, v := range rewrapData {
+			if k != field {
+				data[k] = v
+			}
+		}
+		if resp, err := doReq("rewrap/foo", data); err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected rewrap without %s to fail", field)
+		}
+	}
+
+	rewrapData["chunk_size"] = 16
+	resp := mustSucceed("rewrap/foo", rewrapData)
+	if resp.Data["aad_hash"] == nil {
+		t.Fatalf("expected aad_hash, got %#v", resp.Data)
+	}
+	rewrappedChunks := resp.Data["ciphertext_chunks"].([]string)
+	for _, chunk := range rewrappedChunks[:len(rewrappedChunks)-1] {
+		if len(chunk) != 16 {
+			t.Fatalf("bad chunks: %v", rewrappedChunks)
+		}
+	}
+
+	// The new ciphertext keeps the prefix and hex encoding and still
+	// authenticates the same associated data, entity and key
+	rewrapped := strings.Join(rewrappedChunks, "")
+	if !strings.HasPrefix(rewrapped, "enc_v2:") || decodeHexCiphertext(rewrapped) == rewrapped {
+		t.Fatalf("bad ciphertext: %s", rewrapped)
+	}
+	resp = mustSucceed("decrypt/foo", map[string]interface{}{
+		"ciphertext_chunks":      rewrappedChunks,
+		"associated_data":        associatedData,
+		"bind_to_entity":         true,
+		"include_key_commitment": true,
+	})
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad plaintext: %#v", resp.Data)
+	}
+	if resp, err := doReq("decrypt/foo", map[string]interface{}{
+		"ciphertext":      rewrapped,
+		"associated_data": associatedData,
+	}); err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected decryption without the entity binding and key commitment to fail")
+	}
+}
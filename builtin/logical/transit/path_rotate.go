@@ -2,7 +2,10 @@ package transit
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/keysutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -16,6 +19,8 @@ func (b *backend) pathRotate() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the key",
 			},
+
+			"key_namespace": keyNamespaceSchema,
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -28,7 +33,10 @@ func (b *backend) pathRotate() *framework.Path {
 }
 
 func (b *backend) pathRotateWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 
 	// Get the policy
 	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
@@ -44,12 +52,224 @@ func (b *backend) pathRotateWrite(ctx context.Context, req *logical.Request, d *
 	if !b.System().CachingDisabled() {
 		p.Lock(true)
 	}
+	defer p.Unlock()
+
+	if rotationQuorum(p) > 1 {
+		resp, err := b.requestRotation(ctx, req, p)
+		if err != nil {
+			switch err.(type) {
+			case errutil.UserError:
+				return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+			default:
+				return nil, err
+			}
+		}
+		return resp, nil
+	}
 
 	// Rotate the policy
-	err = p.Rotate(ctx, req.Storage)
+	return nil, b.rotateKey(ctx, req.Storage, p)
+}
+
+func (b *backend) pathRotateCheck() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/rotate-check",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathRotateCheckWrite,
+		},
+
+		HelpSynopsis:    pathRotateCheckHelpSyn,
+		HelpDescription: pathRotateCheckHelpDesc,
+	}
+}
+
+func (b *backend) pathRotateCheckWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(false)
+	}
+	defer p.Unlock()
+
+	issues, err := b.rotationIssues(ctx, req, p)
+	if err != nil {
+		return nil, err
+	}
 
-	p.Unlock()
-	return nil, err
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"ok": len(issues) == 0,
+		},
+	}
+	if len(issues) != 0 {
+		resp.Data["issues"] = issues
+	}
+	return resp, nil
+}
+
+// rotationIssues returns the reasons a rotation of the key requested by req
+// would fail or leave the key in breach of its settings, without modifying
+// any state. The caller must hold the policy's lock.
+func (b *backend) rotationIssues(ctx context.Context, req *logical.Request, p *keysutil.Policy) ([]string, error) {
+	var issues []string
+
+	if rotationQuorum(p) > 1 {
+		if _, err := rotationApprover(req); err != nil {
+			issues = append(issues, err.Error())
+		}
+
+		// Read the pending rotation directly, since getPendingRotation
+		// removes expired ones
+		entry, err := req.Storage.Get(ctx, pendingRotationPrefix+p.Name)
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			var pending pendingRotation
+			if err := entry.DecodeJSON(&pending); err != nil {
+				return nil, err
+			}
+			if time.Now().Before(pending.Expiration) {
+				issues = append(issues, fmt.Sprintf("a rotation of the key is already pending until %s", pending.Expiration.Format(time.RFC3339)))
+			}
+		}
+	}
+
+	// Work out the versions that would remain decryptable after the
+	// rotation, the same way rotateKey advances the min decryption version
+	latest := p.LatestVersion + 1
+	minDecryptionVersion := p.MinDecryptionVersion
+	lag, managed, err := b.minDecryptionVersionLag(ctx, req.Storage, p)
+	if err != nil {
+		return nil, err
+	}
+	if managed {
+		minDecryptionVersion = autoMinDecryptionVersion(minDecryptionVersion, p.MinEncryptionVersion, latest, lag)
+	}
+
+	if p.LifecyclePolicy != "" {
+		lp, err := b.getLifecyclePolicy(ctx, req.Storage, p.LifecyclePolicy)
+		if err != nil {
+			return nil, err
+		}
+		if lp != nil && lp.MaxVersions > 0 {
+			if decryptable := latest - minDecryptionVersion + 1; decryptable > lp.MaxVersions {
+				issues = append(issues, fmt.Sprintf("%d versions would remain decryptable, above the max_versions of %d of lifecycle policy %q; min_encryption_version %d holds back the min decryption version", decryptable, lp.MaxVersions, p.LifecyclePolicy, p.MinEncryptionVersion))
+			}
+		}
+	}
+
+	if p.MinAvailableVersion > minDecryptionVersion {
+		issues = append(issues, fmt.Sprintf("min decryption version %d would be less than min available version %d", minDecryptionVersion, p.MinAvailableVersion))
+	}
+	if p.MinAvailableVersion > p.MinEncryptionVersion {
+		issues = append(issues, fmt.Sprintf("min encryption version %d is less than min available version %d", p.MinEncryptionVersion, p.MinAvailableVersion))
+	}
+
+	switch p.EscrowKeyName {
+	case "":
+	case p.Name:
+		// The policy's lock is already held, so it is not looked up again
+		issues = append(issues, "a key cannot be its own escrow key")
+	default:
+		escrowPolicy, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+			Storage: req.Storage,
+			Name:    p.EscrowKeyName,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if escrowPolicy == nil {
+			issues = append(issues, fmt.Sprintf("escrow key %q not found", p.EscrowKeyName))
+		} else if b.System().CachingDisabled() {
+			escrowPolicy.Unlock()
+		}
+	}
+
+	return issues, nil
+}
+
+// rotateKey rotates the policy and reports the rotation. The new version is
+// escrowed if the key has an escrow key, and the min decryption version is
+// advanced if that is enabled, before the rotation is persisted, so that
+// either all of them happen or the key is not rotated.
+func (b *backend) rotateKey(ctx context.Context, storage logical.Storage, p *keysutil.Policy) error {
+	lag, managed, err := b.minDecryptionVersionLag(ctx, storage, p)
+	if err != nil {
+		return err
+	}
+
+	oldStatus := keyStatus(p)
+	priorStatus := p.Status
+	var advanced bool
+	err = p.RotateWithOptions(ctx, storage, &keysutil.RotateOptions{
+		BeforePersist: func() error {
+			p.Status = keyStatusRotated
+
+			// The version never moves backward and never passes a non-zero
+			// min encryption version
+			if managed {
+				minDecryptionVersion := autoMinDecryptionVersion(p.MinDecryptionVersion, p.MinEncryptionVersion, p.LatestVersion, lag)
+				if minDecryptionVersion != p.MinDecryptionVersion {
+					p.MinDecryptionVersion = minDecryptionVersion
+					p.Status = keyStatusMinDecryptionVersionAdvanced
+					advanced = true
+				}
+			}
+
+			// An escrow entry written for a rotation that then fails to
+			// persist is overwritten by the next rotation
+			if err := b.escrowKeyVersion(ctx, storage, p, p.LatestVersion); err != nil {
+				return fmt.Errorf("key was not rotated as its new version could not be escrowed: %v", err)
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		p.Status = priorStatus
+		return err
+	}
+
+	b.notifyKeyStatus(ctx, storage, p, oldStatus, keyStatusRotated)
+	if advanced {
+		b.notifyKeyStatus(ctx, storage, p, keyStatusRotated, keyStatusMinDecryptionVersionAdvanced)
+	}
+	return nil
+}
+
+// autoMinDecryptionVersion returns max(current, latest - lag), capped at
+// minEncryption if that is set.
+func autoMinDecryptionVersion(current, minEncryption, latest, lag int) int {
+	target := latest - lag
+	if minEncryption > 0 && target > minEncryption {
+		target = minEncryption
+	}
+	if target < current {
+		return current
+	}
+	return target
 }
 
 const pathRotateHelpSyn = `Rotate named encryption key`
@@ -58,4 +278,17 @@ const pathRotateHelpDesc = `
 This path is used to rotate the named key. After rotation,
 new encryption requests using this name will use the new key,
 but decryption will still be supported for older versions.
+If the key's rotation_quorum is above 1, the rotation is only
+requested and happens once it is approved.
+`
+
+const pathRotateCheckHelpSyn = `Check whether a key can be rotated`
+
+const pathRotateCheckHelpDesc = `
+This path reports whether rotating the named key would succeed and keep the
+key within its settings, without rotating it. It checks that a rotation that
+needs approvals can be requested, that the versions left decryptable stay
+within the max_versions of the key's lifecycle policy and above its min
+available version, and that the key's escrow key exists. The response holds
+ok and, if that is false, the issues found.
 `
@@ -0,0 +1,237 @@
+package transit
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_AutoMinDecryptionVersionArithmetic(t *testing.T) {
+	cases := []struct {
+		current, minEncryption, latest, lag int
+		expected                            int
+	}{
+		{1, 0, 1, 0, 1},
+		{1, 0, 2, 0, 2},
+		{1, 0, 5, 2, 3},
+		{1, 0, 2, 2, 1},
+		{1, 0, 3, 5, 1},
+		{4, 0, 5, 2, 4},
+		{1, 3, 10, 2, 3},
+		{1, 0, 100, 10, 90},
+		// never moves backward, even if the lag has since been raised
+		{7, 0, 8, 5, 7},
+	}
+
+	for _, tc := range cases {
+		actual := autoMinDecryptionVersion(tc.current, tc.minEncryption, tc.latest, tc.lag)
+		if actual != tc.expected {
+			t.Fatalf("current=%d min_encryption=%d latest=%d lag=%d: expected %d, got %d",
+				tc.current, tc.minEncryption, tc.latest, tc.lag, tc.expected, actual)
+		}
+	}
+}
+
+func TestTransit_RotateAutoMinDecryptionVersion(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		return resp
+	}
+	readMin := func() int {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.ReadOperation,
+			Path:      "keys/foo",
+		})
+		if err != nil || resp == nil || resp.IsError() {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		return resp.Data["min_decryption_version"].(int)
+	}
+
+	doReq("keys/foo", nil)
+
+	// Disabled by default
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 1 {
+		t.Fatalf("expected min decryption version 1, got %d", min)
+	}
+
+	doReq("keys/foo/config", map[string]interface{}{
+		"auto_min_decryption_version_lag": 2,
+	})
+
+	// latest 3, lag 2 -> 1
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 1 {
+		t.Fatalf("expected min decryption version 1, got %d", min)
+	}
+
+	// latest 4, lag 2 -> 2
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 2 {
+		t.Fatalf("expected min decryption version 2, got %d", min)
+	}
+
+	// Raising the lag must not move the version backward
+	doReq("keys/foo/config", map[string]interface{}{
+		"auto_min_decryption_version_lag": 4,
+	})
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 2 {
+		t.Fatalf("expected min decryption version 2, got %d", min)
+	}
+
+	// Lag of zero leaves only the latest version
+	doReq("keys/foo/config", map[string]interface{}{
+		"auto_min_decryption_version_lag": 0,
+	})
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 6 {
+		t.Fatalf("expected min decryption version 6, got %d", min)
+	}
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Storage:   storage,
+		Operation: logical.UpdateOperation,
+		Path:      "keys/foo/config",
+		Data: map[string]interface{}{
+			"auto_min_decryption_version_lag": -2,
+		},
+	})
+	if err == nil && (resp == nil || !resp.IsError()) {
+		t.Fatal("expected error for a lag below -1")
+	}
+
+	// A lag of -1 stops the advancement
+	doReq("keys/foo/config", map[string]interface{}{
+		"auto_min_decryption_version_lag": -1,
+	})
+	doReq("keys/foo/rotate", nil)
+	if min := readMin(); min != 6 {
+		t.Fatalf("expected min decryption version 6, got %d", min)
+	}
+}
+
+func TestTransit_RotateCheck(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(accessor, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:             s,
+			Operation:           logical.UpdateOperation,
+			Path:                path,
+			Data:                data,
+			ClientTokenAccessor: accessor,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	check := func(accessor, name string, expected ...string) {
+		t.Helper()
+		resp := doReq(accessor, "keys/"+name+"/rotate-check", nil)
+		issues, _ := resp.Data["issues"].([]string)
+		if resp.Data["ok"] != (len(expected) == 0) || len(issues) != len(expected) {
+			t.Fatalf("key %s: expected issues %q, got %#v", name, expected, resp.Data)
+		}
+		for i, substr := range expected {
+			if !strings.Contains(issues[i], substr) {
+				t.Fatalf("key %s: expected issue containing %q, got %q", name, substr, issues[i])
+			}
+		}
+	}
+	getPolicy := func(name string) *keysutil.Policy {
+		t.Helper()
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: s,
+			Name:    name,
+		})
+		if err != nil || p == nil {
+			t.Fatalf("err:%v policy:%v", err, p)
+		}
+		return p
+	}
+
+	// A passing check does not modify the key, and is followed by a
+	// successful rotation
+	doReq("", "keys/aes", nil)
+	before, err := s.Get(context.Background(), "policy/aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("", "aes")
+	after, err := s.Get(context.Background(), "policy/aes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(before.Value) != string(after.Value) {
+		t.Fatal("check modified the stored key")
+	}
+	doReq("", "keys/aes/rotate", nil)
+	if p := getPolicy("aes"); p.LatestVersion != 2 {
+		t.Fatalf("expected rotation to version 2, got %d", p.LatestVersion)
+	}
+
+	// Rotations that need approvals need an approver and no pending rotation
+	doReq("", "keys/quorum", nil)
+	doReq("", "keys/quorum/config", map[string]interface{}{
+		"rotation_quorum": 2,
+	})
+	check("", "quorum", "require a request with an entity or token")
+	check("accessor1", "quorum")
+	doReq("accessor1", "keys/quorum/rotate", nil)
+	check("accessor2", "quorum", "already pending")
+
+	// A min encryption version can keep more versions decryptable than the
+	// lifecycle policy allows
+	doReq("", "lifecycle-policies/short", map[string]interface{}{
+		"max_versions": 2,
+	})
+	doReq("", "keys/lifecycle", nil)
+	doReq("", "keys/lifecycle/config", map[string]interface{}{
+		"lifecycle_policy": "short",
+	})
+	doReq("", "keys/lifecycle/rotate", nil)
+	doReq("", "keys/lifecycle/rotate", nil)
+	check("", "lifecycle")
+	doReq("", "keys/lifecycle/config", map[string]interface{}{
+		"min_encryption_version": 2,
+	})
+	check("", "lifecycle", "above the max_versions of 2")
+
+	// Keys whose versions were trimmed past their min decryption or
+	// encryption version are reported
+	doReq("", "keys/trimmed", nil)
+	doReq("", "keys/trimmed/rotate", nil)
+	p := getPolicy("trimmed")
+	p.MinAvailableVersion = 2
+	if err := p.Persist(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	check("", "trimmed", "min decryption version 1", "min encryption version 0")
+
+	// The escrow key must exist
+	doReq("", "keys/escrowed", nil)
+	p = getPolicy("escrowed")
+	p.EscrowKeyName = "missing"
+	if err := p.Persist(context.Background(), s); err != nil {
+		t.Fatal(err)
+	}
+	check("", "escrowed", `escrow key "missing" not found`)
+}
@@ -0,0 +1,259 @@
+package transit
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const pendingRotationPrefix = "pending-rotations/"
+
+// defaultRotationQuorumTTL is how long a pending rotation collects approvals
+// unless the key sets rotation_quorum_ttl
+const defaultRotationQuorumTTL = 24 * time.Hour
+
+// pendingRotation is a rotation request waiting for approvals. Only the hash
+// of its approval token is stored.
+type pendingRotation struct {
+	ApprovalTokenHash string    `json:"approval_token_hash"`
+	Approvers         []string  `json:"approvers"`
+	Expiration        time.Time `json:"expiration"`
+}
+
+// rotationQuorum returns the number of approvers a rotation of the key needs
+func rotationQuorum(p *keysutil.Policy) int {
+	if p.RotationQuorum < 1 {
+		return 1
+	}
+	return p.RotationQuorum
+}
+
+// rotationQuorumTTL returns how long a pending rotation of the key collects
+// approvals
+func rotationQuorumTTL(p *keysutil.Policy) time.Duration {
+	if p.RotationQuorumTTL == 0 {
+		return defaultRotationQuorumTTL
+	}
+	return p.RotationQuorumTTL
+}
+
+// rotationApprover identifies who made the request, by entity if it has one
+// so that an entity's several tokens count once, otherwise by token
+func rotationApprover(req *logical.Request) (string, error) {
+	switch {
+	case req.EntityID != "":
+		return "entity:" + req.EntityID, nil
+	case req.ClientTokenAccessor != "":
+		return "token:" + req.ClientTokenAccessor, nil
+	default:
+		return "", errutil.UserError{Err: "rotations that need approval require a request with an entity or token"}
+	}
+}
+
+func hashApprovalToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *backend) pathApproveRotation() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/approve-rotation",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+
+			"approval_token": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "The approval token returned by the rotate endpoint",
+			},
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathApproveRotationWrite,
+		},
+
+		HelpSynopsis:    pathApproveRotationHelpSyn,
+		HelpDescription: pathApproveRotationHelpDesc,
+	}
+}
+
+// requestRotation starts a pending rotation of a key that needs approvals,
+// with the requester as its first approver. The caller must hold the policy's
+// write lock.
+func (b *backend) requestRotation(ctx context.Context, req *logical.Request, p *keysutil.Policy) (*logical.Response, error) {
+	approver, err := rotationApprover(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := getPendingRotation(ctx, req.Storage, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, errutil.UserError{Err: fmt.Sprintf("a rotation of the key is already pending until %s", pending.Expiration.Format(time.RFC3339))}
+	}
+
+	token, err := uuid.GenerateUUID()
+	if err != nil {
+		return nil, err
+	}
+	pending = &pendingRotation{
+		ApprovalTokenHash: hashApprovalToken(token),
+		Approvers:         []string{approver},
+		Expiration:        time.Now().Add(rotationQuorumTTL(p)).UTC(),
+	}
+	if err := putPendingRotation(ctx, req.Storage, p.Name, pending); err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"status":          "pending",
+			"approval_token":  token,
+			"approvals":       len(pending.Approvers),
+			"rotation_quorum": rotationQuorum(p),
+			"expiration":      pending.Expiration.Format(time.RFC3339),
+		},
+	}, nil
+}
+
+func (b *backend) pathApproveRotationWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	token := d.Get("approval_token").(string)
+	if token == "" {
+		return logical.ErrorResponse("missing approval_token"), logical.ErrInvalidRequest
+	}
+
+	p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: req.Storage,
+		Name:    name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return logical.ErrorResponse("key not found"), logical.ErrInvalidRequest
+	}
+	if !b.System().CachingDisabled() {
+		p.Lock(true)
+	}
+	defer p.Unlock()
+
+	resp, err := b.approveRotation(ctx, req, p, token)
+	if err != nil {
+		switch err.(type) {
+		case errutil.UserError:
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		default:
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// approveRotation adds the requester's approval to the pending rotation of
+// the key and rotates it once the quorum is reached
+func (b *backend) approveRotation(ctx context.Context, req *logical.Request, p *keysutil.Policy, token string) (*logical.Response, error) {
+	approver, err := rotationApprover(req)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := getPendingRotation(ctx, req.Storage, p.Name)
+	if err != nil {
+		return nil, err
+	}
+	if pending == nil || subtle.ConstantTimeCompare([]byte(hashApprovalToken(token)), []byte(pending.ApprovalTokenHash)) != 1 {
+		return nil, errutil.UserError{Err: "no pending rotation of the key matches the approval token"}
+	}
+	if strutil.StrListContains(pending.Approvers, approver) {
+		return nil, errutil.UserError{Err: "the rotation has already been approved by the requester"}
+	}
+	pending.Approvers = append(pending.Approvers, approver)
+
+	if len(pending.Approvers) < rotationQuorum(p) {
+		if err := putPendingRotation(ctx, req.Storage, p.Name, pending); err != nil {
+			return nil, err
+		}
+		return &logical.Response{
+			Data: map[string]interface{}{
+				"status":          "pending",
+				"approvals":       len(pending.Approvers),
+				"rotation_quorum": rotationQuorum(p),
+				"expiration":      pending.Expiration.Format(time.RFC3339),
+			},
+		}, nil
+	}
+
+	if err := req.Storage.Delete(ctx, pendingRotationPrefix+p.Name); err != nil {
+		return nil, err
+	}
+	if err := b.rotateKey(ctx, req.Storage, p); err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"status":         "rotated",
+			"approvals":      len(pending.Approvers),
+			"latest_version": p.LatestVersion,
+		},
+	}, nil
+}
+
+// getPendingRotation returns the pending rotation of the named key, or nil if
+// there is none. Expired rotations are removed and not returned.
+func getPendingRotation(ctx context.Context, s logical.Storage, name string) (*pendingRotation, error) {
+	entry, err := s.Get(ctx, pendingRotationPrefix+name)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, nil
+	}
+
+	var pending pendingRotation
+	if err := entry.DecodeJSON(&pending); err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(pending.Expiration) {
+		return nil, s.Delete(ctx, pendingRotationPrefix+name)
+	}
+	return &pending, nil
+}
+
+func putPendingRotation(ctx context.Context, s logical.Storage, name string, pending *pendingRotation) error {
+	entry, err := logical.StorageEntryJSON(pendingRotationPrefix+name, pending)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, entry)
+}
+
+const pathApproveRotationHelpSyn = `Approve a pending rotation of a key`
+
+const pathApproveRotationHelpDesc = `
+When a key's rotation_quorum is above 1, the rotate endpoint only starts a
+pending rotation and returns an approval token. This path adds the approval of
+the requesting entity, or of the requesting token if it has no entity, to the
+pending rotation. The key is rotated once the number of distinct approvers,
+counting the one who requested the rotation, reaches the quorum. Pending
+rotations expire after the key's rotation_quorum_ttl.
+`
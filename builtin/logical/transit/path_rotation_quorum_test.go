@@ -0,0 +1,134 @@
+package transit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_RotationQuorum(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(accessor string, op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:             s,
+			Operation:           op,
+			Path:                path,
+			Data:                data,
+			ClientTokenAccessor: accessor,
+		})
+	}
+	mustSucceed := func(accessor string, op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(accessor, op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(accessor string, op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(accessor, op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+	latestVersion := func() int {
+		t.Helper()
+		return mustSucceed("", logical.ReadOperation, "keys/key", nil).Data["latest_version"].(int)
+	}
+	approve := func(accessor, token string) *logical.Response {
+		t.Helper()
+		return mustSucceed(accessor, logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+			"approval_token": token,
+		})
+	}
+
+	mustSucceed("", logical.UpdateOperation, "keys/key", nil)
+	resp := mustSucceed("", logical.ReadOperation, "keys/key", nil)
+	if resp.Data["rotation_quorum"] != 1 || resp.Data["rotation_quorum_ttl"] != int64(86400) {
+		t.Fatalf("bad defaults: %#v", resp.Data)
+	}
+	mustFail("", logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"rotation_quorum": 0,
+	})
+
+	// Without a quorum the key rotates at once
+	mustSucceed("", logical.UpdateOperation, "keys/key/rotate", nil)
+	if v := latestVersion(); v != 2 {
+		t.Fatalf("expected version 2, got %d", v)
+	}
+
+	mustSucceed("", logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"rotation_quorum":     3,
+		"rotation_quorum_ttl": "1h",
+	})
+
+	// Requests need an identity for their approvals to be counted
+	mustFail("", logical.UpdateOperation, "keys/key/rotate", nil)
+
+	resp = mustSucceed("alice", logical.UpdateOperation, "keys/key/rotate", nil)
+	if resp.Data["status"] != "pending" || resp.Data["approvals"] != 1 || resp.Data["rotation_quorum"] != 3 {
+		t.Fatalf("bad pending rotation: %#v", resp.Data)
+	}
+	token := resp.Data["approval_token"].(string)
+
+	// Only one rotation can be pending, and approvals need the right token
+	// and distinct approvers
+	mustFail("bob", logical.UpdateOperation, "keys/key/rotate", nil)
+	mustFail("bob", logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+		"approval_token": "not-the-token",
+	})
+	mustFail("alice", logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+		"approval_token": token,
+	})
+
+	resp = approve("bob", token)
+	if resp.Data["status"] != "pending" || resp.Data["approvals"] != 2 {
+		t.Fatalf("bad approval: %#v", resp.Data)
+	}
+	mustFail("bob", logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+		"approval_token": token,
+	})
+	if v := latestVersion(); v != 2 {
+		t.Fatalf("rotated before the quorum was reached: version %d", v)
+	}
+
+	resp = approve("carol", token)
+	if resp.Data["status"] != "rotated" || resp.Data["latest_version"] != 3 {
+		t.Fatalf("bad final approval: %#v", resp.Data)
+	}
+	if v := latestVersion(); v != 3 {
+		t.Fatalf("expected version 3, got %d", v)
+	}
+
+	// The token is spent once the key has rotated
+	mustFail("dave", logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+		"approval_token": token,
+	})
+
+	// Expired rotations cannot be approved and do not block new ones
+	resp = mustSucceed("alice", logical.UpdateOperation, "keys/key/rotate", nil)
+	token = resp.Data["approval_token"].(string)
+	approve("bob", token)
+	pending, err := getPendingRotation(context.Background(), s, "key")
+	if err != nil || pending == nil {
+		t.Fatalf("failed to load pending rotation: %v", err)
+	}
+	pending.Expiration = time.Now().Add(-time.Second)
+	if err := putPendingRotation(context.Background(), s, "key", pending); err != nil {
+		t.Fatal(err)
+	}
+	mustFail("carol", logical.UpdateOperation, "keys/key/approve-rotation", map[string]interface{}{
+		"approval_token": token,
+	})
+	if v := latestVersion(); v != 3 {
+		t.Fatalf("expired rotation was applied: version %d", v)
+	}
+	resp = mustSucceed("alice", logical.UpdateOperation, "keys/key/rotate", nil)
+	if resp.Data["approvals"] != 1 || resp.Data["approval_token"] == token {
+		t.Fatalf("bad new pending rotation: %#v", resp.Data)
+	}
+}
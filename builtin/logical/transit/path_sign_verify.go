@@ -2,8 +2,16 @@ package transit
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/keysutil"
@@ -11,6 +19,12 @@ import (
 	"github.com/hashicorp/vault/logical/framework"
 )
 
+const (
+	messageEncodingBase64    = "base64"
+	messageEncodingBase64URL = "base64url"
+	messageEncodingHex       = "hex"
+)
+
 func (b *backend) pathSign() *framework.Path {
 	return &framework.Path{
 		Pattern: "sign/" + framework.GenericNameRegex("name") + framework.OptionalParamRegex("urlalgorithm"),
@@ -20,11 +34,20 @@ func (b *backend) pathSign() *framework.Path {
 				Description: "The key to use",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"input": {
 				Type:        framework.TypeString,
 				Description: "The base64-encoded input data",
 			},
 
+			"message_encoding": {
+				Type:    framework.TypeString,
+				Default: messageEncodingBase64,
+				Description: `The encoding of 'input'. Valid values are "base64",
+"base64url" and "hex". Defaults to "base64".`,
+			},
+
 			"context": {
 				Type: framework.TypeString,
 				Description: `Base64 encoded context for key derivation. Required if key
@@ -80,6 +103,45 @@ Options are 'pss' or 'pkcs1v15'. Defaults to 'pss'`,
 				Default:     "asn1",
 				Description: `The method by which to marshal the signature. The default is 'asn1' which is used by openssl and X.509. It can also be set to 'jws' which is used for JWT signatures; setting it to this will also cause the encoding of the signature to be url-safe base64 instead of using standard base64 encoding. Currently only valid for ECDSA P-256 key types".`,
 			},
+
+			"output_format": {
+				Type: framework.TypeString,
+				Description: `If set to 'json-ecdsa', the R and S components of the
+signature are returned as separate base64-encoded values
+along with the key version, instead of a single
+signature string. Only valid for ECDSA P-256 keys.`,
+			},
+
+			"merkle_tree_leaves": {
+				Type: framework.TypeStringSlice,
+				Description: `Base64-encoded SHA-256 leaf hashes. If set, the root
+of the Merkle tree over the leaves is signed instead of
+'input', and the root and tree are returned.`,
+			},
+
+			"signature_context": {
+				Type: framework.TypeString,
+				Description: `Base64-encoded context that is bound into the
+signature. The same context must be given to verify it.
+Cannot be combined with 'prehashed'.`,
+			},
+
+			"detached": {
+				Type: framework.TypeBool,
+				Description: `Set to 'true' to make a detached signature, to be
+stored apart from 'input'. The response holds the
+signature but never the signed data. Cannot be combined
+with 'merkle_tree_leaves', whose root is returned.`,
+			},
+
+			"include_timestamp": {
+				Type: framework.TypeBool,
+				Description: `Set to 'true' to sign the current time along with
+the input, so that verification can reject stale
+signatures with 'freshness_ttl'. The timestamp is
+appended to the signature. Cannot be combined with
+'prehashed' or output format 'json-ecdsa'.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -100,6 +162,8 @@ func (b *backend) pathVerify() *framework.Path {
 				Description: "The key to use",
 			},
 
+			"key_namespace": keyNamespaceSchema,
+
 			"context": {
 				Type: framework.TypeString,
 				Description: `Base64 encoded context for key derivation. Required if key
@@ -121,6 +185,35 @@ derivation is enabled; currently only available with ed25519 keys.`,
 				Description: "The base64-encoded input data to verify",
 			},
 
+			"detached": {
+				Type: framework.TypeBool,
+				Description: `Set to 'true' to verify a detached signature. Both
+'input' and 'signature' must then be given explicitly.`,
+			},
+
+			"message_encoding": {
+				Type:    framework.TypeString,
+				Default: messageEncodingBase64,
+				Description: `The encoding of 'input'. Valid values are "base64",
+"base64url" and "hex". Defaults to "base64".`,
+			},
+
+			"timestamp_nonce": {
+				Type: framework.TypeBool,
+				Description: `Must be set to verify an HMAC generated with
+timestamp_nonce. The HMAC is accepted if it was
+generated in the current 30-second window or the
+ones next to it.`,
+			},
+
+			"constant_time_verify": {
+				Type:    framework.TypeBool,
+				Default: true,
+				Description: `When verifying an HMAC, compare it in time that
+does not depend on its length or contents. Defaults
+to true.`,
+			},
+
 			"urlalgorithm": {
 				Type:        framework.TypeString,
 				Description: `Hash algorithm to use (POST URL parameter)`,
@@ -162,6 +255,48 @@ Options are 'pss' or 'pkcs1v15'. Defaults to 'pss'`,
 				Default:     "asn1",
 				Description: `The method by which to unmarshal the signature when verifying. The default is 'asn1' which is used by openssl and X.509; can also be set to 'jws' which is used for JWT signatures in which case the signature is also expected to be url-safe base64 encoding instead of standard base64 encoding. Currently only valid for ECDSA P-256 key types".`,
 			},
+
+			"input_format": {
+				Type: framework.TypeString,
+				Description: `If set to 'json-ecdsa', the signature is given by the
+'r', 's' and 'key_version' parameters instead of
+'signature'. Only valid for ECDSA P-256 keys.`,
+			},
+
+			"merkle_tree_leaves": {
+				Type: framework.TypeStringSlice,
+				Description: `Base64-encoded SHA-256 leaf hashes. If set, the
+signature is verified over the root of the Merkle tree
+over the leaves instead of 'input'.`,
+			},
+
+			"signature_context": {
+				Type: framework.TypeString,
+				Description: `Base64-encoded context that was bound into the
+signature when it was created.`,
+			},
+
+			"r": {
+				Type:        framework.TypeString,
+				Description: "The base64-encoded R component of an ECDSA signature, used with input_format 'json-ecdsa'",
+			},
+
+			"s": {
+				Type:        framework.TypeString,
+				Description: "The base64-encoded S component of an ECDSA signature, used with input_format 'json-ecdsa'",
+			},
+
+			"key_version": {
+				Type:        framework.TypeInt,
+				Description: "The version of the key that created the signature, used with input_format 'json-ecdsa'",
+			},
+
+			"freshness_ttl": {
+				Type: framework.TypeDurationSecond,
+				Description: `If set, the signature must have been made with
+'include_timestamp', and is only valid if its timestamp
+is within this duration of the current time.`,
+			},
 		},
 
 		Callbacks: map[logical.Operation]framework.OperationFunc{
@@ -174,7 +309,10 @@ Options are 'pss' or 'pkcs1v15'. Defaults to 'pss'`,
 }
 
 func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	ver := d.Get("key_version").(int)
 	inputB64 := d.Get("input").(string)
 	hashAlgorithmStr := d.Get("urlalgorithm").(string)
@@ -196,12 +334,47 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse(fmt.Sprintf("invalid marshaling type %q", marshalingStr)), logical.ErrInvalidRequest
 	}
 
+	outputFormat := d.Get("output_format").(string)
+	switch outputFormat {
+	case "":
+	case "json-ecdsa":
+		if marshaling != keysutil.MarshalingTypeASN1 {
+			return logical.ErrorResponse("output format 'json-ecdsa' cannot be combined with 'jws' marshaling"), logical.ErrInvalidRequest
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid output format %q", outputFormat)), logical.ErrInvalidRequest
+	}
+
 	prehashed := d.Get("prehashed").(bool)
 	sigAlgorithm := d.Get("signature_algorithm").(string)
 
-	input, err := base64.StdEncoding.DecodeString(inputB64)
+	includeTimestamp := d.Get("include_timestamp").(bool)
+	if includeTimestamp && (prehashed || outputFormat == "json-ecdsa") {
+		return logical.ErrorResponse("'include_timestamp' cannot be combined with 'prehashed' or output format 'json-ecdsa'"), logical.ErrInvalidRequest
+	}
+
+	if _, ok := d.GetOk("merkle_tree_leaves"); ok && d.Get("detached").(bool) {
+		return logical.ErrorResponse("'detached' cannot be combined with 'merkle_tree_leaves'"), logical.ErrInvalidRequest
+	}
+
+	input, tree, err := signatureInput(inputB64, d)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("unable to decode input as base64: %s", err)), logical.ErrInvalidRequest
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	keysConfig, err := b.getKeysConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	input, err = bindSignatureContext(input, d, prehashed, keysConfig.RequireSignatureContext)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	var timestamp time.Time
+	if includeTimestamp {
+		timestamp = signatureTimestampNow()
+		input = timestampedSignatureInput(input, timestamp.UnixNano())
 	}
 
 	// Get the policy
@@ -217,6 +390,18 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 	}
 	if !b.System().CachingDisabled() {
 		p.Lock(false)
+
+		// Keys that limit their signatures are locked exclusively, so that
+		// the use count of the version can be updated and persisted
+		if p.MaxSignUses > 0 {
+			p.Unlock()
+			p.Lock(true)
+		}
+	}
+
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
 	}
 
 	if !p.Type.SigningSupported() {
@@ -224,6 +409,11 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 		return logical.ErrorResponse(fmt.Sprintf("key type %v does not support signing", p.Type)), logical.ErrInvalidRequest
 	}
 
+	if outputFormat == "json-ecdsa" && p.Type != keysutil.KeyType_ECDSA_P256 {
+		p.Unlock()
+		return logical.ErrorResponse(fmt.Sprintf("output format 'json-ecdsa' is not supported for key type %v", p.Type)), logical.ErrInvalidRequest
+	}
+
 	contextRaw := d.Get("context").(string)
 	var context []byte
 	if len(contextRaw) != 0 {
@@ -240,6 +430,11 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 		input = hf.Sum(nil)
 	}
 
+	if err := checkSignEnabled(p, ver); err != nil {
+		p.Unlock()
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
 	sig, err := p.Sign(ver, context, input, hashAlgorithm, sigAlgorithm, marshaling)
 	if err != nil {
 		p.Unlock()
@@ -250,17 +445,48 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 		return nil, fmt.Errorf("signature could not be computed")
 	}
 
+	if p.MaxSignUses > 0 {
+		if err := recordSignUse(ctx, req.Storage, p, sig.KeyVersion); err != nil {
+			p.Unlock()
+			return nil, err
+		}
+	}
+
 	// Generate the response
-	resp := &logical.Response{
-		Data: map[string]interface{}{
+	resp := &logical.Response{}
+	if outputFormat == "json-ecdsa" {
+		resp.Data = map[string]interface{}{
+			"r":           base64.StdEncoding.EncodeToString(sig.R.Bytes()),
+			"s":           base64.StdEncoding.EncodeToString(sig.S.Bytes()),
+			"key_version": sig.KeyVersion,
+		}
+	} else {
+		resp.Data = map[string]interface{}{
 			"signature": sig.Signature,
-		},
+		}
+	}
+
+	if includeTimestamp {
+		resp.Data["signature"] = fmt.Sprintf("%s%s%d", sig.Signature, signatureTimestampSeparator, timestamp.UnixNano())
+		resp.Data["timestamp"] = timestamp.UTC().Format(time.RFC3339Nano)
 	}
 
 	if len(sig.PublicKey) > 0 {
 		resp.Data["public_key"] = sig.PublicKey
 	}
 
+	if tree != nil {
+		levels := make([][]string, len(tree))
+		for i, level := range tree {
+			levels[i] = make([]string, len(level))
+			for j, node := range level {
+				levels[i][j] = base64.StdEncoding.EncodeToString(node)
+			}
+		}
+		resp.Data["merkle_root"] = levels[len(levels)-1][0]
+		resp.Data["merkle_tree"] = levels
+	}
+
 	p.Unlock()
 	return resp, nil
 }
@@ -268,7 +494,34 @@ func (b *backend) pathSignWrite(ctx context.Context, req *logical.Request, d *fr
 func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	sig := d.Get("signature").(string)
 	hmac := d.Get("hmac").(string)
+
+	inputFormat := d.Get("input_format").(string)
+	switch inputFormat {
+	case "":
+	case "json-ecdsa":
+		if sig != "" || hmac != "" {
+			return logical.ErrorResponse("'signature' and 'hmac' cannot be used with input format 'json-ecdsa'"), logical.ErrInvalidRequest
+		}
+		if d.Get("r").(string) == "" || d.Get("s").(string) == "" {
+			return logical.ErrorResponse("input format 'json-ecdsa' requires 'r' and 's'"), logical.ErrInvalidRequest
+		}
+	default:
+		return logical.ErrorResponse(fmt.Sprintf("invalid input format %q", inputFormat)), logical.ErrInvalidRequest
+	}
+
+	if d.Get("detached").(bool) {
+		if _, ok := d.GetOk("input"); !ok {
+			return logical.ErrorResponse("detached verification requires 'input'"), logical.ErrInvalidRequest
+		}
+		if sig == "" {
+			return logical.ErrorResponse("detached verification requires 'signature'"), logical.ErrInvalidRequest
+		}
+	}
+
 	switch {
+	case inputFormat == "json-ecdsa":
+		// The signature is assembled from r and s once the key is loaded
+
 	case sig != "" && hmac != "":
 		return logical.ErrorResponse("provide one of 'signature' or 'hmac'"), logical.ErrInvalidRequest
 
@@ -279,7 +532,10 @@ func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *
 		return b.pathHMACVerify(ctx, req, d, hmac)
 	}
 
-	name := d.Get("name").(string)
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
 	inputB64 := d.Get("input").(string)
 	hashAlgorithmStr := d.Get("urlalgorithm").(string)
 	if hashAlgorithmStr == "" {
@@ -303,9 +559,33 @@ func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *
 	prehashed := d.Get("prehashed").(bool)
 	sigAlgorithm := d.Get("signature_algorithm").(string)
 
-	input, err := base64.StdEncoding.DecodeString(inputB64)
+	input, _, err := signatureInput(inputB64, d)
 	if err != nil {
-		return logical.ErrorResponse(fmt.Sprintf("unable to decode input as base64: %s", err)), logical.ErrInvalidRequest
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	keysConfig, err := b.getKeysConfig(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	input, err = bindSignatureContext(input, d, prehashed, keysConfig.RequireSignatureContext)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	sig, timestamp, hasTimestamp, err := splitSignatureTimestamp(sig)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+	freshnessTTL := time.Duration(d.Get("freshness_ttl").(int)) * time.Second
+	switch {
+	case freshnessTTL < 0:
+		return logical.ErrorResponse("'freshness_ttl' cannot be negative"), logical.ErrInvalidRequest
+	case freshnessTTL > 0 && !hasTimestamp:
+		return logical.ErrorResponse("'freshness_ttl' requires a signature made with 'include_timestamp'"), logical.ErrInvalidRequest
+	}
+	if hasTimestamp {
+		input = timestampedSignatureInput(input, timestamp)
 	}
 
 	// Get the policy
@@ -323,11 +603,33 @@ func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *
 		p.Lock(false)
 	}
 
+	if resp, err := b.authorizeSubject(p, req); resp != nil || err != nil {
+		p.Unlock()
+		return resp, err
+	}
+
 	if !p.Type.SigningSupported() {
 		p.Unlock()
 		return logical.ErrorResponse(fmt.Sprintf("key type %v does not support verification", p.Type)), logical.ErrInvalidRequest
 	}
 
+	if inputFormat == "json-ecdsa" {
+		if p.Type != keysutil.KeyType_ECDSA_P256 {
+			p.Unlock()
+			return logical.ErrorResponse(fmt.Sprintf("input format 'json-ecdsa' is not supported for key type %v", p.Type)), logical.ErrInvalidRequest
+		}
+		if marshaling != keysutil.MarshalingTypeASN1 {
+			p.Unlock()
+			return logical.ErrorResponse("input format 'json-ecdsa' cannot be combined with 'jws' marshaling"), logical.ErrInvalidRequest
+		}
+
+		sig, err = ecdsaJSONSignature(p, d.Get("key_version").(int), d.Get("r").(string), d.Get("s").(string))
+		if err != nil {
+			p.Unlock()
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
+	}
+
 	contextRaw := d.Get("context").(string)
 	var context []byte
 	if len(contextRaw) != 0 {
@@ -359,6 +661,14 @@ func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *
 		}
 	}
 
+	// The timestamp is only trusted once the signature over it verifies.
+	// Timestamps too far in the future are rejected as well, which allows
+	// for the same clock skew either way.
+	if valid && freshnessTTL > 0 {
+		age := signatureTimestampNow().Sub(time.Unix(0, timestamp))
+		valid = age <= freshnessTTL && age >= -freshnessTTL
+	}
+
 	// Generate the response
 	resp := &logical.Response{
 		Data: map[string]interface{}{
@@ -370,6 +680,221 @@ func (b *backend) pathVerifyWrite(ctx context.Context, req *logical.Request, d *
 	return resp, nil
 }
 
+// signatureTimestampSeparator separates a signature from the Unix nanosecond
+// timestamp appended to it by include_timestamp. It cannot occur in the
+// encoded signature that precedes it.
+const signatureTimestampSeparator = ":ts"
+
+// signatureTimestampNow returns the time signed by include_timestamp and
+// checked by freshness_ttl. Tests replace it to backdate signatures.
+var signatureTimestampNow = time.Now
+
+// timestampedSignatureInput prepends the Unix nanosecond timestamp to the
+// input as an 8-byte big-endian integer
+func timestampedSignatureInput(input []byte, timestamp int64) []byte {
+	buf := make([]byte, 8, 8+len(input))
+	binary.BigEndian.PutUint64(buf, uint64(timestamp))
+	return append(buf, input...)
+}
+
+// splitSignatureTimestamp removes the timestamp appended by
+// include_timestamp, if any, from the signature
+func splitSignatureTimestamp(sig string) (string, int64, bool, error) {
+	idx := strings.LastIndex(sig, signatureTimestampSeparator)
+	if idx == -1 {
+		return sig, 0, false, nil
+	}
+	suffix := sig[idx+len(signatureTimestampSeparator):]
+	if suffix == "" || strings.Trim(suffix, "0123456789") != "" {
+		return sig, 0, false, nil
+	}
+
+	timestamp, err := strconv.ParseInt(suffix, 10, 64)
+	if err != nil {
+		return "", 0, false, fmt.Errorf("invalid signature timestamp %q", suffix)
+	}
+	return sig[:idx], timestamp, true, nil
+}
+
+// signatureInput returns the data to sign or verify: the input decoded per
+// message_encoding, or the root of the Merkle tree over merkle_tree_leaves if
+// set, in which case the levels of the tree are returned as well.
+func signatureInput(rawInput string, d *framework.FieldData) ([]byte, [][][]byte, error) {
+	encoding := d.Get("message_encoding").(string)
+	switch encoding {
+	case messageEncodingBase64, messageEncodingBase64URL, messageEncodingHex:
+	default:
+		return nil, nil, fmt.Errorf("invalid message encoding %q", encoding)
+	}
+
+	leavesRaw, ok := d.GetOk("merkle_tree_leaves")
+	if !ok {
+		input, err := decodeMessage(rawInput, encoding)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode input as %s: %s", encoding, err)
+		}
+		return input, nil, nil
+	}
+
+	if rawInput != "" {
+		return nil, nil, fmt.Errorf("'input' and 'merkle_tree_leaves' cannot both be set")
+	}
+
+	leavesB64 := leavesRaw.([]string)
+	if len(leavesB64) == 0 {
+		return nil, nil, fmt.Errorf("'merkle_tree_leaves' must contain at least one leaf")
+	}
+	leaves := make([][]byte, len(leavesB64))
+	for i, leafB64 := range leavesB64 {
+		leaf, err := base64.StdEncoding.DecodeString(leafB64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode leaf %d as base64: %s", i, err)
+		}
+		if len(leaf) != sha256.Size {
+			return nil, nil, fmt.Errorf("leaf %d must be a %d-byte SHA-256 hash", i, sha256.Size)
+		}
+		leaves[i] = leaf
+	}
+
+	tree := merkleTree(leaves)
+	return tree[len(tree)-1][0], tree, nil
+}
+
+// decodeMessage decodes input in the given message encoding. URL-safe base64
+// is accepted with or without padding.
+func decodeMessage(input, encoding string) ([]byte, error) {
+	switch encoding {
+	case messageEncodingBase64URL:
+		return base64.RawURLEncoding.DecodeString(strings.TrimRight(input, "="))
+	case messageEncodingHex:
+		return hex.DecodeString(input)
+	default:
+		return base64.StdEncoding.DecodeString(input)
+	}
+}
+
+// bindSignatureContext combines the signature_context, if given, with the
+// input so that a signature only verifies under the same context. The
+// combined message is hashed as usual for key types that hash their input,
+// which is why a context cannot be given with prehashed input.
+func bindSignatureContext(input []byte, d *framework.FieldData, prehashed, required bool) ([]byte, error) {
+	contextB64 := d.Get("signature_context").(string)
+	if contextB64 == "" {
+		if required {
+			return nil, fmt.Errorf("a 'signature_context' is required by the mount configuration")
+		}
+		return input, nil
+	}
+	if prehashed {
+		return nil, fmt.Errorf("'signature_context' cannot be used with prehashed input")
+	}
+
+	sigContext, err := base64.StdEncoding.DecodeString(contextB64)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode signature_context as base64: %s", err)
+	}
+
+	return composeAssociatedData(
+		aadSegment{label: "signature_context", value: sigContext},
+		aadSegment{label: "input", value: input},
+	), nil
+}
+
+// merkleTree returns the levels of the Merkle tree over the given leaf
+// hashes, from the leaves up to the root. As in RFC 6962, an interior node
+// is SHA-256(0x01 || left || right). A node without a sibling is carried up
+// to the next level unchanged, which yields the same root as the RFC 6962
+// definition.
+func merkleTree(leaves [][]byte) [][][]byte {
+	tree := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			h := sha256.New()
+			h.Write([]byte{0x01})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		tree = append(tree, next)
+		level = next
+	}
+	return tree
+}
+
+// ecdsaJSONSignature assembles the ASN.1 marshaled, version-prefixed
+// signature string for the given base64-encoded R and S components.
+func ecdsaJSONSignature(p *keysutil.Policy, ver int, rB64, sB64 string) (string, error) {
+	if ver <= 0 {
+		return "", fmt.Errorf("a positive key_version is required with input format 'json-ecdsa'")
+	}
+
+	rBytes, err := base64.StdEncoding.DecodeString(rB64)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode r as base64: %s", err)
+	}
+	sBytes, err := base64.StdEncoding.DecodeString(sB64)
+	if err != nil {
+		return "", fmt.Errorf("unable to decode s as base64: %s", err)
+	}
+
+	der, err := asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(rBytes),
+		S: new(big.Int).SetBytes(sBytes),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal signature: %s", err)
+	}
+
+	return p.VersionPrefix(ver) + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// checkSignEnabled returns an error if the given version of the key, or the
+// latest if ver is 0, has been disabled for signing or has already made as
+// many signatures as a since lowered max_sign_uses allows
+func checkSignEnabled(p *keysutil.Policy, ver int) error {
+	if ver == 0 {
+		ver = p.LatestVersion
+	}
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if ok && (entry.SignDisabled || (p.MaxSignUses > 0 && entry.SignUses >= p.MaxSignUses)) {
+		return fmt.Errorf("version %d of the key has reached its limit of signatures and is disabled for signing", ver)
+	}
+	return nil
+}
+
+// recordSignUse counts a signature made with the given version of the key
+// and disables the version for signing once it reaches the key's
+// max_sign_uses. The count is persisted before the signature is returned, so
+// a failure to persist it fails the request. The caller must hold the
+// policy's write lock.
+func recordSignUse(ctx context.Context, s logical.Storage, p *keysutil.Policy, ver int) error {
+	k := strconv.Itoa(ver)
+	original, ok := p.Keys[k]
+	if !ok {
+		return fmt.Errorf("version %d of the key could not be found", ver)
+	}
+
+	entry := original
+	entry.SignUses++
+	if entry.SignUses >= p.MaxSignUses {
+		entry.SignDisabled = true
+	}
+	p.Keys[k] = entry
+
+	if err := p.Persist(ctx, s); err != nil {
+		p.Keys[k] = original
+		return err
+	}
+	return nil
+}
+
 const pathSignHelpSyn = `Generate a signature for input data using the named key`
 
 const pathSignHelpDesc = `
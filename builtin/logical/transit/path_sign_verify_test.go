@@ -2,10 +2,17 @@ package transit
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"golang.org/x/crypto/ed25519"
 
@@ -427,3 +434,690 @@ func TestTransit_SignVerify_ED25519(t *testing.T) {
 	verifyRequest(req, false, "bar", sig)
 	verifyRequest(req, true, "bar", v1sig)
 }
+
+func TestTransit_SignVerify_ECDSAJSON(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("err:%v resp:%#v", err, resp)
+		}
+		return resp
+	}
+	doErrReq := func(path string, data map[string]interface{}) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	doReq("keys/foo", map[string]interface{}{"type": "ecdsa-p256"})
+	doReq("keys/foo/rotate", nil)
+
+	input := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+
+	// JSON output must convert into a standard signature that verifies
+	resp := doReq("sign/foo", map[string]interface{}{
+		"input":         input,
+		"output_format": "json-ecdsa",
+	})
+	if _, ok := resp.Data["signature"]; ok {
+		t.Fatal("signature should not be set with json-ecdsa output")
+	}
+	if resp.Data["key_version"].(int) != 2 {
+		t.Fatalf("bad key_version: %v", resp.Data["key_version"])
+	}
+	rBytes, err := base64.StdEncoding.DecodeString(resp.Data["r"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sBytes, err := base64.StdEncoding.DecodeString(resp.Data["s"].(string))
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := asn1.Marshal(struct {
+		R, S *big.Int
+	}{new(big.Int).SetBytes(rBytes), new(big.Int).SetBytes(sBytes)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = doReq("verify/foo", map[string]interface{}{
+		"input":     input,
+		"signature": "vault:v2:" + base64.StdEncoding.EncodeToString(der),
+	})
+	if !resp.Data["valid"].(bool) {
+		t.Fatal("expected json-ecdsa signature to verify as DER")
+	}
+	resp = doReq("verify/foo", map[string]interface{}{
+		"input":        input,
+		"input_format": "json-ecdsa",
+		"r":            base64.StdEncoding.EncodeToString(rBytes),
+		"s":            base64.StdEncoding.EncodeToString(sBytes),
+		"key_version":  2,
+	})
+	if !resp.Data["valid"].(bool) {
+		t.Fatal("expected json-ecdsa signature to verify")
+	}
+
+	// A standard signature must split into R and S that verify as JSON
+	resp = doReq("sign/foo", map[string]interface{}{
+		"input": input,
+	})
+	sig := resp.Data["signature"].(string)
+	if !strings.HasPrefix(sig, "vault:v2:") {
+		t.Fatalf("bad signature: %s", sig)
+	}
+	der, err = base64.StdEncoding.DecodeString(strings.TrimPrefix(sig, "vault:v2:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed struct {
+		R, S *big.Int
+	}
+	if _, err := asn1.Unmarshal(der, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	jsonInput := map[string]interface{}{
+		"input":        input,
+		"input_format": "json-ecdsa",
+		"r":            base64.StdEncoding.EncodeToString(parsed.R.Bytes()),
+		"s":            base64.StdEncoding.EncodeToString(parsed.S.Bytes()),
+		"key_version":  2,
+	}
+	resp = doReq("verify/foo", jsonInput)
+	if !resp.Data["valid"].(bool) {
+		t.Fatal("expected DER signature to verify as json-ecdsa")
+	}
+
+	// The wrong key version must not verify
+	jsonInput["key_version"] = 1
+	resp = doReq("verify/foo", jsonInput)
+	if resp.Data["valid"].(bool) {
+		t.Fatal("expected signature with wrong key version to fail")
+	}
+
+	// Invalid combinations
+	doErrReq("sign/foo", map[string]interface{}{
+		"input":                input,
+		"output_format":        "json-ecdsa",
+		"marshaling_algorithm": "jws",
+	})
+	doErrReq("sign/foo", map[string]interface{}{
+		"input":         input,
+		"output_format": "bogus",
+	})
+	doErrReq("verify/foo", map[string]interface{}{
+		"input":        input,
+		"input_format": "json-ecdsa",
+		"signature":    sig,
+	})
+	doErrReq("verify/foo", map[string]interface{}{
+		"input":        input,
+		"input_format": "json-ecdsa",
+		"r":            base64.StdEncoding.EncodeToString(parsed.R.Bytes()),
+	})
+
+	doReq("keys/ed", map[string]interface{}{"type": "ed25519"})
+	doErrReq("sign/ed", map[string]interface{}{
+		"input":         input,
+		"output_format": "json-ecdsa",
+	})
+}
+
+func TestTransit_MerkleTreeRoot(t *testing.T) {
+	// Test vectors from the Certificate Transparency reference
+	// implementation, where each leaf hash is SHA-256(0x00 || data)
+	inputs := []string{
+		"",
+		"00",
+		"10",
+		"2021",
+		"3031",
+		"40414243",
+		"5051525354555657",
+		"606162636465666768696a6b6c6d6e6f",
+	}
+	roots := []string{
+		"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+		"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+		"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+		"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+		"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+		"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+	}
+
+	var leaves [][]byte
+	for i, input := range inputs {
+		data, err := hex.DecodeString(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf := sha256.Sum256(append([]byte{0x00}, data...))
+		leaves = append(leaves, leaf[:])
+
+		tree := merkleTree(leaves)
+		root := hex.EncodeToString(tree[len(tree)-1][0])
+		if root != roots[i] {
+			t.Fatalf("%d leaves: expected root %s, got %s", i+1, roots[i], root)
+		}
+		if len(tree[0]) != i+1 || len(tree[len(tree)-1]) != 1 {
+			t.Fatalf("%d leaves: bad tree shape", i+1)
+		}
+	}
+}
+
+func TestTransit_SignVerify_MerkleTree(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	var leaves []string
+	for i := 0; i < 5; i++ {
+		leaf := sha256.Sum256([]byte{byte(i)})
+		leaves = append(leaves, base64.StdEncoding.EncodeToString(leaf[:]))
+	}
+
+	for _, keyType := range []string{"ecdsa-p256", "ed25519", "rsa-2048"} {
+		doReq("keys/"+keyType, map[string]interface{}{
+			"type": keyType,
+		})
+
+		resp := doReq("sign/"+keyType, map[string]interface{}{
+			"merkle_tree_leaves": leaves,
+		})
+		signature := resp.Data["signature"].(string)
+		root := resp.Data["merkle_root"].(string)
+		tree := resp.Data["merkle_tree"].([][]string)
+		if !reflect.DeepEqual(tree[0], leaves) {
+			t.Fatalf("%s: bad leaves in tree: %#v", keyType, tree[0])
+		}
+		if len(tree) != 4 || len(tree[3]) != 1 || tree[3][0] != root {
+			t.Fatalf("%s: bad tree: %#v", keyType, tree)
+		}
+
+		// Signing the root directly gives a signature that verifies
+		// against the leaves
+		resp = doReq("verify/"+keyType, map[string]interface{}{
+			"merkle_tree_leaves": leaves,
+			"signature":          signature,
+		})
+		if !resp.Data["valid"].(bool) {
+			t.Fatalf("%s: signature over leaves did not verify", keyType)
+		}
+		resp = doReq("verify/"+keyType, map[string]interface{}{
+			"input":     root,
+			"signature": signature,
+		})
+		if !resp.Data["valid"].(bool) {
+			t.Fatalf("%s: signature did not verify against the root", keyType)
+		}
+
+		// A tampered leaf invalidates the signature
+		tampered := append([]string(nil), leaves...)
+		tampered[3] = leaves[4]
+		resp = doReq("verify/"+keyType, map[string]interface{}{
+			"merkle_tree_leaves": tampered,
+			"signature":          signature,
+		})
+		if resp.Data["valid"].(bool) {
+			t.Fatalf("%s: signature verified with a tampered leaf", keyType)
+		}
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"merkle_tree_leaves": leaves, "input": "dGVzdA=="},
+		{"merkle_tree_leaves": []string{}},
+		{"merkle_tree_leaves": []string{"dGVzdA=="}},
+		{"merkle_tree_leaves": []string{"not base64"}},
+	} {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      "sign/ed25519",
+			Data:      data,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; data:%#v", data)
+		}
+	}
+}
+
+func TestTransit_SignVerify_MessageEncoding(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	// Chosen so that standard and URL-safe base64 differ
+	message := []byte{0xfb, 0xff, 0xbf, 0x3e, 0x01}
+	encoded := map[string]string{
+		"base64":    base64.StdEncoding.EncodeToString(message),
+		"base64url": base64.URLEncoding.EncodeToString(message),
+		"hex":       hex.EncodeToString(message),
+	}
+	if encoded["base64"] == encoded["base64url"] {
+		t.Fatal("test message does not exercise URL-safe base64")
+	}
+
+	// ed25519 signatures are deterministic, so identical decoded bytes must
+	// give identical signatures
+	mustSucceed("keys/ed", map[string]interface{}{"type": "ed25519"})
+	var signature string
+	for encoding, input := range encoded {
+		resp := mustSucceed("sign/ed", map[string]interface{}{
+			"input":            input,
+			"message_encoding": encoding,
+		})
+		sig := resp.Data["signature"].(string)
+		if signature == "" {
+			signature = sig
+		} else if sig != signature {
+			t.Fatalf("%s: signature %q differs from %q", encoding, sig, signature)
+		}
+	}
+
+	// Unpadded URL-safe base64 is accepted as well
+	resp := mustSucceed("sign/ed", map[string]interface{}{
+		"input":            base64.RawURLEncoding.EncodeToString(message),
+		"message_encoding": "base64url",
+	})
+	if resp.Data["signature"].(string) != signature {
+		t.Fatal("unpadded base64url input gave a different signature")
+	}
+
+	// A signature verifies whichever encoding the input is given in
+	mustSucceed("keys/ec", map[string]interface{}{"type": "ecdsa-p256"})
+	resp = mustSucceed("sign/ec", map[string]interface{}{
+		"input":            encoded["hex"],
+		"message_encoding": "hex",
+	})
+	ecSignature := resp.Data["signature"].(string)
+	for encoding, input := range encoded {
+		for name, sig := range map[string]string{"ed": signature, "ec": ecSignature} {
+			resp = mustSucceed("verify/"+name, map[string]interface{}{
+				"input":            input,
+				"message_encoding": encoding,
+				"signature":        sig,
+			})
+			if !resp.Data["valid"].(bool) {
+				t.Fatalf("%s: %s signature did not verify", encoding, name)
+			}
+		}
+	}
+
+	for _, data := range []map[string]interface{}{
+		{"input": encoded["hex"], "message_encoding": "base32"},
+		{"input": encoded["base64"], "message_encoding": "hex"},
+		{"input": encoded["base64url"], "message_encoding": "base64"},
+	} {
+		resp, err := doReq("sign/ed", data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; data:%#v", data)
+		}
+	}
+}
+
+func TestTransit_SignVerify_Detached(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	input := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	for _, keyType := range []string{"ed25519", "ecdsa-p256"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{"type": keyType})
+
+		// The response holds the signature and never the signed data
+		resp := mustSucceed("sign/"+keyType, map[string]interface{}{
+			"input":    input,
+			"detached": true,
+		})
+		for k, v := range resp.Data {
+			if k != "signature" && k != "public_key" {
+				t.Fatalf("%s: unexpected field %q in detached response", keyType, k)
+			}
+			if v == input {
+				t.Fatalf("%s: detached response contains the input", keyType)
+			}
+		}
+		signature := resp.Data["signature"].(string)
+
+		resp = mustSucceed("verify/"+keyType, map[string]interface{}{
+			"input":     input,
+			"signature": signature,
+			"detached":  true,
+		})
+		if !resp.Data["valid"].(bool) {
+			t.Fatalf("%s: detached signature did not verify", keyType)
+		}
+		resp = mustSucceed("verify/"+keyType, map[string]interface{}{
+			"input":     "b3RoZXIgaW5wdXQ=",
+			"signature": signature,
+			"detached":  true,
+		})
+		if resp.Data["valid"].(bool) {
+			t.Fatalf("%s: detached signature verified against other input", keyType)
+		}
+
+		// Detached verification needs both the input and the signature
+		mustFail("verify/"+keyType, map[string]interface{}{
+			"signature": signature,
+			"detached":  true,
+		})
+		mustFail("verify/"+keyType, map[string]interface{}{
+			"input":    input,
+			"detached": true,
+		})
+	}
+
+	mustFail("verify/ecdsa-p256", map[string]interface{}{
+		"input":        input,
+		"input_format": "json-ecdsa",
+		"r":            "AQ==",
+		"s":            "AQ==",
+		"detached":     true,
+	})
+	mustFail("sign/ed25519", map[string]interface{}{
+		"merkle_tree_leaves": []string{base64.StdEncoding.EncodeToString(make([]byte, 32))},
+		"detached":           true,
+	})
+}
+
+func TestTransit_SignVerify_Timestamp(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: logical.UpdateOperation,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(path string, data map[string]interface{}) *logical.Response {
+		resp, err := doReq(path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(path string, data map[string]interface{}) {
+		resp, err := doReq(path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	defer func() { signatureTimestampNow = time.Now }()
+	signAt := func(keyType string, at time.Time) string {
+		signatureTimestampNow = func() time.Time { return at }
+		defer func() { signatureTimestampNow = time.Now }()
+		resp := mustSucceed("sign/"+keyType, map[string]interface{}{
+			"input":             "dGhlIHF1aWNrIGJyb3duIGZveA==",
+			"include_timestamp": true,
+		})
+		if ts, err := time.Parse(time.RFC3339Nano, resp.Data["timestamp"].(string)); err != nil || !ts.Equal(at) {
+			t.Fatalf("%s: bad timestamp %v: %v", keyType, resp.Data["timestamp"], err)
+		}
+		return resp.Data["signature"].(string)
+	}
+	verify := func(keyType, signature, input string, data map[string]interface{}) bool {
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		data["input"] = input
+		data["signature"] = signature
+		return mustSucceed("verify/"+keyType, data).Data["valid"].(bool)
+	}
+
+	input := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	for _, keyType := range []string{"ed25519", "ecdsa-p256", "rsa-2048"} {
+		mustSucceed("keys/"+keyType, map[string]interface{}{"type": keyType})
+
+		recent := signAt(keyType, time.Now().Add(-time.Minute))
+		old := signAt(keyType, time.Now().Add(-6*time.Minute))
+		future := signAt(keyType, time.Now().Add(6*time.Minute))
+		if !strings.HasPrefix(recent, "vault:v1:") || !strings.Contains(recent, signatureTimestampSeparator) {
+			t.Fatalf("%s: bad signature %q", keyType, recent)
+		}
+
+		if !verify(keyType, recent, input, map[string]interface{}{"freshness_ttl": "5m"}) {
+			t.Fatalf("%s: recent signature failed the freshness check", keyType)
+		}
+		if verify(keyType, old, input, map[string]interface{}{"freshness_ttl": "5m"}) {
+			t.Fatalf("%s: signature backdated by 6 minutes passed the freshness check", keyType)
+		}
+		if verify(keyType, future, input, map[string]interface{}{"freshness_ttl": "5m"}) {
+			t.Fatalf("%s: signature dated 6 minutes ahead passed the freshness check", keyType)
+		}
+
+		// Without a freshness check timestamped signatures verify as usual
+		if !verify(keyType, old, input, nil) || verify(keyType, old, "b3RoZXIgaW5wdXQ=", nil) {
+			t.Fatalf("%s: bad verification without freshness_ttl", keyType)
+		}
+
+		// The timestamp is authenticated, so it cannot be moved forward
+		sep := strings.LastIndex(old, signatureTimestampSeparator)
+		forged := old[:sep] + recent[strings.LastIndex(recent, signatureTimestampSeparator):]
+		if verify(keyType, forged, input, nil) || verify(keyType, forged, input, map[string]interface{}{"freshness_ttl": "5m"}) {
+			t.Fatalf("%s: signature verified with a replaced timestamp", keyType)
+		}
+		if verify(keyType, old[:sep], input, nil) {
+			t.Fatalf("%s: signature verified with the timestamp removed", keyType)
+		}
+
+		// Signatures without a timestamp cannot pass a freshness check
+		resp := mustSucceed("sign/"+keyType, map[string]interface{}{
+			"input": input,
+		})
+		mustFail("verify/"+keyType, map[string]interface{}{
+			"input":         input,
+			"signature":     resp.Data["signature"],
+			"freshness_ttl": "5m",
+		})
+	}
+
+	mustFail("sign/ecdsa-p256", map[string]interface{}{
+		"input":             input,
+		"include_timestamp": true,
+		"output_format":     "json-ecdsa",
+	})
+	mustFail("sign/ecdsa-p256", map[string]interface{}{
+		"input":             base64.StdEncoding.EncodeToString(make([]byte, 32)),
+		"include_timestamp": true,
+		"prehashed":         true,
+	})
+}
+
+func TestTransit_SignVerify_MaxSignUses(t *testing.T) {
+	b, storage := createBackendWithSysView(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   storage,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+	}
+
+	input := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+	sign := func(data map[string]interface{}) (string, error) {
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		data["input"] = input
+		resp, err := doReq(logical.UpdateOperation, "sign/key", data)
+		if resp != nil && resp.IsError() {
+			err = fmt.Errorf("%v", resp.Data["error"])
+		}
+		if err != nil {
+			return "", err
+		}
+		return resp.Data["signature"].(string), nil
+	}
+	verify := func(signature string) bool {
+		t.Helper()
+		return mustSucceed(logical.UpdateOperation, "verify/key", map[string]interface{}{
+			"input":     input,
+			"signature": signature,
+		}).Data["valid"].(bool)
+	}
+	versionState := func(ver string) (int, bool) {
+		t.Helper()
+		keys := mustSucceed(logical.ReadOperation, "keys/key", nil).Data["keys"].(map[string]map[string]interface{})
+		return keys[ver]["sign_uses"].(int), keys[ver]["sign_disabled"].(bool)
+	}
+
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustFail(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"max_sign_uses": 1,
+	})
+
+	mustSucceed(logical.UpdateOperation, "keys/key", map[string]interface{}{
+		"type": "ed25519",
+	})
+	mustFail(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"max_sign_uses": -1,
+	})
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"max_sign_uses": 3,
+	})
+	if resp := mustSucceed(logical.ReadOperation, "keys/key", nil); resp.Data["max_sign_uses"] != 3 {
+		t.Fatalf("bad max_sign_uses: %#v", resp.Data)
+	}
+
+	// The version is disabled exactly at the limit
+	var signatures []string
+	for i := 1; i <= 3; i++ {
+		signature, err := sign(nil)
+		if err != nil {
+			t.Fatalf("signature %d failed: %v", i, err)
+		}
+		signatures = append(signatures, signature)
+		uses, disabled := versionState("1")
+		if uses != i || disabled != (i == 3) {
+			t.Fatalf("after %d signatures: uses %d, disabled %t", i, uses, disabled)
+		}
+	}
+	if _, err := sign(nil); err == nil || !strings.Contains(err.Error(), "disabled for signing") {
+		t.Fatalf("expected the version to be disabled, got %v", err)
+	}
+	if uses, _ := versionState("1"); uses != 3 {
+		t.Fatalf("rejected signature was counted: %d uses", uses)
+	}
+
+	// Signatures made before the limit still verify
+	for _, signature := range signatures {
+		if !verify(signature) {
+			t.Fatalf("signature %s no longer verifies", signature)
+		}
+	}
+
+	// The limit applies to each version, and the count survives a reload
+	mustSucceed(logical.UpdateOperation, "keys/key/rotate", nil)
+	signature, err := sign(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signature, "vault:v2:") {
+		t.Fatalf("expected a version 2 signature, got %s", signature)
+	}
+	if _, err := sign(map[string]interface{}{"key_version": 1}); err == nil {
+		t.Fatal("expected version 1 to stay disabled")
+	}
+
+	b.lm.InvalidatePolicy("key")
+	if uses, disabled := versionState("2"); uses != 1 || disabled {
+		t.Fatalf("bad persisted state of version 2: uses %d, disabled %t", uses, disabled)
+	}
+
+	// Lowering the limit below the count stops the version at once, and
+	// removing it leaves disabled versions disabled
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"max_sign_uses": 1,
+	})
+	if _, err := sign(nil); err == nil {
+		t.Fatal("expected version 2 to be at its lowered limit")
+	}
+	mustSucceed(logical.UpdateOperation, "keys/key/config", map[string]interface{}{
+		"max_sign_uses": 0,
+	})
+	if _, err := sign(nil); err != nil {
+		t.Fatalf("expected version 2 to sign without a limit: %v", err)
+	}
+	if _, err := sign(map[string]interface{}{"key_version": 1}); err == nil {
+		t.Fatal("expected version 1 to stay disabled without a limit")
+	}
+}
@@ -0,0 +1,114 @@
+package transit
+
+import (
+	"context"
+	"time"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathSnapshot() *framework.Path {
+	return &framework.Path{
+		Pattern: "snapshot$",
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathSnapshotRead,
+		},
+
+		HelpSynopsis:    pathSnapshotHelpSyn,
+		HelpDescription: pathSnapshotHelpDesc,
+	}
+}
+
+func (b *backend) pathSnapshotRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	timestamp := time.Now().UTC()
+
+	names, err := keysutil.ListPolicies(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	autoRotatePeriods := map[string]time.Duration{}
+	keys := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			// Deleted since the listing
+			continue
+		}
+
+		if p.LifecyclePolicy != "" {
+			if _, ok := autoRotatePeriods[p.LifecyclePolicy]; !ok {
+				lp, err := b.getLifecyclePolicy(ctx, req.Storage, p.LifecyclePolicy)
+				if err != nil {
+					return nil, err
+				}
+				if lp != nil {
+					autoRotatePeriods[p.LifecyclePolicy] = lp.AutoRotatePeriod
+				}
+			}
+		}
+
+		keys[name] = keySnapshot(p, autoRotatePeriods[p.LifecyclePolicy])
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"timestamp": timestamp,
+			"keys":      keys,
+		},
+	}, nil
+}
+
+// keySnapshot returns the configuration of a key, without any key material
+func keySnapshot(p *keysutil.Policy, autoRotatePeriod time.Duration) map[string]interface{} {
+	replicationScope := p.ReplicationScope
+	if replicationScope == "" {
+		replicationScope = keysutil.ReplicationScopeCluster
+	}
+
+	snapshot := map[string]interface{}{
+		"name":                            p.Name,
+		"type":                            p.Type.String(),
+		"latest_version":                  p.LatestVersion,
+		"min_available_version":           p.MinAvailableVersion,
+		"min_decryption_version":          p.MinDecryptionVersion,
+		"min_encryption_version":          p.MinEncryptionVersion,
+		"auto_min_decryption_version_lag": minDecryptionVersionLagSetting(p),
+		"lifecycle_policy":                p.LifecyclePolicy,
+		"auto_rotate_period":              int64(autoRotatePeriod.Seconds()),
+		"key_rotation_required":           p.KeyRotationRequired,
+		"deletion_allowed":                p.DeletionAllowed,
+		"exportable":                      p.Exportable,
+		"exportable_after_rotation":       p.ExportableAfterRotation,
+		"allow_plaintext_backup":          p.AllowPlaintextBackup,
+		"derived":                         p.Derived,
+		"convergent_encryption":           p.ConvergentEncryption,
+		"replication_scope":               replicationScope,
+		"audit_read":                      p.AuditRead,
+		"soft_deleted":                    p.SoftDeleted,
+	}
+	if p.CiphertextPrefix != "" {
+		snapshot["ciphertext_prefix"] = p.CiphertextPrefix
+	}
+	if p.HDParent != "" {
+		snapshot["hd_parent"] = p.HDParent
+		snapshot["hd_path"] = p.HDPath
+	}
+
+	return snapshot
+}
+
+const pathSnapshotHelpSyn = `Return the configuration of every key on the mount`
+
+const pathSnapshotHelpDesc = `
+This path returns a point-in-time snapshot of the configuration of every key
+on the mount, such as its type, versions and rotation and deletion settings,
+along with the time the snapshot was taken. It is intended for compliance
+audits. Key material is never read into the snapshot.
+`
@@ -0,0 +1,107 @@
+package transit
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_Snapshot(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+
+	doReq(logical.UpdateOperation, "lifecycle-policies/daily", map[string]interface{}{
+		"auto_rotate_period": "24h",
+	})
+	keys := map[string]map[string]interface{}{
+		"aes":     {"type": "aes256-gcm96", "exportable": true, "lifecycle_policy": "daily"},
+		"chacha":  {"type": "chacha20-poly1305", "exportable": true, "replication_scope": "local"},
+		"ed25519": {"type": "ed25519", "exportable": true},
+		"rsa":     {"type": "rsa-2048", "exportable": true},
+		"derived": {"type": "aes256-gcm96", "exportable": true, "derived": true, "convergent_encryption": true},
+	}
+	for name, data := range keys {
+		doReq(logical.UpdateOperation, "keys/"+name, data)
+	}
+	doReq(logical.UpdateOperation, "keys/aes/rotate", nil)
+	doReq(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"deletion_allowed": true,
+	})
+
+	before := time.Now().UTC()
+	resp := doReq(logical.ReadOperation, "snapshot", nil)
+	timestamp := resp.Data["timestamp"].(time.Time)
+	if timestamp.Before(before.Add(-time.Second)) || timestamp.After(time.Now().Add(time.Second)) {
+		t.Fatalf("bad timestamp %v", timestamp)
+	}
+
+	// Every key appears with its configuration
+	snapshot := resp.Data["keys"].(map[string]interface{})
+	if len(snapshot) != len(keys) {
+		t.Fatalf("expected %d keys, got %d: %#v", len(keys), len(snapshot), snapshot)
+	}
+	for name, data := range keys {
+		entry, ok := snapshot[name].(map[string]interface{})
+		if !ok {
+			t.Fatalf("key %q missing from snapshot", name)
+		}
+		if entry["name"] != name || entry["type"] != data["type"] || entry["exportable"] != true {
+			t.Fatalf("bad snapshot entry for %q: %#v", name, entry)
+		}
+	}
+	aes := snapshot["aes"].(map[string]interface{})
+	if aes["latest_version"] != 2 || aes["deletion_allowed"] != true || aes["auto_rotate_period"] != int64(86400) || aes["lifecycle_policy"] != "daily" {
+		t.Fatalf("bad snapshot entry: %#v", aes)
+	}
+	if snapshot["chacha"].(map[string]interface{})["replication_scope"] != "local" {
+		t.Fatalf("bad snapshot entry: %#v", snapshot["chacha"])
+	}
+	derived := snapshot["derived"].(map[string]interface{})
+	if derived["derived"] != true || derived["convergent_encryption"] != true || derived["auto_rotate_period"] != int64(0) {
+		t.Fatalf("bad snapshot entry: %#v", derived)
+	}
+
+	// No key material, in any form, appears in the snapshot
+	raw, err := json.Marshal(resp.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range keys {
+		for _, exportType := range []string{"encryption-key", "signing-key", "hmac-key"} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   s,
+				Operation: logical.ReadOperation,
+				Path:      "export/" + exportType + "/" + name,
+			})
+			if err != nil || resp == nil || resp.IsError() {
+				continue
+			}
+			for _, material := range resp.Data["keys"].(map[string]string) {
+				if strings.Contains(string(raw), material) {
+					t.Fatalf("snapshot contains %s material of %q", exportType, name)
+				}
+			}
+		}
+	}
+	for _, field := range []string{`"keys":{"1"`, "PRIVATE KEY", "hmac_key", "public_key"} {
+		if strings.Contains(string(raw), field) {
+			t.Fatalf("snapshot contains %q", field)
+		}
+	}
+}
@@ -16,6 +16,8 @@ func (b *backend) pathTrim() *framework.Path {
 				Type:        framework.TypeString,
 				Description: "Name of the key",
 			},
+
+			"key_namespace": keyNamespaceSchema,
 			"min_available_version": &framework.FieldSchema{
 				Type: framework.TypeInt,
 				Description: `
@@ -38,7 +40,10 @@ allowed to be set when either 'min_encryption_version' or
 
 func (b *backend) pathTrimUpdate() framework.OperationFunc {
 	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (resp *logical.Response, retErr error) {
-		name := d.Get("name").(string)
+		name, err := keyName(d)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+		}
 
 		p, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
 			Storage: req.Storage,
@@ -0,0 +1,107 @@
+package transit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+func (b *backend) pathUndelete() *framework.Path {
+	return &framework.Path{
+		Pattern: "keys/" + framework.GenericNameRegex("name") + "/undelete",
+		Fields: map[string]*framework.FieldSchema{
+			"name": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: "Name of the key",
+			},
+
+			"key_namespace": keyNamespaceSchema,
+		},
+
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathUndeleteWrite,
+		},
+
+		HelpSynopsis:    pathUndeleteHelpSyn,
+		HelpDescription: pathUndeleteHelpDesc,
+	}
+}
+
+func (b *backend) pathUndeleteWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name, err := keyName(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), logical.ErrInvalidRequest
+	}
+
+	p, err := keysutil.LoadPolicyMetadata(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Undelete does its own locking
+	err = b.lm.UndeletePolicy(ctx, req.Storage, name)
+	if err != nil {
+		return logical.ErrorResponse(fmt.Sprintf("error undeleting policy %s: %s", name, err)), logical.ErrInvalidRequest
+	}
+
+	if p != nil {
+		p.SoftDeleted = false
+		b.notifyKeyStatus(ctx, req.Storage, p, keyStatusScheduledForDeletion, keyStatus(p))
+	}
+
+	return nil, nil
+}
+
+// purgeSoftDeletedKeys removes soft-deleted keys whose recovery window has
+// passed from storage
+func (b *backend) purgeSoftDeletedKeys(ctx context.Context, s logical.Storage) error {
+	keys, err := keysutil.ListPolicies(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var errs *multierror.Error
+	for _, key := range keys {
+		// Only soft-deleted keys are purged, so the rest are skipped without
+		// taking their locks. The status webhook of the key is read before
+		// it is purged.
+		p, err := keysutil.LoadPolicyMetadata(ctx, s, key)
+		if err != nil {
+			errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to read key %q: {{err}}", key), err))
+			continue
+		}
+		if p == nil || !p.SoftDeleted {
+			continue
+		}
+
+		purged, err := b.lm.PurgeSoftDeletedPolicy(ctx, s, key, now)
+		if err != nil {
+			errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to purge key %q: {{err}}", key), err))
+			continue
+		}
+		if purged {
+			if err := b.deleteNonceFilters(ctx, s, key); err != nil {
+				errs = multierror.Append(errs, errwrap.Wrapf(fmt.Sprintf("failed to delete nonce filters of key %q: {{err}}", key), err))
+			}
+			b.Logger().Info("purged soft-deleted key", "key", key)
+			b.notifyKeyStatus(ctx, s, p, keyStatusScheduledForDeletion, keyStatusDeleted)
+		}
+	}
+
+	return errs.ErrorOrNil()
+}
+
+const pathUndeleteHelpSyn = `Recover a soft-deleted key`
+
+const pathUndeleteHelpDesc = `
+This path restores a key that was deleted without the permanent flag, as long
+as the recovery window set in config/keys has not passed. Once it has, the key
+is removed from storage in the background and cannot be recovered.
+`
@@ -0,0 +1,154 @@
+package transit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_SoftDeleteUndelete(t *testing.T) {
+	for _, cachingDisabled := range []bool{false, true} {
+		sysView := logical.TestSystemView()
+		sysView.CachingDisabledVal = cachingDisabled
+		s := &logical.InmemStorage{}
+		conf := &logical.BackendConfig{
+			StorageView: s,
+			System:      sysView,
+		}
+		b := Backend(conf)
+		if err := b.Backend.Setup(context.Background(), conf); err != nil {
+			t.Fatal(err)
+		}
+
+		doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+			return b.HandleRequest(context.Background(), &logical.Request{
+				Storage:   s,
+				Operation: op,
+				Path:      path,
+				Data:      data,
+			})
+		}
+		mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+			resp, err := doReq(op, path, data)
+			if err != nil || (resp != nil && resp.IsError()) {
+				t.Fatalf("caching disabled %t: path:%s err:%v resp:%#v", cachingDisabled, path, err, resp)
+			}
+			return resp
+		}
+		mustFail := func(op logical.Operation, path string, data map[string]interface{}) {
+			resp, err := doReq(op, path, data)
+			if err == nil && (resp == nil || !resp.IsError()) {
+				t.Fatalf("caching disabled %t: expected error; path:%s data:%#v", cachingDisabled, path, data)
+			}
+		}
+
+		plaintext := "dGhlIHF1aWNrIGJyb3duIGZveA=="
+		mustSucceed(logical.UpdateOperation, "keys/soft", nil)
+		resp := mustSucceed(logical.UpdateOperation, "encrypt/soft", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		ciphertext := resp.Data["ciphertext"].(string)
+
+		// Soft deletion still requires deletion to be allowed
+		mustFail(logical.DeleteOperation, "keys/soft", nil)
+		mustSucceed(logical.UpdateOperation, "keys/soft/config", map[string]interface{}{
+			"deletion_allowed": true,
+		})
+		mustSucceed(logical.DeleteOperation, "keys/soft", nil)
+		mustFail(logical.DeleteOperation, "keys/soft", nil)
+
+		// Metadata is still readable
+		resp = mustSucceed(logical.ReadOperation, "keys/soft", nil)
+		if resp == nil || resp.Data["soft_deleted"] != true {
+			t.Fatalf("expected soft_deleted key, got %#v", resp)
+		}
+		deadline := resp.Data["recovery_deadline"].(time.Time)
+		if d := time.Until(deadline); d < 29*24*time.Hour || d > defaultRecoveryWindow {
+			t.Fatalf("bad recovery deadline %v", deadline)
+		}
+		resp = mustSucceed(logical.ListOperation, "keys", nil)
+		if keys := resp.Data["keys"].([]string); len(keys) != 1 || keys[0] != "soft" {
+			t.Fatalf("bad keys: %#v", keys)
+		}
+
+		// Every operation is blocked, including recreating the key
+		mustFail(logical.UpdateOperation, "encrypt/soft", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		mustFail(logical.UpdateOperation, "decrypt/soft", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		mustFail(logical.UpdateOperation, "keys/soft/rotate", nil)
+		mustFail(logical.UpdateOperation, "keys/soft/config", map[string]interface{}{
+			"min_decryption_version": 1,
+		})
+		mustFail(logical.UpdateOperation, "keys/soft", nil)
+		resp, err := doReq(logical.CreateOperation, "encrypt/soft", map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatal("expected upsert of a soft-deleted key to fail")
+		}
+
+		// Undeleting restores the key
+		mustSucceed(logical.UpdateOperation, "keys/soft/undelete", nil)
+		mustFail(logical.UpdateOperation, "keys/soft/undelete", nil)
+		resp = mustSucceed(logical.UpdateOperation, "decrypt/soft", map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		if resp.Data["plaintext"] != plaintext {
+			t.Fatalf("bad plaintext: %#v", resp.Data["plaintext"])
+		}
+		resp = mustSucceed(logical.ReadOperation, "keys/soft", nil)
+		if resp.Data["soft_deleted"] != false {
+			t.Fatalf("expected key to be undeleted: %#v", resp.Data)
+		}
+		if _, ok := resp.Data["recovery_deadline"]; ok {
+			t.Fatalf("unexpected recovery deadline: %#v", resp.Data)
+		}
+
+		// The periodic function leaves keys within the window alone and
+		// purges them once it has passed
+		mustFail(logical.UpdateOperation, "config/keys", map[string]interface{}{
+			"recovery_window": 0,
+		})
+		mustSucceed(logical.UpdateOperation, "config/keys", map[string]interface{}{
+			"recovery_window": 1,
+		})
+		resp = mustSucceed(logical.ReadOperation, "config/keys", nil)
+		if resp.Data["recovery_window"] != int64(1) {
+			t.Fatalf("bad recovery window: %#v", resp.Data["recovery_window"])
+		}
+		mustSucceed(logical.DeleteOperation, "keys/soft", nil)
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+			t.Fatal(err)
+		}
+		if resp = mustSucceed(logical.ReadOperation, "keys/soft", nil); resp == nil {
+			t.Fatal("key purged within its recovery window")
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		mustFail(logical.UpdateOperation, "keys/soft/undelete", nil)
+		if err := b.periodicFunc(context.Background(), &logical.Request{Storage: s}); err != nil {
+			t.Fatal(err)
+		}
+		if resp = mustSucceed(logical.ReadOperation, "keys/soft", nil); resp != nil {
+			t.Fatalf("expected key to be purged: %#v", resp)
+		}
+
+		// A purged name can be reused, and permanent deletion skips the
+		// recovery window
+		mustSucceed(logical.UpdateOperation, "keys/soft", nil)
+		mustSucceed(logical.UpdateOperation, "keys/soft/config", map[string]interface{}{
+			"deletion_allowed": true,
+		})
+		mustSucceed(logical.DeleteOperation, "keys/soft", map[string]interface{}{
+			"permanent": true,
+		})
+		if resp = mustSucceed(logical.ReadOperation, "keys/soft", nil); resp != nil {
+			t.Fatalf("expected key to be deleted: %#v", resp)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package transit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// plaintextHMACHeaderSize is the size of the header that hmac_before_encrypt
+// prepends to plaintexts: the big-endian version of the HMAC key followed by
+// the HMAC-SHA256 of the plaintext
+const plaintextHMACHeaderSize = 4 + sha256.Size
+
+// linkedHMACKey returns the given version, or the latest if ver is 0, of the
+// HMAC key of a key that the policy's configuration names. The caller must
+// hold the policy's lock, so the policy's own HMAC key is read directly
+// rather than by locking it again.
+func (b *backend) linkedHMACKey(ctx context.Context, req *logical.Request, p *keysutil.Policy, name string, ver int) (int, []byte, error) {
+	if name == p.Name {
+		return policyHMACKeyVersion(p, ver)
+	}
+	return b.hmacKeyVersion(ctx, req, name, ver)
+}
+
+// plaintextHMACKey returns the given version, or the latest if ver is 0, of
+// the HMAC key that the policy's hmac_before_encrypt names
+func (b *backend) plaintextHMACKey(ctx context.Context, req *logical.Request, p *keysutil.Policy, ver int) (int, []byte, error) {
+	return b.linkedHMACKey(ctx, req, p, p.HMACBeforeEncrypt, ver)
+}
+
+// framePlaintext prepends the header of hmac_before_encrypt, computed with
+// the given version of the HMAC key, to a base64 encoded plaintext
+func framePlaintext(plaintext string, ver int, key []byte) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return "", errutil.UserError{Err: "failed to base64-decode plaintext"}
+	}
+
+	framed := make([]byte, 4, plaintextHMACHeaderSize+len(raw))
+	binary.BigEndian.PutUint32(framed, uint32(ver))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	framed = mac.Sum(framed)
+	framed = append(framed, raw...)
+
+	return base64.StdEncoding.EncodeToString(framed), nil
+}
+
+// framePolicyPlaintext frames a base64 encoded plaintext with the latest
+// version of the policy's hmac_before_encrypt key. The caller must hold the
+// policy's lock.
+func (b *backend) framePolicyPlaintext(ctx context.Context, req *logical.Request, p *keysutil.Policy, plaintext string) (string, error) {
+	ver, key, err := b.plaintextHMACKey(ctx, req, p, 0)
+	if err != nil {
+		return "", err
+	}
+	return framePlaintext(plaintext, ver, key)
+}
+
+// unframePlaintext verifies and strips the header that framePlaintext
+// prepended to a base64 encoded plaintext. The caller must hold the policy's
+// lock.
+func (b *backend) unframePlaintext(ctx context.Context, req *logical.Request, p *keysutil.Policy, plaintext string) (string, error) {
+	framed, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return "", err
+	}
+	if len(framed) < plaintextHMACHeaderSize {
+		return "", errutil.UserError{Err: "plaintext HMAC verification failed: header is missing"}
+	}
+
+	ver := int(binary.BigEndian.Uint32(framed[:4]))
+	if ver < 1 {
+		return "", errutil.UserError{Err: "plaintext HMAC verification failed: invalid key version"}
+	}
+	_, key, err := b.plaintextHMACKey(ctx, req, p, ver)
+	if err != nil {
+		return "", err
+	}
+
+	raw := framed[plaintextHMACHeaderSize:]
+	mac := hmac.New(sha256.New, key)
+	mac.Write(raw)
+	if !hmac.Equal(mac.Sum(nil), framed[4:plaintextHMACHeaderSize]) {
+		return "", errutil.UserError{Err: "plaintext HMAC verification failed"}
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// validateLinkedHMACKey checks that the named key exists so that the policy
+// can link to its HMAC key in its configuration
+func (b *backend) validateLinkedHMACKey(ctx context.Context, s logical.Storage, p *keysutil.Policy, name string) error {
+	if name == p.Name {
+		return nil
+	}
+
+	hmacPolicy, _, err := b.lm.GetPolicy(ctx, keysutil.PolicyRequest{
+		Storage: s,
+		Name:    name,
+	})
+	if err != nil {
+		return err
+	}
+	if hmacPolicy == nil {
+		return errutil.UserError{Err: "HMAC key not found"}
+	}
+	return nil
+}
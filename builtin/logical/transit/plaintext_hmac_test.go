@@ -0,0 +1,176 @@
+package transit
+
+import (
+	"context"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/vault/helper/keysutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestTransit_HMACBeforeEncrypt(t *testing.T) {
+	b, s := createBackendWithStorage(t)
+
+	doReq := func(op logical.Operation, path string, data map[string]interface{}) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Storage:   s,
+			Operation: op,
+			Path:      path,
+			Data:      data,
+		})
+	}
+	mustSucceed := func(op logical.Operation, path string, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := doReq(op, path, data)
+		if err != nil || (resp != nil && resp.IsError()) {
+			t.Fatalf("path:%s err:%v resp:%#v", path, err, resp)
+		}
+		return resp
+	}
+	mustFailWith := func(path string, data map[string]interface{}, message string) {
+		t.Helper()
+		resp, err := doReq(logical.UpdateOperation, path, data)
+		if err == nil && (resp == nil || !resp.IsError()) {
+			t.Fatalf("expected error; path:%s data:%#v", path, data)
+		}
+		if !strings.Contains(resp.Data["error"].(string), message) {
+			t.Fatalf("expected %q, got %q", message, resp.Data["error"])
+		}
+	}
+	encrypt := func(name, plaintext string) string {
+		t.Helper()
+		resp := mustSucceed(logical.UpdateOperation, "encrypt/"+name, map[string]interface{}{
+			"plaintext": plaintext,
+		})
+		return resp.Data["ciphertext"].(string)
+	}
+	decrypt := func(name, ciphertext string) string {
+		t.Helper()
+		resp := mustSucceed(logical.UpdateOperation, "decrypt/"+name, map[string]interface{}{
+			"ciphertext": ciphertext,
+		})
+		return resp.Data["plaintext"].(string)
+	}
+	getPolicy := func(name string) *keysutil.Policy {
+		t.Helper()
+		p, _, err := b.lm.GetPolicy(context.Background(), keysutil.PolicyRequest{
+			Storage: s,
+			Name:    name,
+		})
+		if err != nil || p == nil {
+			t.Fatalf("failed to load key %s: %v", name, err)
+		}
+		return p
+	}
+
+	plaintext := base64.StdEncoding.EncodeToString([]byte("the quick brown fox"))
+	mustSucceed(logical.UpdateOperation, "keys/aes", nil)
+	mustSucceed(logical.UpdateOperation, "keys/hmac", nil)
+	mustSucceed(logical.UpdateOperation, "keys/ed25519", map[string]interface{}{
+		"type": "ed25519",
+	})
+	unframed := encrypt("aes", plaintext)
+
+	mustFailWith("keys/aes/config", map[string]interface{}{
+		"hmac_before_encrypt": "missing",
+	}, "HMAC key not found")
+	mustFailWith("keys/ed25519/config", map[string]interface{}{
+		"hmac_before_encrypt": "hmac",
+	}, "not valid for key type")
+
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"hmac_before_encrypt": "hmac",
+	})
+	if resp := mustSucceed(logical.ReadOperation, "keys/aes", nil); resp.Data["hmac_before_encrypt"] != "hmac" {
+		t.Fatalf("bad hmac_before_encrypt: %#v", resp.Data)
+	}
+
+	ciphertext := encrypt("aes", plaintext)
+	if got := decrypt("aes", ciphertext); got != plaintext {
+		t.Fatalf("bad plaintext: %s", got)
+	}
+
+	// The HMAC travels inside the ciphertext, ahead of the plaintext
+	p := getPolicy("aes")
+	framed, err := p.Decrypt(nil, nil, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(framed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != plaintextHMACHeaderSize+len("the quick brown fox") {
+		t.Fatalf("unexpected framed plaintext length %d", len(raw))
+	}
+
+	// A plaintext corrupted between the HMAC and the cipher is caught on
+	// decryption even though the ciphertext itself authenticates
+	raw[len(raw)-1] ^= 1
+	corrupted, err := p.Encrypt(0, nil, nil, base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustFailWith("decrypt/aes", map[string]interface{}{
+		"ciphertext": corrupted,
+	}, "plaintext HMAC verification failed")
+
+	// Ciphertexts without the HMAC cannot be decrypted while it is set
+	mustFailWith("decrypt/aes", map[string]interface{}{
+		"ciphertext": unframed,
+	}, "plaintext HMAC verification failed")
+
+	resp := mustSucceed(logical.UpdateOperation, "decrypt/aes", map[string]interface{}{
+		"batch_input": []interface{}{
+			map[string]interface{}{"ciphertext": ciphertext},
+			map[string]interface{}{"ciphertext": corrupted},
+		},
+	})
+	results := resp.Data["batch_results"].([]BatchResponseItem)
+	if results[0].Plaintext != plaintext || results[1].Error == "" {
+		t.Fatalf("bad batch results: %#v", results)
+	}
+
+	// Rotating the HMAC key keeps earlier ciphertexts verifiable
+	mustSucceed(logical.UpdateOperation, "keys/hmac/rotate", nil)
+	rotated := encrypt("aes", plaintext)
+	for _, c := range []string{ciphertext, rotated} {
+		if got := decrypt("aes", c); got != plaintext {
+			t.Fatalf("bad plaintext after HMAC key rotation: %s", got)
+		}
+	}
+
+	// Data keys and envelope encryption are authenticated as well
+	resp = mustSucceed(logical.UpdateOperation, "datakey/plaintext/aes", nil)
+	if got := decrypt("aes", resp.Data["ciphertext"].(string)); got != resp.Data["plaintext"] {
+		t.Fatal("data key does not decrypt to its plaintext")
+	}
+	resp = mustSucceed(logical.UpdateOperation, "envelope/aes/encrypt", map[string]interface{}{
+		"plaintext": plaintext,
+	})
+	resp = mustSucceed(logical.UpdateOperation, "envelope/aes/decrypt", resp.Data)
+	if resp.Data["plaintext"] != plaintext {
+		t.Fatalf("bad envelope plaintext: %v", resp.Data["plaintext"])
+	}
+
+	// A key can authenticate plaintexts with its own HMAC key
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"hmac_before_encrypt": "aes",
+	})
+	if got := decrypt("aes", encrypt("aes", plaintext)); got != plaintext {
+		t.Fatalf("bad plaintext: %s", got)
+	}
+	mustFailWith("decrypt/aes", map[string]interface{}{
+		"ciphertext": ciphertext,
+	}, "plaintext HMAC verification failed")
+
+	// Disabling it restores plain decryption
+	mustSucceed(logical.UpdateOperation, "keys/aes/config", map[string]interface{}{
+		"hmac_before_encrypt": "",
+	})
+	if got := decrypt("aes", unframed); got != plaintext {
+		t.Fatalf("bad plaintext: %s", got)
+	}
+}
@@ -0,0 +1,121 @@
+package transit
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// maxTemplateBits bounds the total entropy an output template may request
+const maxTemplateBits = 8192
+
+// randomTemplateReader is the source of the random bits of output templates
+var randomTemplateReader io.Reader = rand.Reader
+
+// Named alphabets for output templates. Any other charset is used as the
+// alphabet itself.
+var templateCharsets = map[string]string{
+	"base62":  "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	"base58":  "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+	"base32":  "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567",
+	"hex":     "0123456789abcdef",
+	"numeric": "0123456789",
+}
+
+// templateAlphabet returns the alphabet named by charset, or charset itself
+// if it is not a known name and has at least two distinct characters
+func templateAlphabet(charset string) ([]rune, error) {
+	if named, ok := templateCharsets[charset]; ok {
+		charset = named
+	}
+
+	alphabet := []rune(charset)
+	if len(alphabet) < 2 {
+		return nil, fmt.Errorf("charset must name an alphabet or list at least two characters")
+	}
+	seen := make(map[rune]bool, len(alphabet))
+	for _, r := range alphabet {
+		if seen[r] {
+			return nil, fmt.Errorf("charset contains %q more than once", r)
+		}
+		seen[r] = true
+	}
+	return alphabet, nil
+}
+
+// renderRandomTemplate replaces each {rN} placeholder in the template with N
+// bits read from rand, written in the alphabet with as many characters as it
+// takes to represent any N-bit value. Other text is copied as is; a '{'
+// must start a placeholder.
+func renderRandomTemplate(template string, alphabet []rune, rand io.Reader) (string, error) {
+	var out strings.Builder
+	var placeholders, totalBits int
+
+	for rest := template; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			out.WriteString(rest)
+			break
+		}
+		out.WriteString(rest[:start])
+
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 || !strings.HasPrefix(rest[start:], "{r") {
+			return "", fmt.Errorf("invalid output template: '{' at offset %d does not start an {rN} placeholder", len(template)-len(rest)+start)
+		}
+		placeholder := rest[start : start+end+1]
+		bits, err := strconv.Atoi(placeholder[2 : len(placeholder)-1])
+		if err != nil || bits < 1 {
+			return "", fmt.Errorf("invalid output template placeholder %q; N must be a positive number of bits", placeholder)
+		}
+		totalBits += bits
+		if totalBits > maxTemplateBits {
+			return "", fmt.Errorf("output template requests more than %d random bits", maxTemplateBits)
+		}
+
+		segment, err := randomSegment(bits, alphabet, rand)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(segment)
+		placeholders++
+		rest = rest[start+end+1:]
+	}
+
+	if placeholders == 0 {
+		return "", fmt.Errorf("output template must contain at least one {rN} placeholder")
+	}
+	return out.String(), nil
+}
+
+// randomSegment writes bits random bits in the alphabet, left-padded to the
+// width of the largest bits-bit value so that every segment of a placeholder
+// has the same length
+func randomSegment(bits int, alphabet []rune, rand io.Reader) (string, error) {
+	buf := make([]byte, (bits+7)/8)
+	if _, err := io.ReadFull(rand, buf); err != nil {
+		return "", err
+	}
+	if extra := uint(len(buf)*8 - bits); extra != 0 {
+		buf[0] &= 0xff >> extra
+	}
+	value := new(big.Int).SetBytes(buf)
+
+	base := big.NewInt(int64(len(alphabet)))
+	limit := new(big.Int).Lsh(big.NewInt(1), uint(bits))
+	width := 0
+	for span := big.NewInt(1); span.Cmp(limit) < 0; span.Mul(span, base) {
+		width++
+	}
+
+	digits := make([]rune, width)
+	digit := new(big.Int)
+	for i := width - 1; i >= 0; i-- {
+		value.DivMod(value, base, digit)
+		digits[i] = alphabet[digit.Int64()]
+	}
+	return string(digits), nil
+}
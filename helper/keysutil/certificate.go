@@ -0,0 +1,124 @@
+package keysutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/vault/helper/errutil"
+)
+
+// CrossSignCertificate returns the DER of an X.509 certificate for the public
+// key of toVersion, signed with the private key of fromVersion. Both the
+// subject and the issuer are the given name, as in the key rollover
+// certificates of RFC 4210, so that holders of a certificate for the old
+// version can chain to the new one. The signing version must still be
+// decryptable.
+func (p *Policy) CrossSignCertificate(fromVersion, toVersion int, subject string, ttl time.Duration) ([]byte, error) {
+	switch p.Type {
+	case KeyType_ECDSA_P256, KeyType_RSA2048, KeyType_RSA4096:
+	default:
+		return nil, errutil.UserError{Err: fmt.Sprintf("cross-signed certificates are not supported for key type %v", p.Type)}
+	}
+	if p.Derived {
+		return nil, errutil.UserError{Err: "cross-signed certificates are not supported for derived keys"}
+	}
+
+	switch {
+	case fromVersion <= 0 || toVersion <= 0:
+		return nil, errutil.UserError{Err: "from_version and to_version must be positive"}
+	case fromVersion > p.LatestVersion || toVersion > p.LatestVersion:
+		return nil, errutil.UserError{Err: "requested version is higher than the latest key version"}
+	case fromVersion >= toVersion:
+		return nil, errutil.UserError{Err: "from_version must be lower than to_version"}
+	case fromVersion < p.MinDecryptionVersion:
+		return nil, errutil.UserError{Err: "from_version is less than the minimum decryption key version"}
+	case ttl <= 0:
+		return nil, errutil.UserError{Err: "ttl must be positive"}
+	}
+
+	signer, err := p.certificateSigner(fromVersion)
+	if err != nil {
+		return nil, err
+	}
+	toSigner, err := p.certificateSigner(toVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	subjectKeyID, err := certificateKeyID(toSigner.Public())
+	if err != nil {
+		return nil, err
+	}
+	issuerKeyID, err := certificateKeyID(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: subject},
+		// Allow for clock skew between Vault and the verifier
+		NotBefore:             now.Add(-30 * time.Second),
+		NotAfter:              now.Add(ttl),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		SubjectKeyId:          subjectKeyID,
+	}
+	parent := &x509.Certificate{
+		Subject:      template.Subject,
+		SubjectKeyId: issuerKeyID,
+	}
+
+	return x509.CreateCertificate(rand.Reader, template, parent, toSigner.Public(), signer)
+}
+
+// certificateSigner returns the private key of the given version as a signer
+func (p *Policy) certificateSigner(ver int) (crypto.Signer, error) {
+	keyEntry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return nil, errutil.UserError{Err: fmt.Sprintf("key version %d is not available", ver)}
+	}
+
+	switch p.Type {
+	case KeyType_ECDSA_P256:
+		return &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     keyEntry.EC_X,
+				Y:     keyEntry.EC_Y,
+			},
+			D: keyEntry.EC_D,
+		}, nil
+	case KeyType_RSA2048, KeyType_RSA4096:
+		return keyEntry.RSAKey, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %v", p.Type)
+}
+
+// certificateKeyID identifies a public key by the SHA-1 hash of its DER
+// encoded SubjectPublicKeyInfo
+func certificateKeyID(pub crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha1.Sum(der)
+	return sum[:], nil
+}
@@ -0,0 +1,72 @@
+package keysutil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/hashicorp/vault/helper/errutil"
+)
+
+// CompressionGzip labels ciphertexts whose plaintext was gzip-compressed
+// before encryption. The label is written after the version prefix.
+const CompressionGzip = "gzip"
+
+// DefaultCompressionLevel is the gzip level plaintexts are compressed at
+// unless another is requested
+const DefaultCompressionLevel = 6
+
+// compressPlaintext gzip-compresses the plaintext at the given level. It
+// reports false if the compressed form, together with the label recording
+// it, would not give a shorter ciphertext, in which case the plaintext
+// should be encrypted as is.
+func compressPlaintext(plaintext []byte, level int) ([]byte, bool, error) {
+	if level < gzip.BestSpeed || level > gzip.BestCompression {
+		return nil, false, errutil.UserError{Err: "compression level must be between 1 and 9"}
+	}
+
+	var buf bytes.Buffer
+	w, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, false, errutil.InternalError{Err: err.Error()}
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, false, errutil.InternalError{Err: err.Error()}
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, errutil.InternalError{Err: err.Error()}
+	}
+
+	compressedLen := base64.StdEncoding.EncodedLen(buf.Len()) + len(CompressionGzip) + 1
+	if compressedLen >= base64.StdEncoding.EncodedLen(len(plaintext)) {
+		return nil, false, nil
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+// MaxDecompressedPlaintextSize is the largest plaintext that a compressed
+// ciphertext is decompressed to. It matches the default maximum request size,
+// which bounds the plaintexts that can be encrypted.
+const MaxDecompressedPlaintextSize = 32 * 1024 * 1024
+
+func decompressPlaintext(compressed []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errutil.UserError{Err: "invalid ciphertext: could not decompress plaintext"}
+	}
+	defer r.Close()
+
+	plaintext, err := ioutil.ReadAll(io.LimitReader(r, MaxDecompressedPlaintextSize+1))
+	if err != nil {
+		return nil, errutil.UserError{Err: "invalid ciphertext: could not decompress plaintext"}
+	}
+	if len(plaintext) > MaxDecompressedPlaintextSize {
+		return nil, errutil.UserError{Err: fmt.Sprintf("invalid ciphertext: decompressed plaintext is larger than %d bytes", MaxDecompressedPlaintextSize)}
+	}
+
+	return plaintext, nil
+}
@@ -7,6 +7,19 @@ import (
 	"hash"
 )
 
+// Replication scopes of a policy. Local policies are stored under
+// LocalStoragePrefix.
+const (
+	ReplicationScopeCluster = "cluster"
+	ReplicationScopeLocal   = "local"
+)
+
+// LocalStoragePrefix is the storage prefix of policies that are not
+// replicated to performance secondaries. Backends must list it in the local
+// storage paths of their special paths. Local storage is still replicated to
+// disaster recovery secondaries, which hold a full copy of the primary.
+const LocalStoragePrefix = "local/"
+
 type HashType uint32
 
 const (
@@ -26,6 +39,23 @@ const (
 	MarshalingTypeJWS
 )
 
+type ExternalFormat uint32
+
+const (
+	_                                = iota
+	ExternalFormatJWK ExternalFormat = iota
+	ExternalFormatPKCS8
+)
+
+type PaddingMode uint32
+
+const (
+	_                                 = iota
+	PaddingModeOAEPSHA256 PaddingMode = iota
+	PaddingModeOAEPSHA1
+	PaddingModePKCS1v15
+)
+
 var (
 	HashTypeMap = map[string]HashType{
 		"sha1":     HashTypeSHA1,
@@ -47,4 +77,15 @@ var (
 		"asn1": MarshalingTypeASN1,
 		"jws":  MarshalingTypeJWS,
 	}
+
+	ExternalFormatMap = map[string]ExternalFormat{
+		"jwk":   ExternalFormatJWK,
+		"pkcs8": ExternalFormatPKCS8,
+	}
+
+	PaddingModeMap = map[string]PaddingMode{
+		"oaep-sha256": PaddingModeOAEPSHA256,
+		"oaep-sha1":   PaddingModeOAEPSHA1,
+		"pkcs1v15":    PaddingModePKCS1v15,
+	}
 )
@@ -0,0 +1,537 @@
+package keysutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	uuid "github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/vault/logical"
+	"golang.org/x/crypto/ed25519"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// JWK algorithm identifiers used to distinguish symmetric key types, which
+// otherwise share the same "oct" representation
+const (
+	jwkAlgorithmAES256GCM        = "A256GCM"
+	jwkAlgorithmChaCha20Poly1305 = "C20P"
+)
+
+// oidEd25519 is the algorithm identifier for Ed25519 keys from RFC 8410
+var oidEd25519 = asn1.ObjectIdentifier{1, 3, 101, 112}
+
+// pkcs8 mirrors the ASN.1 structure of a PKCS#8 private key. It is used to
+// handle Ed25519 keys, which not every version of crypto/x509 supports.
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+// BackupPolicyExternal returns the key material of the named policy in the
+// given external format. The same restrictions as BackupPolicy apply.
+func (lm *LockManager) BackupPolicyExternal(ctx context.Context, storage logical.Storage, name string, format ExternalFormat) (string, error) {
+	return lm.backupPolicy(ctx, storage, name, func(p *Policy) (string, error) {
+		return p.BackupExternal(ctx, storage, format)
+	})
+}
+
+// ExternalRestoreOptions controls how key material restored from an external
+// format is validated
+type ExternalRestoreOptions struct {
+	// Force overwrites an existing policy of the same name
+	Force bool
+
+	// MinEntropyScore is the lowest entropy score accepted for any version
+	MinEntropyScore float64
+
+	// WeakKeyPatterns rejects symmetric keys made up entirely of repetitions
+	// of one of the patterns
+	WeakKeyPatterns [][]byte
+
+	// MaxChiSquared rejects symmetric keys whose byte distribution has a
+	// chi-squared statistic above it. Zero disables the test.
+	MaxChiSquared float64
+}
+
+// RestorePolicyExternal creates the named policy from key material in an
+// external format, as produced by BackupPolicyExternal or by other key
+// management systems. The key type is inferred from the material, which is
+// validated according to opts.
+func (lm *LockManager) RestorePolicyExternal(ctx context.Context, storage logical.Storage, name, backup string, opts ExternalRestoreOptions) error {
+	if name == "" {
+		return fmt.Errorf("a name is required to restore a key from an external format")
+	}
+
+	keyType, versions, keys, err := parseExternalBackup(backup)
+	if err != nil {
+		return err
+	}
+
+	p, archive, err := newPolicyFromExternalKeys(name, keyType, versions, keys)
+	if err != nil {
+		return err
+	}
+
+	if issues := checkExternalKeys(p, versions, opts); len(issues) != 0 {
+		return issues[0]
+	}
+
+	return lm.restoreKeyData(ctx, storage, &KeyData{
+		Policy:       p,
+		ArchivedKeys: archive,
+	}, opts.Force)
+}
+
+// CheckExternalKeys validates key material in an external format as
+// RestorePolicyExternal does with the same options, without restoring it. It
+// returns the inferred key type and every reason the key material would be
+// rejected, or an error if the material cannot be parsed at all.
+func CheckExternalKeys(backup string, opts ExternalRestoreOptions) (KeyType, []error, error) {
+	keyType, versions, keys, err := parseExternalBackup(backup)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	p, _, err := newPolicyFromExternalKeys("", keyType, versions, keys)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return keyType, checkExternalKeys(p, versions, opts), nil
+}
+
+// checkExternalKeys returns an error for each check that a version of the
+// externally sourced policy fails
+func checkExternalKeys(p *Policy, versions []int, opts ExternalRestoreOptions) []error {
+	var issues []error
+	for _, ver := range versions {
+		entry := p.Keys[strconv.Itoa(ver)]
+		if entry.EntropyScore < opts.MinEntropyScore {
+			issues = append(issues, fmt.Errorf("key version %d has an entropy score of %.2f, below the minimum of %.2f", ver, entry.EntropyScore, opts.MinEntropyScore))
+		}
+
+		switch p.Type {
+		case KeyType_AES256_GCM96, KeyType_ChaCha20_Poly1305:
+			if err := CheckSymmetricKeyMaterial(entry.Key, opts.WeakKeyPatterns, opts.MaxChiSquared); err != nil {
+				issues = append(issues, errwrap.Wrapf(fmt.Sprintf("key version %d was rejected: {{err}}", ver), err))
+			}
+		}
+	}
+	return issues
+}
+
+// BackupExternal returns the key material of every available version of the
+// policy in the given external format. For JWK this is a JWK Set in which
+// the key ID is the key version; for PKCS#8 it is a series of PEM blocks
+// ordered from the oldest to the latest version.
+func (p *Policy) BackupExternal(ctx context.Context, storage logical.Storage, format ExternalFormat) (out string, retErr error) {
+	if !p.Exportable {
+		return "", fmt.Errorf("exporting is disallowed on the policy")
+	}
+
+	if !p.AllowPlaintextBackup {
+		return "", fmt.Errorf("plaintext backup is disallowed on the policy")
+	}
+
+	if p.Derived {
+		return "", fmt.Errorf("external backup formats do not support derived keys")
+	}
+
+	if format == ExternalFormatPKCS8 {
+		switch p.Type {
+		case KeyType_ECDSA_P256, KeyType_ED25519, KeyType_RSA2048, KeyType_RSA4096:
+		default:
+			return "", fmt.Errorf("pkcs8 format is not supported for key type %v", p.Type)
+		}
+	}
+
+	archive, err := p.LoadArchive(ctx, storage)
+	if err != nil {
+		return "", err
+	}
+
+	minVersion := p.MinAvailableVersion
+	if minVersion < 1 {
+		minVersion = 1
+	}
+
+	var jwks jose.JSONWebKeySet
+	var pemBuf bytes.Buffer
+	for ver := minVersion; ver <= p.LatestVersion; ver++ {
+		entry, ok := p.Keys[strconv.Itoa(ver)]
+		if !ok {
+			idx := ver - p.MinAvailableVersion
+			if idx < 0 || idx >= len(archive.Keys) {
+				return "", fmt.Errorf("key version %d could not be found", ver)
+			}
+			entry = archive.Keys[idx]
+		}
+
+		switch format {
+		case ExternalFormatJWK:
+			jwk, err := p.externalJWK(ver, entry)
+			if err != nil {
+				return "", err
+			}
+			jwks.Keys = append(jwks.Keys, jwk)
+
+		case ExternalFormatPKCS8:
+			der, err := p.externalPKCS8(entry)
+			if err != nil {
+				return "", err
+			}
+			if err := pem.Encode(&pemBuf, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+				return "", err
+			}
+
+		default:
+			return "", fmt.Errorf("unsupported external format")
+		}
+	}
+
+	priorBackupInfo := p.BackupInfo
+
+	defer func() {
+		if retErr != nil {
+			p.BackupInfo = priorBackupInfo
+		}
+	}()
+
+	// Create a record of this backup operation in the policy
+	p.BackupInfo = &BackupInfo{
+		Time:    time.Now(),
+		Version: p.LatestVersion,
+	}
+	if err := p.Persist(ctx, storage); err != nil {
+		return "", errwrap.Wrapf("failed to persist policy with backup info: {{err}}", err)
+	}
+
+	if format == ExternalFormatPKCS8 {
+		return pemBuf.String(), nil
+	}
+
+	encoded, err := json.Marshal(jwks)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func (p *Policy) externalJWK(ver int, entry KeyEntry) (jose.JSONWebKey, error) {
+	jwk := jose.JSONWebKey{
+		KeyID: strconv.Itoa(ver),
+	}
+
+	switch p.Type {
+	case KeyType_AES256_GCM96:
+		jwk.Key = entry.Key
+		jwk.Algorithm = jwkAlgorithmAES256GCM
+	case KeyType_ChaCha20_Poly1305:
+		jwk.Key = entry.Key
+		jwk.Algorithm = jwkAlgorithmChaCha20Poly1305
+	case KeyType_ECDSA_P256:
+		jwk.Key = &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     entry.EC_X,
+				Y:     entry.EC_Y,
+			},
+			D: entry.EC_D,
+		}
+		jwk.Algorithm = "ES256"
+	case KeyType_ED25519:
+		jwk.Key = ed25519.PrivateKey(entry.Key)
+		jwk.Algorithm = "EdDSA"
+	case KeyType_RSA2048, KeyType_RSA4096:
+		jwk.Key = entry.RSAKey
+	default:
+		return jwk, fmt.Errorf("unsupported key type %v", p.Type)
+	}
+
+	return jwk, nil
+}
+
+// JWKS returns a JWK Set of the given versions of an asymmetric key, keyed by
+// version. Only the public keys are included unless includePrivate is set.
+func (p *Policy) JWKS(versions []int, includePrivate bool) (string, error) {
+	switch p.Type {
+	case KeyType_ECDSA_P256, KeyType_ED25519, KeyType_RSA2048, KeyType_RSA4096:
+	default:
+		return "", fmt.Errorf("jwks format is not supported for key type %v", p.Type)
+	}
+
+	if p.Derived {
+		return "", fmt.Errorf("jwks format does not support derived keys")
+	}
+
+	var jwks jose.JSONWebKeySet
+	for _, ver := range versions {
+		entry, ok := p.Keys[strconv.Itoa(ver)]
+		if !ok {
+			return "", fmt.Errorf("key version %d could not be found", ver)
+		}
+		jwk, err := p.externalJWK(ver, entry)
+		if err != nil {
+			return "", err
+		}
+		if !includePrivate {
+			jwk = jwk.Public()
+		}
+		jwks.Keys = append(jwks.Keys, jwk)
+	}
+
+	encoded, err := json.Marshal(jwks)
+	if err != nil {
+		return "", err
+	}
+	return string(encoded), nil
+}
+
+func (p *Policy) externalPKCS8(entry KeyEntry) ([]byte, error) {
+	switch p.Type {
+	case KeyType_ECDSA_P256:
+		return x509.MarshalPKCS8PrivateKey(&ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     entry.EC_X,
+				Y:     entry.EC_Y,
+			},
+			D: entry.EC_D,
+		})
+	case KeyType_ED25519:
+		seed, err := asn1.Marshal(ed25519.PrivateKey(entry.Key)[:ed25519.SeedSize])
+		if err != nil {
+			return nil, err
+		}
+		return asn1.Marshal(pkcs8{
+			Algo: pkix.AlgorithmIdentifier{
+				Algorithm: oidEd25519,
+			},
+			PrivateKey: seed,
+		})
+	case KeyType_RSA2048, KeyType_RSA4096:
+		return x509.MarshalPKCS8PrivateKey(entry.RSAKey)
+	}
+
+	return nil, fmt.Errorf("pkcs8 format is not supported for key type %v", p.Type)
+}
+
+// parseExternalBackup decodes a JWK Set or a series of PKCS#8 PEM blocks and
+// returns the inferred key type along with the key versions, in ascending
+// order, and their key material
+func parseExternalBackup(backup string) (KeyType, []int, map[int]interface{}, error) {
+	keys := make(map[int]interface{})
+	algorithms := make(map[int]string)
+
+	trimmed := bytes.TrimSpace([]byte(backup))
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		var jwks jose.JSONWebKeySet
+		if err := json.Unmarshal(trimmed, &jwks); err != nil {
+			return 0, nil, nil, errwrap.Wrapf("failed to parse JWK set: {{err}}", err)
+		}
+		for _, jwk := range jwks.Keys {
+			ver, err := strconv.Atoi(jwk.KeyID)
+			if err != nil || ver < 1 {
+				return 0, nil, nil, fmt.Errorf("invalid key ID %q; key IDs must be positive key versions", jwk.KeyID)
+			}
+			if _, ok := keys[ver]; ok {
+				return 0, nil, nil, fmt.Errorf("duplicate key version %d", ver)
+			}
+			if jwk.IsPublic() {
+				return 0, nil, nil, fmt.Errorf("key version %d does not contain private key material", ver)
+			}
+			keys[ver] = jwk.Key
+			algorithms[ver] = jwk.Algorithm
+		}
+
+	default:
+		rest := trimmed
+		for ver := 1; ; ver++ {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type != "PRIVATE KEY" {
+				return 0, nil, nil, fmt.Errorf("unexpected PEM block type %q", block.Type)
+			}
+			key, err := parsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return 0, nil, nil, err
+			}
+			keys[ver] = key
+		}
+		if len(bytes.TrimSpace(rest)) != 0 {
+			return 0, nil, nil, fmt.Errorf("backup contains data that is neither a JWK set nor PEM-encoded PKCS#8")
+		}
+	}
+
+	if len(keys) == 0 {
+		return 0, nil, nil, fmt.Errorf("no keys found in backup")
+	}
+
+	versions := make([]int, 0, len(keys))
+	for ver := range keys {
+		versions = append(versions, ver)
+	}
+	sort.Ints(versions)
+
+	for i := 1; i < len(versions); i++ {
+		if versions[i] != versions[i-1]+1 {
+			return 0, nil, nil, fmt.Errorf("key versions must be contiguous; version %d is missing", versions[i-1]+1)
+		}
+	}
+
+	var keyType KeyType
+	for i, ver := range versions {
+		kt, err := externalKeyType(keys[ver], algorithms[ver])
+		if err != nil {
+			return 0, nil, nil, errwrap.Wrapf(fmt.Sprintf("key version %d: {{err}}", ver), err)
+		}
+		if i > 0 && kt != keyType {
+			return 0, nil, nil, fmt.Errorf("key version %d has type %v, expected %v", ver, kt, keyType)
+		}
+		keyType = kt
+	}
+
+	return keyType, versions, keys, nil
+}
+
+func parsePKCS8PrivateKey(der []byte) (interface{}, error) {
+	var raw pkcs8
+	if _, err := asn1.Unmarshal(der, &raw); err == nil && raw.Algo.Algorithm.Equal(oidEd25519) {
+		var seed []byte
+		if _, err := asn1.Unmarshal(raw.PrivateKey, &seed); err != nil {
+			return nil, errwrap.Wrapf("failed to parse Ed25519 private key: {{err}}", err)
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("invalid Ed25519 private key length %d", len(seed))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errwrap.Wrapf("failed to parse PKCS#8 private key: {{err}}", err)
+	}
+	return key, nil
+}
+
+func externalKeyType(key interface{}, algorithm string) (KeyType, error) {
+	switch key := key.(type) {
+	case []byte:
+		if len(key) != 32 {
+			return 0, fmt.Errorf("symmetric keys must be 32 bytes long")
+		}
+		switch algorithm {
+		case "", jwkAlgorithmAES256GCM:
+			return KeyType_AES256_GCM96, nil
+		case jwkAlgorithmChaCha20Poly1305:
+			return KeyType_ChaCha20_Poly1305, nil
+		}
+		return 0, fmt.Errorf("unsupported symmetric key algorithm %q", algorithm)
+
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return 0, fmt.Errorf("unsupported elliptic curve %s", key.Curve.Params().Name)
+		}
+		return KeyType_ECDSA_P256, nil
+
+	case ed25519.PrivateKey:
+		return KeyType_ED25519, nil
+
+	case *rsa.PrivateKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return KeyType_RSA2048, nil
+		case 4096:
+			return KeyType_RSA4096, nil
+		}
+		return 0, fmt.Errorf("unsupported RSA key size %d", key.N.BitLen())
+	}
+
+	return 0, fmt.Errorf("unsupported key material %T", key)
+}
+
+// newPolicyFromExternalKeys builds a policy, and the matching archive, that
+// holds the given key versions. External formats do not carry HMAC keys, so
+// a fresh one is generated for every version.
+func newPolicyFromExternalKeys(name string, keyType KeyType, versions []int, keys map[int]interface{}) (*Policy, *archivedKeys, error) {
+	minVersion, latestVersion := versions[0], versions[len(versions)-1]
+
+	p := &Policy{
+		Name:                 name,
+		Type:                 keyType,
+		Keys:                 keyEntryMap{},
+		LatestVersion:        latestVersion,
+		MinDecryptionVersion: minVersion,
+		MinAvailableVersion:  minVersion,
+		ArchiveVersion:       latestVersion,
+		ArchiveMinVersion:    minVersion,
+	}
+	archive := &archivedKeys{
+		Keys: make([]KeyEntry, 0, len(versions)),
+	}
+
+	now := time.Now()
+	for _, ver := range versions {
+		entry := KeyEntry{
+			CreationTime:           now,
+			DeprecatedCreationTime: now.Unix(),
+		}
+
+		hmacKey, err := uuid.GenerateRandomBytes(32)
+		if err != nil {
+			return nil, nil, err
+		}
+		entry.HMACKey = hmacKey
+
+		switch key := keys[ver].(type) {
+		case []byte:
+			entry.Key = key
+
+		case *ecdsa.PrivateKey:
+			entry.EC_D = key.D
+			entry.EC_X = key.X
+			entry.EC_Y = key.Y
+			derBytes, err := x509.MarshalPKIXPublicKey(key.Public())
+			if err != nil {
+				return nil, nil, errwrap.Wrapf("error marshaling public key: {{err}}", err)
+			}
+			entry.FormattedPublicKey = string(pem.EncodeToMemory(&pem.Block{
+				Type:  "PUBLIC KEY",
+				Bytes: derBytes,
+			}))
+
+		case ed25519.PrivateKey:
+			entry.Key = key
+			entry.FormattedPublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+
+		case *rsa.PrivateKey:
+			entry.RSAKey = key
+		}
+
+		entry.EntropyScore = EntropyScore(entry.keyMaterial(keyType))
+
+		p.Keys[strconv.Itoa(ver)] = entry
+		archive.Keys = append(archive.Keys, entry)
+	}
+
+	return p, archive, nil
+}
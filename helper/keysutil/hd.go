@@ -0,0 +1,253 @@
+package keysutil
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/errutil"
+	"github.com/hashicorp/vault/helper/locksutil"
+	"github.com/hashicorp/vault/logical"
+)
+
+// HardenedKeyStart is the first BIP32 child index that uses hardened
+// derivation
+const HardenedKeyStart = 1 << 31
+
+// bip32SeedKey is the HMAC key BIP32 uses to derive the master key from a
+// seed
+var bip32SeedKey = []byte("Bitcoin seed")
+
+// secp256k1 curve parameters. BIP32 adds child tweaks modulo the group order
+// and needs the compressed public key of the parent for non-hardened
+// derivation. crypto/elliptic assumes a = -3, so the curve, which has a = 0,
+// is implemented here.
+var (
+	secp256k1P, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f", 16)
+	secp256k1N, _  = new(big.Int).SetString("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141", 16)
+	secp256k1Gx, _ = new(big.Int).SetString("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", 16)
+	secp256k1Gy, _ = new(big.Int).SetString("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", 16)
+)
+
+// HDKey is a BIP32 extended private key. The depth, parent fingerprint and
+// child number of the BIP32 serialization are not tracked; the fingerprint
+// needs RIPEMD-160, which is not available.
+type HDKey struct {
+	Key       []byte
+	ChainCode []byte
+}
+
+// ParseHDPath parses a BIP32 derivation path such as "m/44'/60'/0'/0/0".
+// Hardened indexes are marked with a trailing ', h or H.
+func ParseHDPath(hdPath string) ([]uint32, error) {
+	parts := strings.Split(hdPath, "/")
+	if parts[0] != "m" {
+		return nil, errutil.UserError{Err: fmt.Sprintf("invalid derivation path %q, must start with \"m\"", hdPath)}
+	}
+	if len(parts)-1 > 255 {
+		return nil, errutil.UserError{Err: "derivation path is deeper than 255 levels"}
+	}
+
+	indexes := make([]uint32, 0, len(parts)-1)
+	for _, part := range parts[1:] {
+		hardened := false
+		if strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h") || strings.HasSuffix(part, "H") {
+			hardened = true
+			part = part[:len(part)-1]
+		}
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, errutil.UserError{Err: fmt.Sprintf("invalid derivation path %q, indexes must be below 2^31", hdPath)}
+		}
+		if hardened {
+			index += HardenedKeyStart
+		}
+		indexes = append(indexes, uint32(index))
+	}
+
+	return indexes, nil
+}
+
+// DeriveHDKey derives the BIP32 extended private key at the given path from
+// the seed
+func DeriveHDKey(seed []byte, hdPath string) (*HDKey, error) {
+	indexes, err := ParseHDPath(hdPath)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha512.New, bip32SeedKey)
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	k := new(big.Int).SetBytes(sum[:32])
+	if k.Sign() == 0 || k.Cmp(secp256k1N) >= 0 {
+		return nil, fmt.Errorf("seed does not produce a valid master key")
+	}
+	key := &HDKey{
+		Key:       sum[:32],
+		ChainCode: sum[32:],
+	}
+
+	for _, index := range indexes {
+		key, err = key.child(index)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return key, nil
+}
+
+func (k *HDKey) child(index uint32) (*HDKey, error) {
+	parent := new(big.Int).SetBytes(k.Key)
+
+	mac := hmac.New(sha512.New, k.ChainCode)
+	if index >= HardenedKeyStart {
+		mac.Write([]byte{0})
+		mac.Write(k.Key)
+	} else {
+		mac.Write(secp256k1CompressedPublicKey(parent))
+	}
+	var indexBytes [4]byte
+	binary.BigEndian.PutUint32(indexBytes[:], index)
+	mac.Write(indexBytes[:])
+	sum := mac.Sum(nil)
+
+	// BIP32 skips to the next index in these cases, which happen with
+	// negligible probability
+	tweak := new(big.Int).SetBytes(sum[:32])
+	if tweak.Cmp(secp256k1N) >= 0 {
+		return nil, errutil.UserError{Err: fmt.Sprintf("child index %d gives an invalid key, use the next index", index)}
+	}
+	childKey := tweak.Add(tweak, parent)
+	childKey.Mod(childKey, secp256k1N)
+	if childKey.Sign() == 0 {
+		return nil, errutil.UserError{Err: fmt.Sprintf("child index %d gives an invalid key, use the next index", index)}
+	}
+
+	return &HDKey{
+		Key:       leftPad(childKey.Bytes(), 32),
+		ChainCode: sum[32:],
+	}, nil
+}
+
+func leftPad(b []byte, size int) []byte {
+	out := make([]byte, size)
+	copy(out[size-len(b):], b)
+	return out
+}
+
+// secp256k1Add adds two affine points; nil coordinates are the point at
+// infinity
+func secp256k1Add(x1, y1, x2, y2 *big.Int) (*big.Int, *big.Int) {
+	if x1 == nil {
+		return x2, y2
+	}
+	if x2 == nil {
+		return x1, y1
+	}
+
+	p := secp256k1P
+	var l *big.Int
+	if x1.Cmp(x2) == 0 {
+		if new(big.Int).Add(y1, y2).Mod(new(big.Int).Add(y1, y2), p).Sign() == 0 {
+			return nil, nil
+		}
+		// l = 3x^2 / 2y
+		num := new(big.Int).Mul(x1, x1)
+		num.Mul(num, big.NewInt(3))
+		den := new(big.Int).Lsh(y1, 1)
+		l = num.Mul(num, den.ModInverse(den.Mod(den, p), p))
+	} else {
+		// l = (y2 - y1) / (x2 - x1)
+		num := new(big.Int).Sub(y2, y1)
+		den := new(big.Int).Sub(x2, x1)
+		l = num.Mul(num, den.ModInverse(den.Mod(den, p), p))
+	}
+	l.Mod(l, p)
+
+	x := new(big.Int).Mul(l, l)
+	x.Sub(x, x1)
+	x.Sub(x, x2)
+	x.Mod(x, p)
+
+	y := new(big.Int).Sub(x1, x)
+	y.Mul(y, l)
+	y.Sub(y, y1)
+	y.Mod(y, p)
+
+	return x, y
+}
+
+func secp256k1ScalarBaseMult(k *big.Int) (*big.Int, *big.Int) {
+	var x, y *big.Int
+	px, py := secp256k1Gx, secp256k1Gy
+	for i := 0; i < k.BitLen(); i++ {
+		if k.Bit(i) == 1 {
+			x, y = secp256k1Add(x, y, px, py)
+		}
+		px, py = secp256k1Add(px, py, px, py)
+	}
+	return x, y
+}
+
+func secp256k1CompressedPublicKey(k *big.Int) []byte {
+	x, y := secp256k1ScalarBaseMult(k)
+	return append([]byte{byte(2 + y.Bit(0))}, leftPad(x.Bytes(), 32)...)
+}
+
+// CreateHDChildPolicy creates a single-version policy holding key material
+// derived from the named parent policy along the given BIP32 path
+func (lm *LockManager) CreateHDChildPolicy(ctx context.Context, storage logical.Storage, name string, keyType KeyType, key []byte, exportable bool, parentName, hdPath string) error {
+	switch keyType {
+	case KeyType_AES256_GCM96, KeyType_ChaCha20_Poly1305:
+	default:
+		return fmt.Errorf("child keys cannot be derived for key type %v", keyType)
+	}
+
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if lm.useCache {
+		if _, ok := lm.cache.Load(name); ok {
+			return errutil.UserError{Err: fmt.Sprintf("key %q already exists", name)}
+		}
+	}
+	existing, err := lm.getPolicyFromStorage(ctx, storage, name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return errutil.UserError{Err: fmt.Sprintf("key %q already exists", name)}
+	}
+
+	p, archive, err := newPolicyFromExternalKeys(name, keyType, []int{1}, map[int]interface{}{1: key})
+	if err != nil {
+		return err
+	}
+	p.Exportable = exportable
+	p.HDParent = parentName
+	p.HDPath = hdPath
+
+	if err := p.storeArchive(ctx, storage, archive); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("failed to store archived keys for key %q: {{err}}", name), err)
+	}
+	if err := p.Persist(ctx, storage); err != nil {
+		return errwrap.Wrapf(fmt.Sprintf("failed to store key %q: {{err}}", name), err)
+	}
+
+	p.l = new(sync.RWMutex)
+	if lm.useCache {
+		lm.cache.Store(name, p)
+	}
+
+	return nil
+}
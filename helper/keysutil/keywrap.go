@@ -0,0 +1,218 @@
+package keysutil
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/errutil"
+)
+
+const (
+	// KeyWrapAlgorithmAESKW is the AES Key Wrap of RFC 3394
+	KeyWrapAlgorithmAESKW = "aes-kw"
+
+	// KeyWrapAlgorithmAESKWP is the AES Key Wrap with Padding of RFC 5649
+	KeyWrapAlgorithmAESKWP = "aes-kwp"
+)
+
+var (
+	// keyWrapIV is the default initial value of RFC 3394, section 2.2.3.1
+	keyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+	// keyWrapPadICV is the constant half of the alternative initial value of
+	// RFC 5649, section 3
+	keyWrapPadICV = []byte{0xa6, 0x59, 0x59, 0xa6}
+)
+
+// WrapKey wraps a key with the given version of the policy using AES key
+// wrap, which is deterministic and has no nonce. Only AES policies support
+// it. It returns the version that was used along with the wrapped key.
+func (p *Policy) WrapKey(ver int, context, key []byte, algorithm, derivationAlgorithm string) (int, []byte, error) {
+	if p.Type != KeyType_AES256_GCM96 {
+		return 0, nil, errutil.UserError{Err: fmt.Sprintf("key wrapping algorithm %q not supported for key type %v", algorithm, p.Type)}
+	}
+
+	switch {
+	case ver == 0:
+		ver = p.LatestVersion
+	case ver < 0:
+		return 0, nil, errutil.UserError{Err: "requested version for encryption is negative"}
+	case ver > p.LatestVersion:
+		return 0, nil, errutil.UserError{Err: "requested version for encryption is higher than the latest key version"}
+	case ver < p.MinEncryptionVersion:
+		return 0, nil, errutil.UserError{Err: "requested version for encryption is less than the minimum encryption key version"}
+	}
+
+	if err := p.checkActivationWindow(ver); err != nil {
+		return 0, nil, err
+	}
+
+	kek, err := p.deriveKey(context, ver, 32, derivationAlgorithm)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var wrapped []byte
+	switch algorithm {
+	case KeyWrapAlgorithmAESKW:
+		wrapped, err = WrapKeyAES(kek, key)
+	case KeyWrapAlgorithmAESKWP:
+		wrapped, err = WrapKeyAESPadded(kek, key)
+	default:
+		return 0, nil, errutil.UserError{Err: fmt.Sprintf("unknown key wrapping algorithm %q", algorithm)}
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return ver, wrapped, nil
+}
+
+// WrapKeyAES wraps a key with the key encryption key kek as described in RFC
+// 3394. The key must be a multiple of 8 bytes and at least 16 bytes long.
+func WrapKeyAES(kek, key []byte) ([]byte, error) {
+	if len(key) < 16 || len(key)%8 != 0 {
+		return nil, errutil.UserError{Err: "AES key wrap requires a key that is a multiple of 8 bytes and at least 16 bytes long"}
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errutil.InternalError{Err: err.Error()}
+	}
+
+	return keyWrap(block, keyWrapIV, key), nil
+}
+
+// UnwrapKeyAES unwraps a key wrapped by WrapKeyAES
+func UnwrapKeyAES(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 24 || len(wrapped)%8 != 0 {
+		return nil, errutil.UserError{Err: "invalid wrapped key length"}
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errutil.InternalError{Err: err.Error()}
+	}
+
+	iv, key := keyUnwrap(block, wrapped)
+	if subtle.ConstantTimeCompare(iv, keyWrapIV) != 1 {
+		return nil, errutil.UserError{Err: "wrapped key integrity check failed"}
+	}
+	return key, nil
+}
+
+// WrapKeyAESPadded wraps a key of any non-zero length with the key encryption
+// key kek as described in RFC 5649
+func WrapKeyAESPadded(kek, key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, errutil.UserError{Err: "AES key wrap with padding requires a non-empty key"}
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errutil.InternalError{Err: err.Error()}
+	}
+
+	iv := make([]byte, 8)
+	copy(iv, keyWrapPadICV)
+	binary.BigEndian.PutUint32(iv[4:], uint32(len(key)))
+
+	padded := make([]byte, (len(key)+7)/8*8)
+	copy(padded, key)
+
+	// A single padded block is encrypted directly with AES in ECB mode
+	if len(padded) == 8 {
+		wrapped := make([]byte, 16)
+		copy(wrapped, iv)
+		copy(wrapped[8:], padded)
+		block.Encrypt(wrapped, wrapped)
+		return wrapped, nil
+	}
+
+	return keyWrap(block, iv, padded), nil
+}
+
+// UnwrapKeyAESPadded unwraps a key wrapped by WrapKeyAESPadded
+func UnwrapKeyAESPadded(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped) < 16 || len(wrapped)%8 != 0 {
+		return nil, errutil.UserError{Err: "invalid wrapped key length"}
+	}
+
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, errutil.InternalError{Err: err.Error()}
+	}
+
+	var iv, padded []byte
+	if len(wrapped) == 16 {
+		out := make([]byte, 16)
+		block.Decrypt(out, wrapped)
+		iv, padded = out[:8], out[8:]
+	} else {
+		iv, padded = keyUnwrap(block, wrapped)
+	}
+
+	failed := subtle.ConstantTimeCompare(iv[:4], keyWrapPadICV) != 1
+	length := int(binary.BigEndian.Uint32(iv[4:]))
+	if failed || length <= len(padded)-8 || length > len(padded) {
+		return nil, errutil.UserError{Err: "wrapped key integrity check failed"}
+	}
+	for _, b := range padded[length:] {
+		if b != 0 {
+			return nil, errutil.UserError{Err: "wrapped key integrity check failed"}
+		}
+	}
+
+	return padded[:length], nil
+}
+
+// keyWrap is the wrapping process W of RFC 3394, section 2.2.1, with the
+// given initial value
+func keyWrap(block cipher.Block, iv, plaintext []byte) []byte {
+	n := len(plaintext) / 8
+	out := make([]byte, 8+len(plaintext))
+	copy(out, iv)
+	copy(out[8:], plaintext)
+
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, out[:8])
+			copy(buf[8:], out[i*8:(i+1)*8])
+			block.Encrypt(buf, buf)
+
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(out[i*8:], buf[8:])
+		}
+	}
+
+	return out
+}
+
+// keyUnwrap is the unwrapping process W^-1 of RFC 3394, section 2.2.2. It
+// returns the recovered initial value, which the caller must check, and the
+// plaintext.
+func keyUnwrap(block cipher.Block, ciphertext []byte) ([]byte, []byte) {
+	n := len(ciphertext)/8 - 1
+	out := make([]byte, len(ciphertext))
+	copy(out, ciphertext)
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(out[:8])^t)
+			copy(buf[8:], out[i*8:(i+1)*8])
+			block.Decrypt(buf, buf)
+
+			copy(out[:8], buf[:8])
+			copy(out[i*8:], buf[8:])
+		}
+	}
+
+	return out[:8], out[8:]
+}
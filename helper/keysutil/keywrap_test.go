@@ -0,0 +1,134 @@
+package keysutil
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestKeyWrap_AESKW(t *testing.T) {
+	// Test vectors from RFC 3394, section 4
+	tests := []struct {
+		kek, key, wrapped string
+	}{
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F1011121314151617",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "96778B25AE6CA435F92B5B97C050AED2468AB8A17AD84E5D",
+		},
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7",
+		},
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F1011121314151617",
+			key:     "00112233445566778899AABBCCDDEEFF0001020304050607",
+			wrapped: "031D33264E15D33268F24EC260743EDCE1C6C7DDEE725A936BA814915C6762D2",
+		},
+		{
+			kek:     "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:     "00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			wrapped: "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+
+	for i, test := range tests {
+		kek, _ := hex.DecodeString(test.kek)
+		key, _ := hex.DecodeString(test.key)
+		expected, _ := hex.DecodeString(test.wrapped)
+
+		wrapped, err := WrapKeyAES(kek, key)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(wrapped, expected) {
+			t.Fatalf("%d: expected %x, got %x", i, expected, wrapped)
+		}
+
+		unwrapped, err := UnwrapKeyAES(kek, wrapped)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Fatalf("%d: expected %x, got %x", i, key, unwrapped)
+		}
+
+		wrapped[len(wrapped)-1] ^= 1
+		if _, err := UnwrapKeyAES(kek, wrapped); err == nil {
+			t.Fatalf("%d: expected integrity check failure", i)
+		}
+	}
+
+	kek := make([]byte, 32)
+	for _, length := range []int{0, 8, 20} {
+		if _, err := WrapKeyAES(kek, make([]byte, length)); err == nil {
+			t.Fatalf("expected error wrapping a %d byte key", length)
+		}
+	}
+}
+
+func TestKeyWrap_AESKWP(t *testing.T) {
+	// Test vectors from RFC 5649, section 6
+	kek, _ := hex.DecodeString("5840DF6E29B02AF1AB493B705BF16EA1AE8338F4DCC176A8")
+	tests := []struct {
+		key, wrapped string
+	}{
+		{
+			key:     "C37B7E6492584340BED12207808941155068F738",
+			wrapped: "138BDEAA9B8FA7FC61F97742E72248EE5AE6AE5360D1AE6A5F54F373FA543B6A",
+		},
+		{
+			key:     "466F7250617369",
+			wrapped: "AFBEB0F07DFBF5419200F2CCB50BB24F",
+		},
+	}
+
+	for i, test := range tests {
+		key, _ := hex.DecodeString(test.key)
+		expected, _ := hex.DecodeString(test.wrapped)
+
+		wrapped, err := WrapKeyAESPadded(kek, key)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(wrapped, expected) {
+			t.Fatalf("%d: expected %x, got %x", i, expected, wrapped)
+		}
+
+		unwrapped, err := UnwrapKeyAESPadded(kek, wrapped)
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		if !bytes.Equal(unwrapped, key) {
+			t.Fatalf("%d: expected %x, got %x", i, key, unwrapped)
+		}
+
+		wrapped[0] ^= 1
+		if _, err := UnwrapKeyAESPadded(kek, wrapped); err == nil {
+			t.Fatalf("%d: expected integrity check failure", i)
+		}
+	}
+
+	// Keys that are already a multiple of 8 bytes are not padded, but are
+	// still bound to their length
+	key := make([]byte, 32)
+	wrapped, err := WrapKeyAESPadded(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wrapped) != 40 {
+		t.Fatalf("bad wrapped length %d", len(wrapped))
+	}
+	if _, err := UnwrapKeyAES(kek, wrapped); err == nil {
+		t.Fatal("expected AES-KW unwrapping of an AES-KWP key to fail")
+	}
+	if _, err := WrapKeyAESPadded(kek, nil); err == nil {
+		t.Fatal("expected error wrapping an empty key")
+	}
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"path"
+	"sort"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/helper/errutil"
 	"github.com/hashicorp/vault/helper/jsonutil"
 	"github.com/hashicorp/vault/helper/locksutil"
 	"github.com/hashicorp/vault/logical"
@@ -51,6 +55,19 @@ type PolicyRequest struct {
 
 	// Whether to allow plaintext backup
 	AllowPlaintextBackup bool
+
+	// The name of the lifecycle policy to attach to the key
+	LifecyclePolicy string
+
+	// The replication scope of the key; empty means cluster scoped
+	ReplicationScope string
+
+	// The URL notified by the backend when the status of the key changes
+	StatusWebhookURL string
+
+	// Whether to return the policy if it has been soft-deleted. Soft-deleted
+	// policies are otherwise treated as not found.
+	AllowSoftDeleted bool
 }
 
 type LockManager struct {
@@ -59,6 +76,9 @@ type LockManager struct {
 	cache sync.Map
 
 	keyLocks []*locksutil.LockEntry
+
+	// The rate limiters of the policies, by rateLimiterKey
+	rateLimiters sync.Map
 }
 
 func NewLockManager(cacheDisabled bool) *LockManager {
@@ -73,6 +93,25 @@ func (lm *LockManager) CacheActive() bool {
 	return lm.useCache
 }
 
+// GetAllPolicyNames returns the sorted names of the policies currently held in
+// the cache. It does not acquire any per-key locks or load key material. If
+// caching is disabled, or nothing has been cached yet, an empty slice is
+// returned.
+func (lm *LockManager) GetAllPolicyNames() []string {
+	names := []string{}
+	if !lm.useCache {
+		return names
+	}
+
+	lm.cache.Range(func(key, value interface{}) bool {
+		names = append(names, key.(string))
+		return true
+	})
+	sort.Strings(names)
+
+	return names
+}
+
 func (lm *LockManager) InvalidatePolicy(name string) {
 	if lm.useCache {
 		lm.cache.Delete(name)
@@ -98,7 +137,131 @@ func (lm *LockManager) RestorePolicy(ctx context.Context, storage logical.Storag
 		keyData.Policy.Name = name
 	}
 
-	name = keyData.Policy.Name
+	// Restoring a key under the name of its escrow key would make it its
+	// own escrow key
+	if keyData.Policy != nil && keyData.Policy.EscrowKeyName == keyData.Policy.Name {
+		return fmt.Errorf("key %q cannot be restored as its own escrow key", keyData.Policy.Name)
+	}
+
+	return lm.restoreKeyData(ctx, storage, &keyData, force)
+}
+
+// MergePolicyVersions appends the versions of the backed up key to the
+// history of the existing key of the given name, which must have the same
+// type and derivation settings. Restored versions are renumbered to follow
+// the existing latest version, in order; versions below the backup's minimum
+// decryption version are left out. The returned map gives the new number of
+// each merged version.
+func (lm *LockManager) MergePolicyVersions(ctx context.Context, storage logical.Storage, name, backup string) (map[int]int, error) {
+	backupBytes, err := base64.StdEncoding.DecodeString(backup)
+	if err != nil {
+		return nil, errutil.UserError{Err: fmt.Sprintf("failed to decode backup: %v", err)}
+	}
+
+	var keyData KeyData
+	err = jsonutil.DecodeJSON(backupBytes, &keyData)
+	if err != nil {
+		return nil, errutil.UserError{Err: fmt.Sprintf("failed to decode backup: %v", err)}
+	}
+	if keyData.Policy == nil {
+		return nil, errutil.UserError{Err: "backup does not contain a key"}
+	}
+	restored := keyData.Policy
+	if name == "" {
+		name = restored.Name
+	}
+
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var p *Policy
+	if lm.useCache {
+		if pRaw, ok := lm.cache.Load(name); ok {
+			p = pRaw.(*Policy)
+		}
+	}
+	if p == nil {
+		p, err = lm.getPolicyFromStorage(ctx, storage, name)
+		if err != nil {
+			return nil, err
+		}
+		if p == nil {
+			return nil, errutil.UserError{Err: fmt.Sprintf("key %q not found", name)}
+		}
+	}
+
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if atomic.LoadUint32(&p.deleted) == 1 {
+		return nil, errutil.UserError{Err: fmt.Sprintf("key %q not found", name)}
+	}
+
+	switch {
+	case restored.Type != p.Type:
+		return nil, errutil.UserError{Err: fmt.Sprintf("cannot merge a key of type %v into a key of type %v", restored.Type, p.Type)}
+	case restored.Derived != p.Derived || restored.KDF != p.KDF || restored.ConvergentEncryption != p.ConvergentEncryption:
+		return nil, errutil.UserError{Err: "cannot merge keys with different derivation settings"}
+	}
+
+	// Versions that are no longer in the backed up policy's key map are in
+	// its archive, indexed from its minimum available version
+	firstVersion := restored.MinDecryptionVersion
+	if firstVersion < 1 {
+		firstVersion = 1
+	}
+	entries := make([]KeyEntry, 0, restored.LatestVersion-firstVersion+1)
+	for ver := firstVersion; ver <= restored.LatestVersion; ver++ {
+		entry, ok := restored.Keys[strconv.Itoa(ver)]
+		if !ok {
+			idx := ver - restored.MinAvailableVersion
+			if keyData.ArchivedKeys == nil || idx < 0 || idx >= len(keyData.ArchivedKeys.Keys) {
+				return nil, errutil.UserError{Err: fmt.Sprintf("version %d is missing from the backup", ver)}
+			}
+			entry = keyData.ArchivedKeys.Keys[idx]
+		}
+		entries = append(entries, entry)
+	}
+
+	priorLatestVersion := p.LatestVersion
+	priorRestoreInfo := p.RestoreInfo
+
+	versionMap := make(map[int]int, len(entries))
+	for i, entry := range entries {
+		newVer := priorLatestVersion + i + 1
+		p.Keys[strconv.Itoa(newVer)] = entry
+		versionMap[firstVersion+i] = newVer
+	}
+	p.LatestVersion = priorLatestVersion + len(entries)
+	p.RestoreInfo = &RestoreInfo{
+		Time:    time.Now(),
+		Version: p.LatestVersion,
+	}
+
+	// The merged versions are added to the archive when persisting
+	if err := p.Persist(ctx, storage); err != nil {
+		for _, newVer := range versionMap {
+			delete(p.Keys, strconv.Itoa(newVer))
+		}
+		p.LatestVersion = priorLatestVersion
+		p.RestoreInfo = priorRestoreInfo
+		return nil, errwrap.Wrapf(fmt.Sprintf("failed to merge versions into key %q: {{err}}", name), err)
+	}
+
+	if lm.useCache {
+		lm.cache.Store(name, p)
+	}
+
+	return versionMap, nil
+}
+
+// restoreKeyData stores the given policy and its archived keys, replacing an
+// existing policy of the same name only if force is set.
+func (lm *LockManager) restoreKeyData(ctx context.Context, storage logical.Storage, keyData *KeyData, force bool) error {
+	var err error
+
+	name := keyData.Policy.Name
 
 	// Grab the exclusive lock as we'll be modifying disk
 	lock := locksutil.LockForKey(lm.keyLocks, name)
@@ -172,6 +335,16 @@ func (lm *LockManager) RestorePolicy(ctx context.Context, storage logical.Storag
 		return errwrap.Wrapf(fmt.Sprintf("failed to restore the policy %q: {{err}}", name), err)
 	}
 
+	// A replaced policy with a different replication scope lives under a
+	// different prefix, so its entries are not overwritten above
+	if p != nil && p.StoragePrefix != keyData.Policy.StoragePrefix {
+		for _, key := range []string{path.Join(p.StoragePrefix, "policy", name), path.Join(p.StoragePrefix, "archive", name)} {
+			if err := storage.Delete(ctx, key); err != nil {
+				return errwrap.Wrapf(fmt.Sprintf("failed to remove the replaced policy %q: {{err}}", name), err)
+			}
+		}
+	}
+
 	keyData.Policy.l = new(sync.RWMutex)
 
 	// Update the cache to contain the restored policy
@@ -183,6 +356,14 @@ func (lm *LockManager) RestorePolicy(ctx context.Context, storage logical.Storag
 }
 
 func (lm *LockManager) BackupPolicy(ctx context.Context, storage logical.Storage, name string) (string, error) {
+	return lm.backupPolicy(ctx, storage, name, func(p *Policy) (string, error) {
+		return p.Backup(ctx, storage)
+	})
+}
+
+// backupPolicy loads the named policy under an exclusive lock and returns the
+// output of the given backup function
+func (lm *LockManager) backupPolicy(ctx context.Context, storage logical.Storage, name string, backupFunc func(*Policy) (string, error)) (string, error) {
 	var p *Policy
 	var err error
 
@@ -217,7 +398,7 @@ func (lm *LockManager) BackupPolicy(ctx context.Context, storage logical.Storage
 		return "", fmt.Errorf(fmt.Sprintf("key %q not found", name))
 	}
 
-	backup, err := p.Backup(ctx, storage)
+	backup, err := backupFunc(p)
 	if err != nil {
 		return "", err
 	}
@@ -323,7 +504,7 @@ func (lm *LockManager) GetPolicy(ctx context.Context, req PolicyRequest) (retP *
 				return nil, false, fmt.Errorf("convergent encryption not supported for keys of type %v", req.KeyType)
 			}
 
-		case KeyType_RSA2048, KeyType_RSA4096:
+		case KeyType_RSA2048, KeyType_RSA4096, KeyType_X25519:
 			if req.Derived || req.Convergent {
 				cleanup()
 				return nil, false, fmt.Errorf("key derivation and convergent encryption not supported for keys of type %v", req.KeyType)
@@ -341,6 +522,18 @@ func (lm *LockManager) GetPolicy(ctx context.Context, req PolicyRequest) (retP *
 			Derived:              req.Derived,
 			Exportable:           req.Exportable,
 			AllowPlaintextBackup: req.AllowPlaintextBackup,
+			LifecyclePolicy:      req.LifecyclePolicy,
+			StatusWebhookURL:     req.StatusWebhookURL,
+		}
+
+		switch req.ReplicationScope {
+		case "", ReplicationScopeCluster:
+		case ReplicationScopeLocal:
+			p.ReplicationScope = req.ReplicationScope
+			p.StoragePrefix = LocalStoragePrefix
+		default:
+			cleanup()
+			return nil, false, fmt.Errorf("unsupported replication scope %q", req.ReplicationScope)
 		}
 
 		if req.Derived {
@@ -384,6 +577,26 @@ func (lm *LockManager) GetPolicy(ctx context.Context, req PolicyRequest) (retP *
 		}
 	}
 
+	// Soft-deleted policies are never cached, so that the cache only holds
+	// usable policies
+	if p.SoftDeleted {
+		switch {
+		case req.Upsert:
+			cleanup()
+			return nil, false, fmt.Errorf("key %q has been soft-deleted; undelete it or delete it permanently first", req.Name)
+		case !req.AllowSoftDeleted:
+			cleanup()
+			return nil, false, nil
+		}
+		if !lm.useCache {
+			p.l = &lock.RWMutex
+			p.writeLocked = true
+		}
+		retP = p
+		cleanup()
+		return
+	}
+
 	if lm.useCache {
 		lm.cache.Store(req.Name, p)
 	} else {
@@ -438,12 +651,38 @@ func (lm *LockManager) DeletePolicy(ctx context.Context, storage logical.Storage
 		lm.cache.Delete(name)
 	}
 
-	err = storage.Delete(ctx, "policy/"+name)
+	return deletePolicyStorage(ctx, storage, p.StoragePrefix, name)
+}
+
+// PurgeSoftDeletedPolicy removes the named policy from storage if it has been
+// soft-deleted and its recovery window has passed by now. It reports whether
+// the policy was removed.
+func (lm *LockManager) PurgeSoftDeletedPolicy(ctx context.Context, storage logical.Storage, name string, now time.Time) (bool, error) {
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	p, err := lm.getPolicyFromStorage(ctx, storage, name)
+	if err != nil {
+		return false, err
+	}
+	if p == nil || !p.SoftDeleted || now.Before(p.RecoveryDeadline) {
+		return false, nil
+	}
+
+	if err := deletePolicyStorage(ctx, storage, p.StoragePrefix, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func deletePolicyStorage(ctx context.Context, storage logical.Storage, prefix, name string) error {
+	err := storage.Delete(ctx, path.Join(prefix, "policy", name))
 	if err != nil {
 		return errwrap.Wrapf(fmt.Sprintf("error deleting key %q: {{err}}", name), err)
 	}
 
-	err = storage.Delete(ctx, "archive/"+name)
+	err = storage.Delete(ctx, path.Join(prefix, "archive", name))
 	if err != nil {
 		return errwrap.Wrapf(fmt.Sprintf("error deleting key %q archive: {{err}}", name), err)
 	}
@@ -451,6 +690,340 @@ func (lm *LockManager) DeletePolicy(ctx context.Context, storage logical.Storage
 	return nil
 }
 
+// SoftDeletePolicy marks the named policy as deleted without removing it from
+// storage. It cannot be used until it is undeleted, which must happen within
+// the recovery window.
+func (lm *LockManager) SoftDeletePolicy(ctx context.Context, storage logical.Storage, name string, recoveryWindow time.Duration) error {
+	var p *Policy
+	var err error
+	var ok bool
+	var pRaw interface{}
+
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if lm.useCache {
+		pRaw, ok = lm.cache.Load(name)
+	}
+	if ok {
+		p = pRaw.(*Policy)
+		p.l.Lock()
+		defer p.l.Unlock()
+	}
+
+	if p == nil {
+		p, err = lm.getPolicyFromStorage(ctx, storage, name)
+		if err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("could not delete key; not found")
+		}
+	}
+
+	if !p.DeletionAllowed {
+		return fmt.Errorf("deletion is not allowed for this key")
+	}
+	if p.SoftDeleted {
+		return fmt.Errorf("key has already been soft-deleted")
+	}
+
+	// A scheduled deletion is superseded, so that an undeleted key is not
+	// deleted again once its grace period has passed
+	scheduledAt, scheduledPermanent := p.DeletionScheduledAt, p.DeletionScheduledPermanent
+	p.SoftDeleted = true
+	p.RecoveryDeadline = time.Now().Add(recoveryWindow)
+	p.DeletionScheduledAt = time.Time{}
+	p.DeletionScheduledPermanent = false
+	if err := p.Persist(ctx, storage); err != nil {
+		p.SoftDeleted = false
+		p.RecoveryDeadline = time.Time{}
+		p.DeletionScheduledAt, p.DeletionScheduledPermanent = scheduledAt, scheduledPermanent
+		return err
+	}
+
+	// Requests still holding the cached policy must not persist it again,
+	// which would clear the soft deletion
+	if ok {
+		atomic.StoreUint32(&p.deleted, 1)
+		lm.cache.Delete(name)
+	}
+
+	return nil
+}
+
+// ScheduleDeletion schedules the deletion of the named policy for the end of
+// its deletion grace period and returns when it is scheduled. If it is
+// already scheduled, the existing schedule is kept.
+func (lm *LockManager) ScheduleDeletion(ctx context.Context, storage logical.Storage, name string, permanent bool) (time.Time, error) {
+	var p *Policy
+	var err error
+	var ok bool
+	var pRaw interface{}
+
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if lm.useCache {
+		pRaw, ok = lm.cache.Load(name)
+	}
+	if ok {
+		p = pRaw.(*Policy)
+		p.l.Lock()
+		defer p.l.Unlock()
+	}
+
+	if p == nil {
+		p, err = lm.getPolicyFromStorage(ctx, storage, name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if p == nil {
+			return time.Time{}, fmt.Errorf("could not delete key; not found")
+		}
+	}
+
+	if !p.DeletionAllowed {
+		return time.Time{}, fmt.Errorf("deletion is not allowed for this key")
+	}
+	if !p.DeletionScheduledAt.IsZero() {
+		return p.DeletionScheduledAt, nil
+	}
+
+	p.DeletionScheduledAt = time.Now().Add(p.DeletionGracePeriod)
+	p.DeletionScheduledPermanent = permanent
+	if err := p.Persist(ctx, storage); err != nil {
+		p.DeletionScheduledAt = time.Time{}
+		p.DeletionScheduledPermanent = false
+		return time.Time{}, err
+	}
+
+	return p.DeletionScheduledAt, nil
+}
+
+// DeletionScheduledAt returns when the named policy is scheduled to be
+// deleted, or the zero time if it is not. With caching enabled only cached
+// policies are consulted, since every policy in use is cached.
+func (lm *LockManager) DeletionScheduledAt(ctx context.Context, storage logical.Storage, name string) (time.Time, error) {
+	if lm.useCache {
+		pRaw, ok := lm.cache.Load(name)
+		if !ok {
+			return time.Time{}, nil
+		}
+		p := pRaw.(*Policy)
+		p.l.RLock()
+		defer p.l.RUnlock()
+		return p.DeletionScheduledAt, nil
+	}
+
+	p, err := LoadPolicyMetadata(ctx, storage, name)
+	if err != nil || p == nil {
+		return time.Time{}, err
+	}
+	return p.DeletionScheduledAt, nil
+}
+
+// UndeletePolicy restores a soft-deleted policy whose recovery window has not
+// yet passed.
+func (lm *LockManager) UndeletePolicy(ctx context.Context, storage logical.Storage, name string) error {
+	lock := locksutil.LockForKey(lm.keyLocks, name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Soft-deleted policies are never cached, so read it from storage
+	p, err := lm.getPolicyFromStorage(ctx, storage, name)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		return fmt.Errorf("could not undelete key; not found")
+	}
+	if !p.SoftDeleted {
+		return fmt.Errorf("key has not been soft-deleted")
+	}
+	if time.Now().After(p.RecoveryDeadline) {
+		return fmt.Errorf("the recovery window of the key has passed")
+	}
+
+	p.SoftDeleted = false
+	p.RecoveryDeadline = time.Time{}
+	return p.Persist(ctx, storage)
+}
+
+// DeletePolicies deletes either all of the named policies or none of them.
+// Policies that cannot be deleted are returned along with the reason; if any
+// are returned, nothing has been deleted. If removing an entry from storage
+// fails, the entries already removed are written back.
+func (lm *LockManager) DeletePolicies(ctx context.Context, storage logical.Storage, names []string) (map[string]error, error) {
+	seen := make(map[string]bool, len(names))
+	var uniqueNames []string
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			uniqueNames = append(uniqueNames, name)
+		}
+	}
+
+	locks := locksutil.LocksForKeys(lm.keyLocks, uniqueNames)
+	for _, lock := range locks {
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	failed := make(map[string]error)
+	policies := make(map[string]*Policy, len(uniqueNames))
+	for _, name := range uniqueNames {
+		var p *Policy
+		if lm.useCache {
+			if pRaw, ok := lm.cache.Load(name); ok {
+				p = pRaw.(*Policy)
+				p.l.Lock()
+				defer p.l.Unlock()
+			}
+		}
+
+		if p == nil {
+			var err error
+			p, err = lm.getPolicyFromStorage(ctx, storage, name)
+			if err != nil {
+				return nil, err
+			}
+			if p == nil {
+				failed[name] = fmt.Errorf("could not delete key; not found")
+				continue
+			}
+		}
+
+		if !p.DeletionAllowed {
+			failed[name] = fmt.Errorf("deletion is not allowed for this key")
+			continue
+		}
+
+		policies[name] = p
+	}
+	if len(failed) > 0 {
+		return failed, nil
+	}
+
+	// Keep the current entries so that they can be written back if any
+	// delete fails
+	var removed []*logical.StorageEntry
+	rollback := func(name string, err error) (map[string]error, error) {
+		for _, entry := range removed {
+			if putErr := storage.Put(ctx, entry); putErr != nil {
+				return nil, errwrap.Wrapf(fmt.Sprintf("error restoring %q after failing to delete key %q: {{err}}", entry.Key, name), putErr)
+			}
+		}
+		return map[string]error{
+			name: err,
+		}, nil
+	}
+
+	for _, name := range uniqueNames {
+		prefix := policies[name].StoragePrefix
+		for _, key := range []string{path.Join(prefix, "policy", name), path.Join(prefix, "archive", name)} {
+			entry, err := storage.Get(ctx, key)
+			if err != nil {
+				return rollback(name, err)
+			}
+			if entry == nil {
+				continue
+			}
+
+			if err := storage.Delete(ctx, key); err != nil {
+				return rollback(name, err)
+			}
+			removed = append(removed, entry)
+		}
+	}
+
+	for name, p := range policies {
+		atomic.StoreUint32(&p.deleted, 1)
+		if lm.useCache {
+			lm.cache.Delete(name)
+		}
+	}
+
+	return nil, nil
+}
+
+// getPolicyFromStorage loads the named policy, looking under the local
+// storage prefix if it is not found among the replicated policies.
 func (lm *LockManager) getPolicyFromStorage(ctx context.Context, storage logical.Storage, name string) (*Policy, error) {
-	return LoadPolicy(ctx, storage, "policy/"+name)
+	return LoadPolicyFromStorage(ctx, storage, name)
+}
+
+// LoadPolicyFromStorage loads the named policy from storage, bypassing the
+// cache. The returned policy is neither cached nor upgraded and does not
+// need to be locked.
+func LoadPolicyFromStorage(ctx context.Context, storage logical.Storage, name string) (*Policy, error) {
+	p, err := LoadPolicy(ctx, storage, "policy/"+name)
+	if err != nil || p != nil {
+		return p, err
+	}
+	return LoadPolicy(ctx, storage, path.Join(LocalStoragePrefix, "policy", name))
+}
+
+// skipJSON discards the JSON value it is decoded from
+type skipJSON struct{}
+
+func (skipJSON) UnmarshalJSON([]byte) error {
+	return nil
+}
+
+// LoadPolicyMetadata loads the named policy from storage, bypassing the
+// cache, without decoding its key material. The Keys of the returned policy
+// are nil, so it can only be used to inspect the configuration of the key.
+func LoadPolicyMetadata(ctx context.Context, storage logical.Storage, name string) (*Policy, error) {
+	raw, err := storage.Get(ctx, "policy/"+name)
+	if err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		raw, err = storage.Get(ctx, path.Join(LocalStoragePrefix, "policy", name))
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			return nil, nil
+		}
+	}
+
+	// The shallower fields take precedence over those of the embedded
+	// policy, so the key material is skipped
+	metadata := struct {
+		*Policy
+		Key  skipJSON `json:"key"`
+		Keys skipJSON `json:"keys"`
+	}{
+		Policy: &Policy{},
+	}
+	if err := jsonutil.DecodeJSON(raw.Value, &metadata); err != nil {
+		return nil, err
+	}
+
+	metadata.Policy.l = new(sync.RWMutex)
+	return metadata.Policy, nil
+}
+
+// ListPolicies returns the sorted names of all policies in storage,
+// including those stored under the local storage prefix.
+func ListPolicies(ctx context.Context, storage logical.Storage) ([]string, error) {
+	names, err := storage.List(ctx, "policy/")
+	if err != nil {
+		return nil, err
+	}
+	localNames, err := storage.List(ctx, path.Join(LocalStoragePrefix, "policy")+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(localNames) == 0 {
+		return names, nil
+	}
+
+	names = append(names, localNames...)
+	sort.Strings(names)
+	return names, nil
 }
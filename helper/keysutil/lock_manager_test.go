@@ -0,0 +1,220 @@
+package keysutil
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+func TestLockManager_GetAllPolicyNames(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+
+	lm := NewLockManager(false)
+
+	names := lm.GetAllPolicyNames()
+	if names == nil || len(names) != 0 {
+		t.Fatalf("expected empty non-nil slice, got %#v", names)
+	}
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		p, _, err := lm.GetPolicy(ctx, PolicyRequest{
+			Upsert:  true,
+			Storage: storage,
+			KeyType: KeyType_AES256_GCM96,
+			Name:    name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil {
+			t.Fatal("nil policy")
+		}
+	}
+
+	names = lm.GetAllPolicyNames()
+	if !reflect.DeepEqual(names, []string{"bar", "baz", "foo"}) {
+		t.Fatalf("bad: %#v", names)
+	}
+
+	// Evicted policies should no longer be listed
+	lm.InvalidatePolicy("baz")
+	names = lm.GetAllPolicyNames()
+	if !reflect.DeepEqual(names, []string{"bar", "foo"}) {
+		t.Fatalf("bad: %#v", names)
+	}
+
+	// Loading from storage should put it back in the cache
+	p, _, err := lm.GetPolicy(ctx, PolicyRequest{
+		Storage: storage,
+		Name:    "baz",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatal("nil policy")
+	}
+	names = lm.GetAllPolicyNames()
+	if !reflect.DeepEqual(names, []string{"bar", "baz", "foo"}) {
+		t.Fatalf("bad: %#v", names)
+	}
+
+	// With the cache disabled nothing is ever returned
+	lm = NewLockManager(true)
+	p, _, err = lm.GetPolicy(ctx, PolicyRequest{
+		Storage: storage,
+		Name:    "foo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p == nil {
+		t.Fatal("nil policy")
+	}
+	p.Unlock()
+	names = lm.GetAllPolicyNames()
+	if names == nil || len(names) != 0 {
+		t.Fatalf("expected empty non-nil slice, got %#v", names)
+	}
+}
+
+// failingDeleteStorage fails to delete a single storage entry
+type failingDeleteStorage struct {
+	logical.Storage
+	failKey string
+}
+
+func (s *failingDeleteStorage) Delete(ctx context.Context, key string) error {
+	if key == s.failKey {
+		return errors.New("injected failure")
+	}
+	return s.Storage.Delete(ctx, key)
+}
+
+func TestLockManager_DeletePolicies(t *testing.T) {
+	ctx := context.Background()
+	storage := &failingDeleteStorage{
+		Storage: &logical.InmemStorage{},
+		failKey: "policy/c",
+	}
+
+	lm := NewLockManager(false)
+	for _, name := range []string{"a", "b", "c"} {
+		p, _, err := lm.GetPolicy(ctx, PolicyRequest{
+			Upsert:  true,
+			Storage: storage,
+			KeyType: KeyType_AES256_GCM96,
+			Name:    name,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.DeletionAllowed = true
+		if err := p.Rotate(ctx, storage); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before, err := storage.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting c fails after a and b have been removed, so they are written
+	// back
+	failed, err := lm.DeletePolicies(ctx, storage, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 1 || failed["c"] == nil {
+		t.Fatalf("bad: %#v", failed)
+	}
+	for _, prefix := range []string{"policy/", "archive/"} {
+		keys, err := storage.List(ctx, prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(keys, []string{"a", "b", "c"}) {
+			t.Fatalf("bad: %s: %#v", prefix, keys)
+		}
+	}
+	after, err := storage.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, after) {
+		t.Fatalf("bad: expected %#v, got %#v", before, after)
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		p, err := LoadPolicy(ctx, storage, "policy/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p == nil || p.LatestVersion != 2 {
+			t.Fatalf("%s: bad policy after rollback: %#v", name, p)
+		}
+	}
+
+	storage.failKey = ""
+	failed, err = lm.DeletePolicies(ctx, storage, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("bad: %#v", failed)
+	}
+	keys, err := storage.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 0 {
+		t.Fatalf("expected empty storage, got %#v", keys)
+	}
+	if names := lm.GetAllPolicyNames(); len(names) != 0 {
+		t.Fatalf("expected empty cache, got %#v", names)
+	}
+}
+
+func TestLoadPolicyMetadata(t *testing.T) {
+	ctx := context.Background()
+	storage := &logical.InmemStorage{}
+	lm := NewLockManager(false)
+
+	p, _, err := lm.GetPolicy(ctx, PolicyRequest{
+		Upsert:     true,
+		Storage:    storage,
+		KeyType:    KeyType_AES256_GCM96,
+		Name:       "foo",
+		Exportable: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Rotate(ctx, storage); err != nil {
+		t.Fatal(err)
+	}
+
+	metadata, err := LoadPolicyMetadata(ctx, storage, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Name != "foo" || metadata.Type != KeyType_AES256_GCM96 || metadata.LatestVersion != 2 || !metadata.Exportable {
+		t.Fatalf("bad metadata: %#v", metadata)
+	}
+	if metadata.Keys != nil || metadata.Key != nil {
+		t.Fatalf("expected no key material, got %#v", metadata.Keys)
+	}
+	if metadata == p {
+		t.Fatal("expected metadata to be loaded from storage")
+	}
+
+	metadata, err = LoadPolicyMetadata(ctx, storage, "bar")
+	if err != nil || metadata != nil {
+		t.Fatalf("expected no policy, got %#v, err %v", metadata, err)
+	}
+}
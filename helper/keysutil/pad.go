@@ -0,0 +1,60 @@
+package keysutil
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/helper/errutil"
+)
+
+// PlaintextPaddingPKCS7 labels ciphertexts whose plaintext was padded with
+// PKCS#7 padding before encryption. The label is written after the version
+// prefix.
+const PlaintextPaddingPKCS7 = "pkcs7"
+
+// MaxPadPlaintextTo is the largest length plaintexts can be padded to, as
+// PKCS#7 padding records its length in a single byte. An empty plaintext is
+// padded with padTo bytes, so padTo must fit in that byte.
+const MaxPadPlaintextTo = 255
+
+// padPlaintext pads the plaintext to padTo bytes with PKCS#7 padding. At
+// least one byte of padding is always added, so the plaintext must be
+// shorter than padTo.
+func padPlaintext(plaintext []byte, padTo int) ([]byte, error) {
+	if padTo < 1 || padTo > MaxPadPlaintextTo {
+		return nil, errutil.UserError{Err: fmt.Sprintf("padded length must be between 1 and %d", MaxPadPlaintextTo)}
+	}
+	if len(plaintext) >= padTo {
+		return nil, errutil.UserError{Err: fmt.Sprintf("plaintext of %d bytes must be shorter than the padded length of %d", len(plaintext), padTo)}
+	}
+
+	padding := padTo - len(plaintext)
+	padded := make([]byte, padTo)
+	copy(padded, plaintext)
+	for i := len(plaintext); i < padTo; i++ {
+		padded[i] = byte(padding)
+	}
+	return padded, nil
+}
+
+// errBadPadding is returned for every kind of malformed padding, so that
+// failures do not reveal how the padding was malformed
+var errBadPadding = errutil.UserError{Err: "invalid ciphertext: bad plaintext padding"}
+
+// unpadPlaintext removes the PKCS#7 padding added by padPlaintext
+func unpadPlaintext(padded []byte) ([]byte, error) {
+	if len(padded) == 0 {
+		return nil, errBadPadding
+	}
+
+	padding := int(padded[len(padded)-1])
+	if padding == 0 || padding > len(padded) {
+		return nil, errBadPadding
+	}
+	for _, b := range padded[len(padded)-padding:] {
+		if int(b) != padding {
+			return nil, errBadPadding
+		}
+	}
+
+	return padded[:len(padded)-padding], nil
+}
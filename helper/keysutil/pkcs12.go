@@ -0,0 +1,292 @@
+package keysutil
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"strconv"
+	"unicode/utf16"
+)
+
+// pkcs12Iterations is the iteration count of the PKCS#12 key derivation
+// used for both encryption and the MAC
+const pkcs12Iterations = 2048
+
+// tagBMPString is the ASN.1 universal tag of a BMPString, used for friendly
+// names
+const tagBMPString = 30
+
+var (
+	oidPKCS7Data                     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS8ShroudedKeyBag           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+	oidSHA1                          = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidFriendlyName                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+
+	// Algorithm identifiers recorded in the PKCS#8 wrapping of symmetric
+	// keys: id-aes256-GCM from RFC 5084 and id-alg-AEADChaCha20Poly1305
+	// from RFC 8103
+	oidAES256GCM        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 46}
+	oidChaCha20Poly1305 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 3, 18}
+)
+
+type pkcs12PBEParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+type pkcs12EncryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pkcs12DigestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type pkcs12MacData struct {
+	Mac        pkcs12DigestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+// The content of a ContentInfo and the value of a SafeBag are explicitly
+// tagged, which encoding/asn1 does not apply to RawValues, so the tags are
+// written by explicitTag
+type pkcs12ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type pkcs12SafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type pkcs12Attribute struct {
+	ID    asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+type pkcs12PFX struct {
+	Version  int
+	AuthSafe pkcs12ContentInfo
+	MacData  pkcs12MacData
+}
+
+// PKCS12 returns a password-protected PKCS#12 archive of the given versions
+// of a symmetric key. Each version is a shrouded key bag holding the key in a
+// PKCS#8 wrapping, encrypted with pbeWithSHAAnd3-KeyTripleDES-CBC, and named
+// by its version. The archive is protected with an HMAC-SHA1 MAC, which is
+// what PKCS#12 readers support most widely.
+func (p *Policy) PKCS12(versions []int, password string) ([]byte, error) {
+	var keyOID asn1.ObjectIdentifier
+	switch p.Type {
+	case KeyType_AES256_GCM96:
+		keyOID = oidAES256GCM
+	case KeyType_ChaCha20_Poly1305:
+		keyOID = oidChaCha20Poly1305
+	default:
+		return nil, fmt.Errorf("pkcs12 format is not supported for key type %v", p.Type)
+	}
+	if p.Derived {
+		return nil, fmt.Errorf("pkcs12 format does not support derived keys")
+	}
+	if password == "" {
+		return nil, fmt.Errorf("a password is required for the pkcs12 format")
+	}
+	encodedPassword := pkcs12Password(password)
+
+	bags := make([]pkcs12SafeBag, 0, len(versions))
+	for _, ver := range versions {
+		entry, ok := p.Keys[strconv.Itoa(ver)]
+		if !ok {
+			return nil, fmt.Errorf("key version %d could not be found", ver)
+		}
+
+		keyInfo, err := asn1.Marshal(pkcs8{
+			Algo:       pkix.AlgorithmIdentifier{Algorithm: keyOID},
+			PrivateKey: entry.Key,
+		})
+		if err != nil {
+			return nil, err
+		}
+		shrouded, err := pkcs12Encrypt(keyInfo, encodedPassword)
+		if err != nil {
+			return nil, err
+		}
+		name, err := asn1.Marshal(asn1.RawValue{
+			Class: asn1.ClassUniversal,
+			Tag:   tagBMPString,
+			Bytes: pkcs12BMPString(strconv.Itoa(ver)),
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		bags = append(bags, pkcs12SafeBag{
+			ID:    oidPKCS8ShroudedKeyBag,
+			Value: explicitTag(shrouded),
+			Attributes: []pkcs12Attribute{{
+				ID:    oidFriendlyName,
+				Value: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: name},
+			}},
+		})
+	}
+
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+	safeContentsInfo, err := dataContentInfo(safeContents)
+	if err != nil {
+		return nil, err
+	}
+	authSafe, err := asn1.Marshal([]pkcs12ContentInfo{safeContentsInfo})
+	if err != nil {
+		return nil, err
+	}
+	authSafeInfo, err := dataContentInfo(authSafe)
+	if err != nil {
+		return nil, err
+	}
+
+	macSalt := make([]byte, 8)
+	if _, err := rand.Read(macSalt); err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha1.New, pkcs12KDF(encodedPassword, macSalt, pkcs12Iterations, 3, sha1.Size))
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pkcs12PFX{
+		Version:  3,
+		AuthSafe: authSafeInfo,
+		MacData: pkcs12MacData{
+			Mac: pkcs12DigestInfo{
+				Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    macSalt,
+			Iterations: pkcs12Iterations,
+		},
+	})
+}
+
+// explicitTag wraps DER in the [0] EXPLICIT tag
+func explicitTag(der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: der}
+}
+
+func dataContentInfo(content []byte) (pkcs12ContentInfo, error) {
+	octets, err := asn1.Marshal(content)
+	if err != nil {
+		return pkcs12ContentInfo{}, err
+	}
+	return pkcs12ContentInfo{
+		ContentType: oidPKCS7Data,
+		Content:     explicitTag(octets),
+	}, nil
+}
+
+// pkcs12Encrypt encrypts the DER of a PKCS#8 key into an
+// EncryptedPrivateKeyInfo using pbeWithSHAAnd3-KeyTripleDES-CBC
+func pkcs12Encrypt(plaintext, encodedPassword []byte) ([]byte, error) {
+	salt := make([]byte, 8)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	params, err := asn1.Marshal(pkcs12PBEParams{Salt: salt, Iterations: pkcs12Iterations})
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := des.NewTripleDESCipher(pkcs12KDF(encodedPassword, salt, pkcs12Iterations, 1, 24))
+	if err != nil {
+		return nil, err
+	}
+	iv := pkcs12KDF(encodedPassword, salt, pkcs12Iterations, 2, block.BlockSize())
+
+	padding := block.BlockSize() - len(plaintext)%block.BlockSize()
+	ciphertext := append(append([]byte{}, plaintext...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+
+	return asn1.Marshal(pkcs12EncryptedPrivateKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidPBEWithSHAAnd3KeyTripleDESCBC,
+			Parameters: asn1.RawValue{FullBytes: params},
+		},
+		EncryptedData: ciphertext,
+	})
+}
+
+// pkcs12BMPString encodes s as UTF-16 big endian
+func pkcs12BMPString(s string) []byte {
+	units := utf16.Encode([]rune(s))
+	out := make([]byte, 0, 2*len(units))
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return out
+}
+
+// pkcs12Password encodes a password for the PKCS#12 key derivation: a
+// BMPString followed by a null character
+func pkcs12Password(password string) []byte {
+	return append(pkcs12BMPString(password), 0, 0)
+}
+
+// pkcs12KDF derives size bytes of key material for the given purpose, 1 for
+// encryption keys, 2 for IVs and 3 for MAC keys, as described in RFC 7292
+// appendix B.2, using SHA-1
+func pkcs12KDF(password, salt []byte, iterations int, id byte, size int) []byte {
+	const u, v = sha1.Size, 64
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	out := make([]byte, 0, size+u)
+	for len(out) < size {
+		h := sha1.New()
+		h.Write(d)
+		h.Write(i)
+		a := h.Sum(nil)
+		for j := 1; j < iterations; j++ {
+			sum := sha1.Sum(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+
+		// Each v-byte block of I becomes (I_j + B + 1) mod 2^(8v), where B
+		// repeats A
+		b := fill(a)
+		for j := 0; j < len(i); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(i[j+k]) + int(b[k]) + carry
+				i[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+
+	return out[:size]
+}
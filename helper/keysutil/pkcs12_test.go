@@ -0,0 +1,105 @@
+package keysutil
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"encoding/asn1"
+	"testing"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+func TestPolicy_PKCS12(t *testing.T) {
+	p := &Policy{
+		Name: "test",
+		Type: KeyType_AES256_GCM96,
+		Keys: keyEntryMap{},
+	}
+	for _, ver := range []string{"1", "2"} {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		p.Keys[ver] = KeyEntry{Key: key}
+	}
+
+	if _, err := p.PKCS12([]int{1, 2}, ""); err == nil {
+		t.Fatal("expected an error without a password")
+	}
+	if _, err := p.PKCS12([]int{3}, "secret"); err == nil {
+		t.Fatal("expected an error for a missing version")
+	}
+
+	der, err := p.PKCS12([]int{1, 2}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The MAC is checked independently of this package
+	if _, err := pkcs12.ToPEM(der, "wrong"); err != pkcs12.ErrIncorrectPassword {
+		t.Fatalf("expected incorrect password error, got %v", err)
+	}
+
+	var pfx struct {
+		Version  int
+		AuthSafe struct {
+			ContentType asn1.ObjectIdentifier
+			Content     []byte `asn1:"tag:0,explicit"`
+		}
+		MacData asn1.RawValue
+	}
+	if _, err := asn1.Unmarshal(der, &pfx); err != nil {
+		t.Fatal(err)
+	}
+	var authSafe []struct {
+		ContentType asn1.ObjectIdentifier
+		Content     []byte `asn1:"tag:0,explicit"`
+	}
+	if _, err := asn1.Unmarshal(pfx.AuthSafe.Content, &authSafe); err != nil || len(authSafe) != 1 {
+		t.Fatalf("bad authenticated safe, err: %v", err)
+	}
+	var bags []struct {
+		ID         asn1.ObjectIdentifier
+		Value      pkcs12EncryptedPrivateKeyInfo `asn1:"tag:0,explicit"`
+		Attributes []struct {
+			ID    asn1.ObjectIdentifier
+			Value []asn1.RawValue `asn1:"set"`
+		} `asn1:"set"`
+	}
+	if _, err := asn1.Unmarshal(authSafe[0].Content, &bags); err != nil || len(bags) != 2 {
+		t.Fatalf("bad safe contents, err: %v", err)
+	}
+
+	password := pkcs12Password("secret")
+	for i, bag := range bags {
+		ver := string(rune('1' + i))
+		if !bag.ID.Equal(oidPKCS8ShroudedKeyBag) || !bag.Attributes[0].ID.Equal(oidFriendlyName) {
+			t.Fatalf("bad bag: %#v", bag)
+		}
+		if name := bag.Attributes[0].Value[0]; name.Tag != tagBMPString || !bytes.Equal(name.Bytes, pkcs12BMPString(ver)) {
+			t.Fatalf("bad friendly name: %#v", name)
+		}
+
+		var params pkcs12PBEParams
+		if _, err := asn1.Unmarshal(bag.Value.Algorithm.Parameters.FullBytes, &params); err != nil {
+			t.Fatal(err)
+		}
+		block, err := des.NewTripleDESCipher(pkcs12KDF(password, params.Salt, params.Iterations, 1, 24))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext := make([]byte, len(bag.Value.EncryptedData))
+		cipher.NewCBCDecrypter(block, pkcs12KDF(password, params.Salt, params.Iterations, 2, 8)).CryptBlocks(plaintext, bag.Value.EncryptedData)
+		plaintext = plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])]
+
+		var keyInfo pkcs8
+		if _, err := asn1.Unmarshal(plaintext, &keyInfo); err != nil {
+			t.Fatal(err)
+		}
+		if !keyInfo.Algo.Algorithm.Equal(oidAES256GCM) || !bytes.Equal(keyInfo.PrivateKey, p.Keys[ver].Key) {
+			t.Fatalf("version %s does not match", ver)
+		}
+	}
+}
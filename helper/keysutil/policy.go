@@ -11,15 +11,20 @@ import (
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/big"
 	"path"
 	"strconv"
@@ -29,6 +34,7 @@ import (
 	"time"
 
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
 	"golang.org/x/crypto/ed25519"
 	"golang.org/x/crypto/hkdf"
 
@@ -55,6 +61,7 @@ const (
 	KeyType_RSA2048
 	KeyType_RSA4096
 	KeyType_ChaCha20_Poly1305
+	KeyType_X25519
 )
 
 const (
@@ -62,10 +69,21 @@ const (
 	// too old.
 	ErrTooOld = "ciphertext or signature version is disallowed by policy (too old)"
 
+	// ErrAuthenticationFailed is returned when the authentication tag of an
+	// AEAD ciphertext does not verify.
+	ErrAuthenticationFailed = "invalid ciphertext: unable to decrypt"
+
 	// DefaultVersionTemplate is used when no version template is provided.
 	DefaultVersionTemplate = "vault:v{{version}}:"
 )
 
+// Hash functions that HKDF can use to derive keys from a context. Ciphertexts
+// produced with any but the default record it after the version prefix.
+const (
+	DerivationAlgorithmHKDFSHA256 = "hkdf-sha256"
+	DerivationAlgorithmHKDFSHA512 = "hkdf-sha512"
+)
+
 type RestoreInfo struct {
 	Time    time.Time `json:"time"`
 	Version int       `json:"version"`
@@ -79,6 +97,60 @@ type BackupInfo struct {
 type SigningResult struct {
 	Signature string
 	PublicKey []byte
+
+	// KeyVersion is the version of the key used to create the signature
+	KeyVersion int
+
+	// R and S are the components of the signature for ECDSA keys
+	R, S *big.Int
+}
+
+// CipherOptions holds optional parameters for EncryptWithOptions and
+// DecryptWithOptions
+type CipherOptions struct {
+	// AssociatedData is authenticated but not encrypted. It is only
+	// supported by AEAD key types and must be identical on decryption.
+	AssociatedData []byte
+
+	// PaddingMode is the padding used by RSA key types. If unset, OAEP with
+	// SHA-256 is used. PKCS#1 v1.5 padding requires AllowPKCS1v15Padding to
+	// be set on the policy.
+	PaddingMode PaddingMode
+
+	// DerivationAlgorithm selects the hash HKDF uses to derive the
+	// encryption key of derived policies. If unset, HKDF-SHA256 is used. It
+	// is recorded in the ciphertext, where it is authenticated, so it is
+	// ignored on decryption.
+	DerivationAlgorithm string
+
+	// CompressionLevel, if set, is the gzip level from 1 to 9 at which the
+	// plaintext is compressed before encryption. It is only supported by
+	// AEAD key types. Compression is recorded in the ciphertext, where it is
+	// authenticated, and skipped when it would not make the ciphertext
+	// shorter. It is ignored on decryption.
+	CompressionLevel int
+
+	// PadTo, if set, is the length in bytes the plaintext is padded to with
+	// PKCS#7 padding before encryption, so that plaintexts of different
+	// lengths give ciphertexts of the same length. It is only supported by
+	// AEAD key types. Padding is recorded in the ciphertext, where it is
+	// authenticated, and cannot be combined with compression, whose output
+	// length depends on the plaintext. It is ignored on decryption.
+	PadTo int
+
+	// TrackNonce, if set, is called with the key version and nonce of
+	// AES-GCM encryptions that use the nonce supplied by the caller, before
+	// the plaintext is sealed. Nonces that are generated or derived from the
+	// plaintext are not passed to it. Returning an error rejects the
+	// encryption. It is ignored on decryption.
+	TrackNonce func(ver int, nonce []byte) error
+
+	// Recorded, if set, is filled in on decryption with the padding,
+	// compression and derivation algorithm that the ciphertext records, so
+	// that the plaintext can be encrypted again the same way. The level of
+	// compression is not recorded, so DefaultCompressionLevel is reported.
+	// It is ignored on encryption.
+	Recorded *CipherOptions
 }
 
 type ecdsaSignature struct {
@@ -103,6 +175,16 @@ func (kt KeyType) DecryptionSupported() bool {
 	return false
 }
 
+// AEADSupported reports whether the key type encrypts with an AEAD, which
+// can authenticate associated data
+func (kt KeyType) AEADSupported() bool {
+	switch kt {
+	case KeyType_AES256_GCM96, KeyType_ChaCha20_Poly1305:
+		return true
+	}
+	return false
+}
+
 func (kt KeyType) SigningSupported() bool {
 	switch kt {
 	case KeyType_ECDSA_P256, KeyType_ED25519, KeyType_RSA2048, KeyType_RSA4096:
@@ -119,6 +201,14 @@ func (kt KeyType) HashSignatureInput() bool {
 	return false
 }
 
+func (kt KeyType) KeyAgreementSupported() bool {
+	switch kt {
+	case KeyType_X25519:
+		return true
+	}
+	return false
+}
+
 func (kt KeyType) DerivationSupported() bool {
 	switch kt {
 	case KeyType_AES256_GCM96, KeyType_ChaCha20_Poly1305, KeyType_ED25519:
@@ -141,6 +231,8 @@ func (kt KeyType) String() string {
 		return "rsa-2048"
 	case KeyType_RSA4096:
 		return "rsa-4096"
+	case KeyType_X25519:
+		return "x25519"
 	}
 
 	return "[unknown]"
@@ -178,6 +270,274 @@ type KeyEntry struct {
 	// This is deprecated (but still filled) in favor of the value above which
 	// is more precise
 	DeprecatedCreationTime int64 `json:"creation_time"`
+
+	// Shannon entropy of the key material normalized to [0, 1], computed
+	// when the key was created or imported
+	EntropyScore float64 `json:"entropy_score,omitempty"`
+
+	// The window in which the key version may be used. A zero value leaves
+	// that side of the window open.
+	UseAfter  time.Time `json:"use_after"`
+	UseBefore time.Time `json:"use_before"`
+
+	// When the key version was archived by age. Archived versions can still
+	// decrypt but are left out of the version listing.
+	ArchivedTime time.Time `json:"archived_time"`
+
+	// The number of signatures made with the key version through the sign
+	// endpoint while the policy limits them, and whether the version has
+	// reached the limit and can no longer sign
+	SignUses     int  `json:"sign_uses,omitempty"`
+	SignDisabled bool `json:"sign_disabled,omitempty"`
+}
+
+// CheckActivationWindow returns an error if the given time is outside of the
+// activation window of the key version
+func (ke *KeyEntry) CheckActivationWindow(ver int, now time.Time) error {
+	if !ke.UseAfter.IsZero() && now.Before(ke.UseAfter) {
+		return errutil.UserError{Err: fmt.Sprintf("key version %d is not active until %s", ver, ke.UseAfter.Format(time.RFC3339))}
+	}
+	if !ke.UseBefore.IsZero() && !now.Before(ke.UseBefore) {
+		return errutil.UserError{Err: fmt.Sprintf("key version %d expired at %s", ver, ke.UseBefore.Format(time.RFC3339))}
+	}
+	return nil
+}
+
+// KeyID returns an opaque identifier of the given key version, or of the
+// latest version if ver is 0: the hex encoded first 16 bytes of the SHA-256
+// of its key material. It only depends on the material, so it is stable
+// across configuration changes and restores.
+func (p *Policy) KeyID(ver int) (string, error) {
+	sum, err := p.keyMaterialSum(ver, nil)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum[:16]), nil
+}
+
+// keyFingerprintPrefix is hashed before the key material for fingerprints, so
+// that a key version's fingerprint is not a part of its key ID
+const keyFingerprintPrefix = "vault-key-fingerprint\x00"
+
+// KeyFingerprint returns the short fingerprint of the given key version, or
+// of the latest version if ver is 0: the hex encoded first 8 bytes of the
+// SHA-256 of keyFingerprintPrefix followed by its key material
+func (p *Policy) KeyFingerprint(ver int) (string, error) {
+	sum, err := p.keyMaterialSum(ver, []byte(keyFingerprintPrefix))
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// keyMaterialSum returns the SHA-256 of the key material of the given key
+// version, or of the latest version if ver is 0, prefixed with the given
+// bytes
+func (p *Policy) keyMaterialSum(ver int, prefix []byte) ([sha256.Size]byte, error) {
+	if ver == 0 {
+		ver = p.LatestVersion
+	}
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return [sha256.Size]byte{}, errutil.UserError{Err: "invalid key version"}
+	}
+
+	material := entry.keyMaterial(p.Type)
+	if len(material) == 0 {
+		return [sha256.Size]byte{}, errutil.InternalError{Err: fmt.Sprintf("key version %d has no key material", ver)}
+	}
+	return sha256.Sum256(append(append([]byte{}, prefix...), material...)), nil
+}
+
+// checkActivationWindow returns an error if the key version may not be used
+// at the current time
+func (p *Policy) checkActivationWindow(ver int) error {
+	entry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return nil
+	}
+	return entry.CheckActivationWindow(ver, time.Now())
+}
+
+// SetActivationWindow sets the activation window of the given key version in
+// both the policy and its archive, so that the window is kept when the
+// version is moved out of the policy and back. It should be called with an
+// exclusive lock held on the policy.
+func (p *Policy) SetActivationWindow(ctx context.Context, storage logical.Storage, ver int, useAfter, useBefore time.Time) error {
+	key := strconv.Itoa(ver)
+	entry, ok := p.Keys[key]
+	if !ok {
+		return errutil.UserError{Err: fmt.Sprintf("key version %d does not exist", ver)}
+	}
+	if !useAfter.IsZero() && !useBefore.IsZero() && !useBefore.After(useAfter) {
+		return errutil.UserError{Err: "use_before must be later than use_after"}
+	}
+
+	original := entry
+	entry.UseAfter = useAfter
+	entry.UseBefore = useBefore
+
+	archive, err := p.LoadArchive(ctx, storage)
+	if err != nil {
+		return err
+	}
+	if idx := ver - p.MinAvailableVersion; idx >= 0 && idx < len(archive.Keys) {
+		archive.Keys[idx] = entry
+		if err := p.storeArchive(ctx, storage, archive); err != nil {
+			return err
+		}
+	}
+
+	p.Keys[key] = entry
+	if err := p.Persist(ctx, storage); err != nil {
+		p.Keys[key] = original
+		return err
+	}
+
+	return nil
+}
+
+// ArchiveVersionsOlderThan marks the decryptable versions of the key created
+// before the cutoff as archived, in both the policy and its archive, and
+// returns the number of versions newly archived. The latest version is never
+// archived. It should be called with an exclusive lock held on the policy.
+func (p *Policy) ArchiveVersionsOlderThan(ctx context.Context, storage logical.Storage, cutoff time.Time) (int, error) {
+	archive, err := p.LoadArchive(ctx, storage)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now()
+	originals := map[string]KeyEntry{}
+	for ver := p.MinDecryptionVersion; ver < p.LatestVersion; ver++ {
+		key := strconv.Itoa(ver)
+		entry, ok := p.Keys[key]
+		if !ok || !entry.ArchivedTime.IsZero() || !entry.CreationTime.Before(cutoff) {
+			continue
+		}
+
+		originals[key] = entry
+		entry.ArchivedTime = now
+		p.Keys[key] = entry
+		if idx := ver - p.MinAvailableVersion; idx >= 0 && idx < len(archive.Keys) {
+			archive.Keys[idx] = entry
+		}
+	}
+	if len(originals) == 0 {
+		return 0, nil
+	}
+
+	restore := func() {
+		for key, entry := range originals {
+			p.Keys[key] = entry
+		}
+	}
+	if err := p.storeArchive(ctx, storage, archive); err != nil {
+		restore()
+		return 0, err
+	}
+	if err := p.Persist(ctx, storage); err != nil {
+		restore()
+		return 0, err
+	}
+
+	return len(originals), nil
+}
+
+// keyMaterial returns the secret bytes of the key entry: the symmetric key,
+// the Ed25519 seed or the private exponent of EC and RSA keys.
+func (ke *KeyEntry) keyMaterial(keyType KeyType) []byte {
+	switch keyType {
+	case KeyType_ED25519:
+		if len(ke.Key) == ed25519.PrivateKeySize {
+			return ed25519.PrivateKey(ke.Key).Seed()
+		}
+		return ke.Key
+	case KeyType_ECDSA_P256:
+		if ke.EC_D != nil {
+			return ke.EC_D.Bytes()
+		}
+	case KeyType_RSA2048, KeyType_RSA4096:
+		if ke.RSAKey != nil {
+			return ke.RSAKey.D.Bytes()
+		}
+	default:
+		return ke.Key
+	}
+	return nil
+}
+
+// EntropyScore returns the Shannon entropy of the byte distribution of the
+// given key material, normalized by the maximum entropy attainable for its
+// length so that the result is in [0, 1]. A uniformly random key scores
+// close to 1, while a key made of a single repeated byte scores 0.
+func EntropyScore(material []byte) float64 {
+	if len(material) < 2 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range material {
+		counts[b]++
+	}
+
+	n := float64(len(material))
+	var entropy float64
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		freq := float64(c) / n
+		entropy -= freq * math.Log2(freq)
+	}
+
+	maxEntropy := math.Log2(math.Min(n, 256))
+	return math.Min(entropy/maxEntropy, 1)
+}
+
+// ChiSquared returns the chi-squared statistic of the byte distribution of
+// the given key material against a uniform distribution over all 256 byte
+// values. Uniformly random 32-byte keys score around 255, while a key made of
+// a single repeated byte scores 8160.
+func ChiSquared(material []byte) float64 {
+	if len(material) == 0 {
+		return 0
+	}
+
+	var counts [256]int
+	for _, b := range material {
+		counts[b]++
+	}
+
+	expected := float64(len(material)) / 256
+	var chiSquared float64
+	for _, c := range counts {
+		diff := float64(c) - expected
+		chiSquared += diff * diff / expected
+	}
+	return chiSquared
+}
+
+// CheckSymmetricKeyMaterial rejects symmetric key material that consists
+// entirely of repetitions of one of the weak patterns, or whose chi-squared
+// statistic exceeds maxChiSquared. A maxChiSquared of zero skips that test.
+func CheckSymmetricKeyMaterial(material []byte, weakPatterns [][]byte, maxChiSquared float64) error {
+	for _, pattern := range weakPatterns {
+		if len(pattern) == 0 || len(material)%len(pattern) != 0 {
+			continue
+		}
+		if bytes.Equal(material, bytes.Repeat(pattern, len(material)/len(pattern))) {
+			return fmt.Errorf("key material matches the weak key pattern %x", pattern)
+		}
+	}
+
+	if maxChiSquared > 0 {
+		if chiSquared := ChiSquared(material); chiSquared > maxChiSquared {
+			return fmt.Errorf("key material has a chi-squared statistic of %.1f, above the maximum of %.1f", chiSquared, maxChiSquared)
+		}
+	}
+
+	return nil
 }
 
 // deprecatedKeyEntryMap is used to allow JSON marshal/unmarshal
@@ -313,12 +673,94 @@ type Policy struct {
 	// Whether the key is exportable
 	Exportable bool `json:"exportable"`
 
+	// ExportableAfterRotation limits export to versions older than the
+	// latest, so the current encryption key is never exported
+	ExportableAfterRotation bool `json:"exportable_after_rotation"`
+
 	// The minimum version of the key allowed to be used for decryption
 	MinDecryptionVersion int `json:"min_decryption_version"`
 
 	// The minimum version of the key allowed to be used for encryption
 	MinEncryptionVersion int `json:"min_encryption_version"`
 
+	// AutoMinDecryptionVersionLag, if set, is the number of versions that
+	// MinDecryptionVersion trails the latest version by, advanced
+	// automatically on rotation
+	AutoMinDecryptionVersionLag *int `json:"auto_min_decryption_version_lag,omitempty"`
+
+	// LifecyclePolicy is the name of the lifecycle policy, managed by the
+	// backend, that is attached to the key
+	LifecyclePolicy string `json:"lifecycle_policy"`
+
+	// KeyRotationRequired causes encryption to fail once the latest version
+	// has outlived the auto rotate period of the lifecycle policy without
+	// being rotated
+	KeyRotationRequired bool `json:"key_rotation_required,omitempty"`
+
+	// RotationQuorum is the number of approvers, counting the requester,
+	// that a rotation through the rotate endpoint needs. Values below 2 need
+	// no approval. Pending rotations expire after RotationQuorumTTL, or the
+	// backend's default if that is zero.
+	RotationQuorum    int           `json:"rotation_quorum,omitempty"`
+	RotationQuorumTTL time.Duration `json:"rotation_quorum_ttl,omitempty"`
+
+	// AllowPKCS1v15Padding allows RSA encryption and decryption with
+	// PKCS#1 v1.5 padding, which is vulnerable to padding oracle attacks
+	AllowPKCS1v15Padding bool `json:"allow_pkcs1v15_padding"`
+
+	// NonceTracking records the nonces used by encryptions with an AES-GCM
+	// key so that caller-supplied nonces cannot be reused. The records are
+	// kept by the backend.
+	NonceTracking bool `json:"nonce_tracking,omitempty"`
+
+	// QuarantineOnAuthFailure records the hashes of ciphertexts that fail
+	// authentication on decryption. The records are kept by the backend.
+	QuarantineOnAuthFailure bool `json:"quarantine_on_auth_failure,omitempty"`
+
+	// EscrowKeyName names an RSA or X25519 key in the same mount under which
+	// the backend escrows a copy of each version of this key's material
+	EscrowKeyName string `json:"escrow_key_name,omitempty"`
+
+	// HMACBeforeEncrypt names a key in the same mount whose HMAC key the
+	// backend uses to authenticate plaintexts before they are encrypted with
+	// this key and to verify them after they are decrypted
+	HMACBeforeEncrypt string `json:"hmac_before_encrypt,omitempty"`
+
+	// BoundHMACKey names a key in the same mount whose HMAC key the backend
+	// uses to append an HMAC to each ciphertext of this key and to verify it
+	// before decryption
+	BoundHMACKey string `json:"bound_hmac_key,omitempty"`
+
+	// ExternalHMACKey names a key in the same mount whose HMAC key decrypt
+	// requests can have verify an external HMAC of the plaintext
+	ExternalHMACKey string `json:"external_hmac_key,omitempty"`
+
+	// MaxSignUses, if set, is the number of signatures each version of the
+	// key can make before it is disabled for signing
+	MaxSignUses int `json:"max_sign_uses,omitempty"`
+
+	// RateLimitPerSecond and HMACRateLimitPerSecond, if set, limit the
+	// number of encrypt and decrypt requests and of HMAC requests made with
+	// the key each second. The lock manager enforces each with its own
+	// limiter, which is kept in memory only.
+	RateLimitPerSecond     int `json:"rate_limit_per_second,omitempty"`
+	HMACRateLimitPerSecond int `json:"hmac_rate_limit_per_second,omitempty"`
+
+	// AuditRead causes every read of the key's metadata to be logged
+	AuditRead bool `json:"audit_read"`
+
+	// CiphertextPrefix, if set, may be requested on encryption to replace the
+	// "vault:" marker at the start of ciphertexts
+	CiphertextPrefix string `json:"ciphertext_prefix,omitempty"`
+
+	// ReplicationScope controls which clusters the policy is replicated to.
+	// Empty means ReplicationScopeCluster.
+	ReplicationScope string `json:"replication_scope,omitempty"`
+
+	// HSMBinding is informational metadata recording the HSM slot that
+	// backs the key. It is not used by the backend.
+	HSMBinding map[string]string `json:"hsm_binding,omitempty"`
+
 	// The latest key version in this policy
 	LatestVersion int `json:"latest_version"`
 
@@ -336,6 +778,49 @@ type Policy struct {
 	// Whether the key is allowed to be deleted
 	DeletionAllowed bool `json:"deletion_allowed"`
 
+	// SoftDeleted marks a key that has been deleted but can be recovered
+	// until RecoveryDeadline, after which it is removed from storage
+	SoftDeleted      bool      `json:"soft_deleted,omitempty"`
+	RecoveryDeadline time.Time `json:"recovery_deadline,omitempty"`
+
+	// DeletionGracePeriod, if set, delays the deletion of the key: deleting
+	// it schedules the deletion for DeletionScheduledAt, until which the key
+	// stays usable. DeletionScheduledPermanent records whether the deletion
+	// that was asked for was permanent.
+	DeletionGracePeriod        time.Duration `json:"deletion_grace_period,omitempty"`
+	DeletionScheduledAt        time.Time     `json:"deletion_scheduled_at,omitempty"`
+	DeletionScheduledPermanent bool          `json:"deletion_scheduled_permanent,omitempty"`
+
+	// StatusWebhookURL, if set, is notified by the backend whenever the key
+	// changes status. Status is the last status the backend recorded for
+	// the key; empty means the key has not changed since it was created.
+	StatusWebhookURL string `json:"status_webhook_url,omitempty"`
+	Status           string `json:"status,omitempty"`
+
+	// RequiredClaims maps the names of claims that the requesting entity
+	// must carry to encrypt or decrypt with the key to their required value;
+	// an empty value accepts any value. The claims are authenticated as
+	// associated data.
+	RequiredClaims map[string]string `json:"required_claims,omitempty"`
+
+	// AllowedSubjects, if set, restricts use of the key to requesting
+	// entities whose ID or alias names match one of the patterns, which may
+	// have a leading or trailing wildcard
+	AllowedSubjects []string `json:"allowed_subjects,omitempty"`
+
+	// AllowedEncryptNamespaces, if set, restricts encryption with the key to
+	// requests made from the listed namespaces, given by canonical path with
+	// the root namespace as "root"
+	AllowedEncryptNamespaces []string `json:"allowed_encrypt_namespaces,omitempty"`
+
+	// AllowedDecryptNamespaces is the same restriction for decryption
+	AllowedDecryptNamespaces []string `json:"allowed_decrypt_namespaces,omitempty"`
+
+	// HDParent and HDPath record the key and BIP32 path this key was
+	// derived from, if any
+	HDParent string `json:"hd_parent,omitempty"`
+	HDPath   string `json:"hd_path,omitempty"`
+
 	// The version of the convergent nonce to use
 	ConvergentVersion int `json:"convergent_version"`
 
@@ -685,6 +1170,24 @@ func (p *Policy) Upgrade(ctx context.Context, storage logical.Storage) (retErr e
 // is required, otherwise the KDF mode is used with the context to derive the
 // proper key.
 func (p *Policy) DeriveKey(context []byte, ver, numBytes int) ([]byte, error) {
+	return p.deriveKey(context, ver, numBytes, "")
+}
+
+// deriveKey is DeriveKey with a choice of hash for HKDF. An empty
+// derivationAlgorithm means HKDF-SHA256.
+func (p *Policy) deriveKey(context []byte, ver, numBytes int, derivationAlgorithm string) ([]byte, error) {
+	hashFunc := sha256.New
+	switch derivationAlgorithm {
+	case "", DerivationAlgorithmHKDFSHA256:
+	case DerivationAlgorithmHKDFSHA512:
+		if !p.Derived || p.KDF != Kdf_hkdf_sha256 {
+			return nil, errutil.UserError{Err: fmt.Sprintf("derivation algorithm %q requires a derived key using HKDF", derivationAlgorithm)}
+		}
+		hashFunc = sha512.New
+	default:
+		return nil, errutil.UserError{Err: fmt.Sprintf("unknown derivation algorithm %q", derivationAlgorithm)}
+	}
+
 	// Fast-path non-derived keys
 	if !p.Derived {
 		return p.Keys[strconv.Itoa(ver)].Key, nil
@@ -714,7 +1217,7 @@ func (p *Policy) DeriveKey(context []byte, ver, numBytes int) ([]byte, error) {
 		return kdf.CounterMode(prf, prfLen, p.Keys[strconv.Itoa(ver)].Key, context, 256)
 
 	case Kdf_hkdf_sha256:
-		reader := hkdf.New(sha256.New, p.Keys[strconv.Itoa(ver)].Key, nil, context)
+		reader := hkdf.New(hashFunc, p.Keys[strconv.Itoa(ver)].Key, nil, context)
 		derBytes := bytes.NewBuffer(nil)
 		derBytes.Grow(numBytes)
 		limReader := &io.LimitedReader{
@@ -769,17 +1272,72 @@ func (p *Policy) convergentVersion(ver int) int {
 	return convergentVersion
 }
 
+// UsesCallerNonce reports whether encryptions with the given version, or the
+// latest version if ver is 0, use the nonce supplied by the caller. Only keys
+// with the first convergent encryption version do; other keys derive or
+// generate their nonces and ignore the one supplied.
+func (p *Policy) UsesCallerNonce(ver int) bool {
+	if ver == 0 {
+		ver = p.LatestVersion
+	}
+	return p.convergentVersion(ver) == 1
+}
+
 func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string, error) {
+	return p.EncryptWithOptions(ver, context, nonce, value, nil)
+}
+
+func (p *Policy) EncryptWithOptions(ver int, context, nonce []byte, value string, opts *CipherOptions) (string, error) {
 	if !p.Type.EncryptionSupported() {
 		return "", errutil.UserError{Err: fmt.Sprintf("message encryption not supported for key type %v", p.Type)}
 	}
 
+	if opts == nil {
+		opts = &CipherOptions{}
+	}
+	if err := p.checkCipherOptions(opts); err != nil {
+		return "", err
+	}
+
 	// Decode the plaintext value
 	plaintext, err := base64.StdEncoding.DecodeString(value)
 	if err != nil {
 		return "", errutil.UserError{Err: err.Error()}
 	}
 
+	var compressed bool
+	if opts.CompressionLevel != 0 {
+		var compressedPlaintext []byte
+		compressedPlaintext, compressed, err = compressPlaintext(plaintext, opts.CompressionLevel)
+		if err != nil {
+			return "", err
+		}
+		if compressed {
+			plaintext = compressedPlaintext
+		}
+	}
+
+	if opts.PadTo != 0 {
+		plaintext, err = padPlaintext(plaintext, opts.PadTo)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// Labels recorded in the ciphertext are authenticated with it, so that
+	// they cannot be added or stripped
+	var labels []string
+	if opts.PadTo != 0 {
+		labels = append(labels, PlaintextPaddingPKCS7)
+	}
+	if compressed {
+		labels = append(labels, CompressionGzip)
+	}
+	if opts.DerivationAlgorithm == DerivationAlgorithmHKDFSHA512 {
+		labels = append(labels, opts.DerivationAlgorithm)
+	}
+	associatedData := labeledAssociatedData(labels, opts.AssociatedData)
+
 	switch {
 	case ver == 0:
 		ver = p.LatestVersion
@@ -791,6 +1349,10 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 		return "", errutil.UserError{Err: "requested version for encryption is less than the minimum encryption key version"}
 	}
 
+	if err := p.checkActivationWindow(ver); err != nil {
+		return "", err
+	}
+
 	var ciphertext []byte
 
 	switch p.Type {
@@ -806,7 +1368,7 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 			deriveHMAC = true
 			numBytes = 64
 		}
-		key, err := p.DeriveKey(context, ver, numBytes)
+		key, err := p.deriveKey(context, ver, numBytes, opts.DerivationAlgorithm)
 		if err != nil {
 			return "", err
 		}
@@ -862,7 +1424,16 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 				if len(hmacKey) == 0 {
 					return "", errutil.InternalError{Err: fmt.Sprintf("invalid hmac key length of zero")}
 				}
-				nonceHmac := hmac.New(sha256.New, hmacKey)
+				// Labeled ciphertexts derive their nonce with a key bound
+				// to the labels, so that they never share a nonce with
+				// ciphertexts of other labels
+				nonceKey := hmacKey
+				if len(labels) != 0 {
+					labelHmac := hmac.New(sha256.New, hmacKey)
+					labelHmac.Write(associatedData)
+					nonceKey = labelHmac.Sum(nil)
+				}
+				nonceHmac := hmac.New(sha256.New, nonceKey)
 				nonceHmac.Write(plaintext)
 				nonceSum := nonceHmac.Sum(nil)
 				nonce = nonceSum[:aead.NonceSize()]
@@ -877,8 +1448,14 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 			}
 		}
 
+		if opts.TrackNonce != nil && p.Type == KeyType_AES256_GCM96 && p.UsesCallerNonce(ver) {
+			if err := opts.TrackNonce(ver, nonce); err != nil {
+				return "", err
+			}
+		}
+
 		// Encrypt and tag with AEAD
-		ciphertext = aead.Seal(nil, nonce, plaintext, nil)
+		ciphertext = aead.Seal(nil, nonce, plaintext, associatedData)
 
 		// Place the encrypted data after the nonce
 		if !p.ConvergentEncryption || p.convergentVersion(ver) > 1 {
@@ -887,7 +1464,14 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 
 	case KeyType_RSA2048, KeyType_RSA4096:
 		key := p.Keys[strconv.Itoa(ver)].RSAKey
-		ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, plaintext, nil)
+		switch opts.PaddingMode {
+		case PaddingModePKCS1v15:
+			ciphertext, err = rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, plaintext)
+		case PaddingModeOAEPSHA1:
+			ciphertext, err = rsa.EncryptOAEP(sha1.New(), rand.Reader, &key.PublicKey, plaintext, nil)
+		default:
+			ciphertext, err = rsa.EncryptOAEP(sha256.New(), rand.Reader, &key.PublicKey, plaintext, nil)
+		}
 		if err != nil {
 			return "", errutil.InternalError{Err: fmt.Sprintf("failed to RSA encrypt the plaintext: %v", err)}
 		}
@@ -899,6 +1483,12 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 	// Convert to base64
 	encoded := base64.StdEncoding.EncodeToString(ciphertext)
 
+	// Record the labels so that decryption undoes the same transformations
+	// and derives the same key. The ':' separator cannot occur in base64.
+	if len(labels) != 0 {
+		encoded = strings.Join(labels, ":") + ":" + encoded
+	}
+
 	// Prepend some information
 	encoded = p.getVersionPrefix(ver) + encoded
 
@@ -906,34 +1496,24 @@ func (p *Policy) Encrypt(ver int, context, nonce []byte, value string) (string,
 }
 
 func (p *Policy) Decrypt(context, nonce []byte, value string) (string, error) {
+	return p.DecryptWithOptions(context, nonce, value, nil)
+}
+
+func (p *Policy) DecryptWithOptions(context, nonce []byte, value string, opts *CipherOptions) (string, error) {
 	if !p.Type.DecryptionSupported() {
 		return "", errutil.UserError{Err: fmt.Sprintf("message decryption not supported for key type %v", p.Type)}
 	}
 
-	tplParts, err := p.getTemplateParts()
-	if err != nil {
-		return "", err
+	if opts == nil {
+		opts = &CipherOptions{}
 	}
-
-	// Verify the prefix
-	if !strings.HasPrefix(value, tplParts[0]) {
-		return "", errutil.UserError{Err: "invalid ciphertext: no prefix"}
-	}
-
-	splitVerCiphertext := strings.SplitN(strings.TrimPrefix(value, tplParts[0]), tplParts[1], 2)
-	if len(splitVerCiphertext) != 2 {
-		return "", errutil.UserError{Err: "invalid ciphertext: wrong number of fields"}
+	if err := p.checkCipherOptions(opts); err != nil {
+		return "", err
 	}
 
-	ver, err := strconv.Atoi(splitVerCiphertext[0])
+	ver, encoded, err := p.splitCiphertext(value)
 	if err != nil {
-		return "", errutil.UserError{Err: "invalid ciphertext: version number could not be decoded"}
-	}
-
-	if ver == 0 {
-		// Compatibility mode with initial implementation, where keys start at
-		// zero
-		ver = 1
+		return "", err
 	}
 
 	if ver > p.LatestVersion {
@@ -944,13 +1524,47 @@ func (p *Policy) Decrypt(context, nonce []byte, value string) (string, error) {
 		return "", errutil.UserError{Err: ErrTooOld}
 	}
 
+	if err := p.checkActivationWindow(ver); err != nil {
+		return "", err
+	}
+
 	convergentVersion := p.convergentVersion(ver)
 	if convergentVersion == 1 && (nonce == nil || len(nonce) == 0) {
 		return "", errutil.UserError{Err: "invalid convergent nonce supplied"}
 	}
 
+	// Padding, compression and a derivation algorithm other than the default
+	// are recorded, in that order, before the encoded ciphertext
+	padded := strings.HasPrefix(encoded, PlaintextPaddingPKCS7+":")
+	encoded = strings.TrimPrefix(encoded, PlaintextPaddingPKCS7+":")
+	compressed := strings.HasPrefix(encoded, CompressionGzip+":")
+	encoded = strings.TrimPrefix(encoded, CompressionGzip+":")
+	var derivationAlgorithm string
+	if strings.HasPrefix(encoded, DerivationAlgorithmHKDFSHA512+":") {
+		if !p.Derived {
+			return "", errutil.UserError{Err: "invalid ciphertext: derivation algorithm given for a key that is not derived"}
+		}
+		derivationAlgorithm = DerivationAlgorithmHKDFSHA512
+		encoded = strings.TrimPrefix(encoded, DerivationAlgorithmHKDFSHA512+":")
+	}
+
+	var labels []string
+	if padded {
+		labels = append(labels, PlaintextPaddingPKCS7)
+	}
+	if compressed {
+		labels = append(labels, CompressionGzip)
+	}
+	if derivationAlgorithm != "" {
+		labels = append(labels, derivationAlgorithm)
+	}
+	if len(labels) != 0 && !p.Type.AEADSupported() {
+		return "", errutil.UserError{Err: fmt.Sprintf("invalid ciphertext: labels are not supported for key type %v", p.Type)}
+	}
+	associatedData := labeledAssociatedData(labels, opts.AssociatedData)
+
 	// Decode the base64
-	decoded, err := base64.StdEncoding.DecodeString(splitVerCiphertext[1])
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
 	if err != nil {
 		return "", errutil.UserError{Err: "invalid ciphertext: could not decode base64"}
 	}
@@ -961,7 +1575,7 @@ func (p *Policy) Decrypt(context, nonce []byte, value string) (string, error) {
 	case KeyType_AES256_GCM96, KeyType_ChaCha20_Poly1305:
 		var aead cipher.AEAD
 
-		encKey, err := p.DeriveKey(context, ver, 32)
+		encKey, err := p.deriveKey(context, ver, 32, derivationAlgorithm)
 		if err != nil {
 			return "", err
 		}
@@ -1009,14 +1623,21 @@ func (p *Policy) Decrypt(context, nonce []byte, value string) (string, error) {
 		}
 
 		// Verify and Decrypt
-		plain, err = aead.Open(nil, nonce, ciphertext, nil)
+		plain, err = aead.Open(nil, nonce, ciphertext, associatedData)
 		if err != nil {
-			return "", errutil.UserError{Err: "invalid ciphertext: unable to decrypt"}
+			return "", errutil.UserError{Err: ErrAuthenticationFailed}
 		}
 
 	case KeyType_RSA2048, KeyType_RSA4096:
 		key := p.Keys[strconv.Itoa(ver)].RSAKey
-		plain, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decoded, nil)
+		switch opts.PaddingMode {
+		case PaddingModePKCS1v15:
+			plain, err = rsa.DecryptPKCS1v15(rand.Reader, key, decoded)
+		case PaddingModeOAEPSHA1:
+			plain, err = rsa.DecryptOAEP(sha1.New(), rand.Reader, key, decoded, nil)
+		default:
+			plain, err = rsa.DecryptOAEP(sha256.New(), rand.Reader, key, decoded, nil)
+		}
 		if err != nil {
 			return "", errutil.InternalError{Err: fmt.Sprintf("failed to RSA decrypt the ciphertext: %v", err)}
 		}
@@ -1025,9 +1646,157 @@ func (p *Policy) Decrypt(context, nonce []byte, value string) (string, error) {
 		return "", errutil.InternalError{Err: fmt.Sprintf("unsupported key type %v", p.Type)}
 	}
 
+	paddedLen := len(plain)
+	if padded {
+		plain, err = unpadPlaintext(plain)
+		if err != nil {
+			return "", err
+		}
+	}
+	if compressed {
+		plain, err = decompressPlaintext(plain)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if opts.Recorded != nil {
+		opts.Recorded.PadTo = 0
+		if padded {
+			opts.Recorded.PadTo = paddedLen
+		}
+		opts.Recorded.CompressionLevel = 0
+		if compressed {
+			opts.Recorded.CompressionLevel = DefaultCompressionLevel
+		}
+		opts.Recorded.DerivationAlgorithm = derivationAlgorithm
+	}
+
 	return base64.StdEncoding.EncodeToString(plain), nil
 }
 
+// CiphertextVersion returns the key version that the ciphertext claims to be
+// encrypted with. The ciphertext is not authenticated.
+func (p *Policy) CiphertextVersion(value string) (int, error) {
+	ver, _, err := p.splitCiphertext(value)
+	return ver, err
+}
+
+// splitCiphertext splits a ciphertext into its key version and the encoded
+// ciphertext that follows the version prefix
+func (p *Policy) splitCiphertext(value string) (int, string, error) {
+	tplParts, err := p.getTemplateParts()
+	if err != nil {
+		return 0, "", err
+	}
+
+	// Verify the prefix
+	if !strings.HasPrefix(value, tplParts[0]) {
+		return 0, "", errutil.UserError{Err: "invalid ciphertext: no prefix"}
+	}
+
+	splitVerCiphertext := strings.SplitN(strings.TrimPrefix(value, tplParts[0]), tplParts[1], 2)
+	if len(splitVerCiphertext) != 2 {
+		return 0, "", errutil.UserError{Err: "invalid ciphertext: wrong number of fields"}
+	}
+
+	ver, err := strconv.Atoi(splitVerCiphertext[0])
+	if err != nil {
+		return 0, "", errutil.UserError{Err: "invalid ciphertext: version number could not be decoded"}
+	}
+
+	if ver == 0 {
+		// Compatibility mode with initial implementation, where keys start at
+		// zero
+		ver = 1
+	}
+
+	return ver, splitVerCiphertext[1], nil
+}
+
+// checkCipherOptions returns an error if the given options cannot be used
+// with the policy
+func (p *Policy) checkCipherOptions(opts *CipherOptions) error {
+	if len(opts.AssociatedData) != 0 {
+		if !p.Type.AEADSupported() {
+			return errutil.UserError{Err: fmt.Sprintf("associated data is not supported for key type %v", p.Type)}
+		}
+
+		// Otherwise an unlabeled ciphertext could be authenticated as a
+		// labeled one
+		if bytes.HasPrefix(opts.AssociatedData, []byte(labeledAssociatedDataPrefix)) {
+			return errutil.UserError{Err: "associated data must not begin with a reserved prefix"}
+		}
+
+		// Convergent nonces are derived from the plaintext alone, so the
+		// same nonce would be used with different associated data
+		if p.ConvergentEncryption {
+			return errutil.UserError{Err: "associated data is not supported with convergent encryption"}
+		}
+	}
+
+	// Labels are authenticated as associated data, which only AEAD key types
+	// support
+	if opts.CompressionLevel != 0 && !p.Type.AEADSupported() {
+		return errutil.UserError{Err: fmt.Sprintf("compression is not supported for key type %v", p.Type)}
+	}
+	if opts.PadTo != 0 && !p.Type.AEADSupported() {
+		return errutil.UserError{Err: fmt.Sprintf("plaintext padding is not supported for key type %v", p.Type)}
+	}
+
+	if opts.PadTo != 0 {
+		if opts.PadTo < 0 || opts.PadTo > MaxPadPlaintextTo {
+			return errutil.UserError{Err: fmt.Sprintf("padded length must be between 1 and %d", MaxPadPlaintextTo)}
+		}
+		if opts.CompressionLevel != 0 {
+			return errutil.UserError{Err: "plaintext padding cannot be combined with compression"}
+		}
+	}
+
+	switch opts.PaddingMode {
+	case 0:
+	case PaddingModeOAEPSHA256, PaddingModeOAEPSHA1, PaddingModePKCS1v15:
+		switch p.Type {
+		case KeyType_RSA2048, KeyType_RSA4096:
+		default:
+			return errutil.UserError{Err: fmt.Sprintf("padding mode is not supported for key type %v", p.Type)}
+		}
+		if opts.PaddingMode == PaddingModePKCS1v15 && !p.AllowPKCS1v15Padding {
+			return errutil.UserError{Err: "pkcs1v15 padding is not allowed for this key"}
+		}
+	default:
+		return errutil.UserError{Err: fmt.Sprintf("unknown padding mode %d", opts.PaddingMode)}
+	}
+
+	switch opts.DerivationAlgorithm {
+	case "", DerivationAlgorithmHKDFSHA256:
+	case DerivationAlgorithmHKDFSHA512:
+		if !p.Derived || p.KDF != Kdf_hkdf_sha256 {
+			return errutil.UserError{Err: fmt.Sprintf("derivation algorithm %q requires a derived key using HKDF", opts.DerivationAlgorithm)}
+		}
+	default:
+		return errutil.UserError{Err: fmt.Sprintf("unknown derivation algorithm %q", opts.DerivationAlgorithm)}
+	}
+
+	return nil
+}
+
+// labeledAssociatedDataPrefix begins the associated data of ciphertexts that
+// record labels. Callers cannot supply associated data with this prefix.
+const labeledAssociatedDataPrefix = "vault-ciphertext-labels\x00"
+
+// labeledAssociatedData returns the associated data that binds the labels
+// recorded in a ciphertext to it. Ciphertexts without labels use the
+// caller's associated data as is.
+func labeledAssociatedData(labels []string, associatedData []byte) []byte {
+	if len(labels) == 0 {
+		return associatedData
+	}
+
+	labeled := []byte(labeledAssociatedDataPrefix + strings.Join(labels, ":") + "\x00")
+	return append(labeled, associatedData...)
+}
+
 func (p *Policy) HMACKey(version int) ([]byte, error) {
 	switch {
 	case version < 0:
@@ -1043,6 +1812,52 @@ func (p *Policy) HMACKey(version int) ([]byte, error) {
 	return p.Keys[strconv.Itoa(version)].HMACKey, nil
 }
 
+// SharedSecret performs an X25519 key agreement between the given version of
+// the key and the peer's public key and returns the raw shared secret.
+func (p *Policy) SharedSecret(ver int, peerPublicKey []byte) ([]byte, error) {
+	if !p.Type.KeyAgreementSupported() {
+		return nil, fmt.Errorf("key agreement not supported for key type %v", p.Type)
+	}
+
+	switch {
+	case ver == 0:
+		ver = p.LatestVersion
+	case ver < 0:
+		return nil, errutil.UserError{Err: "requested version for key agreement is negative"}
+	case ver > p.LatestVersion:
+		return nil, errutil.UserError{Err: "requested version for key agreement is higher than the latest key version"}
+	case p.MinEncryptionVersion > 0 && ver < p.MinEncryptionVersion:
+		return nil, errutil.UserError{Err: "requested version for key agreement is less than the minimum encryption key version"}
+	}
+
+	if err := p.checkActivationWindow(ver); err != nil {
+		return nil, err
+	}
+
+	if len(peerPublicKey) != 32 {
+		return nil, errutil.UserError{Err: "peer public key must be 32 bytes"}
+	}
+
+	keyEntry, ok := p.Keys[strconv.Itoa(ver)]
+	if !ok {
+		return nil, errutil.UserError{Err: "requested version of the key is not available"}
+	}
+
+	var pri, peer, shared [32]byte
+	copy(pri[:], keyEntry.Key)
+	copy(peer[:], peerPublicKey)
+	curve25519.ScalarMult(&shared, &pri, &peer)
+
+	// A low-order peer point yields an all-zero secret regardless of our
+	// private key, so it must not be accepted as a valid agreement.
+	var zero [32]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, errutil.UserError{Err: "peer public key is a low-order point"}
+	}
+
+	return shared[:], nil
+}
+
 func (p *Policy) Sign(ver int, context, input []byte, hashAlgorithm HashType, sigAlgorithm string, marshaling MarshalingType) (*SigningResult, error) {
 	if !p.Type.SigningSupported() {
 		return nil, fmt.Errorf("message signing not supported for key type %v", p.Type)
@@ -1059,8 +1874,13 @@ func (p *Policy) Sign(ver int, context, input []byte, hashAlgorithm HashType, si
 		return nil, errutil.UserError{Err: "requested version for signing is less than the minimum encryption key version"}
 	}
 
+	if err := p.checkActivationWindow(ver); err != nil {
+		return nil, err
+	}
+
 	var sig []byte
 	var pubKey []byte
+	var ecdsaR, ecdsaS *big.Int
 	var err error
 	switch p.Type {
 	case KeyType_ECDSA_P256:
@@ -1079,6 +1899,7 @@ func (p *Policy) Sign(ver int, context, input []byte, hashAlgorithm HashType, si
 		if err != nil {
 			return nil, err
 		}
+		ecdsaR, ecdsaS = r, s
 
 		switch marshaling {
 		case MarshalingTypeASN1:
@@ -1188,8 +2009,11 @@ func (p *Policy) Sign(ver int, context, input []byte, hashAlgorithm HashType, si
 		encoded = base64.RawURLEncoding.EncodeToString(sig)
 	}
 	res := &SigningResult{
-		Signature: p.getVersionPrefix(ver) + encoded,
-		PublicKey: pubKey,
+		Signature:  p.getVersionPrefix(ver) + encoded,
+		PublicKey:  pubKey,
+		KeyVersion: ver,
+		R:          ecdsaR,
+		S:          ecdsaS,
 	}
 
 	return res, nil
@@ -1228,6 +2052,10 @@ func (p *Policy) VerifySignature(context, input []byte, hashAlgorithm HashType,
 		return false, errutil.UserError{Err: ErrTooOld}
 	}
 
+	if err := p.checkActivationWindow(ver); err != nil {
+		return false, err
+	}
+
 	var sigBytes []byte
 	switch marshaling {
 	case MarshalingTypeASN1:
@@ -1329,7 +2157,20 @@ func (p *Policy) VerifySignature(context, input []byte, hashAlgorithm HashType,
 	}
 }
 
-func (p *Policy) Rotate(ctx context.Context, storage logical.Storage) (retErr error) {
+// RotateOptions holds optional parameters for RotateWithOptions
+type RotateOptions struct {
+	// BeforePersist, if set, is called once the new version has been added
+	// to the policy but before the policy is persisted, so that changes
+	// that must accompany the rotation are persisted with it. An error
+	// aborts the rotation.
+	BeforePersist func() error
+}
+
+func (p *Policy) Rotate(ctx context.Context, storage logical.Storage) error {
+	return p.RotateWithOptions(ctx, storage, nil)
+}
+
+func (p *Policy) RotateWithOptions(ctx context.Context, storage logical.Storage, opts *RotateOptions) (retErr error) {
 	priorLatestVersion := p.LatestVersion
 	priorMinDecryptionVersion := p.MinDecryptionVersion
 	var priorKeys keyEntryMap
@@ -1408,6 +2249,15 @@ func (p *Policy) Rotate(ctx context.Context, storage logical.Storage) (retErr er
 		entry.Key = pri
 		entry.FormattedPublicKey = base64.StdEncoding.EncodeToString(pub)
 
+	case KeyType_X25519:
+		var pri, pub [32]byte
+		if _, err := io.ReadFull(rand.Reader, pri[:]); err != nil {
+			return err
+		}
+		curve25519.ScalarBaseMult(&pub, &pri)
+		entry.Key = pri[:]
+		entry.FormattedPublicKey = base64.StdEncoding.EncodeToString(pub[:])
+
 	case KeyType_RSA2048, KeyType_RSA4096:
 		bitSize := 2048
 		if p.Type == KeyType_RSA4096 {
@@ -1426,6 +2276,8 @@ func (p *Policy) Rotate(ctx context.Context, storage logical.Storage) (retErr er
 		}
 	}
 
+	entry.EntropyScore = EntropyScore(entry.keyMaterial(p.Type))
+
 	p.Keys[strconv.Itoa(p.LatestVersion)] = entry
 
 	// This ensures that with new key creations min decryption version is set
@@ -1435,6 +2287,12 @@ func (p *Policy) Rotate(ctx context.Context, storage logical.Storage) (retErr er
 		p.MinDecryptionVersion = 1
 	}
 
+	if opts != nil && opts.BeforePersist != nil {
+		if err := opts.BeforePersist(); err != nil {
+			return err
+		}
+	}
+
 	return p.Persist(ctx, storage)
 }
 
@@ -1445,6 +2303,7 @@ func (p *Policy) MigrateKeyToKeysMap() {
 			Key:                    p.Key,
 			CreationTime:           now,
 			DeprecatedCreationTime: now.Unix(),
+			EntropyScore:           EntropyScore(p.Key),
 		},
 	}
 	p.Key = nil
@@ -1518,6 +2377,12 @@ func (p *Policy) getTemplateParts() ([]string, error) {
 	return tplParts, nil
 }
 
+// VersionPrefix returns the prefix, rendered from the policy's version
+// template, that marks values produced with the given key version.
+func (p *Policy) VersionPrefix(ver int) string {
+	return p.getVersionPrefix(ver)
+}
+
 func (p *Policy) getVersionPrefix(ver int) string {
 	prefixRaw, ok := p.versionPrefixCache.Load(ver)
 	if ok {
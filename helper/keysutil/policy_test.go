@@ -1,7 +1,9 @@
 package keysutil
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"reflect"
 	"strconv"
 	"sync"
@@ -607,3 +609,96 @@ func Test_BadArchive(t *testing.T) {
 		t.Fatalf("unexpected key length %d", len(p.Keys))
 	}
 }
+
+func TestPolicy_EntropyScore(t *testing.T) {
+	if score := EntropyScore(make([]byte, 32)); score != 0 {
+		t.Fatalf("expected 0 for a zero-filled key, got %v", score)
+	}
+	if score := EntropyScore(nil); score != 0 {
+		t.Fatalf("expected 0 for an empty key, got %v", score)
+	}
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if score := EntropyScore(all); score != 1 {
+		t.Fatalf("expected 1 when every byte value occurs once, got %v", score)
+	}
+
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	if score := EntropyScore(random); score < 0.8 {
+		t.Fatalf("expected a random key to score near 1, got %v", score)
+	}
+}
+
+func TestPolicy_ChiSquared(t *testing.T) {
+	if chiSquared := ChiSquared(make([]byte, 32)); chiSquared != 8160 {
+		t.Fatalf("expected 8160 for a zero-filled key, got %v", chiSquared)
+	}
+
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if chiSquared := ChiSquared(all); chiSquared != 0 {
+		t.Fatalf("expected 0 when every byte value occurs once, got %v", chiSquared)
+	}
+
+	weakPatterns := [][]byte{{0x00}, {0xde, 0xad}}
+	for _, material := range [][]byte{make([]byte, 32), bytes.Repeat([]byte{0xde, 0xad}, 16)} {
+		if err := CheckSymmetricKeyMaterial(material, weakPatterns, 0); err == nil {
+			t.Fatalf("expected %x to match a weak pattern", material)
+		}
+	}
+	if err := CheckSymmetricKeyMaterial(all, weakPatterns, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckSymmetricKeyMaterial(bytes.Repeat([]byte{0x12, 0x34}, 16), weakPatterns, 512); err == nil {
+		t.Fatal("expected key to fail the chi-squared test")
+	}
+}
+
+func TestPolicy_DerivationAlgorithm(t *testing.T) {
+	ctx := context.Background()
+	lm := NewLockManager(true)
+	storage := &logical.InmemStorage{}
+	p, _, err := lm.GetPolicy(ctx, PolicyRequest{
+		Upsert:  true,
+		Storage: storage,
+		KeyType: KeyType_AES256_GCM96,
+		Name:    "test",
+		Derived: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Unlock()
+
+	derivationContext := []byte("context")
+	sha256Key, err := p.deriveKey(derivationContext, 1, 32, DerivationAlgorithmHKDFSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultKey, err := p.DeriveKey(derivationContext, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha512Key, err := p.deriveKey(derivationContext, 1, 32, DerivationAlgorithmHKDFSHA512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sha256Key, defaultKey) {
+		t.Fatal("expected HKDF-SHA256 to be the default")
+	}
+	if bytes.Equal(sha256Key, sha512Key) {
+		t.Fatal("expected different derived keys for different hashes")
+	}
+
+	if _, err := p.EncryptWithOptions(0, derivationContext, nil, "dGVzdA==", &CipherOptions{DerivationAlgorithm: "hkdf-md5"}); err == nil {
+		t.Fatal("expected error for an unknown derivation algorithm")
+	}
+}
@@ -0,0 +1,67 @@
+package keysutil
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitClass selects which of a policy's rate limits applies to an
+// operation
+type RateLimitClass int
+
+const (
+	// RateLimitCipher covers encrypt and decrypt requests
+	RateLimitCipher RateLimitClass = iota
+
+	// RateLimitHMAC covers HMAC generation and verification requests
+	RateLimitHMAC
+)
+
+// rateLimiterKey identifies a limiter held by the lock manager
+type rateLimiterKey struct {
+	name  string
+	class RateLimitClass
+}
+
+// rateLimit returns the configured requests per second of the class, or 0
+// if it is not limited
+func (p *Policy) rateLimit(class RateLimitClass) int {
+	switch class {
+	case RateLimitCipher:
+		return p.RateLimitPerSecond
+	case RateLimitHMAC:
+		return p.HMACRateLimitPerSecond
+	}
+	return 0
+}
+
+// ReserveRateLimit takes one request from the policy's limiter of the class.
+// It returns zero if the request is allowed and otherwise how long the
+// caller should wait before retrying. Limiters allow bursts of the configured
+// rate; they are created on first use and replaced, and so refilled, when the
+// configured rate changes. They are kept whether or not policies are cached.
+func (lm *LockManager) ReserveRateLimit(p *Policy, class RateLimitClass) time.Duration {
+	limit := p.rateLimit(class)
+	if limit <= 0 {
+		return 0
+	}
+
+	key := rateLimiterKey{name: p.Name, class: class}
+	var limiter *rate.Limiter
+	if existing, ok := lm.rateLimiters.Load(key); ok && existing.(*rate.Limiter).Limit() == rate.Limit(limit) {
+		limiter = existing.(*rate.Limiter)
+	} else {
+		limiter = rate.NewLimiter(rate.Limit(limit), limit)
+		lm.rateLimiters.Store(key, limiter)
+	}
+
+	if limiter.Allow() {
+		return 0
+	}
+
+	r := limiter.Reserve()
+	delay := r.Delay()
+	r.Cancel()
+	return delay
+}